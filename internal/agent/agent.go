@@ -2,9 +2,13 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
@@ -14,10 +18,17 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/MaximkaSha/log_tools/internal/compress"
 	"github.com/MaximkaSha/log_tools/internal/crypto"
 	"github.com/MaximkaSha/log_tools/internal/models"
+	pb "github.com/MaximkaSha/log_tools/internal/proto"
 	"github.com/MaximkaSha/log_tools/internal/utils"
 	"github.com/caarlos0/env/v6"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	//"github.com/shirou/gopsutil/mem"
 	//"github.com/shirou/gopsutil/v3/cpu"
@@ -36,6 +47,16 @@ type Config struct {
 	//KeyFile - string which contains key to MAC.
 	//BUG(MAX): Again missleading naming. This NOT a path to KEY. It is string which contains bytes to HMAC.
 	KeyFile string `env:"KEY" envDefault:"key.txt"`
+	//AgentID - ID of agent which is sent with every request, hostname if empty.
+	AgentID string `env:"AGENT_ID"`
+	//Hostname - hostname which is sent with every request, os.Hostname() if empty.
+	Hostname string `env:"AGENT_HOSTNAME"`
+	//Transport - "http" sends metrics to HTTP endpoints, "grpc" sends batch to gRPC API.
+	Transport string `env:"TRANSPORT" envDefault:"http"`
+	//GRPCServer - address and port of remote gRPC API.
+	GRPCServer string `env:"GRPC_ADDRESS" envDefault:"localhost:3200"`
+	//Compress - "gzip" or "deflate" compresses JSON batches, empty sends them as is.
+	Compress string `env:"COMPRESS"`
 }
 
 //Agent collects runtime metrics. Main module of agent.
@@ -43,15 +64,33 @@ type Agent struct {
 	logDB   []models.Metrics
 	counter int64
 	cfg     Config
+	client  pb.MetricsClient
 }
 
 //NewAgent - Agent constructor.
 func NewAgent() Agent {
-	return Agent{
+	a := Agent{
 		logDB:   []models.Metrics{},
 		counter: 0,
 		cfg:     parseCfg(),
 	}
+	switch a.cfg.Transport {
+	case "http":
+	case "grpc":
+		conn, err := grpc.Dial(a.cfg.GRPCServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.client = pb.NewMetricsClient(conn)
+	default:
+		log.Fatalf("Unknown TRANSPORT %q", a.cfg.Transport)
+	}
+	switch a.cfg.Compress {
+	case "", compress.Gzip, compress.Deflate:
+	default:
+		log.Fatalf("Unknown COMPRESS %q", a.cfg.Compress)
+	}
+	return a
 }
 
 //AppendMetric - add given models.Metrics to storage.
@@ -96,7 +135,12 @@ func (a *Agent) StartService() {
 }
 
 //AgentSendWorker - send all collected data by POST,JSON and batch JSON to remote server.
+//If gRPC transport is set data is sent by gRPC batch only.
 func (a Agent) AgentSendWorker() {
+	if a.client != nil {
+		a.SendLogsbyGRPC()
+		return
+	}
 	a.SendLogsbyPost("http://" + a.cfg.Server + "/update/")
 	a.SendLogsbyJSON("http://" + a.cfg.Server + "/update/")
 	a.SendLogsbyJSONBatch("http://" + a.cfg.Server + "/updates/")
@@ -110,6 +154,7 @@ func (a Agent) SendLogsbyJSONBatch(url string) error {
 	for i := range a.logDB {
 		var data = models.Metrics{}
 		data = a.logDB[i]
+		a.stampSource(&data)
 		if hasher.IsServiceEnable() {
 			_, err := hasher.Hash(&data)
 			if err != nil {
@@ -120,15 +165,112 @@ func (a Agent) SendLogsbyJSONBatch(url string) error {
 		allData = append(allData, data)
 	}
 	jData, _ := json.Marshal(allData)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jData))
-	if err == nil {
-		defer resp.Body.Close()
+	if a.cfg.Compress != "" {
+		var err error
+		if jData, err = compress.Encode(a.cfg.Compress, jData); err != nil {
+			return err
+		}
+	}
+	// the same key is sent on every attempt, so server applies batch only once
+	batchID := newBatchID()
+	for attempt := 1; attempt <= batchAttempts; attempt++ {
+		req, err := a.newRequest(url, "application/json", bytes.NewReader(jData))
+		if err != nil {
+			return err
+		}
+		req.Header.Set(models.IdempotencyKeyHeader, batchID)
+		if a.cfg.Compress != "" {
+			req.Header.Set("Content-Encoding", a.cfg.Compress)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError {
+				break
+			}
+		}
+		if attempt < batchAttempts {
+			time.Sleep(time.Duration(attempt) * batchRetryDelay)
+		}
 	}
 
 	log.Println("Sended logs by POST JSON Batch")
 	return nil
 }
 
+//SendLogsbyGRPC - send logs to remote server by gRPC batch stream.
+func (a Agent) SendLogsbyGRPC() error {
+	hasher := crypto.NewCryptoService()
+	hasher.InitCryptoService(a.cfg.KeyFile)
+	var allData []*pb.Metric
+	for i := range a.logDB {
+		data := a.logDB[i]
+		a.stampSource(&data)
+		if hasher.IsServiceEnable() {
+			if _, err := hasher.Hash(&data); err != nil {
+				log.Println("Hasher error!")
+				continue
+			}
+		}
+		allData = append(allData, pb.FromModel(data))
+	}
+	// the same key is sent on every attempt, so server applies batch only once
+	md := metadata.Pairs(
+		pb.AgentIDKey, a.cfg.AgentID,
+		pb.AgentHostKey, a.cfg.Hostname,
+		pb.IdempotencyKeyKey, newBatchID(),
+	)
+	var err error
+	for attempt := 1; attempt <= batchAttempts; attempt++ {
+		if err = a.sendGRPCBatch(md, allData); status.Code(err) != codes.Unavailable {
+			break
+		}
+		if attempt < batchAttempts {
+			time.Sleep(time.Duration(attempt) * batchRetryDelay)
+		}
+	}
+	if err != nil {
+		log.Printf("gRPC batch failed: %s", err)
+		return err
+	}
+	log.Println("Sended logs by gRPC batch")
+	return nil
+}
+
+//sendGRPCBatch - send one gRPC batch stream.
+func (a Agent) sendGRPCBatch(md metadata.MD, data []*pb.Metric) error {
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), 10*time.Second)
+	defer cancel()
+	stream, err := a.client.UpdateBatch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range data {
+		if err := stream.Send(&pb.UpdateBatchRequest{Metric: m}); err != nil {
+			//real error is returned by CloseAndRecv
+			break
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+const (
+	//batchAttempts - how many times batch is sent if server is unavailable.
+	batchAttempts = 3
+	//batchRetryDelay - delay before second attempt, it grows with every attempt.
+	batchRetryDelay = time.Second
+)
+
+//newBatchID - return random batch idempotency key.
+func newBatchID() string {
+	buf := make([]byte, 16)
+	if _, err := crand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", rand.Int63())
+	}
+	return hex.EncodeToString(buf)
+}
+
 //SendLogsbyJSON - send logs to remote server by JSON one by one.
 func (a Agent) SendLogsbyJSON(url string) error {
 	hasher := crypto.NewCryptoService()
@@ -136,6 +278,7 @@ func (a Agent) SendLogsbyJSON(url string) error {
 	for i := range a.logDB {
 		var data = models.Metrics{}
 		data = a.logDB[i]
+		a.stampSource(&data)
 		if hasher.IsServiceEnable() {
 			_, err := hasher.Hash(&data)
 			if err != nil {
@@ -146,7 +289,7 @@ func (a Agent) SendLogsbyJSON(url string) error {
 		//log.Println(data)
 		jData, _ := json.Marshal(data)
 
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(jData))
+		resp, err := a.post(url, "application/json", bytes.NewBuffer(jData))
 		if err == nil {
 			defer resp.Body.Close()
 		}
@@ -168,7 +311,7 @@ func (a Agent) getPostStrByIndex(i int, url string) string {
 //SendLogsbyPost - send logs to remote server one by one as POST request.
 func (a *Agent) SendLogsbyPost(sData string) error {
 	for i := range a.logDB {
-		if r, err := http.Post(a.getPostStrByIndex(i, sData), "text/plain", nil); err == nil {
+		if r, err := a.post(a.getPostStrByIndex(i, sData), "text/plain", nil); err == nil {
 			r.Body.Close()
 		}
 	}
@@ -177,6 +320,33 @@ func (a *Agent) SendLogsbyPost(sData string) error {
 	return nil
 }
 
+//post - send POST request with agent identity headers.
+func (a Agent) post(url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := a.newRequest(url, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+//newRequest - create POST request with agent identity headers.
+func (a Agent) newRequest(url string, contentType string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(models.AgentIDHeader, a.cfg.AgentID)
+	req.Header.Set(models.AgentHostHeader, a.cfg.Hostname)
+	return req, nil
+}
+
+//stampSource - set agent identity to metric.
+func (a Agent) stampSource(m *models.Metrics) {
+	m.Source = a.cfg.AgentID
+	m.Host = a.cfg.Hostname
+}
+
 //CollectLogs - collect runtime metrics and save it to storage.
 func (a *Agent) CollectLogs() {
 	var rtm runtime.MemStats
@@ -275,6 +445,11 @@ func parseCfg() Config {
 	flag.DurationVar(&cfgFlag.ReportInterval, "r", time.Duration(10*time.Second), "report to server interval in seconds (default 10s)")
 	flag.DurationVar(&cfgFlag.PollInterval, "p", time.Duration(2*time.Second), "poll interval in seconds (default 2s)")
 	flag.StringVar(&cfgFlag.KeyFile, "k", "", "hmac key")
+	flag.StringVar(&cfgFlag.AgentID, "id", "", "agent id (default hostname)")
+	flag.StringVar(&cfgFlag.Hostname, "host", "", "agent hostname (default os hostname)")
+	flag.StringVar(&cfgFlag.Transport, "t", "http", "transport: http or grpc (default http)")
+	flag.StringVar(&cfgFlag.GRPCServer, "g", "localhost:3200", "gRPC host:port (default localhost:3200)")
+	flag.StringVar(&cfgFlag.Compress, "c", "", "compress JSON batches: gzip or deflate (default none)")
 	flag.Parse()
 	// Потом переписываем ключами из ENV, они имеют приоритет
 	// Это так не работает, т.к. есть значения по-умолчанию
@@ -294,6 +469,28 @@ func parseCfg() Config {
 	if flag := flag.Lookup("k"); (flag != nil) && envCfg["KEY"] {
 		cfg.KeyFile = cfgFlag.KeyFile
 	}
+	if flag := flag.Lookup("t"); (flag != nil) && envCfg["TRANSPORT"] {
+		cfg.Transport = cfgFlag.Transport
+	}
+	if flag := flag.Lookup("g"); (flag != nil) && envCfg["GRPC_ADDRESS"] {
+		cfg.GRPCServer = cfgFlag.GRPCServer
+	}
+	if _, present := os.LookupEnv("COMPRESS"); !present {
+		cfg.Compress = cfgFlag.Compress
+	}
+	if _, present := os.LookupEnv("AGENT_HOSTNAME"); !present {
+		cfg.Hostname = cfgFlag.Hostname
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, err = os.Hostname()
+		utils.CheckError(err)
+	}
+	if _, present := os.LookupEnv("AGENT_ID"); !present {
+		cfg.AgentID = cfgFlag.AgentID
+	}
+	if cfg.AgentID == "" {
+		cfg.AgentID = cfg.Hostname
+	}
 	//log.Println(cfg)
 	return cfg
 }
@@ -0,0 +1,378 @@
+//Package alert evaluates threshold rules against stored metrics and notifies webhooks.
+//
+//Rules are loaded from JSON file and evaluated every interval. Every series
+//matching rule is a separate alert: it is pending while condition holds
+//shorter than rule duration, firing after that and resolved when condition
+//stops holding. Alerts which became firing or resolved are posted to every
+//webhook. Resolved alerts are listed for ResolvedRetention, then forgotten.
+//
+//Series of rate rule which stopped reporting have rate 0, so rule like
+//"rate(PollCount) == 0 for 2m" fires when agent stops.
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/rates"
+)
+
+//States of alert.
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+//DefaultResolvedRetention - how long resolved alerts are listed.
+const DefaultResolvedRetention = 15 * time.Minute
+
+//webhookTimeout - timeout of one webhook request.
+const webhookTimeout = 10 * time.Second
+
+//Alert - state of rule for one series.
+type Alert struct {
+	//Rule - name of rule.
+	Rule string `json:"rule"`
+	//Expr - expression of rule.
+	Expr string `json:"expr"`
+	//Summary - description of rule.
+	Summary string `json:"summary,omitempty"`
+	//ID - metric ID.
+	ID string `json:"id"`
+	//Source - metric source.
+	Source string `json:"source,omitempty"`
+	//Labels - metric labels.
+	Labels map[string]string `json:"labels,omitempty"`
+	//State - StatePending, StateFiring or StateResolved.
+	State string `json:"state"`
+	//Value - value or rate of last evaluation.
+	Value float64 `json:"value"`
+	//ActiveAt - time condition started holding.
+	ActiveAt time.Time `json:"active_at"`
+	//FiredAt - time alert became firing.
+	FiredAt *time.Time `json:"fired_at,omitempty"`
+	//ResolvedAt - time alert was resolved.
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+//Config - rules and webhooks of Manager.
+type Config struct {
+	//Rules - alert rules.
+	Rules []Rule
+	//Webhooks - endpoints of notifications.
+	Webhooks []*Webhook
+}
+
+//fileConfig - JSON file of Config.
+type fileConfig struct {
+	Rules []struct {
+		Name    string `json:"name"`
+		Expr    string `json:"expr"`
+		Summary string `json:"summary"`
+	} `json:"rules"`
+	Webhooks []struct {
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Retries *int              `json:"retries"`
+		Backoff string            `json:"backoff"`
+	} `json:"webhooks"`
+}
+
+//LoadConfig - load Config from JSON file like
+//{"rules":[{"name":"LowMemory","expr":"FreeMemory < 500MB for 5m","summary":"..."}],
+//"webhooks":[{"url":"http://...","headers":{...},"retries":3,"backoff":"1s"}]}.
+func LoadConfig(file string) (Config, error) {
+	jData, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Config{}, err
+	}
+	var fc fileConfig
+	if err = json.Unmarshal(jData, &fc); err != nil {
+		return Config{}, fmt.Errorf("bad alert rules file %s: %w", file, err)
+	}
+	var cfg Config
+	names := make(map[string]bool)
+	for _, r := range fc.Rules {
+		rule, err := ParseRule(r.Name, r.Expr)
+		if err != nil {
+			return Config{}, fmt.Errorf("bad alert rules file %s: %w", file, err)
+		}
+		if names[rule.Name] {
+			return Config{}, fmt.Errorf("bad alert rules file %s: rule %s is repeated", file, rule.Name)
+		}
+		names[rule.Name] = true
+		rule.Summary = r.Summary
+		cfg.Rules = append(cfg.Rules, rule)
+	}
+	for _, w := range fc.Webhooks {
+		if w.URL == "" {
+			return Config{}, fmt.Errorf("bad alert rules file %s: webhook url is empty", file)
+		}
+		webhook := &Webhook{URL: w.URL, Headers: w.Headers, Retries: DefaultRetries, Backoff: DefaultBackoff}
+		if w.Retries != nil {
+			webhook.Retries = *w.Retries
+		}
+		if w.Backoff != "" {
+			if webhook.Backoff, err = time.ParseDuration(w.Backoff); err != nil || webhook.Backoff <= 0 {
+				return Config{}, fmt.Errorf("bad alert rules file %s: bad backoff %q", file, w.Backoff)
+			}
+		}
+		cfg.Webhooks = append(cfg.Webhooks, webhook)
+	}
+	return cfg, nil
+}
+
+//series - value of one series of rule.
+type series struct {
+	id     string
+	source string
+	labels map[string]string
+	value  float64
+	//seen - last time rate series was reported.
+	seen time.Time
+}
+
+//Manager - evaluates rules and keeps alerts. It is safe for concurrent use.
+type Manager struct {
+	//Interval - how often rules are evaluated.
+	Interval time.Duration
+	//ResolvedRetention - how long resolved alerts are listed.
+	ResolvedRetention time.Duration
+	//StaleThreshold - metrics not updated longer are stale, 0 disables staleness.
+	StaleThreshold time.Duration
+	//HideStale - value rules skip stale metrics, so their alerts are resolved.
+	HideStale bool
+
+	rules    []Rule
+	webhooks []*Webhook
+	repo     models.Storager
+	rates    *rates.Tracker
+	now      func() time.Time
+
+	mu     sync.Mutex
+	alerts map[string]*Alert
+	//known - rate series seen by rate rules by rule name, missing ones have rate 0
+	//until they are not seen longer than rule window, For and rates retention.
+	known map[string]map[string]series
+
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+//NewManager - Manager constructor. Tracker may be nil if no rule uses rate.
+func NewManager(cfg Config, repo models.Storager, tracker *rates.Tracker, interval time.Duration) (*Manager, error) {
+	for _, r := range cfg.Rules {
+		if !r.Rate {
+			continue
+		}
+		if tracker == nil {
+			return nil, fmt.Errorf("rule %s uses rate, but rates are disabled", r.Name)
+		}
+		if r.Window > tracker.Retention() {
+			return nil, fmt.Errorf("rule %s: rate window is bigger than rates retention %s", r.Name, tracker.Retention())
+		}
+	}
+	return &Manager{
+		Interval:          interval,
+		ResolvedRetention: DefaultResolvedRetention,
+		rules:             cfg.Rules,
+		webhooks:          cfg.Webhooks,
+		repo:              repo,
+		rates:             tracker,
+		now:               time.Now,
+		alerts:            make(map[string]*Alert),
+		known:             make(map[string]map[string]series),
+		done:              make(chan struct{}),
+	}, nil
+}
+
+//Start - start evaluating rules every Interval and sending notifications.
+func (m *Manager) Start() error {
+	if m.Interval <= 0 {
+		return errors.New("alert interval must be positive")
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	for _, w := range m.webhooks {
+		w.start(client)
+	}
+	m.wg.Add(1)
+	go m.loop()
+	return nil
+}
+
+//Close - stop evaluating rules and sending notifications.
+func (m *Manager) Close() {
+	m.stopOnce.Do(func() {
+		close(m.done)
+		m.wg.Wait()
+		for _, w := range m.webhooks {
+			if w.queue != nil {
+				w.close()
+			}
+		}
+	})
+}
+
+func (m *Manager) loop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), m.Interval)
+			m.notify(m.Eval(ctx))
+			cancel()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+//notify - queue notification of changed alerts to every webhook.
+func (m *Manager) notify(changed []Alert) {
+	if len(changed) == 0 {
+		return
+	}
+	for _, w := range m.webhooks {
+		w.enqueue(Notification{Alerts: changed})
+	}
+}
+
+//Eval - evaluate every rule once and return alerts which became firing or resolved.
+func (m *Manager) Eval(ctx context.Context) []Alert {
+	now := m.now()
+	var data []models.Metrics
+	loaded := false
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active := make(map[string]bool)
+	var changed []Alert
+	for _, r := range m.rules {
+		if !r.Rate && !loaded {
+			data = models.MarkStale(m.repo.GetAll(ctx), now, m.StaleThreshold, m.HideStale)
+			loaded = true
+		}
+		for key, s := range m.seriesOf(r, data, now) {
+			if !r.Holds(s.value) {
+				continue
+			}
+			active[key] = true
+			a, ok := m.alerts[key]
+			if !ok || a.State == StateResolved {
+				a = &Alert{Rule: r.Name, Expr: r.Expr, Summary: r.Summary, ID: s.id, Source: s.source, Labels: s.labels, State: StatePending, ActiveAt: now}
+				m.alerts[key] = a
+			}
+			a.Value = s.value
+			if a.State == StatePending && now.Sub(a.ActiveAt) >= r.For {
+				a.State = StateFiring
+				firedAt := now
+				a.FiredAt = &firedAt
+				changed = append(changed, *a)
+			}
+		}
+	}
+	for key, a := range m.alerts {
+		if active[key] {
+			continue
+		}
+		switch a.State {
+		case StatePending:
+			delete(m.alerts, key)
+		case StateFiring:
+			a.State = StateResolved
+			resolvedAt := now
+			a.ResolvedAt = &resolvedAt
+			changed = append(changed, *a)
+		case StateResolved:
+			if now.Sub(*a.ResolvedAt) >= m.ResolvedRetention {
+				delete(m.alerts, key)
+			}
+		}
+	}
+	sortAlerts(changed)
+	return changed
+}
+
+//seriesOf - return series matching rule by alert key.
+//Rate series which are not reported any more have rate 0 until they are forgotten.
+//m.mu must be locked.
+func (m *Manager) seriesOf(r Rule, data []models.Metrics, now time.Time) map[string]series {
+	result := make(map[string]series)
+	if !r.Rate {
+		for _, d := range data {
+			if !r.Match(d.ID) || (d.Value == nil && d.Delta == nil) {
+				continue
+			}
+			result[r.Name+"\x00"+d.ID+"\x00"+d.Source+"\x00"+d.LabelsKey()] = series{id: d.ID, source: d.Source, labels: d.Labels, value: d.Float()}
+		}
+		return result
+	}
+	known := m.known[r.Name]
+	if known == nil {
+		known = make(map[string]series)
+		m.known[r.Name] = known
+	}
+	for _, rate := range m.rates.Rates("", "", r.Window) {
+		if r.Match(rate.ID) {
+			key := r.Name + "\x00" + rate.ID + "\x00" + rate.Source + "\x00"
+			result[key] = series{id: rate.ID, source: rate.Source, value: rate.PerSecond}
+			known[key] = series{id: rate.ID, source: rate.Source, seen: now}
+		}
+	}
+	window := r.Window
+	if window <= 0 || window > m.rates.Retention() {
+		window = m.rates.Retention()
+	}
+	for key, s := range known {
+		if _, ok := result[key]; ok {
+			continue
+		}
+		if now.Sub(s.seen) > window+r.For+m.rates.Retention() {
+			delete(known, key)
+			continue
+		}
+		result[key] = s
+	}
+	return result
+}
+
+//Alerts - return alerts in state, all if state is empty, ordered by rule, ID, source and labels.
+func (m *Manager) Alerts(state string) []Alert {
+	m.mu.Lock()
+	result := []Alert{}
+	for _, a := range m.alerts {
+		if state == "" || a.State == state {
+			result = append(result, *a)
+		}
+	}
+	m.mu.Unlock()
+	sortAlerts(result)
+	return result
+}
+
+func sortAlerts(alerts []Alert) {
+	sort.Slice(alerts, func(i, j int) bool {
+		a, b := alerts[i], alerts[j]
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return models.Metrics{Labels: a.Labels}.LabelsKey() < models.Metrics{Labels: b.Labels}.LabelsKey()
+	})
+}
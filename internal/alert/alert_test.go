@@ -0,0 +1,222 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/rates"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setGauge(t *testing.T, repo models.Storager, id string, source string, v float64) {
+	require.NoError(t, repo.InsertMetric(context.TODO(), models.Metrics{ID: id, MType: "gauge", Value: &v, Source: source}))
+}
+
+func TestManager_Eval(t *testing.T) {
+	repo := storage.NewRepo()
+	rule, err := ParseRule("LowMemory", "FreeMemory < 500MB for 5m")
+	require.NoError(t, err)
+	m, err := NewManager(Config{Rules: []Rule{rule}}, &repo, nil, time.Second)
+	require.NoError(t, err)
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	setGauge(t, &repo, "FreeMemory", "agent-1", 100<<20)
+	setGauge(t, &repo, "FreeMemory", "agent-2", 1<<30)
+	setGauge(t, &repo, "FreeMemory", "agent-3", 200<<20)
+
+	steps := []struct {
+		name        string
+		advance     time.Duration
+		set         map[string]float64
+		wantChanged []string
+		wantStates  map[string]string
+	}{
+		{
+			name:       "pending",
+			wantStates: map[string]string{"agent-1": StatePending, "agent-3": StatePending},
+		},
+		{
+			name:       "agent-3 recovers while pending",
+			advance:    4 * time.Minute,
+			set:        map[string]float64{"agent-3": 1 << 30},
+			wantStates: map[string]string{"agent-1": StatePending},
+		},
+		{
+			name:        "firing after duration",
+			advance:     time.Minute,
+			wantChanged: []string{"agent-1 " + StateFiring},
+			wantStates:  map[string]string{"agent-1": StateFiring},
+		},
+		{
+			name:       "still firing",
+			advance:    time.Minute,
+			wantStates: map[string]string{"agent-1": StateFiring},
+		},
+		{
+			name:        "resolved",
+			advance:     time.Minute,
+			set:         map[string]float64{"agent-1": 1 << 30},
+			wantChanged: []string{"agent-1 " + StateResolved},
+			wantStates:  map[string]string{"agent-1": StateResolved},
+		},
+		{
+			name:       "resolved is forgotten",
+			advance:    DefaultResolvedRetention,
+			wantStates: map[string]string{},
+		},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		for source, v := range step.set {
+			setGauge(t, &repo, "FreeMemory", source, v)
+		}
+		var changed []string
+		for _, a := range m.Eval(context.TODO()) {
+			changed = append(changed, a.Source+" "+a.State)
+		}
+		assert.Equal(t, step.wantChanged, changed, step.name)
+		states := make(map[string]string)
+		for _, a := range m.Alerts("") {
+			states[a.Source] = a.State
+			assert.Equal(t, "LowMemory", a.Rule, step.name)
+		}
+		assert.Equal(t, step.wantStates, states, step.name)
+	}
+	assert.Empty(t, m.Alerts(StateFiring))
+}
+
+func TestManager_EvalRate(t *testing.T) {
+	repo := storage.NewRepo()
+	tracker := rates.NewTracker(50 * time.Millisecond)
+	rule, err := ParseRule("AgentDown", "rate(PollCount) == 0")
+	require.NoError(t, err)
+	_, err = NewManager(Config{Rules: []Rule{rule}}, &repo, nil, time.Second)
+	assert.Error(t, err)
+	m, err := NewManager(Config{Rules: []Rule{rule}}, &repo, tracker, time.Second)
+	require.NoError(t, err)
+
+	tracker.Observe("agent-1", "PollCount", 1)
+	time.Sleep(5 * time.Millisecond)
+	tracker.Observe("agent-1", "PollCount", 5)
+	assert.Empty(t, m.Eval(context.TODO()))
+	// samples leave window when agent stops reporting
+	time.Sleep(60 * time.Millisecond)
+	changed := m.Eval(context.TODO())
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateFiring, changed[0].State)
+	assert.Equal(t, "agent-1", changed[0].Source)
+	assert.Zero(t, changed[0].Value)
+	// series is forgotten after window and retention
+	time.Sleep(110 * time.Millisecond)
+	changed = m.Eval(context.TODO())
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateResolved, changed[0].State)
+	assert.Empty(t, m.known[rule.Name])
+}
+
+func TestManager_EvalStale(t *testing.T) {
+	repo := storage.NewRepo()
+	rule, err := ParseRule("LowMemory", "FreeMemory < 500MB")
+	require.NoError(t, err)
+	m, err := NewManager(Config{Rules: []Rule{rule}}, &repo, nil, time.Second)
+	require.NoError(t, err)
+	m.StaleThreshold = time.Minute
+	m.HideStale = true
+	setGauge(t, &repo, "FreeMemory", "agent-1", 100<<20)
+	changed := m.Eval(context.TODO())
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateFiring, changed[0].State)
+	// agent stops reporting
+	m.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	changed = m.Eval(context.TODO())
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateResolved, changed[0].State)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "positive",
+			data: `{"rules":[{"name":"LowMemory","expr":"FreeMemory < 500MB for 5m","summary":"Low memory"}],
+				"webhooks":[{"url":"http://localhost/hook","headers":{"Authorization":"Bearer x"},"retries":0,"backoff":"2s"},{"url":"http://localhost/other"}]}`,
+		},
+		{name: "negative bad expression", data: `{"rules":[{"name":"A","expr":"FreeMemory"}]}`, wantErr: true},
+		{name: "negative repeated rule", data: `{"rules":[{"name":"A","expr":"A < 1"},{"name":"A","expr":"B < 1"}]}`, wantErr: true},
+		{name: "negative webhook without url", data: `{"webhooks":[{}]}`, wantErr: true},
+		{name: "negative bad backoff", data: `{"webhooks":[{"url":"http://localhost","backoff":"soon"}]}`, wantErr: true},
+		{name: "negative not JSON", data: `rules`, wantErr: true},
+	}
+	for k, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "rules"+string(rune('a'+k))+".json")
+			require.NoError(t, ioutil.WriteFile(file, []byte(tt.data), 0600))
+			cfg, err := LoadConfig(file)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, cfg.Rules, 1)
+			assert.Equal(t, "Low memory", cfg.Rules[0].Summary)
+			require.Len(t, cfg.Webhooks, 2)
+			assert.Equal(t, 0, cfg.Webhooks[0].Retries)
+			assert.Equal(t, 2*time.Second, cfg.Webhooks[0].Backoff)
+			assert.Equal(t, DefaultRetries, cfg.Webhooks[1].Retries)
+			assert.Equal(t, DefaultBackoff, cfg.Webhooks[1].Backoff)
+		})
+	}
+	_, err := LoadConfig(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestWebhook_Retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+	}{
+		{name: "positive after retries", statuses: []int{500, 429, 200}, wantAttempts: 3},
+		{name: "negative retries exhausted", statuses: []int{503, 503, 503, 503}, wantAttempts: 3},
+		{name: "negative client error is not repeated", statuses: []int{400, 200}, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var n Notification
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+				assert.Equal(t, "Bearer x", r.Header.Get("Authorization"))
+				assert.Len(t, n.Alerts, 1)
+				mu.Lock()
+				defer mu.Unlock()
+				w.WriteHeader(tt.statuses[attempts])
+				attempts++
+			}))
+			defer srv.Close()
+			w := &Webhook{URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer x"}, Retries: 2, Backoff: time.Millisecond}
+			w.start(srv.Client())
+			w.enqueue(Notification{Alerts: []Alert{{Rule: "LowMemory", State: StateFiring}}})
+			time.Sleep(50 * time.Millisecond)
+			w.close()
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, tt.wantAttempts, attempts)
+		})
+	}
+}
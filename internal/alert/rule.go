@@ -0,0 +1,128 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Comparison operators of rule.
+const (
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpEqual        = "=="
+	OpNotEqual     = "!="
+)
+
+//exprRe - selector, operator, threshold with unit and optional duration of rule expression.
+var exprRe = regexp.MustCompile(`^\s*(rate\(\s*([^()\s\[\]]+)\s*(?:\[\s*([^\]\s]+)\s*\])?\s*\)|[^()\s<>=!]+)\s*(<=|>=|==|!=|<|>)\s*([-+]?[0-9.]+(?:[eE][-+]?[0-9]+)?)\s*([A-Za-z%]*)\s*(?:\s+for\s+(\S+))?\s*$`)
+
+//units - multipliers of threshold units, byte units are powers of 1024.
+var units = map[string]float64{
+	"":   1,
+	"%":  1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+}
+
+//Rule - alert rule parsed from expression.
+type Rule struct {
+	//Name - name of rule.
+	Name string
+	//Expr - expression rule was parsed from.
+	Expr string
+	//Summary - human readable description sent with alert.
+	Summary string
+	//Pattern - metric ID pattern in path.Match syntax.
+	Pattern string
+	//Rate - true if rule checks per-second rate of counter instead of metric value.
+	Rate bool
+	//Window - window of rate, 0 means rates retention.
+	Window time.Duration
+	//Op - comparison operator.
+	Op string
+	//Threshold - value compared with, units are applied.
+	Threshold float64
+	//For - how long condition must hold before alert fires.
+	For time.Duration
+}
+
+//ParseRule - parse rule of expression like "FreeMemory < 500MB for 5m" or "rate(PollCount[1m]) == 0 for 2m".
+//Selector is metric ID pattern in path.Match syntax or rate of counters matching it, threshold may have unit
+//B, KB, MB, GB, TB (powers of 1024), k, M, G (powers of 1000) or %.
+func ParseRule(name string, expr string) (Rule, error) {
+	if name == "" {
+		return Rule{}, errors.New("rule name is empty")
+	}
+	parts := exprRe.FindStringSubmatch(expr)
+	if parts == nil {
+		return Rule{}, fmt.Errorf("rule %s: bad expression %q", name, expr)
+	}
+	r := Rule{Name: name, Expr: strings.TrimSpace(expr), Pattern: parts[1], Op: parts[4]}
+	if parts[2] != "" {
+		r.Rate = true
+		r.Pattern = parts[2]
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return Rule{}, fmt.Errorf("rule %s: bad metric pattern %q", name, r.Pattern)
+	}
+	var err error
+	if parts[3] != "" {
+		if r.Window, err = time.ParseDuration(parts[3]); err != nil || r.Window <= 0 {
+			return Rule{}, fmt.Errorf("rule %s: bad rate window %q", name, parts[3])
+		}
+	}
+	threshold, err := strconv.ParseFloat(parts[5], 64)
+	if err != nil || math.IsInf(threshold, 0) {
+		return Rule{}, fmt.Errorf("rule %s: bad threshold %q", name, parts[5])
+	}
+	unit, ok := units[parts[6]]
+	if !ok {
+		return Rule{}, fmt.Errorf("rule %s: unknown unit %q", name, parts[6])
+	}
+	r.Threshold = threshold * unit
+	if parts[7] != "" {
+		if r.For, err = time.ParseDuration(parts[7]); err != nil || r.For < 0 {
+			return Rule{}, fmt.Errorf("rule %s: bad duration %q", name, parts[7])
+		}
+	}
+	return r, nil
+}
+
+//Match - return true if metric ID matches rule pattern.
+func (r Rule) Match(id string) bool {
+	ok, _ := path.Match(r.Pattern, id)
+	return ok
+}
+
+//Holds - return true if value meets rule condition.
+func (r Rule) Holds(value float64) bool {
+	switch r.Op {
+	case OpLess:
+		return value < r.Threshold
+	case OpLessEqual:
+		return value <= r.Threshold
+	case OpGreater:
+		return value > r.Threshold
+	case OpGreaterEqual:
+		return value >= r.Threshold
+	case OpEqual:
+		return value == r.Threshold
+	case OpNotEqual:
+		return value != r.Threshold
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    Rule
+		wantErr bool
+	}{
+		{
+			name: "positive value with unit and duration",
+			expr: "FreeMemory < 500MB for 5m",
+			want: Rule{Pattern: "FreeMemory", Op: OpLess, Threshold: 500 << 20, For: 5 * time.Minute},
+		},
+		{
+			name: "positive rate",
+			expr: "rate(PollCount) == 0 for 2m",
+			want: Rule{Pattern: "PollCount", Rate: true, Op: OpEqual, For: 2 * time.Minute},
+		},
+		{
+			name: "positive rate with window and glob",
+			expr: " rate( Requests* [1m] )>=1.5e3 ",
+			want: Rule{Pattern: "Requests*", Rate: true, Window: time.Minute, Op: OpGreaterEqual, Threshold: 1500},
+		},
+		{
+			name: "positive percent without duration",
+			expr: "CPUutilization*>90%",
+			want: Rule{Pattern: "CPUutilization*", Op: OpGreater, Threshold: 90},
+		},
+		{
+			name: "positive negative threshold",
+			expr: "Temperature != -1.5k",
+			want: Rule{Pattern: "Temperature", Op: OpNotEqual, Threshold: -1500},
+		},
+		{name: "negative no operator", expr: "FreeMemory 500", wantErr: true},
+		{name: "negative unknown unit", expr: "FreeMemory < 500PB", wantErr: true},
+		{name: "negative bad duration", expr: "FreeMemory < 500 for ever", wantErr: true},
+		{name: "negative bad window", expr: "rate(PollCount[0s]) == 0", wantErr: true},
+		{name: "negative bad pattern", expr: "Free[ < 1", wantErr: true},
+		{name: "negative missing duration", expr: "FreeMemory < 500 for", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ParseRule("Rule", tt.expr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			tt.want.Name = "Rule"
+			tt.want.Expr = r.Expr
+			assert.Equal(t, tt.want, r)
+		})
+	}
+	_, err := ParseRule("", "FreeMemory < 1")
+	assert.Error(t, err)
+}
+
+func TestRule_Holds(t *testing.T) {
+	for op, want := range map[string][3]bool{
+		OpLess:         {true, false, false},
+		OpLessEqual:    {true, true, false},
+		OpGreater:      {false, false, true},
+		OpGreaterEqual: {false, true, true},
+		OpEqual:        {false, true, false},
+		OpNotEqual:     {true, false, true},
+	} {
+		r := Rule{Op: op, Threshold: 1}
+		assert.Equal(t, want, [3]bool{r.Holds(0), r.Holds(1), r.Holds(2)}, op)
+	}
+}
@@ -0,0 +1,127 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//DefaultRetries - number of repeated attempts of failed notification.
+const DefaultRetries = 3
+
+//DefaultBackoff - delay before the first repeated attempt, it doubles with every attempt.
+const DefaultBackoff = time.Second
+
+//queueSize - number of notifications waiting for webhook, newer ones are dropped.
+const queueSize = 100
+
+//Notification - body of webhook request.
+type Notification struct {
+	//Alerts - alerts which became firing or resolved.
+	Alerts []Alert `json:"alerts"`
+}
+
+//Webhook - HTTP endpoint notifications are posted to.
+//Notifications are sent one by one in order, failed ones are repeated with exponential backoff.
+type Webhook struct {
+	//URL - endpoint notifications are posted to as JSON.
+	URL string
+	//Headers - extra headers of request, for example Authorization.
+	Headers map[string]string
+	//Retries - number of repeated attempts, request is repeated on network error, 429 and 5xx status.
+	Retries int
+	//Backoff - delay before the first repeated attempt.
+	Backoff time.Duration
+
+	client *http.Client
+	queue  chan Notification
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+//start - start sending notifications.
+func (w *Webhook) start(client *http.Client) {
+	w.client = client
+	w.queue = make(chan Notification, queueSize)
+	w.done = make(chan struct{})
+	w.wg.Add(1)
+	go w.run()
+}
+
+//enqueue - queue notification, it is dropped if queue is full.
+func (w *Webhook) enqueue(n Notification) {
+	select {
+	case w.queue <- n:
+	default:
+		log.Printf("Alert webhook %s: queue is full, notification dropped", w.URL)
+	}
+}
+
+//close - stop sending, waiting retries are cancelled.
+func (w *Webhook) close() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+func (w *Webhook) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case n := <-w.queue:
+			if err := w.send(n); err != nil {
+				log.Printf("Alert webhook %s: %s", w.URL, err)
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+//send - post notification, repeating failed attempts.
+func (w *Webhook) send(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	delay := w.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.Retries {
+			return fmt.Errorf("notification failed after %d attempts: %w", attempt+1, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-w.done:
+			return fmt.Errorf("notification cancelled: %w", err)
+		}
+		delay *= 2
+	}
+}
+
+//post - make one attempt, retry is true if attempt may be repeated.
+func (w *Webhook) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("status %s", resp.Status)
+}
@@ -0,0 +1,213 @@
+//Package compress decodes compressed request bodies and negotiates response compression.
+//
+//Decompress middleware transparently decodes gzip and deflate request bodies
+//into memory, bodies bigger than limit after decoding are rejected, so small
+//compressed request can not exhaust memory. Bodies with other encodings (snappy
+//of remote write) are passed to handlers as is.
+//
+//Negotiate middleware reduces Accept-Encoding to the one supported coding client
+//prefers, so response compressor compresses only if client really accepts it.
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Supported encodings.
+const (
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+//DefaultMaxSize - default limit of decoded request body.
+const DefaultMaxSize = 32 << 20
+
+//ErrTooLarge - decoded body is bigger than limit.
+var ErrTooLarge = errors.New("decoded body is too large")
+
+//ErrUnknownEncoding - encoding is not supported.
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+//Decompress - middleware which decodes gzip and deflate request bodies.
+//Decoded body must not be bigger than limit bytes, DefaultMaxSize is used if it is not positive.
+//If it is bigger then 413, if body can not be decoded then 400.
+func Decompress(limit int64) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		limit = DefaultMaxSize
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodings, ok := requestEncodings(r.Header.Get("Content-Encoding"))
+			if !ok || len(encodings) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body, err := decode(r.Body, encodings, limit)
+			r.Body.Close()
+			if errors.Is(err, ErrTooLarge) {
+				http.Error(w, "Request is too large!", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Bad "+r.Header.Get("Content-Encoding")+" body!", http.StatusBadRequest)
+				return
+			}
+			r.Header.Del("Content-Encoding")
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			r.ContentLength = int64(len(body))
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//requestEncodings - return encodings of Content-Encoding in order they were applied, identity is skipped.
+//ok is false if any of them is not gzip or deflate.
+func requestEncodings(header string) ([]string, bool) {
+	var encodings []string
+	for _, e := range strings.Split(header, ",") {
+		switch e = strings.ToLower(strings.TrimSpace(e)); e {
+		case "", "identity":
+		case Gzip, "x-gzip":
+			encodings = append(encodings, Gzip)
+		case Deflate:
+			encodings = append(encodings, Deflate)
+		default:
+			return nil, false
+		}
+	}
+	return encodings, true
+}
+
+//decode - read body and undo encodings in reverse order.
+func decode(body io.Reader, encodings []string, limit int64) ([]byte, error) {
+	data, err := readLimited(body, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var rd io.ReadCloser
+		switch encodings[i] {
+		case Gzip:
+			if rd, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+				return nil, err
+			}
+		case Deflate:
+			rd = newDeflateReader(data)
+		}
+		data, err = readLimited(rd, limit)
+		rd.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+//newDeflateReader - return reader of zlib data, or of raw deflate data which some clients send.
+func newDeflateReader(data []byte) io.ReadCloser {
+	if len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0 {
+		if rd, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			return rd
+		}
+	}
+	return flate.NewReader(bytes.NewReader(data))
+}
+
+//readLimited - read all of rd, ErrTooLarge is returned if it is longer than limit.
+func readLimited(rd io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(rd, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+//Negotiate - middleware which replaces Accept-Encoding of request with the supported coding client prefers,
+//or removes it if client accepts none of them.
+//Codings are ordered by q-value, supported order breaks ties, q=0 and "*" are respected.
+func Negotiate(supported ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if header := r.Header.Get("Accept-Encoding"); header != "" {
+				if encoding := AcceptEncoding(header, supported...); encoding != "" {
+					r.Header.Set("Accept-Encoding", encoding)
+				} else {
+					r.Header.Del("Accept-Encoding")
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//AcceptEncoding - return supported coding with the highest q-value in Accept-Encoding header,
+//empty string if none is acceptable.
+func AcceptEncoding(header string, supported ...string) string {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if name == "x-gzip" {
+			name = Gzip
+		}
+		weights[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range supported {
+		q, ok := weights[encoding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+//Encode - compress data with gzip or deflate (zlib).
+func Encode(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var wr io.WriteCloser
+	switch encoding {
+	case Gzip:
+		wr = gzip.NewWriter(&buf)
+	case Deflate:
+		wr = zlib.NewWriter(&buf)
+	default:
+		return nil, ErrUnknownEncoding
+	}
+	if _, err := wr.Write(data); err != nil {
+		return nil, err
+	}
+	if err := wr.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
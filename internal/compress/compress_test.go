@@ -0,0 +1,187 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rawDeflate(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	wr, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	require.NoError(t, err)
+	wr.Write(data)
+	require.NoError(t, wr.Close())
+	return buf.Bytes()
+}
+
+func encode(t *testing.T, encoding string, data []byte) []byte {
+	out, err := Encode(encoding, data)
+	require.NoError(t, err)
+	return out
+}
+
+func TestDecompress(t *testing.T) {
+	payload := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	tests := []struct {
+		name         string
+		encoding     string
+		body         []byte
+		limit        int64
+		code         int
+		want         []byte
+		wantEncoding string
+	}{
+		{
+			name:     "positive gzip",
+			encoding: "gzip",
+			body:     encode(t, Gzip, payload),
+			code:     200,
+			want:     payload,
+		},
+		{
+			name:     "positive zlib deflate",
+			encoding: "Deflate",
+			body:     encode(t, Deflate, payload),
+			code:     200,
+			want:     payload,
+		},
+		{
+			name:     "positive raw deflate",
+			encoding: "deflate",
+			body:     rawDeflate(t, payload),
+			code:     200,
+			want:     payload,
+		},
+		{
+			name:     "positive stacked encodings",
+			encoding: "deflate, gzip",
+			body:     encode(t, Gzip, encode(t, Deflate, payload)),
+			code:     200,
+			want:     payload,
+		},
+		{
+			name:         "positive identity",
+			encoding:     "identity",
+			body:         payload,
+			code:         200,
+			want:         payload,
+			wantEncoding: "identity",
+		},
+		{
+			name:         "positive unknown encoding is passed as is",
+			encoding:     "snappy",
+			body:         []byte("snappy data"),
+			code:         200,
+			want:         []byte("snappy data"),
+			wantEncoding: "snappy",
+		},
+		{
+			name:     "negative bomb",
+			encoding: "gzip",
+			body:     encode(t, Gzip, make([]byte, 1<<20)),
+			limit:    1 << 16,
+			code:     413,
+		},
+		{
+			name:     "negative corrupt gzip",
+			encoding: "gzip",
+			body:     []byte("not gzip"),
+			code:     400,
+		},
+		{
+			name:     "negative truncated gzip",
+			encoding: "gzip",
+			body:     encode(t, Gzip, payload)[:20],
+			code:     400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			var gotEncoding string
+			var gotLength int64
+			handler := Decompress(tt.limit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = io.ReadAll(r.Body)
+				gotEncoding = r.Header.Get("Content-Encoding")
+				gotLength = r.ContentLength
+			}))
+			request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(tt.body))
+			request.Header.Set("Content-Encoding", tt.encoding)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+			require.Equal(t, tt.code, w.Code)
+			if tt.want == nil {
+				assert.Nil(t, got)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, int64(len(tt.want)), gotLength)
+			assert.Equal(t, tt.wantEncoding, gotEncoding)
+		})
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "positive gzip", header: "gzip", want: Gzip},
+		{name: "positive order of supported breaks ties", header: "deflate, gzip", want: Gzip},
+		{name: "positive q-value", header: "gzip;q=0.5, deflate", want: Deflate},
+		{name: "positive wildcard", header: "br, *;q=0.1", want: Gzip},
+		{name: "positive x-gzip", header: "x-gzip", want: Gzip},
+		{name: "negative refused gzip", header: "gzip;q=0", want: ""},
+		{name: "negative wildcard refused", header: "*;q=0, br", want: ""},
+		{name: "negative identity only", header: "identity", want: ""},
+		{name: "negative unsupported", header: "br", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, AcceptEncoding(tt.header, Gzip, Deflate))
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	body := strings.Repeat(`{"id":"Alloc","type":"gauge","value":1}`, 100)
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{name: "positive gzip", accept: "gzip, deflate", want: "gzip"},
+		{name: "positive deflate preferred", accept: "gzip;q=0.2, deflate", want: "deflate"},
+		{name: "negative refused", accept: "gzip;q=0, deflate;q=0", want: ""},
+		{name: "negative no header", accept: "", want: ""},
+	}
+	compressor := middleware.NewCompressor(flate.DefaultCompression)
+	handler := Negotiate(Gzip, Deflate)(compressor.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	})))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				request.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+			assert.Equal(t, tt.want, w.Header().Get("Content-Encoding"))
+			if tt.want == "" {
+				assert.Equal(t, body, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+//Package dashboard renders HTML pages of the server dashboard.
+//Templates are embedded into the binary, pages have no external assets.
+package dashboard
+
+import (
+	"embed"
+	"html/template"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/rates"
+)
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+var templates = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"value":     formatValue,
+	"time":      formatTime,
+	"metricURL": MetricURL,
+	"labels":    formatLabels,
+}).ParseFS(templatesFS, "templates/*.html"))
+
+//Page - data common for all pages.
+type Page struct {
+	//Title - page title.
+	Title string
+	//Query - search query.
+	Query string
+	//Type - metric type filter.
+	Type string
+	//Source - metric source filter.
+	Source string
+	//Refresh - auto-refresh interval in seconds, 0 disables refresh.
+	Refresh int
+	//Generated - time page was generated.
+	Generated time.Time
+}
+
+//Group - metrics of one type reported by one source.
+type Group struct {
+	Type    string
+	Source  string
+	Metrics []models.Metrics
+}
+
+//IndexPage - data of metrics list page.
+type IndexPage struct {
+	Page
+	//Groups - metrics grouped by type and source.
+	Groups []Group
+	//Total - number of shown metrics.
+	Total int
+	//Truncated - true if not all found metrics are shown.
+	Truncated bool
+}
+
+//MetricPage - data of metric detail page.
+type MetricPage struct {
+	Page
+	//Metric - metric aggregated across sources.
+	Metric models.Metrics
+	//Aggregation - aggregation used for Metric.
+	Aggregation string
+	//Series - metric reported by every source.
+	Series []models.Metrics
+	//Rates - rates of counter per source.
+	Rates []rates.Rate
+}
+
+//GroupMetrics - group metrics by type and source.
+//Groups are sorted by type and source, metrics in group by ID.
+func GroupMetrics(data []models.Metrics) []Group {
+	index := make(map[[2]string]int)
+	groups := []Group{}
+	for _, m := range data {
+		key := [2]string{m.MType, m.Source}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, Group{Type: m.MType, Source: m.Source})
+		}
+		groups[i].Metrics = append(groups[i].Metrics, m)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Type != groups[j].Type {
+			return groups[i].Type < groups[j].Type
+		}
+		return groups[i].Source < groups[j].Source
+	})
+	for _, g := range groups {
+		sort.Slice(g.Metrics, func(i, j int) bool {
+			return g.Metrics[i].ID < g.Metrics[j].ID
+		})
+	}
+	return groups
+}
+
+//RenderIndex - write metrics list page.
+func RenderIndex(w io.Writer, p IndexPage) error {
+	return templates.ExecuteTemplate(w, "index", p)
+}
+
+//RenderMetric - write metric detail page.
+func RenderMetric(w io.Writer, p MetricPage) error {
+	return templates.ExecuteTemplate(w, "metric", p)
+}
+
+//MetricURL - return URL of metric detail page.
+func MetricURL(m models.Metrics) string {
+	return "/metric/" + url.PathEscape(m.MType) + "/" + url.PathEscape(m.ID)
+}
+
+func formatValue(m models.Metrics) string {
+	switch {
+	case m.Value != nil && m.MType != "counter":
+		return strconv.FormatFloat(*m.Value, 'f', -1, 64)
+	case m.Delta != nil:
+		return strconv.FormatInt(*m.Delta, 10)
+	case m.Value != nil:
+		return strconv.FormatFloat(*m.Value, 'f', -1, 64)
+	}
+	return ""
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func formatTime(t interface{}) string {
+	switch v := t.(type) {
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05 MST")
+	case *time.Time:
+		if v != nil {
+			return v.Format("2006-01-02 15:04:05 MST")
+		}
+	}
+	return ""
+}
@@ -6,13 +6,16 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/pubsub"
 	"github.com/MaximkaSha/log_tools/internal/utils"
 	_ "github.com/lib/pq"
 )
@@ -23,12 +26,17 @@ type Database struct {
 	ConString string
 	//DB - pointer to sql.DB object.
 	DB *sql.DB
+	//KeyTTL - how long batch idempotency keys are remembered.
+	KeyTTL time.Duration
+	hub    *pubsub.Hub
 }
 
 //NewDatabase - Database cinstructor.
 func NewDatabase(con string) Database {
 	return Database{
 		ConString: con,
+		KeyTTL:    24 * time.Hour,
+		hub:       pubsub.NewHub(),
 	}
 }
 
@@ -45,6 +53,8 @@ func (d *Database) InitDatabase() {
 	CheckError(err)
 	err = d.CreateTableIfNotExist()
 	CheckError(err)
+	err = d.Migrate()
+	CheckError(err)
 
 }
 
@@ -87,43 +97,173 @@ func (d Database) CreateTableIfNotExist() error {
 
 }
 
-//InsertMetric - save or update models.Metrics to database.
-func (d Database) InsertMetric(ctx context.Context, m models.Metrics) error {
-	var query = `INSERT INTO log_data_2 (id, mtype, delta, value, hash)
-	VALUES ($1, $2, $3, $4, $5)
-	ON CONFLICT (id)
+//migrations - statements which update tables created by previous versions.
+//Every statement must be safe to run more than once.
+var migrations = []string{
+	`ALTER TABLE log_data_2 ADD COLUMN IF NOT EXISTS source character varying(100) COLLATE pg_catalog."default" NOT NULL DEFAULT ''`,
+	`ALTER TABLE log_data_2 ADD COLUMN IF NOT EXISTS host character varying(255) COLLATE pg_catalog."default" NOT NULL DEFAULT ''`,
+	`ALTER TABLE log_data_2 DROP CONSTRAINT IF EXISTS log_data_2_pkey`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS log_data_2_series_idx ON log_data_2 (id, source)`,
+	`ALTER TABLE log_data_2 ADD COLUMN IF NOT EXISTS first_seen timestamp with time zone`,
+	`ALTER TABLE log_data_2 ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone`,
+	`CREATE TABLE IF NOT EXISTS public.batch_keys
+(
+    key character varying(255) COLLATE pg_catalog."default" NOT NULL,
+    result text COLLATE pg_catalog."default" NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+	PRIMARY KEY (key)
+)`,
+	`ALTER TABLE log_data_2 ADD COLUMN IF NOT EXISTS labels text COLLATE pg_catalog."default" NOT NULL DEFAULT ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS log_data_2_labels_idx ON log_data_2 (id, source, labels)`,
+	`DROP INDEX IF EXISTS log_data_2_series_idx`,
+	`ALTER TABLE batch_keys ADD COLUMN IF NOT EXISTS hash character varying(64) COLLATE pg_catalog."default" NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS batch_keys_created_at_idx ON batch_keys (created_at)`,
+}
+
+//Migrate - update project tables to current structure.
+func (d Database) Migrate() error {
+	ctx, cancelfunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelfunc()
+	for _, query := range migrations {
+		if _, err := d.DB.ExecContext(ctx, query); err != nil {
+			log.Printf("Error %s when migrating table", err)
+			return err
+		}
+	}
+	return nil
+}
+
+//metricColumns - columns of log_data_2 in order of scanMetric.
+const metricColumns = `id, mtype, delta, value, hash, source, host, first_seen, updated_at, labels`
+
+//upsertQuery - save metric, counters are added to stored value.
+//first_seen of stored metric is kept.
+const upsertQuery = `INSERT INTO log_data_2 (id, mtype, delta, value, hash, source, host, first_seen, updated_at, labels)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (id, source, labels)
 	DO UPDATE SET
 	mtype = EXCLUDED.mtype,
 	delta = EXCLUDED.delta + log_data_2.delta,
 	value = EXCLUDED.value,
-	hash = EXCLUDED.hash`
-	_, err := d.DB.ExecContext(ctx, query, m.ID, m.MType, m.Delta, m.Value, m.Hash)
+	hash = EXCLUDED.hash,
+	host = EXCLUDED.host,
+	first_seen = COALESCE(log_data_2.first_seen, EXCLUDED.first_seen),
+	updated_at = EXCLUDED.updated_at`
+
+//setQuery - save metric, counters replace stored value.
+//first_seen of stored metric is kept.
+const setQuery = `INSERT INTO log_data_2 (id, mtype, delta, value, hash, source, host, first_seen, updated_at, labels)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (id, source, labels)
+	DO UPDATE SET
+	mtype = EXCLUDED.mtype,
+	delta = EXCLUDED.delta,
+	value = EXCLUDED.value,
+	hash = EXCLUDED.hash,
+	host = EXCLUDED.host,
+	first_seen = COALESCE(log_data_2.first_seen, EXCLUDED.first_seen),
+	updated_at = EXCLUDED.updated_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMetric(row scanner) (models.Metrics, error) {
+	model := models.Metrics{}
+	var labels string
+	err := row.Scan(&model.ID, &model.MType, &model.Delta, &model.Value, &model.Hash, &model.Source, &model.Host, &model.FirstSeen, &model.UpdatedAt, &labels)
+	if err != nil {
+		return model, err
+	}
+	model.Labels, err = models.ParseLabelsKey(labels)
+	return model, err
+}
+
+//upsertArgs - arguments of upsertQuery and setQuery for metric written at now.
+func upsertArgs(m models.Metrics, now time.Time) []interface{} {
+	m.Touch(nil, now)
+	return []interface{}{m.ID, m.MType, m.Delta, m.Value, m.Hash, m.Source, m.Host, m.FirstSeen, m.UpdatedAt, m.LabelsKey()}
+}
+
+//InsertMetric - save or update models.Metrics to database.
+func (d Database) InsertMetric(ctx context.Context, m models.Metrics) error {
+	if !d.hub.HasSubscribers() {
+		_, err := d.DB.ExecContext(ctx, upsertQuery, upsertArgs(m, time.Now())...)
+		if err != nil {
+			log.Printf("Error %s when appending  data", err)
+			return err
+		}
+		return err
+	}
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	changes, err := d.insertBatch(ctx, tx, upsertQuery, []models.Metrics{m})
 	if err != nil {
 		log.Printf("Error %s when appending  data", err)
 		return err
 	}
-	return err
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	d.publish(changes)
+	return nil
 }
 
 //GetMetric - get models.Metrics from database.
+//If data.Source is empty metric is aggregated across sources.
 func (d Database) GetMetric(data models.Metrics) (models.Metrics, error) {
 	//log.Println(data)
-	err := d.DB.QueryRow("SELECT mtype,delta,value,hash FROM log_data_2 WHERE id = $1", data.ID).Scan(&data.MType, &data.Delta, &data.Value, &data.Hash)
+	series := d.GetSeries(context.Background(), data.ID)
+	if data.Source != "" {
+		filtered := []models.Metrics{}
+		for _, m := range series {
+			if m.Source == data.Source {
+				filtered = append(filtered, m)
+			}
+		}
+		series = filtered
+	}
+	found, err := models.AggregateSources(series, "")
 	//log.Println(data)
-	if data.Delta == nil && data.Value == nil {
+	if err != nil || (found.Delta == nil && found.Value == nil) {
 		data.Delta = new(int64)
 		data.Value = new(float64)
 		err = errors.New("no data")
 		return data, err
 	}
-	return data, err
+	return found, nil
+
+}
 
+//GetSeries - get series of metric id reported by all sources.
+func (d Database) GetSeries(ctx context.Context, id string) []models.Metrics {
+	var query = `SELECT ` + metricColumns + ` FROM log_data_2 WHERE id = $1 ORDER BY source, labels`
+	data := []models.Metrics{}
+	rows, err := d.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		log.Printf("Error %s when getting series", err)
+		return data
+	}
+	defer rows.Close()
+	for rows.Next() {
+		model, err := scanMetric(rows)
+		if err != nil {
+			log.Printf("Error %s when getting series", err)
+			return data
+		}
+		data = append(data, model)
+	}
+	CheckError(rows.Err())
+	return data
 }
 
 //GetAll - get all models.Metrics from database.
 //Return []models.Metrics.
 func (d Database) GetAll(ctx context.Context) []models.Metrics {
-	var query = `SELECT * from log_data_2`
+	var query = `SELECT ` + metricColumns + ` from log_data_2`
 	rows, err := d.DB.QueryContext(ctx, query)
 	rows.Err()
 	if err != nil {
@@ -132,8 +272,8 @@ func (d Database) GetAll(ctx context.Context) []models.Metrics {
 	defer rows.Close()
 	data := []models.Metrics{}
 	for rows.Next() {
-		model := models.Metrics{}
-		if err := rows.Scan(&model.ID, &model.MType, &model.Delta, &model.Value, &model.Hash); err != nil {
+		model, err := scanMetric(rows)
+		if err != nil {
 			log.Fatal(err)
 		}
 		data = append(data, model)
@@ -141,6 +281,109 @@ func (d Database) GetAll(ctx context.Context) []models.Metrics {
 	return data
 }
 
+//sortColumns - expressions metrics are sorted by, strings are compared bytewise like in Go.
+var sortColumns = map[string]string{
+	models.SortID:        `id COLLATE "C"`,
+	models.SortType:      `mtype COLLATE "C"`,
+	models.SortSource:    `source COLLATE "C"`,
+	models.SortUpdatedAt: `COALESCE(updated_at, 'epoch'::timestamptz)`,
+}
+
+//likeEscaper - escape LIKE wildcards.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+//List - get page of metrics which match query filters in query order.
+//Filters, order and page are evaluated by database, except Regex: Postgres
+//regular expressions are not RE2, so rows are filtered by ListQuery.Match
+//and read until page is full.
+func (d Database) List(ctx context.Context, q models.ListQuery) (models.ListPage, error) {
+	if err := q.Prepare(); err != nil {
+		return models.ListPage{}, err
+	}
+	scan := q
+	if q.Regex != "" {
+		scan.Limit = models.MaxListLimit
+	}
+	page := models.ListPage{Metrics: []models.Metrics{}}
+	for {
+		rows, err := d.listRows(ctx, scan)
+		if err != nil {
+			return models.ListPage{}, err
+		}
+		for _, model := range rows {
+			if q.Match(model) {
+				page.Metrics = append(page.Metrics, model)
+			}
+		}
+		if len(page.Metrics) > q.Limit || len(rows) <= scan.Limit {
+			break
+		}
+		scan.Cursor = scan.NextCursor(rows[len(rows)-1])
+		if err = scan.Prepare(); err != nil {
+			return models.ListPage{}, err
+		}
+	}
+	if len(page.Metrics) > q.Limit {
+		page.Metrics = page.Metrics[:q.Limit]
+		page.NextCursor = q.NextCursor(page.Metrics[q.Limit-1])
+	}
+	return page, nil
+}
+
+//listRows - get up to q.Limit+1 rows after q cursor which match all filters but Regex.
+func (d Database) listRows(ctx context.Context, q models.ListQuery) ([]models.Metrics, error) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q.Type != "" {
+		where = append(where, "mtype = "+arg(q.Type))
+	}
+	if q.Source != "" {
+		where = append(where, "source = "+arg(q.Source))
+	}
+	if !q.UpdatedSince.IsZero() {
+		where = append(where, "(updated_at IS NULL OR updated_at >= "+arg(q.UpdatedSince)+")")
+	}
+	if q.Prefix != "" {
+		where = append(where, "id LIKE "+arg(likeEscaper.Replace(q.Prefix)+"%"))
+	}
+	if q.Glob != "" {
+		where = append(where, "id ~ "+arg(models.GlobToRegex(q.Glob)))
+	}
+	sortColumn := sortColumns[q.Sort]
+	op, order := ">", "ASC"
+	if q.Desc {
+		op, order = "<", "DESC"
+	}
+	if key, id, source, labels, ok := q.CursorValues(); ok {
+		where = append(where, fmt.Sprintf(`(%s, id COLLATE "C", source COLLATE "C", labels COLLATE "C") %s (%s, %s, %s, %s)`,
+			sortColumn, op, arg(key), arg(id), arg(source), arg(labels)))
+	}
+	query := `SELECT ` + metricColumns + ` FROM log_data_2`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(` ORDER BY %s %s, id COLLATE "C" %s, source COLLATE "C" %s, labels COLLATE "C" %s LIMIT %s`,
+		sortColumn, order, order, order, order, arg(q.Limit+1))
+	rows, err := d.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []models.Metrics
+	for rows.Next() {
+		model, err := scanMetric(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
 //InsertData - save raw metrics data to database.
 //
 //Deprecated: use InsertMetric.
@@ -205,24 +448,10 @@ func (d Database) PingDB() bool {
 }
 
 //BatchInsert - save []models.Metrics to database.
-//Check if current rnd value is commited before insert.
 func (d Database) BatchInsert(ctx context.Context, dataModels []models.Metrics) error {
 	if len(dataModels) == 0 {
 		return errors.New("empty batch")
 	}
-	for _, k := range dataModels {
-		if k.ID == "RandomValue" && *k.Value == d.GetCurrentCommit() {
-			return errors.New("already commited")
-		}
-	}
-	var query = `INSERT INTO log_data_2 (id, mtype, delta, value, hash)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (id)
-		DO UPDATE SET
-		mtype = EXCLUDED.mtype,
-		delta = EXCLUDED.delta + log_data_2.delta,
-		value = EXCLUDED.value,
-		hash = EXCLUDED.hash`
 	// шаг 1 — объявляем транзакцию
 	tx, err := d.DB.Begin()
 	if err != nil {
@@ -230,35 +459,152 @@ func (d Database) BatchInsert(ctx context.Context, dataModels []models.Metrics)
 	}
 	// шаг 1.1 — если возникает ошибка, откатываем изменения
 	defer tx.Rollback()
-	// шаг 2 — готовим инструкцию
+	changes, err := d.insertBatch(ctx, tx, upsertQuery, dataModels)
+	if err != nil {
+		return err
+	}
+	// шаг 4 — сохраняем изменения
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	d.publish(changes)
+	return nil
 
-	stmt, err := tx.PrepareContext(ctx, query)
+}
+
+//BatchSet - save []models.Metrics to database, counters replace stored values.
+func (d Database) BatchSet(ctx context.Context, dataModels []models.Metrics) error {
+	if len(dataModels) == 0 {
+		return errors.New("empty batch")
+	}
+	tx, err := d.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	// шаг 2.1 — не забываем закрыть инструкцию, когда она больше не нужна
-	defer stmt.Close()
+	defer tx.Rollback()
+	changes, err := d.insertBatch(ctx, tx, setQuery, dataModels)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	d.publish(changes)
+	return nil
+}
 
-	for _, v := range dataModels {
-		// шаг 3 — указываем, что каждое видео будет добавлено в транзакцию
-		if _, err = stmt.ExecContext(ctx, v.ID, v.MType, v.Delta, v.Value, v.Hash); err != nil {
-			return err
+//BatchInsertOnce - save []models.Metrics to database once per idempotency key.
+//Key, hash and result are saved in the same transaction as metrics.
+//If key was saved during KeyTTL with the same hash, saved result and true are returned and nothing is saved,
+//if it was saved with other hash, models.ErrKeyConflict is returned.
+func (d Database) BatchInsertOnce(ctx context.Context, key string, hash string, dataModels []models.Metrics, result models.BatchResult) (models.BatchResult, bool, error) {
+	if len(dataModels) == 0 {
+		return result, false, errors.New("empty batch")
+	}
+	jResult, err := json.Marshal(result)
+	if err != nil {
+		return result, false, err
+	}
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return result, false, err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	if _, err = tx.ExecContext(ctx, `DELETE FROM batch_keys WHERE created_at < $1`, now.Add(-d.KeyTTL)); err != nil {
+		return result, false, err
+	}
+	// concurrent batch with the same key waits here until first one is commited or rolled back
+	res, err := tx.ExecContext(ctx, `INSERT INTO batch_keys (key, result, created_at, hash)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (key) DO NOTHING`, key, string(jResult), now, hash)
+	if err != nil {
+		return result, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return result, false, err
+	} else if n == 0 {
+		var stored, storedHash string
+		if err = tx.QueryRowContext(ctx, `SELECT result, hash FROM batch_keys WHERE key = $1`, key).Scan(&stored, &storedHash); err != nil {
+			return result, false, err
 		}
+		if storedHash != hash {
+			return result, false, models.ErrKeyConflict
+		}
+		var storedResult models.BatchResult
+		err = json.Unmarshal([]byte(stored), &storedResult)
+		return storedResult, true, err
 	}
-	// шаг 4 — сохраняем изменения
-	return tx.Commit()
-
+	changes, err := d.insertBatch(ctx, tx, upsertQuery, dataModels)
+	if err != nil {
+		return result, false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return result, false, err
+	}
+	d.publish(changes)
+	return result, false, nil
 }
 
-//GetCurrentCommit - get current rnd value from DB.
-//Used by BatchInsert in order to know if needed to update.
-func (d Database) GetCurrentCommit() float64 {
-	randVal := models.Metrics{
-		ID: "RandomValue",
+//insertBatch - save []models.Metrics in transaction with upsertQuery or setQuery.
+//If there are subscribers, changes to publish after commit are returned.
+func (d Database) insertBatch(ctx context.Context, tx *sql.Tx, query string, dataModels []models.Metrics) ([]models.ChangeEvent, error) {
+	// шаг 2 — готовим инструкцию
+	if !d.hub.HasSubscribers() {
+		stmt, err := tx.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		// шаг 2.1 — не забываем закрыть инструкцию, когда она больше не нужна
+		defer stmt.Close()
+		now := time.Now()
+		for _, v := range dataModels {
+			// шаг 3 — указываем, что каждое видео будет добавлено в транзакцию
+			if _, err = stmt.ExecContext(ctx, upsertArgs(v, now)...); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
 	}
-	randVal, err := d.GetMetric(randVal)
+	oldStmt, err := tx.PrepareContext(ctx, `SELECT `+metricColumns+` FROM log_data_2 WHERE id = $1 AND source = $2 AND labels = $3 FOR UPDATE`)
 	if err != nil {
-		return 0
+		return nil, err
 	}
-	return *randVal.Value
+	defer oldStmt.Close()
+	stmt, err := tx.PrepareContext(ctx, query+` RETURNING `+metricColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	now := time.Now()
+	changes := make([]models.ChangeEvent, 0, len(dataModels))
+	for _, v := range dataModels {
+		var change models.ChangeEvent
+		old, err := scanMetric(oldStmt.QueryRowContext(ctx, v.ID, v.Source, v.LabelsKey()))
+		switch {
+		case err == nil:
+			change.Old = &old
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, err
+		}
+		if change.New, err = scanMetric(stmt.QueryRowContext(ctx, upsertArgs(v, now)...)); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+//publish - send commited changes to subscribers.
+func (d Database) publish(changes []models.ChangeEvent) {
+	for _, change := range changes {
+		d.hub.Publish(change.Old, change.New)
+	}
+}
+
+//Subscribe - subscribe for changes of metrics which ID matches pattern.
+//Only writes made through this Database are published, after commit, in the order
+//this process finished them. Writes of other processes sharing the database are not seen.
+func (d Database) Subscribe(pattern string, size int) (models.Subscription, error) {
+	return d.hub.Subscribe(pattern, size)
 }
@@ -0,0 +1,296 @@
+//Package export encodes metrics to CSV and JSON Lines and decodes them back.
+//
+//Both formats carry every field of models.Metrics, so metrics exported from one
+//server may be imported to another one. CSV has header row with Columns, labels
+//are JSON object in one cell and times are RFC 3339. JSON Lines is one
+//models.Metrics JSON object per line, the same as NDJSON ingest.
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/ndjson"
+)
+
+//Formats of export.
+const (
+	//FormatCSV - CSV with header row.
+	FormatCSV = "csv"
+	//FormatJSONL - JSON Lines, one metric per line.
+	FormatJSONL = "jsonl"
+)
+
+//CSVContentType - media type of CSV.
+const CSVContentType = "text/csv"
+
+//Columns - header row of CSV.
+var Columns = []string{"id", "type", "delta", "value", "source", "host", "labels", "first_seen", "updated_at", "stale", "hash"}
+
+//ErrUnknownFormat - format is not FormatCSV or FormatJSONL.
+var ErrUnknownFormat = errors.New("unknown format")
+
+//ErrBadHeader - CSV header row is missing or has unknown columns.
+var ErrBadHeader = errors.New("bad CSV header")
+
+//ErrBadRow - CSV row has malformed cell.
+var ErrBadRow = errors.New("bad CSV row")
+
+//ContentType - return media type of format.
+func ContentType(format string) string {
+	if format == FormatCSV {
+		return CSVContentType + "; charset=utf-8"
+	}
+	return ndjson.ContentType
+}
+
+//FormatOf - return format of media type, text/csv is FormatCSV,
+//application/x-ndjson and application/jsonl are FormatJSONL.
+func FormatOf(contentType string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnknownFormat, err)
+	}
+	switch mediaType {
+	case CSVContentType:
+		return FormatCSV, nil
+	case ndjson.ContentType, "application/jsonl":
+		return FormatJSONL, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownFormat, mediaType)
+}
+
+//Encoder - writes metrics in format.
+type Encoder interface {
+	//Encode - write one metric.
+	Encode(m models.Metrics) error
+	//Flush - write buffered data.
+	Flush() error
+}
+
+//NewEncoder - Encoder of format writing to w.
+func NewEncoder(w io.Writer, format string) (Encoder, error) {
+	switch format {
+	case FormatCSV:
+		return &csvEncoder{w: csv.NewWriter(w)}, nil
+	case FormatJSONL:
+		buf := bufio.NewWriter(w)
+		return jsonlEncoder{buf: buf, enc: json.NewEncoder(buf)}, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownFormat, format)
+}
+
+//csvEncoder - Encoder of CSV, header is written before the first row.
+type csvEncoder struct {
+	w      *csv.Writer
+	header bool
+}
+
+//writeHeader - write header row if it is not written.
+func (e *csvEncoder) writeHeader() error {
+	if e.header {
+		return nil
+	}
+	e.header = true
+	return e.w.Write(Columns)
+}
+
+//Encode - write metric as CSV row.
+func (e *csvEncoder) Encode(m models.Metrics) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	row := make([]string, len(Columns))
+	row[0] = m.ID
+	row[1] = m.MType
+	if m.Delta != nil {
+		row[2] = strconv.FormatInt(*m.Delta, 10)
+	}
+	if m.Value != nil {
+		row[3] = strconv.FormatFloat(*m.Value, 'g', -1, 64)
+	}
+	row[4] = m.Source
+	row[5] = m.Host
+	if len(m.Labels) > 0 {
+		labels, err := json.Marshal(m.Labels)
+		if err != nil {
+			return err
+		}
+		row[6] = string(labels)
+	}
+	if m.FirstSeen != nil {
+		row[7] = m.FirstSeen.Format(time.RFC3339Nano)
+	}
+	if m.UpdatedAt != nil {
+		row[8] = m.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	row[9] = strconv.FormatBool(m.Stale)
+	row[10] = m.Hash
+	return e.w.Write(row)
+}
+
+//Flush - write buffered rows, header is written even if there are no rows.
+func (e *csvEncoder) Flush() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+//jsonlEncoder - Encoder of JSON Lines.
+type jsonlEncoder struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+//Encode - write metric as JSON line.
+func (e jsonlEncoder) Encode(m models.Metrics) error {
+	return e.enc.Encode(m)
+}
+
+//Flush - write buffered lines.
+func (e jsonlEncoder) Flush() error {
+	return e.buf.Flush()
+}
+
+//NewDecoder - ndjson.Decoder of format reading from r.
+//CSV header is read at once, ErrBadHeader is returned if it is missing or has unknown columns.
+func NewDecoder(r io.Reader, format string) (ndjson.Decoder, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVDecoder(r)
+	case FormatJSONL:
+		return ndjson.NewDecoder(r), nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownFormat, format)
+}
+
+//csvDecoder - ndjson.Decoder of CSV.
+type csvDecoder struct {
+	r *csv.Reader
+	//columns - index of column in Columns by index of cell.
+	columns []int
+	line    int
+}
+
+func newCSVDecoder(r io.Reader) (*csvDecoder, error) {
+	d := &csvDecoder{r: csv.NewReader(r)}
+	d.r.ReuseRecord = true
+	header, err := d.r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: no header row", ErrBadHeader)
+	}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("%w: %s", ErrBadHeader, err)
+		}
+		return nil, fmt.Errorf("%w: %s", ndjson.ErrRead, err)
+	}
+	seen := make(map[int]bool)
+	for _, name := range header {
+		k := columnIndex(name)
+		if k < 0 {
+			return nil, fmt.Errorf("%w: unknown column %q", ErrBadHeader, name)
+		}
+		if seen[k] {
+			return nil, fmt.Errorf("%w: column %q is repeated", ErrBadHeader, name)
+		}
+		seen[k] = true
+		d.columns = append(d.columns, k)
+	}
+	if !seen[0] || !seen[1] {
+		return nil, fmt.Errorf("%w: columns id and type are required", ErrBadHeader)
+	}
+	d.line, _ = d.r.FieldPos(0)
+	return d, nil
+}
+
+func columnIndex(name string) int {
+	for k, column := range Columns {
+		if column == name {
+			return k
+		}
+	}
+	return -1
+}
+
+//Next - return number of line and metric of next CSV row.
+//Cell stale is ignored, staleness is computed by server.
+func (d *csvDecoder) Next() (int, models.Metrics, error) {
+	var m models.Metrics
+	row, err := d.r.Read()
+	if err == io.EOF {
+		return d.line, m, io.EOF
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		d.line = parseErr.StartLine
+		return d.line, m, fmt.Errorf("%w: %s", ErrBadRow, parseErr.Err)
+	}
+	if err != nil {
+		return d.line + 1, m, fmt.Errorf("%w: %s", ndjson.ErrRead, err)
+	}
+	d.line, _ = d.r.FieldPos(0)
+	for i, cell := range row {
+		if err := setColumn(&m, d.columns[i], cell); err != nil {
+			return d.line, m, fmt.Errorf("%w: column %s: %s", ErrBadRow, Columns[d.columns[i]], err)
+		}
+	}
+	return d.line, m, nil
+}
+
+//setColumn - set field of column k to value of cell, empty cells are skipped.
+func setColumn(m *models.Metrics, k int, cell string) error {
+	if cell == "" {
+		return nil
+	}
+	switch Columns[k] {
+	case "id":
+		m.ID = cell
+	case "type":
+		m.MType = cell
+	case "delta":
+		delta, err := strconv.ParseInt(cell, 10, 64)
+		if err != nil {
+			return err
+		}
+		m.Delta = &delta
+	case "value":
+		value, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			return err
+		}
+		m.Value = &value
+	case "source":
+		m.Source = cell
+	case "host":
+		m.Host = cell
+	case "labels":
+		return json.Unmarshal([]byte(cell), &m.Labels)
+	case "first_seen":
+		t, err := time.Parse(time.RFC3339Nano, cell)
+		if err != nil {
+			return err
+		}
+		m.FirstSeen = &t
+	case "updated_at":
+		t, err := time.Parse(time.RFC3339Nano, cell)
+		if err != nil {
+			return err
+		}
+		m.UpdatedAt = &t
+	case "hash":
+		m.Hash = cell
+	}
+	return nil
+}
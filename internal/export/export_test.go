@@ -0,0 +1,139 @@
+package export
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/ndjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoder_RoundTrip(t *testing.T) {
+	value := 1.5e-3
+	var delta int64 = -7
+	now := time.Date(2022, 10, 1, 12, 30, 0, 5, time.UTC)
+	data := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value, Source: "agent-1", Host: "host, \"one\"", Labels: map[string]string{"dc": "eu", "rack": "a,b"}, FirstSeen: &now, UpdatedAt: &now, Hash: "ab"},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+	for _, format := range []string{FormatCSV, FormatJSONL} {
+		t.Run("positive "+format, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, err := NewEncoder(&buf, format)
+			require.NoError(t, err)
+			for _, m := range data {
+				require.NoError(t, enc.Encode(m))
+			}
+			require.NoError(t, enc.Flush())
+			dec, err := NewDecoder(&buf, format)
+			require.NoError(t, err)
+			// CSV rows start after header
+			first := 1
+			if format == FormatCSV {
+				first = 2
+			}
+			for k := range data {
+				line, m, err := dec.Next()
+				require.NoError(t, err)
+				assert.Equal(t, first+k, line)
+				assert.Equal(t, data[k], m)
+			}
+			_, _, err = dec.Next()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestEncoder_EmptyCSV(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf, FormatCSV)
+	require.NoError(t, err)
+	require.NoError(t, enc.Flush())
+	assert.Equal(t, strings.Join(Columns, ",")+"\n", buf.String())
+	_, err = NewEncoder(&buf, "xml")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
+
+func TestNewDecoder_CSV(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantErr   error
+		wantLines []int
+		wantErrs  []error
+	}{
+		{
+			name:      "positive columns in any order",
+			body:      "value,type,id\n1,gauge,Alloc\n\n\"2\",gauge,\"Heap\nAlloc\"\n3,gauge,Sys",
+			wantLines: []int{2, 4, 6, 6},
+			wantErrs:  []error{nil, nil, nil, io.EOF},
+		},
+		{
+			name:      "negative bad rows",
+			body:      "id,type,delta,labels\nA,counter,x,\nB,counter,1\nC,counter,1,{\"a\":\nD,counter,1,\n",
+			wantLines: []int{2, 3, 4, 5, 5},
+			wantErrs:  []error{ErrBadRow, ErrBadRow, ErrBadRow, nil, io.EOF},
+		},
+		{
+			name:    "negative no header",
+			wantErr: ErrBadHeader,
+		},
+		{
+			name:    "negative unknown column",
+			body:    "id,type,vaule\n",
+			wantErr: ErrBadHeader,
+		},
+		{
+			name:    "negative repeated column",
+			body:    "id,type,id\n",
+			wantErr: ErrBadHeader,
+		},
+		{
+			name:    "negative no type column",
+			body:    "id,value\n",
+			wantErr: ErrBadHeader,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec, err := NewDecoder(strings.NewReader(tt.body), FormatCSV)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			for k := range tt.wantLines {
+				line, _, err := dec.Next()
+				assert.Equal(t, tt.wantLines[k], line)
+				if tt.wantErrs[k] == nil {
+					assert.NoError(t, err)
+					continue
+				}
+				assert.ErrorIs(t, err, tt.wantErrs[k])
+			}
+		})
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{contentType: "text/csv; charset=utf-8", want: FormatCSV},
+		{contentType: ndjson.ContentType, want: FormatJSONL},
+		{contentType: "application/jsonl", want: FormatJSONL},
+		{contentType: "application/json"},
+		{contentType: ""},
+	}
+	for _, tt := range tests {
+		format, err := FormatOf(tt.contentType)
+		assert.Equal(t, tt.want, format, tt.contentType)
+		assert.Equal(t, tt.want == "", err != nil, tt.contentType)
+	}
+}
@@ -0,0 +1,282 @@
+//Package graphite receives metrics in Graphite plaintext protocol over TCP and writes them to storage.
+//
+//Every line is "path value [timestamp]", timestamp is in Unix seconds, missing
+//or -1 timestamp means now. Paths are mapped to metric IDs and labels by
+//templates, values are stored as gauges.
+//
+//Parsed lines are queued in a bounded queue and written by one writer in
+//batches. When storage is slower than senders the queue fills up and readers
+//stop reading their connections until there is room again, so TCP flow control
+//slows senders down instead of losing data. Malformed lines are counted,
+//logged once per flush and skipped, the connection stays open.
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/validate"
+)
+
+//DefaultSource - source of metrics received by Graphite listener.
+const DefaultSource = "graphite"
+
+//DefaultQueueSize - number of parsed lines queued for writing.
+const DefaultQueueSize = 10000
+
+//DefaultBatchSize - biggest number of metrics written at once.
+const DefaultBatchSize = 1000
+
+//maxLineSize - longest line, longer lines are skipped as malformed.
+const maxLineSize = 64 * 1024
+
+//ParseLine - parse plaintext line to metric, now is used if line has no timestamp.
+func ParseLine(m *Mapper, line string, now time.Time) (models.Metrics, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return models.Metrics{}, fmt.Errorf("want \"path value [timestamp]\", got %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return models.Metrics{}, fmt.Errorf("%s: bad value %q", fields[0], fields[1])
+	}
+	updated := now
+	if len(fields) == 3 && fields[2] != "-1" {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || ts < 0 {
+			return models.Metrics{}, fmt.Errorf("%s: bad timestamp %q", fields[0], fields[2])
+		}
+		sec, frac := math.Modf(ts)
+		updated = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	id, labels, err := m.Map(fields[0])
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	return models.Metrics{ID: id, MType: "gauge", Value: &value, Labels: labels, UpdatedAt: &updated}, nil
+}
+
+//Server - Graphite plaintext listener.
+type Server struct {
+	//Addr - host:port to listen TCP on.
+	Addr string
+	//Mapper - maps paths to metrics.
+	Mapper *Mapper
+	//Repo - storage metrics are written to.
+	Repo models.Storager
+	//Source - source of written metrics.
+	Source string
+	//FlushInterval - longest time metric waits in queue.
+	FlushInterval time.Duration
+	//BatchSize - biggest number of metrics written at once.
+	BatchSize int
+	//Validator - checks parsed metrics, rejected lines are counted as malformed.
+	Validator validate.Validator
+
+	queue    chan models.Metrics
+	bad      uint64
+	ln       net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	done     chan struct{}
+	readers  sync.WaitGroup
+	writer   sync.WaitGroup
+	stopOnce sync.Once
+}
+
+//NewServer - Server constructor, queueSize is size of write queue.
+func NewServer(addr string, mapper *Mapper, repo models.Storager, queueSize int) *Server {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	return &Server{
+		Addr:          addr,
+		Mapper:        mapper,
+		Repo:          repo,
+		Source:        DefaultSource,
+		FlushInterval: time.Second,
+		BatchSize:     DefaultBatchSize,
+		Validator:     validate.New(),
+		queue:         make(chan models.Metrics, queueSize),
+		conns:         make(map[net.Conn]struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+//Start - open listener and start writer.
+func (s *Server) Start() error {
+	var err error
+	if s.ln, err = net.Listen("tcp", s.Addr); err != nil {
+		return err
+	}
+	s.writer.Add(1)
+	go s.writeLoop()
+	s.readers.Add(1)
+	go s.serve()
+	log.Printf("Graphite is listening on %s", s.ln.Addr())
+	return nil
+}
+
+//ListenAddr - return address of listener.
+func (s *Server) ListenAddr() net.Addr {
+	return s.ln.Addr()
+}
+
+//Close - stop listener, close connections and write queued metrics.
+func (s *Server) Close() error {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.ln.Close()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		s.readers.Wait()
+		close(s.queue)
+	})
+	s.writer.Wait()
+	return nil
+}
+
+func (s *Server) serve() {
+	defer s.readers.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("Graphite accept failed: %s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		select {
+		case <-s.done:
+			//Close has already closed connections
+			s.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.readers.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.readers.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	r := bufio.NewReaderSize(conn, maxLineSize)
+	for {
+		line, err := readLine(r)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			atomic.AddUint64(&s.bad, 1)
+			continue
+		}
+		if len(line) > 0 {
+			s.handleLine(string(line), host)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//readLine - read line without line end.
+//If line is longer than buffer, it is discarded and bufio.ErrBufferFull is returned.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = r.ReadSlice('\n')
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, bufio.ErrBufferFull
+	}
+	return bytes.TrimRight(line, "\r\n"), err
+}
+
+func (s *Server) handleLine(text string, host string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	m, err := ParseLine(s.Mapper, text, time.Now())
+	if err == nil {
+		err = s.Validator.Metric(m)
+	}
+	if err != nil {
+		atomic.AddUint64(&s.bad, 1)
+		return
+	}
+	m.Source = s.Source
+	m.Host = host
+	select {
+	case s.queue <- m:
+	case <-s.done:
+	}
+}
+
+func (s *Server) writeLoop() {
+	defer s.writer.Done()
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]models.Metrics, 0, s.BatchSize)
+	for {
+		select {
+		case m, ok := <-s.queue:
+			if !ok {
+				s.write(batch)
+				return
+			}
+			batch = append(batch, m)
+			if len(batch) >= s.BatchSize {
+				s.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *Server) write(batch []models.Metrics) {
+	if bad := atomic.SwapUint64(&s.bad, 0); bad > 0 {
+		log.Printf("Graphite: %d malformed lines skipped", bad)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Repo.BatchInsert(ctx, batch); err != nil {
+		log.Printf("Graphite write of %d metrics failed: %s", len(batch), err)
+	}
+}
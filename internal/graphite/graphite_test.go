@@ -0,0 +1,181 @@
+package graphite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapper_Map(t *testing.T) {
+	templates := []string{
+		"servers.* .host.measurement*",
+		"apps.*.*.requests .app.env.measurement.status",
+		"measurement.measurement.region",
+	}
+	tests := []struct {
+		name       string
+		path       string
+		wantID     string
+		wantLabels map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "positive host template",
+			path:       "servers.web01.cpu.load",
+			wantID:     "cpu.load",
+			wantLabels: map[string]string{"host": "web01"},
+		},
+		{
+			name:       "positive skipped and labels",
+			path:       "apps.billing.prod.requests.500",
+			wantID:     "requests",
+			wantLabels: map[string]string{"app": "billing", "env": "prod", "status": "500"},
+		},
+		{
+			name:       "positive default template",
+			path:       "db.queries.eu",
+			wantID:     "db.queries",
+			wantLabels: map[string]string{"region": "eu"},
+		},
+		{
+			name:    "negative empty part",
+			path:    "servers..cpu",
+			wantErr: true,
+		},
+		{
+			name:    "negative too short",
+			path:    "servers.web01",
+			wantErr: true,
+		},
+	}
+	m, err := NewMapper(templates)
+	require.NoError(t, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, labels, err := m.Map(tt.path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantID, id)
+			assert.Equal(t, tt.wantLabels, labels)
+		})
+	}
+	t.Run("positive no templates", func(t *testing.T) {
+		m, err := NewMapper(nil)
+		require.NoError(t, err)
+		id, labels, err := m.Map("servers.web01.cpu")
+		require.NoError(t, err)
+		assert.Equal(t, "servers.web01.cpu", id)
+		assert.Nil(t, labels)
+	})
+}
+
+func TestParseTemplate(t *testing.T) {
+	for _, s := range []string{"host.cpu", "a.* b.measurement* c", "measurement*.host", "[ .measurement"} {
+		t.Run(s, func(t *testing.T) {
+			_, err := ParseTemplate(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	m, err := NewMapper(nil)
+	require.NoError(t, err)
+	now := time.Unix(1660000000, 0)
+	tests := []struct {
+		line     string
+		wantTime time.Time
+		wantErr  bool
+	}{
+		{line: "cron.backup.duration 12.5 1650000000", wantTime: time.Unix(1650000000, 0)},
+		{line: "cron.backup.duration 12.5 1650000000.5", wantTime: time.Unix(1650000000, 5e8)},
+		{line: "cron.backup.duration 12.5", wantTime: now},
+		{line: "cron.backup.duration 12.5 -1", wantTime: now},
+		{line: "cron.backup.duration", wantErr: true},
+		{line: "cron.backup.duration twelve 1650000000", wantErr: true},
+		{line: "cron.backup.duration NaN", wantErr: true},
+		{line: "cron.backup.duration +Inf", wantErr: true},
+		{line: "cron.backup.duration 12.5 yesterday", wantErr: true},
+		{line: "cron.backup.duration 12.5 1650000000 extra", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := ParseLine(m, tt.line, now)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "cron.backup.duration", got.ID)
+			assert.Equal(t, "gauge", got.MType)
+			assert.Equal(t, 12.5, *got.Value)
+			assert.True(t, tt.wantTime.Equal(*got.UpdatedAt))
+		})
+	}
+}
+
+//gatedRepo - storage which blocks writes until gate is closed.
+type gatedRepo struct {
+	models.Storager
+	gate chan struct{}
+}
+
+func (r *gatedRepo) BatchInsert(ctx context.Context, data []models.Metrics) error {
+	<-r.gate
+	return r.Storager.BatchInsert(ctx, data)
+}
+
+func TestServer(t *testing.T) {
+	m, err := NewMapper([]string{"servers.* .host.measurement*"})
+	require.NoError(t, err)
+	repo := storage.NewRepo()
+	gated := &gatedRepo{Storager: &repo, gate: make(chan struct{})}
+	s := NewServer("127.0.0.1:0", m, gated, 2)
+	s.BatchSize = 2
+	s.FlushInterval = 50 * time.Millisecond
+	require.NoError(t, s.Start())
+
+	conn, err := net.Dial("tcp", s.ListenAddr().String())
+	require.NoError(t, err)
+	var lines []string
+	lines = append(lines, "broken line with too many fields", strings.Repeat("x", maxLineSize+10)+" 1")
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("servers.web%02d.cpu.load %d 1650000000", i, i))
+	}
+	//storage is blocked, so writes stop when queue is full and continue after gate is opened
+	sent := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		sent <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, repo.GetAll(context.TODO()))
+	close(gated.gate)
+	require.NoError(t, <-sent)
+
+	//connection is still open after malformed lines
+	_, err = conn.Write([]byte("servers.web99.cpu.load 99\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(repo.GetAll(context.TODO())) == 51
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, conn.Close())
+	require.NoError(t, s.Close())
+
+	series := repo.GetSeries(context.TODO(), "cpu.load")
+	require.Len(t, series, 51)
+	assert.Equal(t, "web00", series[0].Labels["host"])
+	assert.Equal(t, DefaultSource, series[0].Source)
+	assert.Equal(t, "127.0.0.1", series[0].Host)
+}
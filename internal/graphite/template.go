@@ -0,0 +1,147 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+//Template parts with special meaning.
+const (
+	//PartMeasurement - path part which is included in metric ID.
+	PartMeasurement = "measurement"
+	//PartMeasurementRest - this and all following path parts are included in metric ID.
+	PartMeasurementRest = "measurement*"
+)
+
+//Template - maps dotted Graphite path to metric ID and labels.
+//
+//Template is written as "[filter ]pattern". Filter is dotted glob, every part
+//of it is matched with path.Match against path part at the same position,
+//template without filter matches all paths. Pattern parts are dot separated
+//names of path parts at the same position: PartMeasurement parts are joined
+//by dot into metric ID, PartMeasurementRest takes the rest of path into ID,
+//empty parts are skipped and any other name makes label with path part as value.
+//
+//For example template "servers.* .host.measurement*" maps path
+//"servers.web01.cpu.load" to metric "cpu.load" with label host="web01".
+type Template struct {
+	filter  []string
+	pattern []string
+}
+
+//ParseTemplate - parse template.
+func ParseTemplate(s string) (Template, error) {
+	fields := strings.Fields(s)
+	var t Template
+	switch len(fields) {
+	case 1:
+		t.pattern = strings.Split(fields[0], ".")
+	case 2:
+		t.filter = strings.Split(fields[0], ".")
+		for _, part := range t.filter {
+			if _, err := path.Match(part, ""); err != nil {
+				return Template{}, fmt.Errorf("template %q: bad filter: %w", s, err)
+			}
+		}
+		t.pattern = strings.Split(fields[1], ".")
+	default:
+		return Template{}, fmt.Errorf("template %q: want \"[filter ]pattern\"", s)
+	}
+	measurement := false
+	for i, part := range t.pattern {
+		switch part {
+		case PartMeasurement:
+			measurement = true
+		case PartMeasurementRest:
+			if i != len(t.pattern)-1 {
+				return Template{}, fmt.Errorf("template %q: %s must be the last part", s, PartMeasurementRest)
+			}
+			measurement = true
+		}
+	}
+	if !measurement {
+		return Template{}, fmt.Errorf("template %q: no %s part", s, PartMeasurement)
+	}
+	return t, nil
+}
+
+//Match - return true if template filter matches path parts.
+func (t Template) Match(parts []string) bool {
+	if len(t.filter) > len(parts) {
+		return false
+	}
+	for i, f := range t.filter {
+		if ok, _ := path.Match(f, parts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//Apply - return metric ID and labels of path parts.
+//Path parts without pattern part are ignored.
+func (t Template) Apply(parts []string) (string, map[string]string, error) {
+	var id []string
+	var labels map[string]string
+	for i, name := range t.pattern {
+		if i >= len(parts) {
+			break
+		}
+		switch name {
+		case "":
+		case PartMeasurement:
+			id = append(id, parts[i])
+		case PartMeasurementRest:
+			id = append(id, parts[i:]...)
+		default:
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[name] = parts[i]
+		}
+	}
+	if len(id) == 0 {
+		return "", nil, errors.New("path is too short for template")
+	}
+	return strings.Join(id, "."), labels, nil
+}
+
+//Mapper - maps paths with the first matching template.
+//Path no template matches becomes metric ID as is.
+type Mapper struct {
+	templates []Template
+}
+
+//NewMapper - Mapper constructor, templates are parsed with ParseTemplate.
+func NewMapper(templates []string) (*Mapper, error) {
+	m := &Mapper{}
+	for _, s := range templates {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		t, err := ParseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		m.templates = append(m.templates, t)
+	}
+	return m, nil
+}
+
+//Map - return metric ID and labels of dotted path.
+func (m *Mapper) Map(p string) (string, map[string]string, error) {
+	parts := strings.Split(p, ".")
+	for _, part := range parts {
+		if part == "" {
+			return "", nil, fmt.Errorf("bad path %q", p)
+		}
+	}
+	for _, t := range m.templates {
+		if t.Match(parts) {
+			return t.Apply(parts)
+		}
+	}
+	return p, nil, nil
+}
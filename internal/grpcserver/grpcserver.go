@@ -0,0 +1,308 @@
+//Package grpcserver serves metrics gRPC API defined in internal/proto.
+//
+//Service shares logic, HMAC verification and storage with HTTP endpoints via
+//handlers.Handlers. Agent identity is read from x-agent-id and x-agent-hostname
+//metadata, batch idempotency key from idempotency-key metadata. Calls and
+//streamed messages are limited by Handlers.RateLimit like HTTP requests.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/handlers"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	pb "github.com/MaximkaSha/log_tools/internal/proto"
+	"github.com/MaximkaSha/log_tools/internal/rates"
+	"github.com/MaximkaSha/log_tools/internal/validate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+//Server - gRPC server of metrics service.
+type Server struct {
+	pb.UnimplementedMetricsServer
+	//Addr - host:port to listen on.
+	Addr string
+	//Handlers - shared logic and storage.
+	Handlers *handlers.Handlers
+
+	srv *grpc.Server
+	ln  net.Listener
+}
+
+//NewServer - Server constructor.
+func NewServer(addr string, handl *handlers.Handlers) *Server {
+	s := &Server{
+		Addr:     addr,
+		Handlers: handl,
+	}
+	s.srv = grpc.NewServer(grpc.ChainUnaryInterceptor(recoverUnary, s.limitUnary), grpc.ChainStreamInterceptor(recoverStream, s.limitStream))
+	pb.RegisterMetricsServer(s.srv, s)
+	return s
+}
+
+//Start - open listener and serve in background.
+func (s *Server) Start() error {
+	var err error
+	if s.ln, err = net.Listen("tcp", s.Addr); err != nil {
+		return err
+	}
+	go func() {
+		if err := s.srv.Serve(s.ln); err != nil {
+			log.Printf("gRPC server stopped: %s", err)
+		}
+	}()
+	log.Printf("gRPC is listening on %s", s.ln.Addr())
+	return nil
+}
+
+//ListenAddr - return address of listener.
+func (s *Server) ListenAddr() net.Addr {
+	return s.ln.Addr()
+}
+
+//Close - stop accepting requests and wait for running ones.
+func (s *Server) Close() {
+	s.srv.GracefulStop()
+}
+
+//recoverUnary - turn panic of handler into Internal status, so one request can not stop server.
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("gRPC %s panic: %v", info.FullMethod, p)
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+//recoverStream - turn panic of stream handler into Internal status, so one stream can not stop server.
+func recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("gRPC %s panic: %v", info.FullMethod, p)
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(srv, ss)
+}
+
+//limitUnary - reject call over rate limit of Handlers.RateLimit with ResourceExhausted.
+func (s *Server) limitUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.allow(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+//limitStream - take rate limit token of Handlers.RateLimit for every received message of stream.
+func (s *Server) limitStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if s.Handlers.RateLimit == nil {
+		return handler(srv, ss)
+	}
+	return handler(srv, &limitedStream{ServerStream: ss, s: s})
+}
+
+//limitedStream - grpc.ServerStream which fails receiving message over rate limit.
+type limitedStream struct {
+	grpc.ServerStream
+	s *Server
+}
+
+func (ls *limitedStream) RecvMsg(m interface{}) error {
+	if err := ls.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return ls.s.allow(ls.Context())
+}
+
+//allow - take rate limit token of call client, client is peer IP with agent ID and API key of metadata.
+func (s *Server) allow(ctx context.Context) error {
+	limiter := s.Handlers.RateLimit
+	if limiter == nil {
+		return nil
+	}
+	ok, retryAfter := limiter.AllowClient(peerHost(ctx), firstValue(ctx, pb.AgentIDKey), firstValue(ctx, strings.ToLower(limiter.APIKeyHeader)))
+	if !ok {
+		return status.Errorf(codes.ResourceExhausted, "too many requests, retry after %s", retryAfter.Round(time.Millisecond))
+	}
+	return nil
+}
+
+//Update - write metric.
+func (s *Server) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	m, err := s.toModel(req.GetMetric())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	stampSource(ctx, &m)
+	if err := s.Handlers.Update(ctx, m); err != nil {
+		return nil, statusOf(err)
+	}
+	return &pb.UpdateResponse{Metric: pb.FromModel(m)}, nil
+}
+
+//UpdateBatch - write stream of metrics at once when client closes stream.
+//Response has status of every metric. If no metric is written because of rejected ones,
+//InvalidArgument status is returned with UpdateBatchResponse in details.
+//Message without metric is InvalidArgument, stream longer than batch limit is ResourceExhausted
+//as soon as limit is passed.
+func (s *Server) UpdateBatch(stream pb.Metrics_UpdateBatchServer) error {
+	var data []models.Metrics
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if req.GetMetric() == nil {
+			return status.Error(codes.InvalidArgument, "message has no metric")
+		}
+		if err := s.Handlers.Validator.BatchSize(len(data) + 1); err != nil {
+			return statusOf(err)
+		}
+		// metrics are checked by Handlers.UpdateBatch, so bad one does not break best effort batch
+		m := req.GetMetric().ToModel()
+		stampSource(stream.Context(), &m)
+		data = append(data, m)
+	}
+	ctx, cancel := requestContext(stream.Context())
+	defer cancel()
+	scope := firstValue(ctx, pb.AgentIDKey)
+	if scope == "" {
+		scope = rates.SourceFromContext(ctx)
+	}
+	result, replayed, err := s.Handlers.UpdateBatch(ctx, scope, firstValue(ctx, pb.IdempotencyKeyKey), data)
+	if errors.Is(err, handlers.ErrBatchRejected) {
+		st, detailErr := status.New(codes.InvalidArgument, err.Error()).WithDetails(pb.FromBatchResult(result, false))
+		if detailErr != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return st.Err()
+	}
+	if err != nil {
+		return statusOf(err)
+	}
+	return stream.SendAndClose(pb.FromBatchResult(result, replayed))
+}
+
+//GetValue - read metric value.
+func (s *Server) GetValue(ctx context.Context, req *pb.GetValueRequest) (*pb.GetValueResponse, error) {
+	if req.GetType() != "gauge" && req.GetType() != "counter" {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown type %q", req.GetType())
+	}
+	m, err := s.Handlers.Value(ctx, models.Metrics{ID: req.GetId(), MType: req.GetType(), Source: req.GetSource()}, req.GetAgg())
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return &pb.GetValueResponse{Metric: pb.FromModel(m)}, nil
+}
+
+//List - read page of metrics.
+func (s *Server) List(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	page, err := s.Handlers.List(ctx, models.ListQuery{
+		Type:   req.GetType(),
+		Prefix: req.GetPrefix(),
+		Glob:   req.GetGlob(),
+		Regex:  req.GetRegex(),
+		Source: req.GetSource(),
+		Sort:   req.GetSort(),
+		Desc:   req.GetDesc(),
+		Limit:  int(req.GetLimit()),
+		Cursor: req.GetCursor(),
+	})
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	resp := &pb.ListResponse{Metrics: make([]*pb.Metric, 0, len(page.Metrics)), NextCursor: page.NextCursor}
+	for _, m := range page.Metrics {
+		resp.Metrics = append(resp.Metrics, pb.FromModel(m))
+	}
+	return resp, nil
+}
+
+//toModel - convert metric message to models.Metrics and check it with Handlers.Validator.
+//If metric is missing or bad InvalidArgument status is returned.
+func (s *Server) toModel(m *pb.Metric) (models.Metrics, error) {
+	if m == nil {
+		return models.Metrics{}, status.Error(codes.InvalidArgument, "request has no metric")
+	}
+	data := m.ToModel()
+	if err := s.Handlers.Validator.Metric(data); err != nil {
+		return models.Metrics{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return data, nil
+}
+
+//statusOf - convert error of shared logic to status.
+func statusOf(err error) error {
+	switch {
+	case errors.Is(err, handlers.ErrBadHash), errors.Is(err, handlers.ErrBadQuery):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, validate.ErrTooLarge):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, validate.ErrBadName), errors.Is(err, validate.ErrUnknownType), errors.Is(err, validate.ErrBadValue):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, handlers.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, models.ErrKeyConflict):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	log.Println(err)
+	return status.Error(codes.Internal, "storage error")
+}
+
+//requestContext - return context of write with peer address as rates source.
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(rates.WithSource(ctx, peerHost(ctx)), 5*time.Second)
+}
+
+//peerHost - return host of peer address, empty if context has no peer.
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+//stampSource - set source and host of metric from agent metadata if metric has none.
+func stampSource(ctx context.Context, m *models.Metrics) {
+	if m.Source == "" {
+		m.Source = firstValue(ctx, pb.AgentIDKey)
+	}
+	if m.Host == "" {
+		m.Host = firstValue(ctx, pb.AgentHostKey)
+	}
+}
+
+//firstValue - return first value of incoming metadata key.
+func firstValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
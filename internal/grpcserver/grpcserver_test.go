@@ -0,0 +1,233 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/MaximkaSha/log_tools/internal/crypto"
+	"github.com/MaximkaSha/log_tools/internal/handlers"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	pb "github.com/MaximkaSha/log_tools/internal/proto"
+	"github.com/MaximkaSha/log_tools/internal/ratelimit"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newClient(t *testing.T, key string) (pb.MetricsClient, *storage.Repository) {
+	repo := storage.NewRepo()
+	cryptoService := crypto.NewCryptoService()
+	if key != "" {
+		cryptoService.InitCryptoService(key)
+	}
+	handl := handlers.NewHandlers(&repo, cryptoService)
+	return serve(t, &handl), &repo
+}
+
+//serve - start server of handl on in-memory listener and return its client.
+func serve(t *testing.T, handl *handlers.Handlers) pb.MetricsClient {
+	s := NewServer("", handl)
+	ln := bufconn.Listen(1 << 20)
+	go s.srv.Serve(ln)
+	t.Cleanup(s.Close)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+func gauge(id string, value float64) *pb.Metric {
+	return &pb.Metric{Id: id, Type: "gauge", Value: &value}
+}
+
+func counter(id string, delta int64) *pb.Metric {
+	return &pb.Metric{Id: id, Type: "counter", Delta: &delta}
+}
+
+func TestServer_Update(t *testing.T) {
+	client, _ := newClient(t, "")
+	tests := []struct {
+		name   string
+		metric *pb.Metric
+		code   codes.Code
+	}{
+		{name: "positive gauge", metric: gauge("Alloc", 1.5), code: codes.OK},
+		{name: "positive counter", metric: counter("PollCount", 2), code: codes.OK},
+		{name: "negative counter without delta", metric: &pb.Metric{Id: "PollCount", Type: "counter"}, code: codes.InvalidArgument},
+		{name: "negative unknown type", metric: &pb.Metric{Id: "Alloc", Type: "gouge"}, code: codes.InvalidArgument},
+		{name: "negative no id", metric: gauge("", 1), code: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.Update(context.Background(), &pb.UpdateRequest{Metric: tt.metric})
+			assert.Equal(t, tt.code, status.Code(err), err)
+		})
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), pb.AgentIDKey, "agent1")
+	_, err := client.Update(ctx, &pb.UpdateRequest{Metric: counter("PollCount", 3)})
+	require.NoError(t, err)
+	resp, err := client.GetValue(context.Background(), &pb.GetValueRequest{Id: "PollCount", Type: "counter"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), resp.GetMetric().GetDelta())
+	resp, err = client.GetValue(context.Background(), &pb.GetValueRequest{Id: "PollCount", Type: "counter", Source: "agent1"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.GetMetric().GetDelta())
+
+	_, err = client.GetValue(context.Background(), &pb.GetValueRequest{Id: "Missing", Type: "gauge"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.GetValue(context.Background(), &pb.GetValueRequest{Id: "Alloc", Type: "gauge", Agg: "median"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_UpdateBatch(t *testing.T) {
+	client, repo := newClient(t, "")
+	send := func(key string) *pb.UpdateBatchResponse {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), pb.AgentIDKey, "agent1", pb.IdempotencyKeyKey, key)
+		stream, err := client.UpdateBatch(ctx)
+		require.NoError(t, err)
+		for _, m := range []*pb.Metric{gauge("Alloc", 1), counter("PollCount", 1), counter("PollCount", 2)} {
+			require.NoError(t, stream.Send(&pb.UpdateBatchRequest{Metric: m}))
+		}
+		resp, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		return resp
+	}
+	resp := send("batch1")
+	assert.Equal(t, int64(3), resp.GetAccepted())
+	assert.False(t, resp.GetReplayed())
+	resp = send("batch1")
+	assert.True(t, resp.GetReplayed())
+
+	got, err := repo.GetMetric(models.Metrics{ID: "PollCount", MType: "counter", Source: "agent1"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *got.Delta)
+
+	list, err := client.List(context.Background(), &pb.ListRequest{Type: "counter"})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 1)
+	assert.Equal(t, "agent1", list.GetMetrics()[0].GetSource())
+	_, err = client.List(context.Background(), &pb.ListRequest{Sort: "value"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_UpdateBatchRejected(t *testing.T) {
+	client, repo := newClient(t, "")
+	stream, err := client.UpdateBatch(context.Background())
+	require.NoError(t, err)
+	for _, m := range []*pb.Metric{gauge("Alloc", 1), {Id: "PollCount", Type: "counter"}} {
+		require.NoError(t, stream.Send(&pb.UpdateBatchRequest{Metric: m}))
+	}
+	_, err = stream.CloseAndRecv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	details := status.Convert(err).Details()
+	require.Len(t, details, 1)
+	resp, ok := details[0].(*pb.UpdateBatchResponse)
+	require.True(t, ok)
+	assert.Equal(t, int64(0), resp.GetAccepted())
+	assert.Equal(t, int64(2), resp.GetRejected())
+	require.Len(t, resp.GetItems(), 2)
+	assert.Equal(t, models.BatchItemSkipped, resp.GetItems()[0].GetStatus())
+	assert.Equal(t, models.BatchItemRejected, resp.GetItems()[1].GetStatus())
+	assert.NotEmpty(t, resp.GetItems()[1].GetReason())
+	_, err = repo.GetMetric(models.Metrics{ID: "Alloc", MType: "gauge"})
+	assert.Error(t, err)
+}
+
+func TestServer_EmptyMetric(t *testing.T) {
+	client, _ := newClient(t, "")
+	_, err := client.Update(context.Background(), &pb.UpdateRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), err)
+
+	stream, err := client.UpdateBatch(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.UpdateBatchRequest{}))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), err)
+
+	//server is still up
+	_, err = client.Update(context.Background(), &pb.UpdateRequest{Metric: gauge("Alloc", 1)})
+	assert.NoError(t, err)
+}
+
+func TestServer_UpdateBatchLimit(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := handlers.NewHandlers(&repo, crypto.NewCryptoService())
+	handl.Validator.MaxBatchSize = 2
+	client := serve(t, &handl)
+	stream, err := client.UpdateBatch(context.Background())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		if err = stream.Send(&pb.UpdateBatchRequest{Metric: gauge("Alloc", 1)}); err != nil {
+			break
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), err)
+	assert.Empty(t, repo.GetAll(context.Background()))
+}
+
+func TestRecover(t *testing.T) {
+	_, err := recoverUnary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	err = recoverStream(nil, nil, &grpc.StreamServerInfo{FullMethod: "/test"}, func(srv interface{}, stream grpc.ServerStream) error {
+		panic("boom")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := handlers.NewHandlers(&repo, crypto.NewCryptoService())
+	var err error
+	handl.RateLimit, err = ratelimit.NewLimiter(ratelimit.KeyAgent, ratelimit.Limit{Rate: 0.001, Burst: 2}, nil)
+	require.NoError(t, err)
+	client := serve(t, &handl)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), pb.AgentIDKey, "agent1")
+	for i, want := range []codes.Code{codes.OK, codes.OK, codes.ResourceExhausted} {
+		_, err = client.Update(ctx, &pb.UpdateRequest{Metric: gauge("Alloc", 1)})
+		assert.Equal(t, want, status.Code(err), "call %d", i)
+	}
+
+	// every streamed message takes token
+	ctx = metadata.AppendToOutgoingContext(context.Background(), pb.AgentIDKey, "agent2")
+	stream, err := client.UpdateBatch(ctx)
+	require.NoError(t, err)
+	for _, m := range []*pb.Metric{gauge("Alloc", 1), gauge("Sys", 1), gauge("Heap", 1)} {
+		_ = stream.Send(&pb.UpdateBatchRequest{Metric: m})
+	}
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = repo.GetMetric(models.Metrics{ID: "Sys", MType: "gauge"})
+	assert.Error(t, err, "limited batch is not written")
+}
+
+func TestServer_Hash(t *testing.T) {
+	client, _ := newClient(t, "secret")
+	signer := crypto.NewCryptoService()
+	signer.InitCryptoService("secret")
+	m := gauge("Alloc", 1.5).ToModel()
+	_, err := signer.Hash(&m)
+	require.NoError(t, err)
+
+	_, err = client.Update(context.Background(), &pb.UpdateRequest{Metric: pb.FromModel(m)})
+	require.NoError(t, err)
+	_, err = client.Update(context.Background(), &pb.UpdateRequest{Metric: gauge("Alloc", 1.5)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	resp, err := client.GetValue(context.Background(), &pb.GetValueRequest{Id: "Alloc", Type: "gauge"})
+	require.NoError(t, err)
+	assert.Equal(t, m.Hash, resp.GetMetric().GetHash())
+}
@@ -0,0 +1,733 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/alert"
+	"github.com/MaximkaSha/log_tools/internal/export"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/ndjson"
+	metricsquery "github.com/MaximkaSha/log_tools/internal/query"
+	"github.com/MaximkaSha/log_tools/internal/rates"
+	"github.com/MaximkaSha/log_tools/internal/validate"
+	"github.com/MaximkaSha/log_tools/internal/webhooks"
+	"github.com/go-chi/chi/v5"
+)
+
+// APIPrefix path /api/v1 routes are mounted on.
+const APIPrefix = "/api/v1"
+
+// OpenAPI OpenAPI 3 document of /api/v1, it is served at /api/v1/openapi.json.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// Error codes of /api/v1 error bodies.
+const (
+	// CodeInvalidJSON request body is not valid JSON of expected shape.
+	CodeInvalidJSON = "invalid_json"
+	// CodeUnsupportedMediaType request body is not application/json.
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	// CodeBadRequest query or path parametr is bad.
+	CodeBadRequest = "bad_request"
+	// CodeUnknownType metric type is not gauge or counter.
+	CodeUnknownType = "unknown_type"
+	// CodeBadValue metric has bad name or value which does not match its type.
+	CodeBadValue = "bad_value"
+	// CodeTooLarge request body or batch is bigger than limit.
+	CodeTooLarge = "too_large"
+	// CodeBadHash metric hash does not match server key.
+	CodeBadHash = "bad_hash"
+	// CodeNotFound metric or route is not found.
+	CodeNotFound = "not_found"
+	// CodeKeyConflict idempotency key was used with other batch.
+	CodeKeyConflict = "key_conflict"
+	// CodeMethodNotAllowed route does not support method.
+	CodeMethodNotAllowed = "method_not_allowed"
+	// CodeDisabled feature is disabled on server.
+	CodeDisabled = "disabled"
+	// CodeStorageError storage failed.
+	CodeStorageError = "storage_error"
+	// CodeUnavailable storage is not reachable.
+	CodeUnavailable = "unavailable"
+	// CodeUnauthorized request has no valid admin token.
+	CodeUnauthorized = "unauthorized"
+	// CodeForbidden request is not allowed by server configuration.
+	CodeForbidden = "forbidden"
+)
+
+// APIError error of /api/v1 request.
+type APIError struct {
+	// Code machine readable error code, one of Code constants.
+	Code string `json:"code"`
+	// Message human readable description.
+	Message string `json:"message"`
+}
+
+// apiErrorBody JSON body of /api/v1 error response.
+type apiErrorBody struct {
+	Error APIError `json:"error"`
+}
+
+// webhookInput JSON body of webhook subscription request.
+type webhookInput struct {
+	Pattern   string  `json:"pattern"`
+	MinChange float64 `json:"min_change"`
+	URL       string  `json:"url"`
+	Secret    string  `json:"secret"`
+}
+
+// APIRouter returns router of /api/v1 routes, it is mounted on APIPrefix.
+// Every error is JSON {"error":{"code":...,"message":...}} except of remote write which follows Prometheus protocol.
+func (h *Handlers) APIRouter() http.Handler {
+	r := chi.NewRouter()
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, CodeNotFound, "route "+r.URL.Path+" is not found")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method "+r.Method+" is not allowed")
+	})
+	r.Get("/openapi.json", h.HandleGetOpenAPI)
+	r.Get("/ping", h.HandleAPIPing)
+	r.Get("/metrics", h.HandleAPIList)
+	r.Post("/metrics", h.HandleAPIUpdate)
+	r.Post("/metrics/batch", h.HandleAPIUpdates)
+	r.Post("/metrics/ndjson", h.HandlePostNDJSON)
+	r.Get("/metrics/{type}/{name}", h.HandleAPIValue)
+	r.Get("/rates", h.HandleAPIRates)
+	r.Get("/rates/{name}", h.HandleAPIRates)
+	r.Get("/stale", h.HandleAPIStale)
+	r.Get("/query", h.HandleAPIQuery)
+	r.Get("/alerts", h.HandleAPIAlerts)
+	r.Get("/ratelimit", h.HandleAPIRateLimit)
+	r.Group(func(r chi.Router) {
+		r.Use(h.webhookAuth)
+		r.Get("/webhooks", h.HandleAPIListWebhooks)
+		r.Post("/webhooks", h.HandleAPICreateWebhook)
+		r.Get("/webhooks/{id}", h.HandleAPIGetWebhook)
+		r.Delete("/webhooks/{id}", h.HandleAPIDeleteWebhook)
+		r.Get("/webhooks/{id}/deliveries", h.HandleAPIWebhookDeliveries)
+	})
+	r.Get("/export", h.HandleAPIExport)
+	r.Post("/import", h.HandleAPIImport)
+	r.Post("/write", h.HandlePostRemoteWrite)
+	return r
+}
+
+// HandleGetOpenAPI returns OpenAPI document of /api/v1.
+func (h *Handlers) HandleGetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(OpenAPI)
+}
+
+// HandleAPIPing returns {"status":"ok"} if storage is reachable, otherwise 503.
+func (h *Handlers) HandleAPIPing(w http.ResponseWriter, r *http.Request) {
+	if !h.Repo.PingDB() {
+		writeAPIError(w, http.StatusServiceUnavailable, CodeUnavailable, "storage is not reachable")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// HandleAPIUpdate writes models.Metrics JSON and returns it.
+// Body must be application/json, metric is checked by Validator.
+func (h *Handlers) HandleAPIUpdate(w http.ResponseWriter, r *http.Request) {
+	var data models.Metrics
+	if !h.decodeAPIBody(w, r, &data) {
+		return
+	}
+	stampSource(r, &data)
+	ctx, cancel := context.WithTimeout(rates.WithSource(r.Context(), rates.SourceFromRequest(r)), 5*time.Second)
+	defer cancel()
+	if err := h.Update(ctx, data); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// HandleAPIUpdates writes []models.Metrics JSON at once and returns models.BatchResult
+// with status and reason of every metric. Bad metrics are rejected, good ones are written unless
+// BatchPolicy is atomic. If no metric is written because of rejected ones then 422 with models.BatchResult.
+// Batch with Idempotency-Key or X-Batch-ID header is applied once, repeated batch gets
+// the original result with Idempotent-Replayed header. Keys are scoped by agent ID,
+// key reused with other batch gets 409.
+func (h *Handlers) HandleAPIUpdates(w http.ResponseWriter, r *http.Request) {
+	var data models.MetricsDB
+	if !h.decodeAPIBody(w, r, &data) {
+		return
+	}
+	for k := range data {
+		stampSource(r, &data[k])
+	}
+	ctx, cancel := context.WithTimeout(rates.WithSource(r.Context(), rates.SourceFromRequest(r)), 5*time.Second)
+	defer cancel()
+	result, replayed, err := h.UpdateBatch(ctx, batchScope(r), batchKey(r), data)
+	if errors.Is(err, ErrBatchRejected) {
+		writeJSON(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if replayed {
+		w.Header().Set(models.ReplayedHeader, "true")
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HandlePostNDJSON streams application/x-ndjson body, one models.Metrics JSON per line, to storage
+// in chunks and returns ndjson.Result with progress and errors of invalid lines.
+// Invalid lines are rejected, the rest are written. If reading body fails then 400, if storage fails then 500,
+// both with ndjson.Result of lines written before.
+func (h *Handlers) HandlePostNDJSON(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != ndjson.ContentType {
+		writeAPIError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "content type must be "+ndjson.ContentType)
+		return
+	}
+	ctx := rates.WithSource(r.Context(), rates.SourceFromRequest(r))
+	result, err := h.Ingest(ctx, ndjson.NewDecoder(r.Body), func(m *models.Metrics) {
+		stampSource(r, m)
+		stampServer(m)
+	})
+	writeIngestResult(w, result, err)
+}
+
+// HandleAPIQuery returns query.Result JSON of aggregation of stored metrics.
+// Metrics are selected by type, prefix, glob, regex and source parametrs,
+// agg is sum, avg, min, max, count or topk with k, by is comma separated group keys:
+// source, host, id, type or label name.
+func (h *Handlers) HandleAPIQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := queryOf(query)
+	if kVal := query.Get("k"); kVal != "" {
+		var err error
+		if q.K, err = strconv.Atoi(kVal); err != nil {
+			writeAPIError(w, http.StatusBadRequest, CodeBadRequest, "bad k")
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	result, err := h.Query(ctx, q)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HandleAPIAlerts returns []alert.Alert JSON of current alerts, parametr state selects
+// pending, firing or resolved alerts. If alerting is disabled then 501.
+func (h *Handlers) HandleAPIAlerts(w http.ResponseWriter, r *http.Request) {
+	if h.Alerts == nil {
+		writeAPIError(w, http.StatusNotImplemented, CodeDisabled, "alerting is disabled")
+		return
+	}
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", alert.StatePending, alert.StateFiring, alert.StateResolved:
+	default:
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("unknown state %q", state))
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Alerts.Alerts(state))
+}
+
+// HandleAPIRateLimit returns ratelimit.Stats JSON with limits, buckets of recent clients
+// and numbers of allowed and rejected requests. If rate limiting is disabled then 501.
+func (h *Handlers) HandleAPIRateLimit(w http.ResponseWriter, r *http.Request) {
+	if h.RateLimit == nil {
+		writeAPIError(w, http.StatusNotImplemented, CodeDisabled, "rate limiting is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, h.RateLimit.Stats())
+}
+
+// HandleAPIListWebhooks returns []webhooks.Subscription JSON of webhook subscriptions.
+func (h *Handlers) HandleAPIListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !h.webhooksEnabled(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Webhooks.List())
+}
+
+// HandleAPICreateWebhook creates webhook subscription of {"pattern","min_change","url","secret"} JSON
+// and returns it with 201. Secret is never returned.
+func (h *Handlers) HandleAPICreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !h.webhooksEnabled(w) {
+		return
+	}
+	var input webhookInput
+	if !h.decodeAPIBody(w, r, &input) {
+		return
+	}
+	sub, err := h.Webhooks.Create(webhooks.Subscription{Pattern: input.Pattern, MinChange: input.MinChange, URL: input.URL, Secret: input.Secret})
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+// HandleAPIGetWebhook returns webhooks.Subscription JSON of URL parametr id.
+func (h *Handlers) HandleAPIGetWebhook(w http.ResponseWriter, r *http.Request) {
+	if !h.webhooksEnabled(w) {
+		return
+	}
+	sub, err := h.Webhooks.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// HandleAPIDeleteWebhook deletes webhook subscription of URL parametr id, response is 204.
+func (h *Handlers) HandleAPIDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if !h.webhooksEnabled(w) {
+		return
+	}
+	if err := h.Webhooks.Delete(chi.URLParam(r, "id")); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAPIWebhookDeliveries returns []webhooks.Delivery JSON of last deliveries
+// of subscription of URL parametr id, the newest first.
+func (h *Handlers) HandleAPIWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !h.webhooksEnabled(w) {
+		return
+	}
+	deliveries, err := h.Webhooks.Deliveries(chi.URLParam(r, "id"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// webhookAuth requires "Authorization: Bearer <WebhookToken>" header on webhook routes.
+// If WebhookToken is empty subscriptions may be read, but not changed.
+func (h *Handlers) webhookAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.WebhookToken == "" {
+			if r.Method != http.MethodGet {
+				writeAPIError(w, http.StatusForbidden, CodeForbidden, "webhooks are read-only, admin token is not configured")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.WebhookToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, CodeUnauthorized, "admin token is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// webhooksEnabled writes 501 and returns false if webhooks are disabled.
+func (h *Handlers) webhooksEnabled(w http.ResponseWriter) bool {
+	if h.Webhooks == nil {
+		writeAPIError(w, http.StatusNotImplemented, CodeDisabled, "webhooks are disabled")
+		return false
+	}
+	return true
+}
+
+// HandleAPIExport streams metrics matching list filters (type, prefix, glob, regex, source, sort, order)
+// as CSV or JSON Lines, parametr format is csv or jsonl (default).
+// If parametr history is true then changes kept by Stream are exported in order instead of current metrics,
+// counters carry stored sum. Metrics are signed with server key, so they may be imported by server with the same key.
+func (h *Handlers) HandleAPIExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = export.FormatJSONL
+	}
+	enc, err := export.NewEncoder(w, format)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	history := false
+	if historyVal := query.Get("history"); historyVal != "" {
+		if history, err = strconv.ParseBool(historyVal); err != nil {
+			writeAPIError(w, http.StatusBadRequest, CodeBadRequest, "bad history")
+			return
+		}
+	}
+	q, _, err := listQuery(query)
+	if err == nil {
+		err = q.Prepare()
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if history && h.Stream == nil {
+		writeAPIError(w, http.StatusNotImplemented, CodeDisabled, "history is disabled")
+		return
+	}
+	if history {
+		var changes []models.Metrics
+		for _, ev := range h.Stream.History() {
+			if q.Match(ev.New) {
+				changes = append(changes, ev.New)
+			}
+		}
+		setExportHeaders(w, format)
+		h.writeExport(enc, changes)
+		return
+	}
+	q.Cursor = ""
+	q.Limit = models.MaxListLimit
+	for page := 0; ; page++ {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		data, err := h.List(ctx, q)
+		cancel()
+		if err != nil && page == 0 {
+			writeServiceError(w, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Export stopped after %d pages: %s", page, err)
+			return
+		}
+		if page == 0 {
+			setExportHeaders(w, format)
+		}
+		if !h.writeExport(enc, data.Metrics) || data.NextCursor == "" {
+			return
+		}
+		q.Cursor = data.NextCursor
+	}
+}
+
+// setExportHeaders sets content type and file name of export in format.
+func setExportHeaders(w http.ResponseWriter, format string) {
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", `attachment; filename="metrics.`+format+`"`)
+}
+
+// writeExport signs and writes metrics with enc and flushes them to client.
+// False is returned if writing fails.
+func (h *Handlers) writeExport(enc export.Encoder, data []models.Metrics) bool {
+	for _, m := range data {
+		if h.cryptoService.IsEnable {
+			if _, err := h.cryptoService.Hash(&m); err != nil {
+				log.Printf("Export stopped: %s", err)
+				return false
+			}
+		}
+		if err := enc.Encode(m); err != nil {
+			log.Printf("Export stopped: %s", err)
+			return false
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		log.Printf("Export stopped: %s", err)
+		return false
+	}
+	return true
+}
+
+// HandleAPIImport writes metrics of CSV or JSON Lines body, for example of HandleAPIExport.
+// Format is taken from parametr format or Content-Type: text/csv, application/x-ndjson or application/jsonl.
+// Rows are ingested like NDJSON lines and response is the same as of HandlePostNDJSON,
+// bad CSV header is rejected line 1. Source of metric is taken from row, not from agent headers.
+// Counters are imported as absolute values: they replace stored totals instead of being added,
+// so repeated import of the same export is harmless and needs no idempotency key.
+func (h *Handlers) HandleAPIImport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		var err error
+		if format, err = export.FormatOf(r.Header.Get("Content-Type")); err != nil {
+			writeAPIError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "content type must be text/csv or "+ndjson.ContentType)
+			return
+		}
+	}
+	dec, err := export.NewDecoder(r.Body, format)
+	if errors.Is(err, export.ErrUnknownFormat) {
+		writeAPIError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, err.Error())
+		return
+	}
+	if err != nil {
+		var result ndjson.Result
+		if errors.Is(err, export.ErrBadHeader) {
+			result.Lines = 1
+			result.Reject(1, err)
+		}
+		result.Error = err.Error()
+		writeJSON(w, http.StatusBadRequest, result)
+		return
+	}
+	result, err := h.Import(r.Context(), dec)
+	writeIngestResult(w, result, err)
+}
+
+// writeIngestResult writes result of Ingest: 200 if stream is ingested to the end,
+// 400 if it can not be read and 500 if storage fails.
+func writeIngestResult(w http.ResponseWriter, result ndjson.Result, err error) {
+	if err != nil {
+		log.Printf("Ingest stopped after line %d: %s", result.CommittedLine, err)
+		result.Error = err.Error()
+		if errors.Is(err, ndjson.ErrRead) {
+			writeJSON(w, http.StatusBadRequest, result)
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HandleAPIValue returns models.Metrics of URL parametrs type and name.
+// Query parametr source selects source, if it is empty agg sets aggregation across sources.
+func (h *Handlers) HandleAPIValue(w http.ResponseWriter, r *http.Request) {
+	typeVal := chi.URLParam(r, "type")
+	if typeVal != "gauge" && typeVal != "counter" {
+		writeAPIError(w, http.StatusBadRequest, CodeUnknownType, fmt.Sprintf("unknown type %q", typeVal))
+		return
+	}
+	data := models.Metrics{ID: chi.URLParam(r, "name"), MType: typeVal, Source: r.URL.Query().Get("source")}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	d, err := h.Value(ctx, data, r.URL.Query().Get("agg"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// HandleAPIList returns page of metrics in models.ListPage JSON, parametrs are the same as of HandleGetList.
+func (h *Handlers) HandleAPIList(w http.ResponseWriter, r *http.Request) {
+	q, fields, err := listQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	page, err := h.List(ctx, q)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, listBody(page, fields))
+}
+
+// HandleAPIRates returns []rates.Rate JSON, parametrs are the same as of HandleGetRates.
+func (h *Handlers) HandleAPIRates(w http.ResponseWriter, r *http.Request) {
+	if h.Rates == nil {
+		writeAPIError(w, http.StatusNotImplemented, CodeDisabled, "rates are disabled")
+		return
+	}
+	window, err := h.rateWindow(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Rates.Rates(chi.URLParam(r, "name"), r.URL.Query().Get("source"), window))
+}
+
+// HandleAPIStale returns []models.Metrics JSON of stale metrics, parametrs are the same as of HandleGetStale.
+func (h *Handlers) HandleAPIStale(w http.ResponseWriter, r *http.Request) {
+	threshold, err := h.staleThreshold(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	writeJSON(w, http.StatusOK, h.staleMetrics(ctx, threshold))
+}
+
+// writeJSON writes v as JSON response with status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	jData, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jData)
+}
+
+// writeAPIError writes JSON error body with status.
+func writeAPIError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, apiErrorBody{Error: APIError{Code: code, Message: message}})
+}
+
+// writeServiceError writes error of shared logic with its status.
+func writeServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, validate.ErrTooLarge):
+		writeAPIError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, err.Error())
+	case errors.Is(err, validate.ErrUnknownType):
+		writeAPIError(w, http.StatusBadRequest, CodeUnknownType, err.Error())
+	case isValidationError(err):
+		writeAPIError(w, http.StatusBadRequest, CodeBadValue, err.Error())
+	case errors.Is(err, ErrBadHash):
+		writeAPIError(w, http.StatusBadRequest, CodeBadHash, err.Error())
+	case errors.Is(err, ErrBadQuery):
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+	case errors.Is(err, ErrNotFound), errors.Is(err, webhooks.ErrNotFound):
+		writeAPIError(w, http.StatusNotFound, CodeNotFound, err.Error())
+	case errors.Is(err, models.ErrKeyConflict):
+		writeAPIError(w, http.StatusConflict, CodeKeyConflict, err.Error())
+	case errors.Is(err, webhooks.ErrBadSubscription):
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+	default:
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, CodeStorageError, "storage error")
+	}
+}
+
+// decodeAPIBody decodes application/json body of request to v, unknown fields are errors.
+// If it fails error is written and false is returned.
+func (h *Handlers) decodeAPIBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "content type must be application/json")
+		return false
+	}
+	body, err := h.Validator.ReadBody(w, r)
+	if errors.Is(err, validate.ErrTooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, err.Error())
+		return false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return false
+	}
+	if err := validate.Decode(body, v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, CodeInvalidJSON, err.Error())
+		return false
+	}
+	return true
+}
+
+// listQuery parses list parametrs, fields is nil if all metric fields are requested.
+func listQuery(query url.Values) (models.ListQuery, []string, error) {
+	q := models.ListQuery{
+		Type:   query.Get("type"),
+		Prefix: query.Get("prefix"),
+		Glob:   query.Get("glob"),
+		Regex:  query.Get("regex"),
+		Source: query.Get("source"),
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, nil, errors.New("bad order")
+	}
+	if limitVal := query.Get("limit"); limitVal != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limitVal); err != nil {
+			return q, nil, errors.New("bad limit")
+		}
+	}
+	var fields []string
+	if fieldsVal := query.Get("fields"); fieldsVal != "" {
+		fields = strings.Split(fieldsVal, ",")
+		for _, field := range fields {
+			if !metricFields[field] {
+				return q, nil, errors.New("unknown field " + field)
+			}
+		}
+	}
+	return q, fields, nil
+}
+
+// listBody returns JSON body of page with only fields of metrics, all fields if it is nil.
+func listBody(page models.ListPage, fields []string) interface{} {
+	if fields == nil {
+		return page
+	}
+	return struct {
+		Metrics    []map[string]interface{} `json:"metrics"`
+		NextCursor string                   `json:"next_cursor,omitempty"`
+	}{selectFields(page.Metrics, fields), page.NextCursor}
+}
+
+// queryOf returns aggregation query of parametrs except of k.
+func queryOf(query url.Values) metricsquery.Query {
+	q := metricsquery.Query{
+		Filter: models.ListQuery{
+			Type:   query.Get("type"),
+			Prefix: query.Get("prefix"),
+			Glob:   query.Get("glob"),
+			Regex:  query.Get("regex"),
+			Source: query.Get("source"),
+		},
+		Agg: query.Get("agg"),
+	}
+	if byVal := query.Get("by"); byVal != "" {
+		q.By = strings.Split(byVal, ",")
+	}
+	return q
+}
+
+// rateWindow parses window parametr, 0 means rates retention.
+func (h *Handlers) rateWindow(query url.Values) (time.Duration, error) {
+	windowVal := query.Get("window")
+	if windowVal == "" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(windowVal)
+	if err != nil || window <= 0 {
+		return 0, errors.New("bad window")
+	}
+	if window > h.Rates.Retention() {
+		return 0, errors.New("window is bigger than retention")
+	}
+	return window, nil
+}
+
+// staleThreshold parses threshold parametr, server threshold is used if it is empty.
+func (h *Handlers) staleThreshold(query url.Values) (time.Duration, error) {
+	threshold := h.StaleThreshold
+	if thresholdVal := query.Get("threshold"); thresholdVal != "" {
+		var err error
+		threshold, err = time.ParseDuration(thresholdVal)
+		if err != nil || threshold <= 0 {
+			return 0, errors.New("bad threshold")
+		}
+	}
+	if threshold == 0 {
+		return 0, errors.New("staleness threshold is not set")
+	}
+	return threshold, nil
+}
+
+// staleMetrics returns metrics not updated longer than threshold.
+func (h *Handlers) staleMetrics(ctx context.Context, threshold time.Duration) []models.Metrics {
+	stale := []models.Metrics{}
+	for _, m := range models.MarkStale(h.Repo.GetAll(ctx), time.Now(), threshold, false) {
+		if m.Stale {
+			stale = append(stale, m)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,770 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/alert"
+	"github.com/MaximkaSha/log_tools/internal/crypto"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/ndjson"
+	"github.com/MaximkaSha/log_tools/internal/ratelimit"
+	"github.com/MaximkaSha/log_tools/internal/rates"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/MaximkaSha/log_tools/internal/stream"
+	"github.com/MaximkaSha/log_tools/internal/webhooks"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openAPISpec parsed OpenAPI document.
+type openAPISpec map[string]interface{}
+
+func loadOpenAPI(t *testing.T) openAPISpec {
+	var spec openAPISpec
+	require.NoError(t, json.Unmarshal(OpenAPI, &spec))
+	return spec
+}
+
+// resolve follows local $ref of node.
+func (s openAPISpec) resolve(t *testing.T, node map[string]interface{}) map[string]interface{} {
+	ref, ok := node["$ref"].(string)
+	if !ok {
+		return node
+	}
+	var cur interface{} = map[string]interface{}(s)
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, ok := cur.(map[string]interface{})
+		require.True(t, ok, "bad $ref %s", ref)
+		cur = m[part]
+	}
+	m, ok := cur.(map[string]interface{})
+	require.True(t, ok, "bad $ref %s", ref)
+	return s.resolve(t, m)
+}
+
+// operation returns operation of path matching template of spec.
+func (s openAPISpec) operation(t *testing.T, method string, path string) map[string]interface{} {
+	for template, item := range s["paths"].(map[string]interface{}) {
+		if !matchTemplate(template, path) {
+			continue
+		}
+		op, ok := item.(map[string]interface{})[strings.ToLower(method)].(map[string]interface{})
+		require.True(t, ok, "%s %s is not documented", method, template)
+		return op
+	}
+	t.Fatalf("path %s is not documented", path)
+	return nil
+}
+
+func matchTemplate(template string, path string) bool {
+	tParts := strings.Split(template, "/")
+	pParts := strings.Split(path, "/")
+	if len(tParts) != len(pParts) {
+		return false
+	}
+	for i := range tParts {
+		if strings.HasPrefix(tParts[i], "{") {
+			if pParts[i] == "" {
+				return false
+			}
+			continue
+		}
+		if tParts[i] != pParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkResponse checks that response is documented and its body matches schema.
+func (s openAPISpec) checkResponse(t *testing.T, method string, path string, w *httptest.ResponseRecorder) {
+	op := s.operation(t, method, path)
+	resp, ok := op["responses"].(map[string]interface{})[strconv.Itoa(w.Code)].(map[string]interface{})
+	require.True(t, ok, "%s %s: status %d is not documented", method, path, w.Code)
+	resp = s.resolve(t, resp)
+	content, ok := resp["content"].(map[string]interface{})
+	if !ok {
+		assert.Empty(t, w.Body.String())
+		return
+	}
+	mediaType := strings.Split(w.Header().Get("Content-Type"), ";")[0]
+	media, ok := content[mediaType].(map[string]interface{})
+	require.True(t, ok, "%s %s: content type %q is not documented", method, path, mediaType)
+	if mediaType != "application/json" {
+		return
+	}
+	var body interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	s.validate(t, "body", media["schema"].(map[string]interface{}), body)
+}
+
+// validate checks value against subset of JSON schema used by spec.
+func (s openAPISpec) validate(t *testing.T, at string, schema map[string]interface{}, value interface{}) {
+	schema = s.resolve(t, schema)
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		assert.Contains(t, enum, value, "%s: value is not in enum", at)
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		require.True(t, ok, "%s: %v is not object", at, value)
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				assert.Contains(t, obj, name, "%s: no required property", at)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		extra, _ := schema["additionalProperties"].(map[string]interface{})
+		for name, v := range obj {
+			if prop, ok := props[name].(map[string]interface{}); ok {
+				s.validate(t, at+"."+name, prop, v)
+			} else if extra != nil {
+				s.validate(t, at+"."+name, extra, v)
+			} else if props != nil {
+				t.Errorf("%s: property %s is not documented", at, name)
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		require.True(t, ok, "%s: %v is not array", at, value)
+		for i, v := range arr {
+			s.validate(t, fmt.Sprintf("%s[%d]", at, i), schema["items"].(map[string]interface{}), v)
+		}
+	case "string":
+		_, ok := value.(string)
+		assert.True(t, ok, "%s: %v is not string", at, value)
+	case "number":
+		_, ok := value.(float64)
+		assert.True(t, ok, "%s: %v is not number", at, value)
+	case "integer":
+		n, ok := value.(float64)
+		assert.True(t, ok && n == math.Trunc(n), "%s: %v is not integer", at, value)
+	case "boolean":
+		_, ok := value.(bool)
+		assert.True(t, ok, "%s: %v is not boolean", at, value)
+	}
+}
+
+func TestHandlers_APIRouter(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+		key         string
+		policy      string
+		code        int
+		errCode     string
+	}{
+		{
+			name:        "positive update gauge",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "application/json",
+			body:        `{"id":"Alloc","type":"gauge","value":1.5}`,
+			code:        200,
+		},
+		{
+			name:        "positive update counter with charset",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"id":"PollCount","type":"counter","delta":3}`,
+			code:        200,
+		},
+		{
+			name:        "negative update invalid json",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "application/json",
+			body:        `{"id":`,
+			code:        400,
+			errCode:     CodeInvalidJSON,
+		},
+		{
+			name:        "negative update unknown field",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "application/json",
+			body:        `{"id":"Alloc","type":"gauge","valeu":1.5}`,
+			code:        400,
+			errCode:     CodeInvalidJSON,
+		},
+		{
+			name:        "negative update counter with value",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "application/json",
+			body:        `{"id":"PollCount","type":"counter","value":1.5}`,
+			code:        400,
+			errCode:     CodeBadValue,
+		},
+		{
+			name:        "negative update unknown type",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "application/json",
+			body:        `{"id":"Alloc","type":"histogram","value":1}`,
+			code:        400,
+			errCode:     CodeUnknownType,
+		},
+		{
+			name:        "negative update no value",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "application/json",
+			body:        `{"id":"Alloc","type":"gauge","delta":1}`,
+			code:        400,
+			errCode:     CodeBadValue,
+		},
+		{
+			name:        "negative update text body",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "text/plain",
+			body:        `{"id":"Alloc","type":"gauge","value":1.5}`,
+			code:        415,
+			errCode:     CodeUnsupportedMediaType,
+		},
+		{
+			name:        "negative update bad hash",
+			method:      http.MethodPost,
+			url:         "/metrics",
+			contentType: "application/json",
+			body:        `{"id":"Alloc","type":"gauge","value":1.5,"hash":"00"}`,
+			key:         "secret",
+			code:        400,
+			errCode:     CodeBadHash,
+		},
+		{
+			name:        "positive batch",
+			method:      http.MethodPost,
+			url:         "/metrics/batch",
+			contentType: "application/json",
+			body:        `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter","delta":1}]`,
+			code:        200,
+		},
+		{
+			name:        "negative atomic batch with bad metric",
+			method:      http.MethodPost,
+			url:         "/metrics/batch",
+			contentType: "application/json",
+			body:        `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter"}]`,
+			code:        422,
+		},
+		{
+			name:        "positive best effort batch with bad metric",
+			method:      http.MethodPost,
+			url:         "/metrics/batch",
+			contentType: "application/json",
+			body:        `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter"}]`,
+			policy:      models.BatchBestEffort,
+			code:        200,
+		},
+		{
+			name:        "negative batch is not array",
+			method:      http.MethodPost,
+			url:         "/metrics/batch",
+			contentType: "application/json",
+			body:        `{"id":"Alloc","type":"gauge","value":1.5}`,
+			code:        400,
+			errCode:     CodeInvalidJSON,
+		},
+		{
+			name:   "positive value",
+			method: http.MethodGet,
+			url:    "/metrics/gauge/Existing",
+			code:   200,
+		},
+		{
+			name:    "negative value not found",
+			method:  http.MethodGet,
+			url:     "/metrics/gauge/Missing",
+			code:    404,
+			errCode: CodeNotFound,
+		},
+		{
+			name:    "negative value unknown type",
+			method:  http.MethodGet,
+			url:     "/metrics/histogram/Existing",
+			code:    400,
+			errCode: CodeUnknownType,
+		},
+		{
+			name:    "negative value unknown aggregation",
+			method:  http.MethodGet,
+			url:     "/metrics/gauge/Existing?agg=median",
+			code:    400,
+			errCode: CodeBadRequest,
+		},
+		{
+			name:   "positive list",
+			method: http.MethodGet,
+			url:    "/metrics?type=gauge&limit=10",
+			code:   200,
+		},
+		{
+			name:    "negative list bad order",
+			method:  http.MethodGet,
+			url:     "/metrics?order=up",
+			code:    400,
+			errCode: CodeBadRequest,
+		},
+		{
+			name:   "positive rates",
+			method: http.MethodGet,
+			url:    "/rates?window=30s",
+			code:   200,
+		},
+		{
+			name:    "negative rates window bigger than retention",
+			method:  http.MethodGet,
+			url:     "/rates/PollCount?window=1h",
+			code:    400,
+			errCode: CodeBadRequest,
+		},
+		{
+			name:        "positive ndjson",
+			method:      http.MethodPost,
+			url:         "/metrics/ndjson",
+			contentType: "application/x-ndjson",
+			body:        "{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}\n{\"id\":\"Alloc\"}\n",
+			code:        200,
+		},
+		{
+			name:        "negative ndjson content type",
+			method:      http.MethodPost,
+			url:         "/metrics/ndjson",
+			contentType: "application/json",
+			body:        `{"id":"Alloc","type":"gauge","value":1}`,
+			code:        415,
+			errCode:     CodeUnsupportedMediaType,
+		},
+		{
+			name:   "positive query sum",
+			method: http.MethodGet,
+			url:    "/query?agg=sum&glob=Ex*&by=source,dc",
+			code:   200,
+		},
+		{
+			name:   "positive query topk",
+			method: http.MethodGet,
+			url:    "/query?agg=topk&k=1&type=gauge",
+			code:   200,
+		},
+		{
+			name:    "negative query unknown aggregation",
+			method:  http.MethodGet,
+			url:     "/query?agg=median",
+			code:    400,
+			errCode: CodeBadRequest,
+		},
+		{
+			name:    "negative query topk without k",
+			method:  http.MethodGet,
+			url:     "/query?agg=topk",
+			code:    400,
+			errCode: CodeBadRequest,
+		},
+		{
+			name:    "negative alerts disabled",
+			method:  http.MethodGet,
+			url:     "/alerts",
+			code:    501,
+			errCode: CodeDisabled,
+		},
+		{
+			name:    "negative rate limit disabled",
+			method:  http.MethodGet,
+			url:     "/ratelimit",
+			code:    501,
+			errCode: CodeDisabled,
+		},
+		{
+			name:    "negative webhooks disabled",
+			method:  http.MethodGet,
+			url:     "/webhooks",
+			code:    501,
+			errCode: CodeDisabled,
+		},
+		{
+			name:   "positive export csv",
+			method: http.MethodGet,
+			url:    "/export?format=csv&prefix=Ex",
+			code:   200,
+		},
+		{
+			name:    "negative export unknown format",
+			method:  http.MethodGet,
+			url:     "/export?format=xml",
+			code:    400,
+			errCode: CodeBadRequest,
+		},
+		{
+			name:    "negative export history disabled",
+			method:  http.MethodGet,
+			url:     "/export?history=true",
+			code:    501,
+			errCode: CodeDisabled,
+		},
+		{
+			name:        "positive import csv",
+			method:      http.MethodPost,
+			url:         "/import",
+			contentType: "text/csv",
+			body:        "id,type,value\nAlloc,gauge,1\nAlloc,counter,1\n",
+			code:        200,
+		},
+		{
+			name:        "negative import bad header",
+			method:      http.MethodPost,
+			url:         "/import?format=csv",
+			contentType: "application/octet-stream",
+			body:        "id,kind\n",
+			code:        400,
+		},
+		{
+			name:        "negative import content type",
+			method:      http.MethodPost,
+			url:         "/import",
+			contentType: "application/json",
+			body:        `[]`,
+			code:        415,
+			errCode:     CodeUnsupportedMediaType,
+		},
+		{
+			name:   "positive stale",
+			method: http.MethodGet,
+			url:    "/stale?threshold=1m",
+			code:   200,
+		},
+		{
+			name:    "negative stale bad threshold",
+			method:  http.MethodGet,
+			url:     "/stale?threshold=soon",
+			code:    400,
+			errCode: CodeBadRequest,
+		},
+		{
+			name:    "negative ping memory storage",
+			method:  http.MethodGet,
+			url:     "/ping",
+			code:    503,
+			errCode: CodeUnavailable,
+		},
+		{
+			name:   "positive openapi",
+			method: http.MethodGet,
+			url:    "/openapi.json",
+			code:   200,
+		},
+		{
+			name:        "negative remote write text error",
+			method:      http.MethodPost,
+			url:         "/write",
+			contentType: "application/json",
+			code:        415,
+		},
+	}
+	spec := loadOpenAPI(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			handl := NewHandlers(&repo, crypto.NewCryptoService())
+			handl.Rates = rates.NewTracker(time.Minute)
+			handl.BatchPolicy = tt.policy
+			if tt.key != "" {
+				require.NoError(t, handl.cryptoService.InitCryptoService(tt.key))
+			}
+			value := 2.0
+			handl.Repo.InsertMetric(context.TODO(), models.Metrics{ID: "Existing", MType: "gauge", Value: &value})
+			request := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				request.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			handl.APIRouter().ServeHTTP(w, request)
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+			spec.checkResponse(t, tt.method, request.URL.Path, w)
+			if tt.errCode != "" {
+				var body apiErrorBody
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				assert.Equal(t, tt.errCode, body.Error.Code)
+				assert.NotEmpty(t, body.Error.Message)
+			}
+		})
+	}
+}
+
+func TestHandlers_APIExportImport(t *testing.T) {
+	value := 1.5
+	var delta int64 = 3
+	data := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value, Source: "agent-1", Labels: map[string]string{"dc": "eu"}},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Source: "agent-2"},
+		{ID: "Sys", MType: "gauge", Value: &value},
+	}
+	for _, format := range []string{"csv", "jsonl"} {
+		t.Run("positive "+format, func(t *testing.T) {
+			from := storage.NewRepo()
+			exporter := NewHandlers(&from, crypto.NewCryptoService())
+			require.NoError(t, exporter.cryptoService.InitCryptoService("secret"))
+			require.NoError(t, from.BatchInsert(context.TODO(), data))
+			w := httptest.NewRecorder()
+			exporter.APIRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/export?glob=*o*&format="+format, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Header().Get("Content-Disposition"), "metrics."+format)
+
+			to := storage.NewRepo()
+			importer := NewHandlers(&to, crypto.NewCryptoService())
+			require.NoError(t, importer.cryptoService.InitCryptoService("secret"))
+			var stored int64 = 10
+			require.NoError(t, to.InsertMetric(context.TODO(), models.Metrics{ID: "PollCount", MType: "counter", Delta: &stored, Source: "agent-2"}))
+			body, contentType := w.Body.String(), w.Header().Get("Content-Type")
+			//counters are set, so the second import changes nothing
+			for i := 0; i < 2; i++ {
+				request := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(body))
+				request.Header.Set("Content-Type", contentType)
+				w = httptest.NewRecorder()
+				importer.APIRouter().ServeHTTP(w, request)
+				require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+				var result ndjson.Result
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+				assert.Equal(t, 2, result.Accepted)
+				assert.Zero(t, result.Rejected)
+			}
+
+			for _, m := range data[:2] {
+				got, err := to.GetMetric(models.Metrics{ID: m.ID, Source: m.Source})
+				require.NoError(t, err)
+				assert.Equal(t, m.Value, got.Value)
+				assert.Equal(t, m.Delta, got.Delta)
+				assert.Equal(t, m.Source, got.Source)
+			}
+			_, err := to.GetMetric(models.Metrics{ID: "Sys"})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHandlers_APIExportHistory(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	broker, err := stream.NewBroker(&repo, 10)
+	require.NoError(t, err)
+	defer broker.Close()
+	handl.Stream = broker
+	for _, v := range []float64{1, 2, 3} {
+		value := v
+		require.NoError(t, repo.InsertMetric(context.TODO(), models.Metrics{ID: "Alloc", MType: "gauge", Value: &value}))
+	}
+	require.NoError(t, repo.InsertMetric(context.TODO(), models.Metrics{ID: "Sys", MType: "gauge", Value: new(float64)}))
+	require.Eventually(t, func() bool { return len(broker.History()) == 4 }, time.Second, 10*time.Millisecond)
+	w := httptest.NewRecorder()
+	handl.APIRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/export?history=true&format=csv&prefix=Al", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 4)
+	for k, want := range []string{"1", "2", "3"} {
+		assert.True(t, strings.HasPrefix(lines[k+1], "Alloc,gauge,,"+want+","), lines[k+1])
+	}
+}
+
+func TestHandlers_APIAlerts(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	rule, err := alert.ParseRule("LowMemory", "FreeMemory < 500MB")
+	require.NoError(t, err)
+	handl.Alerts, err = alert.NewManager(alert.Config{Rules: []alert.Rule{rule}}, &repo, nil, time.Second)
+	require.NoError(t, err)
+	value := 1.0
+	require.NoError(t, repo.InsertMetric(context.TODO(), models.Metrics{ID: "FreeMemory", MType: "gauge", Value: &value, Source: "agent-1"}))
+	handl.Alerts.Eval(context.TODO())
+	spec := loadOpenAPI(t)
+	tests := []struct {
+		name      string
+		url       string
+		code      int
+		wantCount int
+	}{
+		{name: "positive all", url: "/alerts", code: 200, wantCount: 1},
+		{name: "positive firing", url: "/alerts?state=firing", code: 200, wantCount: 1},
+		{name: "positive pending", url: "/alerts?state=pending", code: 200},
+		{name: "negative unknown state", url: "/alerts?state=silenced", code: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			w := httptest.NewRecorder()
+			handl.APIRouter().ServeHTTP(w, request)
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+			spec.checkResponse(t, http.MethodGet, request.URL.Path, w)
+			if tt.code != 200 {
+				return
+			}
+			var alerts []alert.Alert
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &alerts))
+			assert.Len(t, alerts, tt.wantCount)
+		})
+	}
+}
+
+func TestHandlers_APIRateLimit(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	var err error
+	handl.RateLimit, err = ratelimit.NewLimiter(ratelimit.KeyAgent, ratelimit.Limit{Rate: 1, Burst: 1}, nil)
+	require.NoError(t, err)
+	router := handl.RateLimit.Handler(handl.APIRouter())
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		request.Header.Set(models.AgentIDHeader, "agent-1")
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/ratelimit", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, request)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	loadOpenAPI(t).checkResponse(t, http.MethodGet, request.URL.Path, w)
+	var stats ratelimit.Stats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, uint64(2), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	require.Len(t, stats.Clients, 2)
+	assert.Equal(t, "agent:agent-1@192.0.2.1", stats.Clients[0].Client)
+	assert.Equal(t, uint64(1), stats.Clients[0].Rejected)
+}
+
+func TestHandlers_APIWebhooks(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	var err error
+	handl.Webhooks, err = webhooks.NewDispatcher(&repo)
+	require.NoError(t, err)
+	defer handl.Webhooks.Close()
+	spec := loadOpenAPI(t)
+	token := "Bearer admin"
+	serve := func(method string, url string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, url, strings.NewReader(body))
+		if body != "" {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		if token != "" {
+			request.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		handl.APIRouter().ServeHTTP(w, request)
+		spec.checkResponse(t, method, request.URL.Path, w)
+		return w
+	}
+
+	// without admin token webhooks are read-only
+	w := serve(http.MethodPost, "/webhooks", `{"pattern":"Heap*","min_change":10,"url":"http://example.com/hook"}`)
+	assert.Equal(t, 403, w.Code, w.Body.String())
+	w = serve(http.MethodGet, "/webhooks", "")
+	assert.Equal(t, 200, w.Code, w.Body.String())
+
+	handl.WebhookToken = "admin"
+	for _, token = range []string{"", "Bearer other"} {
+		w = serve(http.MethodPost, "/webhooks", `{"pattern":"Heap*","min_change":10,"url":"http://example.com/hook"}`)
+		assert.Equal(t, 401, w.Code, w.Body.String())
+		w = serve(http.MethodGet, "/webhooks", "")
+		assert.Equal(t, 401, w.Code, w.Body.String())
+	}
+	token = "Bearer admin"
+	w = serve(http.MethodPost, "/webhooks", `{"pattern":"Heap*","url":"http://example.com/hook"}`)
+	assert.Equal(t, 400, w.Code, w.Body.String())
+	w = serve(http.MethodPost, "/webhooks", `{"pattern":"Heap*","min_change":10,"url":"http://example.com/hook","secret":"s"}`)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	assert.NotContains(t, w.Body.String(), "secret")
+	var sub webhooks.Subscription
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sub))
+	assert.Equal(t, 10.0, sub.MinChange)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		code   int
+	}{
+		{name: "positive list", method: http.MethodGet, url: "/webhooks", code: 200},
+		{name: "positive get", method: http.MethodGet, url: "/webhooks/" + sub.ID, code: 200},
+		{name: "positive deliveries", method: http.MethodGet, url: "/webhooks/" + sub.ID + "/deliveries", code: 200},
+		{name: "negative get unknown", method: http.MethodGet, url: "/webhooks/unknown", code: 404},
+		{name: "negative deliveries unknown", method: http.MethodGet, url: "/webhooks/unknown/deliveries", code: 404},
+		{name: "positive delete", method: http.MethodDelete, url: "/webhooks/" + sub.ID, code: 204},
+		{name: "negative delete deleted", method: http.MethodDelete, url: "/webhooks/" + sub.ID, code: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.method, tt.url, "")
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestHandlers_APIUnreadableBody(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	request := httptest.NewRequest(http.MethodPost, "/metrics", iotest.ErrReader(errors.New("connection reset")))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handl.APIRouter().ServeHTTP(w, request)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	loadOpenAPI(t).checkResponse(t, http.MethodPost, "/metrics", w)
+	var body apiErrorBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, CodeBadRequest, body.Error.Code)
+}
+
+func TestHandlers_APIRouterUnknownRoute(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	for method, want := range map[string]int{http.MethodGet: 404, http.MethodDelete: 405} {
+		url := "/metrics"
+		if method == http.MethodGet {
+			url = "/unknown"
+		}
+		w := httptest.NewRecorder()
+		handl.APIRouter().ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		require.Equal(t, want, w.Code)
+		var body apiErrorBody
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.NotEmpty(t, body.Error.Code)
+	}
+}
+
+func TestOpenAPI_DocumentsRoutes(t *testing.T) {
+	spec := loadOpenAPI(t)
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	var routes []string
+	err := chi.Walk(handl.APIRouter().(chi.Routes), func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routes = append(routes, strings.ToLower(method)+" "+route)
+		return nil
+	})
+	require.NoError(t, err)
+	var documented []string
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			documented = append(documented, method+" "+path)
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+	assert.Equal(t, documented, routes)
+}
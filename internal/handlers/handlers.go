@@ -4,19 +4,56 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/MaximkaSha/log_tools/internal/alert"
 	"github.com/MaximkaSha/log_tools/internal/crypto"
+	"github.com/MaximkaSha/log_tools/internal/dashboard"
 	"github.com/MaximkaSha/log_tools/internal/database"
+	"github.com/MaximkaSha/log_tools/internal/influx"
+	"github.com/MaximkaSha/log_tools/internal/metadata"
 	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/ndjson"
+	"github.com/MaximkaSha/log_tools/internal/otlp"
+	"github.com/MaximkaSha/log_tools/internal/prometheus"
+	"github.com/MaximkaSha/log_tools/internal/ratelimit"
+	"github.com/MaximkaSha/log_tools/internal/rates"
+	"github.com/MaximkaSha/log_tools/internal/remotewrite"
+	"github.com/MaximkaSha/log_tools/internal/stream"
+	"github.com/MaximkaSha/log_tools/internal/validate"
+	"github.com/MaximkaSha/log_tools/internal/webhooks"
 	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
 )
 
+// dashboardRefresh default dashboard auto-refresh interval in seconds.
+const dashboardRefresh = 10
+
+// defaultStreamHeartbeat heartbeat interval used when StreamHeartbeat is not set.
+const defaultStreamHeartbeat = 15 * time.Second
+
+// streamWriteTimeout longest time of writing one WebSocket message.
+const streamWriteTimeout = 10 * time.Second
+
+// upgrader upgrades stream requests to WebSocket, only same origin pages may connect.
+var upgrader = websocket.Upgrader{}
+
+// dashboardLimit dashboard shows no more metrics than this.
+const dashboardLimit = 5000
+
+// globEscaper escapes glob special characters.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
 // Handlers struct.
 type Handlers struct {
 	handlers *http.ServeMux
@@ -27,6 +64,32 @@ type Handlers struct {
 	cryptoService crypto.CryptoService
 	// DB database pointer.
 	DB *database.Database
+	// Rates counter tracker, nil if rates are disabled.
+	Rates *rates.Tracker
+	// StaleThreshold metrics not updated longer are stale, 0 disables staleness.
+	StaleThreshold time.Duration
+	// HideStale hides stale metrics from responses instead of marking them.
+	HideStale bool
+	// Metadata metrics metadata, nil if there is none.
+	Metadata *metadata.Registry
+	// Stream live changes broker, nil if streaming is disabled.
+	Stream *stream.Broker
+	// StreamHeartbeat interval of heartbeats sent to idle stream clients.
+	StreamHeartbeat time.Duration
+	// Validator checks metrics of every ingest endpoint.
+	Validator validate.Validator
+	// BatchPolicy models.BatchAtomic (default if empty) or models.BatchBestEffort.
+	BatchPolicy string
+	// NDJSONChunkSize number of metrics of NDJSON stream written at once, ndjson.DefaultChunkSize if not set.
+	NDJSONChunkSize int
+	// Alerts alert rules manager, nil if alerting is disabled.
+	Alerts *alert.Manager
+	// Webhooks metric change webhook subscriptions, nil if webhooks are disabled.
+	Webhooks *webhooks.Dispatcher
+	// WebhookToken bearer token of webhook management routes, if empty they are read-only.
+	WebhookToken string
+	// RateLimit per-client request limiter, nil if rate limiting is disabled.
+	RateLimit *ratelimit.Limiter
 }
 
 // NewHandlers constrcutor for Handlers.
@@ -37,6 +100,7 @@ func NewHandlers(repo models.Storager, cryptoService crypto.CryptoService) Handl
 		Repo:          repo,
 		SyncFile:      "",
 		cryptoService: cryptoService,
+		Validator:     validate.New(),
 	}
 }
 
@@ -44,7 +108,7 @@ func NewHandlers(repo models.Storager, cryptoService crypto.CryptoService) Handl
 // Endpoint get data from URL parametrs type/name/value.
 // Readed data pushed to storage.
 // If type is not gauge or counter, then 501 error.
-// If data is not int64 or float64 then error.
+// If name or value is bad (counter value must be integer, gauge value must be finite) then 400.
 // If all OK then 200.
 func (h *Handlers) HandleUpdate(w http.ResponseWriter, r *http.Request) { //should be renamed to HandlePostUpdate
 	typeVal := chi.URLParam(r, "type")
@@ -55,25 +119,20 @@ func (h *Handlers) HandleUpdate(w http.ResponseWriter, r *http.Request) { //shou
 		http.Error(w, "Type not found!", http.StatusNotImplemented)
 		return
 	}
-	var data models.Metrics
+	data, err := h.Validator.ParsePath(typeVal, nameVal, valueVal)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stampSource(r, &data)
 	if h.cryptoService.IsServiceEnable() {
-		data.ID = nameVal
-		data.MType = typeVal
-		switch data.MType {
-		case "gauge":
-			tmp, _ := strconv.ParseFloat(valueVal, 64)
-			data.Value = &tmp
-		case "counter":
-			tmp, _ := strconv.ParseInt(valueVal, 10, 64)
-			data.Delta = &tmp
-		}
 		h.cryptoService.Hash(&data)
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(rates.WithSource(r.Context(), rates.SourceFromRequest(r)), 5*time.Second)
 	defer cancel()
-	result := h.Repo.InsertData(ctx, typeVal, nameVal, valueVal, data.Hash)
-	if result != 200 {
-		http.Error(w, "Bad value found!", result)
+	if err := h.Repo.InsertMetric(ctx, data); err != nil {
+		log.Println(err)
+		http.Error(w, "Storage error!", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -85,29 +144,23 @@ curl --header "Content-Type: application/json" --request POST --data "{\"id\":\"
 // HandlePostJSONUpdate endpoint for JSON data.
 // Endpoint get data from POSTed JSON models.Metrics.
 // Readed data pushed to storage.
-// If type is not gauge or counter, then 501 error.
-// If data is not int64 or float64 then error.
+// If body is not JSON metric then 404.
+// If metric is bad (see validate.Validator), has unknown fields or bad hash then 400.
+// If body is too large then 413, if storage fails then 500.
 // If all OK then 200.
 func (h *Handlers) HandlePostJSONUpdate(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Header.Get("Content-Type") == "application/json" {
 		var data = new(models.Metrics)
-		decoder := json.NewDecoder(r.Body)
-		err := decoder.Decode(&data)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
+		if !h.decodeLegacyBody(w, r, data) {
 			return
 		}
-		if h.cryptoService.IsEnable {
-			if !h.cryptoService.CheckHash(*data) {
-				log.Println("Sing check fail!")
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-		}
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		stampSource(r, data)
+		ctx, cancel := context.WithTimeout(rates.WithSource(r.Context(), rates.SourceFromRequest(r)), 5*time.Second)
 		defer cancel()
-		h.Repo.InsertMetric(ctx, *data)
+		if err := h.Update(ctx, *data); !h.writeLegacyUpdateError(w, err) {
+			return
+		}
 		//h.Repo.SaveData(h.SyncFile)
 		w.WriteHeader(http.StatusOK)
 		jData, _ := json.Marshal(data)
@@ -121,6 +174,7 @@ func (h *Handlers) HandlePostJSONUpdate(w http.ResponseWriter, r *http.Request)
 // HandlePostJSONValue endpoint for getting data from storage.
 // Endpoint reads models.Metrics type and value.
 // For readed data returns models.Metrics with value.
+// If source is empty value is aggregated across sources, query parametr agg sets aggregation.
 // If type is not gauge or counter, then 501 error.
 // If data is not int64 or float64 then error.
 // If all OK then 200.
@@ -135,47 +189,352 @@ func (h *Handlers) HandlePostJSONValue(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Data error!", http.StatusBadRequest)
 			return
 		}
-		if d, err := h.Repo.GetMetric(*data); err == nil {
-			if h.cryptoService.IsEnable {
-				_, err = h.cryptoService.Hash(&d)
-				if err != nil {
-					log.Println("Hasher error!")
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-			}
+		d, err := h.Value(r.Context(), *data, r.URL.Query().Get("agg"))
+		switch {
+		case errors.Is(err, ErrBadQuery):
+			http.Error(w, "Unknown aggregation!", http.StatusBadRequest)
+			return
+		case err == nil:
 			jData, _ := json.Marshal(d)
 			w.WriteHeader(http.StatusOK)
 			w.Write(jData)
 			return
-		} else {
-			_, err = h.cryptoService.Hash(&d)
-			if err != nil {
-				log.Println("Hasher error!")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		case !errors.Is(err, ErrNotFound):
+			log.Println("Hasher error!")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		default:
+			// only ID and type are returned, there is no value to sign
 			jData, _ := json.Marshal(d)
 			w.WriteHeader(http.StatusNotFound)
 			w.Write(jData)
 			return
-
 		}
 	}
 }
 
-// HandleGetHome returns all data from storage in []models.Storage JSON.
+// HandleGetHome returns dashboard HTML page with metrics grouped by type and source.
+// Query parametrs: q searches metrics by name (substring or glob), type and source filter metrics,
+// refresh sets auto-refresh interval in seconds (default is 10, 0 disables it).
+// If Accept header is application/json, all data from storage is returned in []models.Metrics JSON,
+// query parametr source filters by source, agg aggregates metrics across sources.
 func (h *Handlers) HandleGetHome(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		h.handleGetHomeJSON(w, r)
+		return
+	}
+	query := r.URL.Query()
+	page := dashboard.IndexPage{
+		Page: dashboard.Page{
+			Title:     "Metrics",
+			Query:     query.Get("q"),
+			Type:      query.Get("type"),
+			Source:    query.Get("source"),
+			Refresh:   dashboardRefresh,
+			Generated: time.Now(),
+		},
+	}
+	if refreshVal := query.Get("refresh"); refreshVal != "" {
+		refresh, err := strconv.Atoi(refreshVal)
+		if err != nil || refresh < 0 {
+			http.Error(w, "Bad refresh!", http.StatusBadRequest)
+			return
+		}
+		page.Refresh = refresh
+	}
+	q := models.ListQuery{
+		Type:   page.Type,
+		Source: page.Source,
+		Glob:   searchGlob(page.Query),
+		Limit:  models.MaxListLimit,
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var found []models.Metrics
+	for {
+		listPage, err := h.Repo.List(ctx, q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		found = append(found, listPage.Metrics...)
+		if listPage.NextCursor == "" {
+			break
+		}
+		if len(found) >= dashboardLimit {
+			page.Truncated = true
+			break
+		}
+		q.Cursor = listPage.NextCursor
+	}
+	found = models.MarkStale(found, time.Now(), h.StaleThreshold, h.HideStale)
+	page.Total = len(found)
+	page.Groups = dashboard.GroupMetrics(found)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := dashboard.RenderIndex(w, page); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleGetHomeJSON returns all data from storage in []models.Metrics JSON.
+func (h *Handlers) handleGetHomeJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 	repo := h.Repo.GetAll(ctx)
+	if source := r.URL.Query().Get("source"); source != "" {
+		filtered := []models.Metrics{}
+		for _, m := range repo {
+			if m.Source == source {
+				filtered = append(filtered, m)
+			}
+		}
+		repo = filtered
+	}
+	if agg := r.URL.Query().Get("agg"); agg != "" {
+		var err error
+		if repo, err = models.AggregateAll(repo, agg); err != nil {
+			http.Error(w, "Unknown aggregation!", http.StatusBadRequest)
+			return
+		}
+	}
+	repo = models.MarkStale(repo, time.Now(), h.StaleThreshold, h.HideStale)
 	allData, _ := json.MarshalIndent(repo, "", "    ")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(allData))
 }
 
+// HandleGetMetric returns dashboard HTML page of metric with its value per source and rates.
+// Metric is taken from URL parametrs type and name.
+// If type is not gauge or counter then 501, if metric is not found then 404.
+func (h *Handlers) HandleGetMetric(w http.ResponseWriter, r *http.Request) {
+	typeVal := chi.URLParam(r, "type")
+	nameVal := chi.URLParam(r, "name")
+	if (typeVal != "gauge") && (typeVal != "counter") {
+		http.Error(w, "Type not found!", http.StatusNotImplemented)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	series := []models.Metrics{}
+	for _, m := range h.Repo.GetSeries(ctx, nameVal) {
+		if m.MType == typeVal {
+			series = append(series, m)
+		}
+	}
+	series = models.MarkStale(series, time.Now(), h.StaleThreshold, h.HideStale)
+	agg := models.DefaultAggregation(typeVal)
+	metric, err := models.AggregateSources(series, agg)
+	if err != nil {
+		http.Error(w, "Name not found!", http.StatusNotFound)
+		return
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Source < series[j].Source
+	})
+	page := dashboard.MetricPage{
+		Page: dashboard.Page{
+			Title:     nameVal,
+			Type:      typeVal,
+			Generated: time.Now(),
+		},
+		Metric:      metric,
+		Aggregation: agg,
+		Series:      series,
+	}
+	if h.Rates != nil && typeVal == "counter" {
+		page.Rates = h.Rates.Rates(nameVal, "", 0)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := dashboard.RenderMetric(w, page); err != nil {
+		log.Println(err)
+	}
+}
+
+// HandleGetMetrics returns all metrics from storage in Prometheus text exposition format.
+// Output is streamed while storage is read page by page.
+func (h *Handlers) HandleGetMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheus.ContentType)
+	exporter := prometheus.Exporter{
+		Repo:           h.Repo,
+		Metadata:       h.Metadata,
+		StaleThreshold: h.StaleThreshold,
+		HideStale:      h.HideStale,
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := exporter.Write(r.Context(), w); err != nil {
+		log.Printf("Metrics export failed: %s", err)
+	}
+}
+
+// HandlePostRemoteWrite endpoint for Prometheus remote write.
+// Body is snappy compressed protobuf WriteRequest, series are checked by Validator and saved as gauges with BatchInsert.
+// Metadata of metric families is saved to Metadata.
+// If content type or encoding is not supported then 415, if body is too large then 413,
+// if body is malformed then 400, if storage failed then 500 (Prometheus retries it).
+// If all OK then 204.
+func (h *Handlers) HandlePostRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != remotewrite.ContentType {
+		http.Error(w, "Unsupported content type!", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != remotewrite.ContentEncoding {
+		http.Error(w, "Unsupported content encoding!", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := validate.Validator{MaxBodySize: remotewrite.MaxDecodedSize}.ReadBody(w, r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	req, err := remotewrite.Decode(body)
+	if errors.Is(err, remotewrite.ErrTooLarge) {
+		http.Error(w, "Request is too large!", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := req.Metrics()
+	if err == nil {
+		_, _, err = h.checkMetrics(data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.Metadata != nil {
+		req.SaveMetadata(h.Metadata)
+	}
+	if len(data) > 0 {
+		for k := range data {
+			stampSource(r, &data[k])
+		}
+		ctx, cancel := context.WithTimeout(rates.WithSource(r.Context(), rates.SourceFromRequest(r)), 5*time.Second)
+		defer cancel()
+		if err = h.Repo.BatchInsert(ctx, data); err != nil {
+			log.Println(err)
+			http.Error(w, "Cant save metrics", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePostInfluxWrite endpoint for InfluxDB line protocol.
+// Every numeric field of point is saved as gauge with BatchInsert, tags are saved as labels.
+// Query parametr precision sets unit of timestamps, default is nanoseconds.
+// Valid lines are saved even if some lines are invalid, then 400 with influx.WriteResult is returned.
+// If precision is unknown then 400, if body is too large then 413, if storage failed then 500.
+// If all OK then 204.
+func (h *Handlers) HandlePostInfluxWrite(w http.ResponseWriter, r *http.Request) {
+	unit, err := influx.Precision(r.URL.Query().Get("precision"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := validate.Validator{MaxBodySize: influx.MaxBodySize}.ReadBody(w, r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	data, lineErrors := influx.Parse(string(body), unit, time.Now(), h.Validator.Metric)
+	if len(data) > 0 {
+		for k := range data {
+			stampSource(r, &data[k])
+		}
+		ctx, cancel := context.WithTimeout(rates.WithSource(r.Context(), rates.SourceFromRequest(r)), 5*time.Second)
+		defer cancel()
+		if err = h.Repo.BatchInsert(ctx, data); err != nil {
+			log.Println(err)
+			http.Error(w, "Cant save metrics", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(lineErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		jData, _ := json.Marshal(influx.WriteResult{Accepted: len(data), Errors: lineErrors})
+		w.Write(jData)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePostOTLPMetrics endpoint for OTLP/HTTP metrics export.
+// Body is protobuf or JSON ExportMetricsServiceRequest, response is encoded the same way.
+// Gauge, Sum and Histogram data points are saved with BatchInsert, other points are
+// rejected and reported as partial success. Description and unit of metrics are saved to Metadata.
+// If content type is not supported then 415, if body is too large then 413,
+// if body is malformed then 400, if storage failed then 503 (exporters retry it).
+// If all OK then 200.
+func (h *Handlers) HandlePostOTLPMetrics(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != otlp.ContentTypeProtobuf && mediaType != otlp.ContentTypeJSON {
+		http.Error(w, "Unsupported content type!", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := validate.Validator{MaxBodySize: otlp.MaxBodySize}.ReadBody(w, r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	req, err := otlp.Decode(body, mediaType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, rejected, message := req.Metrics()
+	data, invalid, err := h.checkMetrics(data)
+	if invalid > 0 {
+		rejected += int64(invalid)
+		if message == "" {
+			message = err.Error()
+		}
+	}
+	if h.Metadata != nil {
+		req.SaveMetadata(h.Metadata)
+	}
+	if len(data) > 0 {
+		for k := range data {
+			stampSource(r, &data[k])
+		}
+		ctx, cancel := context.WithTimeout(rates.WithSource(r.Context(), rates.SourceFromRequest(r)), 5*time.Second)
+		defer cancel()
+		if err = h.Repo.BatchInsert(ctx, data); err != nil {
+			log.Println(err)
+			http.Error(w, "Cant save metrics", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	resp, err := otlp.Encode(mediaType, rejected, message)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Cant encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// searchGlob converts dashboard search to glob matching metric names.
+// Search without wildcards matches names which contain it.
+func searchGlob(search string) string {
+	if search == "" {
+		return ""
+	}
+	if strings.ContainsAny(search, "*?[") {
+		return search
+	}
+	return "*" + globEscaper.Replace(search) + "*"
+}
+
 // HandleGetUpdate returns models.Metrics{} fro, URI params.
+// Query parametr source selects source, otherwise value is aggregated across sources with agg.
 func (h *Handlers) HandleGetUpdate(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	typeVal := chi.URLParam(r, "type")
@@ -184,10 +543,16 @@ func (h *Handlers) HandleGetUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Type not found!", http.StatusNotImplemented)
 		return
 	}
+	agg := r.URL.Query().Get("agg")
+	if agg != "" && !models.IsAggregation(agg) {
+		http.Error(w, "Unknown aggregation!", http.StatusBadRequest)
+		return
+	}
 	data := models.Metrics{}
 	data.ID = nameVal
 	data.MType = typeVal
-	if valueVar, ok := h.Repo.GetMetric(data); ok != nil {
+	data.Source = r.URL.Query().Get("source")
+	if valueVar, ok := h.getMetric(r.Context(), data, agg); ok != nil || h.hidden(&valueVar) {
 		http.Error(w, "Name not found!", http.StatusNotFound)
 		return
 	} else {
@@ -215,45 +580,44 @@ func (h *Handlers) HandleGetPing(w http.ResponseWriter, r *http.Request) {
 }
 
 //HandlePostJSONUpdates get []models.Metrics{} from POST data and batch update it on storage.
+//Batch with Idempotency-Key or X-Batch-ID header is applied once, repeated batch gets
+//the original models.BatchResult with Idempotent-Replayed header. Keys are scoped by agent ID,
+//key reused with other batch gets 409.
+//Body of application/x-ndjson type is streamed by HandlePostNDJSON.
+//Response is models.BatchResult with status and reason of every metric. Bad metrics are rejected,
+//good ones are written unless BatchPolicy is atomic. If no metric is written because of rejected ones then 400
+//with models.BatchResult, if body is not JSON batch then 404, if batch is too large then 413, if storage fails then 500.
 func (h *Handlers) HandlePostJSONUpdates(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == ndjson.ContentType {
+		h.HandlePostNDJSON(w, r)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if r.Header.Get("Content-Type") == "application/json" {
 		var data models.MetricsDB
-		content, err := ioutil.ReadAll(r.Body)
-		//log.Println(string(content))
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = json.Unmarshal(content, &data)
-		//log.Println(err)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusNotFound)
+		if !h.decodeLegacyBody(w, r, &data) {
 			return
 		}
-		if h.cryptoService.IsEnable {
-			for k := range data {
-				if !h.cryptoService.CheckHash(data[k]) {
-					log.Println("Sing check fail!")
-					w.WriteHeader(http.StatusBadRequest)
-					return
-				}
-			}
-
+		for k := range data {
+			stampSource(r, &data[k])
 		}
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(rates.WithSource(r.Context(), rates.SourceFromRequest(r)), 5*time.Second)
 		defer cancel()
-		err = h.Repo.BatchInsert(ctx, data)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusNotFound)
+		result, replayed, err := h.UpdateBatch(ctx, batchScope(r), batchKey(r), data)
+		if errors.Is(err, ErrBatchRejected) {
+			w.WriteHeader(http.StatusBadRequest)
+			jData, _ := json.Marshal(result)
+			w.Write(jData)
+			return
+		}
+		if !h.writeLegacyUpdateError(w, err) {
 			return
 		}
-		commit := models.NewMetric("RandomValue", "gauge", nil, nil, "")
-		a := h.Repo.GetCurrentCommit()
-		commit.Value = &a
+		if replayed {
+			w.Header().Set(models.ReplayedHeader, "true")
+		}
 		w.WriteHeader(http.StatusOK)
-		jData, _ := json.Marshal(commit)
+		jData, _ := json.Marshal(result)
 		w.Write(jData)
 		return
 	} else {
@@ -262,3 +626,367 @@ func (h *Handlers) HandlePostJSONUpdates(w http.ResponseWriter, r *http.Request)
 	}
 
 }
+
+// writeBodyError writes 413 if body is too large and 400 if it can not be read.
+func writeBodyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, validate.ErrTooLarge) {
+		http.Error(w, "Request is too large!", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// decodeLegacyBody reads JSON body of legacy endpoint to v.
+// If it fails status is written and false is returned: 413 for too large body,
+// 400 for unknown fields or unreadable body and 404 for malformed JSON as before.
+func (h *Handlers) decodeLegacyBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := h.Validator.ReadBody(w, r)
+	if err == nil {
+		err = validate.Decode(body, v)
+	}
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, validate.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, validate.ErrUnknownField), errors.Is(err, validate.ErrReadBody):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return false
+}
+
+// writeLegacyUpdateError writes status of update error of legacy endpoint, it returns true if err is nil.
+func (h *Handlers) writeLegacyUpdateError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrBadHash):
+		log.Println("Sing check fail!")
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, validate.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case isValidationError(err):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, models.ErrKeyConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println(err)
+		http.Error(w, "Storage error!", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// getMetric returns metric of data.Source.
+// If source is empty metric is aggregated across sources with agg or DefaultAggregation.
+func (h *Handlers) getMetric(ctx context.Context, data models.Metrics, agg string) (models.Metrics, error) {
+	if data.Source != "" || agg == "" {
+		return h.Repo.GetMetric(data)
+	}
+	found, err := models.AggregateSources(h.Repo.GetSeries(ctx, data.ID), agg)
+	if err != nil {
+		return h.Repo.GetMetric(data)
+	}
+	data.Delta = found.Delta
+	data.Value = found.Value
+	return data, nil
+}
+
+// hidden marks metric as stale if it is and returns true if stale metrics are hidden.
+func (h *Handlers) hidden(m *models.Metrics) bool {
+	m.Stale = m.IsStale(time.Now(), h.StaleThreshold)
+	return m.Stale && h.HideStale
+}
+
+// batchKey returns idempotency key of batch request.
+func batchKey(r *http.Request) string {
+	if key := r.Header.Get(models.IdempotencyKeyHeader); key != "" {
+		return key
+	}
+	return r.Header.Get(models.BatchIDHeader)
+}
+
+// batchScope returns scope of idempotency keys of request: agent ID or client address if there is none.
+func batchScope(r *http.Request) string {
+	if agent := r.Header.Get(models.AgentIDHeader); agent != "" {
+		return agent
+	}
+	return rates.SourceFromRequest(r)
+}
+
+// stampSource sets source and host of metric from agent headers if metric has none.
+func stampSource(r *http.Request, m *models.Metrics) {
+	if m.Source == "" {
+		m.Source = r.Header.Get(models.AgentIDHeader)
+	}
+	if m.Host == "" {
+		m.Host = r.Header.Get(models.AgentHostHeader)
+	}
+}
+
+// HandleGetRates returns per-second rates and increases of counters in []rates.Rate JSON.
+// Counter name is taken from URL parametr name, if it is empty all counters are returned.
+// Query parametr window sets window (default is rates retention), source filters by source.
+// If rates are disabled then 501, if window is bad then 400.
+func (h *Handlers) HandleGetRates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.Rates == nil {
+		http.Error(w, "Rates are disabled!", http.StatusNotImplemented)
+		return
+	}
+	window, err := h.rateWindow(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := h.Rates.Rates(chi.URLParam(r, "name"), r.URL.Query().Get("source"), window)
+	jData, _ := json.Marshal(result)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jData)
+}
+
+// HandleGetStale returns metrics which were not updated longer than staleness threshold in []models.Metrics JSON.
+// Query parametr threshold overrides server threshold.
+// If threshold is bad or not set then 400.
+func (h *Handlers) HandleGetStale(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	threshold, err := h.staleThreshold(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	stale := h.staleMetrics(ctx, threshold)
+	jData, _ := json.Marshal(stale)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jData)
+}
+
+// HandleGetList returns page of metrics in models.ListPage JSON.
+// Query parametrs: type, prefix, glob, regex and source filter metrics,
+// sort (id, type, source, updated_at) and order (asc, desc) set order,
+// limit and cursor (next_cursor of previous page) select page,
+// fields is comma separated list of metric JSON fields to return.
+// If any parametr is bad then 400.
+func (h *Handlers) HandleGetList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	q, fields, err := listQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	page, err := h.List(ctx, q)
+	if errors.Is(err, ErrBadQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Storage error!", http.StatusInternalServerError)
+		return
+	}
+	jData, _ := json.Marshal(listBody(page, fields))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jData)
+}
+
+// HandleGetStream streams metric changes as Server-Sent Events.
+// Query parametrs: name filters by metric name (glob), type and source filter metrics.
+// Every change is "update" event with stream.Message JSON data and sequence number as ID.
+// Last-Event-ID header or last_event_id query parametr resumes stream after that event,
+// if some changes are lost "gap" event is sent first. Comment is sent as heartbeat.
+// Client which can not keep up is disconnected and should reconnect with Last-Event-ID.
+// If streaming is disabled then 501, if any parametr is bad then 400.
+func (h *Handlers) HandleGetStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if h.Stream == nil || !ok {
+		http.Error(w, "Streaming is disabled!", http.StatusNotImplemented)
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	client, replay, gap, err := h.subscribe(r, lastID)
+	if errors.Is(err, stream.ErrClosed) {
+		http.Error(w, "Server is shutting down!", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer client.Close()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if gap {
+		fmt.Fprintf(w, "event: %s\ndata: {\"event\":\"%s\"}\n\n", stream.EventGap, stream.EventGap)
+	}
+	for _, ev := range replay {
+		writeEvent(w, ev)
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(h.streamHeartbeat())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-client.Events():
+			if !ok {
+				return
+			}
+			writeEvent(w, ev)
+			// send everything buffered at once
+			for n := len(client.Events()); n > 0; n-- {
+				if ev, ok = <-client.Events(); ok {
+					writeEvent(w, ev)
+				}
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes change as Server-Sent Event.
+func writeEvent(w io.Writer, ev models.ChangeEvent) {
+	jData, _ := json.Marshal(stream.NewMessage(ev))
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, stream.EventUpdate, jData)
+}
+
+// HandleGetStreamWS streams metric changes over WebSocket.
+// Query parametrs are the same as of HandleGetStream, last_event_id resumes stream.
+// Every change is text message with stream.Message JSON, WebSocket pings are sent as heartbeat.
+// Client which can not keep up is closed with code 1013 and should reconnect with last_event_id.
+// If streaming is disabled then 501, if any parametr is bad then 400.
+func (h *Handlers) HandleGetStreamWS(w http.ResponseWriter, r *http.Request) {
+	if h.Stream == nil {
+		http.Error(w, "Streaming is disabled!", http.StatusNotImplemented)
+		return
+	}
+	client, replay, gap, err := h.subscribe(r, r.URL.Query().Get("last_event_id"))
+	if errors.Is(err, stream.ErrClosed) {
+		http.Error(w, "Server is shutting down!", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer client.Close()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader has already replied
+		return
+	}
+	defer conn.Close()
+	// reader handles pongs and close, messages from client are ignored
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	write := func(m stream.Message) error {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(m)
+	}
+	if gap {
+		if write(stream.Message{Event: stream.EventGap}) != nil {
+			return
+		}
+	}
+	for _, ev := range replay {
+		if write(stream.NewMessage(ev)) != nil {
+			return
+		}
+	}
+	heartbeat := time.NewTicker(h.streamHeartbeat())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-client.Events():
+			if !ok {
+				code, text := websocket.CloseGoingAway, "server is shutting down"
+				if client.Overflowed() {
+					code, text = websocket.CloseTryAgainLater, "client is too slow"
+				}
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(streamWriteTimeout))
+				return
+			}
+			if write(stream.NewMessage(ev)) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// subscribe subscribes stream client with filter of request, lastID resumes stream if it is not empty.
+func (h *Handlers) subscribe(r *http.Request, lastID string) (*stream.Client, []models.ChangeEvent, bool, error) {
+	query := r.URL.Query()
+	filter := stream.Filter{Pattern: query.Get("name"), Type: query.Get("type"), Source: query.Get("source")}
+	var last uint64
+	if lastID != "" {
+		var err error
+		if last, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			return nil, nil, false, errors.New("bad last event id")
+		}
+	}
+	return h.Stream.Subscribe(filter, last, lastID != "")
+}
+
+func (h *Handlers) streamHeartbeat() time.Duration {
+	if h.StreamHeartbeat > 0 {
+		return h.StreamHeartbeat
+	}
+	return defaultStreamHeartbeat
+}
+
+// metricFields is set of models.Metrics JSON field names.
+var metricFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(models.Metrics{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// selectFields returns metrics as JSON objects with given fields only.
+func selectFields(data []models.Metrics, fields []string) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(data))
+	for _, m := range data {
+		var all map[string]interface{}
+		jData, _ := json.Marshal(m)
+		json.Unmarshal(jData, &all)
+		selected := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if v, ok := all[field]; ok {
+				selected[field] = v
+			}
+		}
+		result = append(result, selected)
+	}
+	return result
+}
@@ -1,10 +1,9 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,13 +11,22 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/MaximkaSha/log_tools/internal/crypto"
+	"github.com/MaximkaSha/log_tools/internal/influx"
+	"github.com/MaximkaSha/log_tools/internal/metadata"
 	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/ndjson"
+	"github.com/MaximkaSha/log_tools/internal/rates"
 	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/MaximkaSha/log_tools/internal/stream"
 	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -73,6 +81,24 @@ func TestHandlers_HandleUpdate(t *testing.T) {
 			url:    "/update/gauge/TestCount/bad_data",
 			method: "POST",
 		},
+		{
+			name: "negative counter float",
+			want: want{
+				code:        400,
+				contentType: "text/plain; charset=utf-8",
+			},
+			url:    "/update/counter/TestCount/1.5",
+			method: "POST",
+		},
+		{
+			name: "negative gauge NaN",
+			want: want{
+				code:        400,
+				contentType: "text/plain; charset=utf-8",
+			},
+			url:    "/update/gauge/TestCount/NaN",
+			method: "POST",
+		},
 		{
 			name: "negative no data",
 			want: want{
@@ -122,7 +148,7 @@ func TestHandlers_HandleUpdate(t *testing.T) {
 			name: "get home", //надо значение из body проверить
 			want: want{
 				code:        200,
-				contentType: "text/html",
+				contentType: "text/html; charset=utf-8",
 			},
 			url:    "/",
 			method: "home",
@@ -239,11 +265,10 @@ func TestHandlers_HandlePostJSONUpdate(t *testing.T) {
 			contentType: "application/json",
 		},
 		{
-			name: "positive json #3",
+			name: "negative json #3 counter with value",
 			want: want{
-				code:        200,
-				contentType: "application/json",
-				body:        `{"id":"Alloc","type":"counter","value":1072448}`,
+				code:        400,
+				contentType: "text/plain; charset=utf-8",
 			},
 			url:         "/update/",
 			method:      "POST",
@@ -319,7 +344,7 @@ func TestHandlers_HandlePostJSONUpdate(t *testing.T) {
 
 			assert.Equal(t, tt.want.code, resp.StatusCode)
 			assert.Equal(t, tt.want.contentType, resp.Header.Get("Content-type"))
-			if tt.data != `` {
+			if tt.data != `` && tt.want.code == http.StatusOK {
 				require.JSONEq(t, tt.want.body, string(respBody))
 			}
 
@@ -415,11 +440,805 @@ func TestHandlers_HandlePostJSONValue(t *testing.T) {
 			assert.Equal(t, tt.want.code, resp.StatusCode)
 			assert.Equal(t, tt.want.contentType, resp.Header.Get("Content-type"))
 			if tt.data != `` {
-				require.JSONEq(t, tt.want.body, string(respBody))
+				require.JSONEq(t, tt.want.body, withoutTimestamps(t, respBody))
+			}
+
+		})
+	}
+}
+
+// withoutTimestamps checks that stored metric has timestamps and removes them.
+func withoutTimestamps(t *testing.T, body []byte) string {
+	var data map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &data))
+	assert.Contains(t, data, "first_seen")
+	assert.Contains(t, data, "updated_at")
+	delete(data, "first_seen")
+	delete(data, "updated_at")
+	jData, _ := json.Marshal(data)
+	return string(jData)
+}
+
+func TestHandlers_Sources(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	mux := chi.NewRouter()
+	mux.Post("/update/{type}/{name}/{value}", handl.HandleUpdate)
+	mux.Get("/value/{type}/{name}", handl.HandleGetUpdate)
+	for agent, value := range map[string]string{"agent1": "10", "agent2": "30"} {
+		request := httptest.NewRequest(http.MethodPost, "/update/gauge/HeapAlloc/"+value, nil)
+		request.Header.Set(models.AgentIDHeader, agent)
+		request.Header.Set(models.AgentHostHeader, agent+".local")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, request)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	require.Len(t, repo.GetAll(context.TODO()), 2)
+	tests := []struct {
+		name string
+		url  string
+		code int
+		body string
+	}{
+		{
+			name: "positive source",
+			url:  "/value/gauge/HeapAlloc?source=agent2",
+			code: 200,
+			body: "30",
+		},
+		{
+			name: "positive default aggregation",
+			url:  "/value/gauge/HeapAlloc",
+			code: 200,
+			body: "20",
+		},
+		{
+			name: "positive max",
+			url:  "/value/gauge/HeapAlloc?agg=max",
+			code: 200,
+			body: "30",
+		},
+		{
+			name: "negative unknown source",
+			url:  "/value/gauge/HeapAlloc?source=agent3",
+			code: 404,
+		},
+		{
+			name: "negative unknown aggregation",
+			url:  "/value/gauge/HeapAlloc?agg=median",
+			code: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			assert.Equal(t, tt.code, w.Code)
+			if tt.body != "" {
+				assert.Equal(t, tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandlers_Stale(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		hide      bool
+		code      int
+		wantStale []string
+	}{
+		{
+			name:      "positive stale list",
+			url:       "/stale/",
+			code:      200,
+			wantStale: []string{"Old"},
+		},
+		{
+			name:      "positive threshold override",
+			url:       "/stale/?threshold=1ns",
+			code:      200,
+			wantStale: []string{"Old", "Fresh"},
+		},
+		{
+			name: "negative bad threshold",
+			url:  "/stale/?threshold=soon",
+			code: 400,
+		},
+		{
+			name: "positive hidden value",
+			url:  "/value/gauge/Old",
+			hide: true,
+			code: 404,
+		},
+		{
+			name: "positive marked value",
+			url:  "/value/gauge/Old",
+			code: 200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			handl := NewHandlers(&repo, crypto.NewCryptoService())
+			handl.StaleThreshold = time.Minute
+			handl.HideStale = tt.hide
+			value := 1.0
+			old := time.Now().Add(-time.Hour)
+			handl.Repo.InsertMetric(context.TODO(), models.Metrics{ID: "Old", MType: "gauge", Value: &value, UpdatedAt: &old})
+			handl.Repo.InsertMetric(context.TODO(), models.Metrics{ID: "Fresh", MType: "gauge", Value: &value})
+			mux := chi.NewRouter()
+			mux.Get("/stale/", handl.HandleGetStale)
+			mux.Get("/value/{type}/{name}", handl.HandleGetUpdate)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			require.Equal(t, tt.code, w.Code)
+			if tt.wantStale != nil {
+				var data []models.Metrics
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+				var ids []string
+				for _, m := range data {
+					assert.True(t, m.Stale)
+					ids = append(ids, m.ID)
+				}
+				assert.Equal(t, tt.wantStale, ids)
+			}
+		})
+	}
+}
+
+func TestHandlers_HiddenValueBody(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	handl.StaleThreshold = time.Minute
+	handl.HideStale = true
+	value := 1.5
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, repo.InsertMetric(context.TODO(), models.Metrics{ID: "Old", MType: "gauge", Value: &value, UpdatedAt: &old}))
+	request := httptest.NewRequest(http.MethodPost, "/value/", strings.NewReader(`{"id":"Old","type":"gauge"}`))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handl.HandlePostJSONValue(w, request)
+	require.Equal(t, 404, w.Code)
+	var got models.Metrics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, "Old", got.ID)
+	assert.Nil(t, got.Value)
+	assert.Nil(t, got.UpdatedAt)
+}
+
+func TestHandlers_ListHiddenStalePages(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	handl.StaleThreshold = time.Minute
+	handl.HideStale = true
+	ctx := context.TODO()
+	value := 1.0
+	old, fresh := time.Now().Add(-time.Hour), time.Now()
+	for _, id := range []string{"A", "B", "C"} {
+		require.NoError(t, repo.InsertMetric(ctx, models.Metrics{ID: id, MType: "gauge", Value: &value, UpdatedAt: &old}))
+	}
+	for _, id := range []string{"D", "E", "F"} {
+		require.NoError(t, repo.InsertMetric(ctx, models.Metrics{ID: id, MType: "gauge", Value: &value, UpdatedAt: &fresh}))
+	}
+	var got []string
+	q := models.ListQuery{Limit: 2}
+	for {
+		page, err := handl.List(ctx, q)
+		require.NoError(t, err)
+		if page.NextCursor != "" {
+			assert.Len(t, page.Metrics, 2, "page is full")
+		}
+		for _, m := range page.Metrics {
+			got = append(got, m.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"D", "E", "F"}, got)
+}
+
+func TestHandlers_AgentTimestampsIgnored(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		body string
+	}{
+		{name: "positive update", url: "/update/", body: `{"id":"Alloc","type":"gauge","value":1,"updated_at":"2100-01-01T00:00:00Z","first_seen":"2000-01-01T00:00:00Z"}`},
+		{name: "positive updates", url: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1,"updated_at":"2100-01-01T00:00:00Z","first_seen":"2000-01-01T00:00:00Z"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			handl := NewHandlers(&repo, crypto.NewCryptoService())
+			mux := chi.NewRouter()
+			mux.Post("/update/", handl.HandlePostJSONUpdate)
+			mux.Post("/updates/", handl.HandlePostJSONUpdates)
+			request := httptest.NewRequest(http.MethodPost, tt.url, strings.NewReader(tt.body))
+			request.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			before := time.Now()
+			mux.ServeHTTP(w, request)
+			require.Equal(t, 200, w.Code, w.Body.String())
+			data := repo.GetAll(context.TODO())
+			require.Len(t, data, 1)
+			assert.WithinDuration(t, before, *data[0].UpdatedAt, time.Minute)
+			assert.Equal(t, *data[0].UpdatedAt, *data[0].FirstSeen)
+		})
+	}
+}
+
+func TestHandlers_HandlePostJSONUpdatesIdempotent(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	mux := chi.NewRouter()
+	mux.Post("/updates/", handl.HandlePostJSONUpdates)
+	batch := `[{"id":"PollCount","type":"counter","delta":5},{"id":"Alloc","type":"gauge","value":1.5}]`
+	items := `"rejected":0,"items":[{"index":0,"id":"PollCount","status":"accepted"},{"index":1,"id":"Alloc","status":"accepted"}]`
+	tests := []struct {
+		name     string
+		header   string
+		key      string
+		agent    string
+		batch    string
+		code     int
+		replayed string
+		body     string
+		delta    int64
+	}{
+		{
+			name:  "positive first batch",
+			key:   "batch-1",
+			body:  `{"key":"batch-1","accepted":2,` + items + `}`,
+			delta: 5,
+		},
+		{
+			name:     "positive repeated batch",
+			key:      "batch-1",
+			replayed: "true",
+			body:     `{"key":"batch-1","accepted":2,` + items + `}`,
+			delta:    5,
+		},
+		{
+			name:   "positive batch id header",
+			header: models.BatchIDHeader,
+			key:    "batch-2",
+			body:   `{"key":"batch-2","accepted":2,` + items + `}`,
+			delta:  10,
+		},
+		{
+			name:     "positive repeated batch id",
+			key:      "batch-2",
+			replayed: "true",
+			body:     `{"key":"batch-2","accepted":2,` + items + `}`,
+			delta:    10,
+		},
+		{
+			name:  "positive no key",
+			body:  `{"accepted":2,` + items + `}`,
+			delta: 15,
+		},
+		{
+			name:  "positive key of other agent",
+			key:   "batch-1",
+			agent: "agent-2",
+			batch: `[{"id":"PollCount","type":"counter","delta":5,"source":"agent-2"},{"id":"Alloc","type":"gauge","value":1.5}]`,
+			body:  `{"key":"batch-1","accepted":2,` + items + `}`,
+			delta: 20,
+		},
+		{
+			name:  "negative key reused with other batch",
+			key:   "batch-1",
+			batch: `[{"id":"PollCount","type":"counter","delta":7}]`,
+			code:  http.StatusConflict,
+			delta: 20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := batch
+			if tt.batch != "" {
+				body = tt.batch
+			}
+			code := tt.code
+			if code == 0 {
+				code = http.StatusOK
+			}
+			request := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			if tt.agent != "" {
+				request.Header.Set(models.AgentIDHeader, tt.agent)
+			}
+			if tt.key != "" {
+				header := tt.header
+				if header == "" {
+					header = models.IdempotencyKeyHeader
+				}
+				request.Header.Set(header, tt.key)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, request)
+			require.Equal(t, code, w.Code, w.Body.String())
+			assert.Equal(t, tt.replayed, w.Header().Get(models.ReplayedHeader))
+			if tt.body != "" {
+				assert.JSONEq(t, tt.body, w.Body.String())
+			}
+			m, err := repo.GetMetric(models.Metrics{ID: "PollCount"})
+			require.NoError(t, err)
+			assert.Equal(t, tt.delta, *m.Delta)
+		})
+	}
+}
+
+func TestHandlers_HandlePostJSONUpdatesItems(t *testing.T) {
+	batch := `[{"id":"PollCount","type":"counter","delta":5},{"id":"Alloc","type":"counter","value":1.5},{"id":"Signed","type":"gauge","value":1,"hash":"00"}]`
+	tests := []struct {
+		name       string
+		policy     string
+		code       int
+		accepted   int
+		statuses   []string
+		wantStored bool
+	}{
+		{
+			name:     "negative atomic",
+			code:     400,
+			statuses: []string{models.BatchItemSkipped, models.BatchItemRejected, models.BatchItemRejected},
+		},
+		{
+			name:       "positive best effort",
+			policy:     models.BatchBestEffort,
+			code:       200,
+			accepted:   1,
+			statuses:   []string{models.BatchItemAccepted, models.BatchItemRejected, models.BatchItemRejected},
+			wantStored: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			handl := NewHandlers(&repo, crypto.NewCryptoService())
+			require.NoError(t, handl.cryptoService.InitCryptoService("secret"))
+			handl.BatchPolicy = tt.policy
+			var data []models.Metrics
+			require.NoError(t, json.Unmarshal([]byte(batch), &data))
+			// first metric is signed with server key, the last one has bad hash
+			_, err := handl.cryptoService.Hash(&data[0])
+			require.NoError(t, err)
+			body, _ := json.Marshal(data)
+			request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handl.HandlePostJSONUpdates(w, request)
+			require.Equal(t, tt.code, w.Code)
+			var result models.BatchResult
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+			assert.Equal(t, tt.accepted, result.Accepted)
+			assert.Equal(t, len(data)-tt.accepted, result.Rejected)
+			require.Len(t, result.Items, len(data))
+			for k, item := range result.Items {
+				assert.Equal(t, k, item.Index)
+				assert.Equal(t, data[k].ID, item.ID)
+				assert.Equal(t, tt.statuses[k], item.Status)
+				assert.Equal(t, item.Status == models.BatchItemAccepted, item.Reason == "")
+			}
+			_, err = repo.GetMetric(models.Metrics{ID: "PollCount", MType: "counter"})
+			assert.Equal(t, tt.wantStored, err == nil)
+		})
+	}
+}
+
+func TestHandlers_HandlePostNDJSON(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		key          string
+		chunkSize    int
+		wantResult   ndjson.Result
+		wantStored   []string
+		wantRejected []string
+	}{
+		{
+			name:       "positive chunks",
+			body:       "{\"id\":\"A\",\"type\":\"gauge\",\"value\":1}\n\n{\"id\":\"B\",\"type\":\"counter\",\"delta\":2}\n{\"id\":\"C\",\"type\":\"gauge\",\"value\":3}",
+			chunkSize:  2,
+			wantResult: ndjson.Result{Lines: 4, Accepted: 3, Chunks: 2, CommittedLine: 4},
+			wantStored: []string{"A", "B", "C"},
+		},
+		{
+			// SIGNED is replaced with metric Signed signed with key
+			name:      "negative bad lines",
+			body:      "SIGNED\n{\"id\":\n{\"id\":\"B\",\"type\":\"counter\",\"value\":2}\n{\"id\":\"C\",\"type\":\"gauge\",\"value\":3,\"hash\":\"00\"}\n" + strings.Repeat("x", ndjson.MaxLineSize+1) + "\n{\"id\":\"D\",\"type\":\"gauge\",\"valeu\":3}\n",
+			key:       "secret",
+			chunkSize: 10,
+			wantResult: ndjson.Result{Lines: 6, Accepted: 1, Rejected: 5, Chunks: 1, CommittedLine: 6, Errors: []ndjson.LineError{
+				{Line: 2}, {Line: 3}, {Line: 4}, {Line: 5}, {Line: 6},
+			}},
+			wantStored:   []string{"Signed"},
+			wantRejected: []string{"B", "C", "D"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			handl := NewHandlers(&repo, crypto.NewCryptoService())
+			handl.NDJSONChunkSize = tt.chunkSize
+			body := tt.body
+			if tt.key != "" {
+				require.NoError(t, handl.cryptoService.InitCryptoService(tt.key))
+				m := models.Metrics{ID: "Signed", MType: "gauge", Value: new(float64)}
+				_, err := handl.cryptoService.Hash(&m)
+				require.NoError(t, err)
+				line, _ := json.Marshal(m)
+				body = strings.ReplaceAll(body, "SIGNED", string(line))
+			}
+			request := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/x-ndjson")
+			w := httptest.NewRecorder()
+			handl.HandlePostJSONUpdates(w, request)
+			require.Equal(t, 200, w.Code, w.Body.String())
+			var result ndjson.Result
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+			for k := range result.Errors {
+				assert.NotEmpty(t, result.Errors[k].Error)
+				result.Errors[k].Error = ""
+			}
+			assert.Equal(t, tt.wantResult, result)
+			for _, id := range tt.wantStored {
+				_, err := repo.GetMetric(models.Metrics{ID: id})
+				assert.NoError(t, err, id)
+			}
+			for _, id := range tt.wantRejected {
+				_, err := repo.GetMetric(models.Metrics{ID: id})
+				assert.Error(t, err, id)
+			}
+		})
+	}
+}
+
+func TestHandlers_HandleGetList(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	ctx := context.TODO()
+	updated := time.Now().Add(-time.Minute)
+	for _, m := range []struct{ id, source string }{
+		{"CPUutilization2", "agent1"},
+		{"CPUutilization1", "agent1"},
+		{"CPUutilization1", "agent2"},
+		{"Alloc", "agent2"},
+	} {
+		value := 1.0
+		updated = updated.Add(time.Second)
+		at := updated
+		handl.Repo.InsertMetric(ctx, models.Metrics{ID: m.id, MType: "gauge", Value: &value, Source: m.source, UpdatedAt: &at})
+	}
+	delta := int64(1)
+	handl.Repo.InsertMetric(ctx, models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	mux := chi.NewRouter()
+	mux.Get("/list/", handl.HandleGetList)
+	tests := []struct {
+		name     string
+		url      string
+		code     int
+		want     []string
+		wantMore bool
+	}{
+		{
+			name: "positive all",
+			url:  "/list/",
+			code: 200,
+			want: []string{"Alloc/agent2", "CPUutilization1/agent1", "CPUutilization1/agent2", "CPUutilization2/agent1", "PollCount/"},
+		},
+		{
+			name: "positive type",
+			url:  "/list/?type=counter",
+			code: 200,
+			want: []string{"PollCount/"},
+		},
+		{
+			name: "positive glob and source",
+			url:  "/list/?glob=CPU*&source=agent1",
+			code: 200,
+			want: []string{"CPUutilization1/agent1", "CPUutilization2/agent1"},
+		},
+		{
+			name: "positive regex desc",
+			url:  "/list/?regex=%5EC.*1$&order=desc",
+			code: 200,
+			want: []string{"CPUutilization1/agent2", "CPUutilization1/agent1"},
+		},
+		{
+			name: "positive sort by source",
+			url:  "/list/?prefix=CPU&sort=source",
+			code: 200,
+			want: []string{"CPUutilization1/agent1", "CPUutilization2/agent1", "CPUutilization1/agent2"},
+		},
+		{
+			name:     "positive page",
+			url:      "/list/?limit=2",
+			code:     200,
+			want:     []string{"Alloc/agent2", "CPUutilization1/agent1"},
+			wantMore: true,
+		},
+		{
+			name: "negative regex",
+			url:  "/list/?regex=(",
+			code: 400,
+		},
+		{
+			name: "negative sort",
+			url:  "/list/?sort=value",
+			code: 400,
+		},
+		{
+			name: "negative cursor",
+			url:  "/list/?cursor=abc",
+			code: 400,
+		},
+		{
+			name: "negative field",
+			url:  "/list/?fields=id,color",
+			code: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			require.Equal(t, tt.code, w.Code)
+			if tt.code != 200 {
+				return
+			}
+			var page models.ListPage
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+			var got []string
+			for _, m := range page.Metrics {
+				got = append(got, m.ID+"/"+m.Source)
 			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantMore, page.NextCursor != "")
+		})
+	}
+	t.Run("positive all pages", func(t *testing.T) {
+		var got []string
+		cursor := ""
+		for {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/list/?limit=2&sort=updated_at&fields=id,source&cursor="+cursor, nil))
+			require.Equal(t, 200, w.Code)
+			var page struct {
+				Metrics    []map[string]string `json:"metrics"`
+				NextCursor string              `json:"next_cursor"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+			for _, m := range page.Metrics {
+				assert.NotContains(t, m, "type")
+				got = append(got, m["id"]+"/"+m["source"])
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		assert.Equal(t, []string{"CPUutilization2/agent1", "CPUutilization1/agent1", "CPUutilization1/agent2", "Alloc/agent2", "PollCount/"}, got)
+	})
+}
+
+func TestHandlers_Dashboard(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	handl.Rates = rates.NewTracker(time.Minute)
+	mux := chi.NewRouter()
+	mux.Get("/", handl.HandleGetHome)
+	mux.Get("/metric/{type}/{name}", handl.HandleGetMetric)
+	var delta int64 = 5
+	value := 1.5
+	require.NoError(t, repo.BatchInsert(context.TODO(), []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta, Source: "agent1"},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Source: "agent2"},
+		{ID: "Alloc", MType: "gauge", Value: &value, Source: "agent1"},
+		{ID: "Heap<b>", MType: "gauge", Value: &value, Source: "agent2"},
+	}))
+	handl.Rates.Observe("agent1", "PollCount", 5)
+	tests := []struct {
+		name        string
+		url         string
+		code        int
+		contains    []string
+		notContains []string
+	}{
+		{
+			name:     "positive home",
+			url:      "/",
+			code:     200,
+			contains: []string{"<html", "PollCount", "Alloc", "Heap&lt;b&gt;", "agent1", "agent2", `content="10"`},
+		},
+		{
+			name:        "positive search",
+			url:         "/?q=oll&refresh=0",
+			code:        200,
+			contains:    []string{"PollCount"},
+			notContains: []string{"Alloc", "http-equiv"},
+		},
+		{
+			name:        "positive glob and filters",
+			url:         "/?q=*A*&type=gauge&source=agent1",
+			code:        200,
+			contains:    []string{"Alloc"},
+			notContains: []string{"PollCount", "agent2"},
+		},
+		{
+			name: "negative refresh",
+			url:  "/?refresh=soon",
+			code: 400,
+		},
+		{
+			name: "negative glob",
+			url:  "/?q=[",
+			code: 400,
+		},
+		{
+			name:     "positive metric",
+			url:      "/metric/counter/PollCount",
+			code:     200,
+			contains: []string{"all sources", "<b>10</b>", "agent1", "agent2", "Rates"},
+		},
+		{
+			name: "negative metric type",
+			url:  "/metric/counter/Alloc",
+			code: 404,
+		},
+		{
+			name: "negative metric name",
+			url:  "/metric/gauge/Unknown",
+			code: 404,
+		},
+		{
+			name: "negative type",
+			url:  "/metric/histogram/Alloc",
+			code: 501,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			require.Equal(t, tt.code, w.Code)
+			if tt.code != 200 {
+				return
+			}
+			assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+			for _, want := range tt.contains {
+				assert.Contains(t, w.Body.String(), want)
+			}
+			for _, want := range tt.notContains {
+				assert.NotContains(t, w.Body.String(), want)
+			}
+		})
+	}
+}
 
+func TestHandlers_HandlePostRemoteWrite(t *testing.T) {
+	payload := func(name string) []byte {
+		body, err := os.ReadFile(filepath.Join("..", "remotewrite", "testdata", name))
+		require.NoError(t, err)
+		return body
+	}
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		encoding    string
+		code        int
+		wantSeries  int
+	}{
+		{
+			name:        "positive node",
+			body:        payload("node.snappy"),
+			contentType: "application/x-protobuf",
+			encoding:    "snappy",
+			code:        204,
+			wantSeries:  4,
+		},
+		{
+			name:        "positive empty",
+			body:        payload("empty.snappy"),
+			contentType: "application/x-protobuf",
+			encoding:    "snappy",
+			code:        204,
+		},
+		{
+			name:        "negative content type",
+			body:        payload("node.snappy"),
+			contentType: "application/json",
+			encoding:    "snappy",
+			code:        415,
+		},
+		{
+			name:        "negative encoding",
+			body:        payload("node.snappy"),
+			contentType: "application/x-protobuf",
+			encoding:    "gzip",
+			code:        415,
+		},
+		{
+			name:        "negative no name",
+			body:        payload("no_name.snappy"),
+			contentType: "application/x-protobuf",
+			encoding:    "snappy",
+			code:        400,
+		},
+		{
+			name:        "negative framed snappy",
+			body:        payload("framed.snappy"),
+			contentType: "application/x-protobuf",
+			encoding:    "snappy",
+			code:        400,
+		},
+		{
+			name:        "negative truncated",
+			body:        payload("truncated.snappy"),
+			contentType: "application/x-protobuf",
+			encoding:    "snappy",
+			code:        400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			handl := NewHandlers(&repo, crypto.NewCryptoService())
+			handl.Metadata = metadata.NewRegistry()
+			mux := chi.NewRouter()
+			mux.Post("/api/v1/write", handl.HandlePostRemoteWrite)
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(tt.body))
+			request.Header.Set("Content-Type", tt.contentType)
+			request.Header.Set("Content-Encoding", tt.encoding)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, request)
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+			assert.Len(t, repo.GetAll(context.TODO()), tt.wantSeries)
 		})
 	}
+	t.Run("negative name rejected by validator", func(t *testing.T) {
+		repo := storage.NewRepo()
+		handl := NewHandlers(&repo, crypto.NewCryptoService())
+		handl.Validator.MaxNameLength = 5
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(payload("node.snappy")))
+		request.Header.Set("Content-Type", "application/x-protobuf")
+		request.Header.Set("Content-Encoding", "snappy")
+		w := httptest.NewRecorder()
+		handl.HandlePostRemoteWrite(w, request)
+		require.Equal(t, 400, w.Code)
+		assert.Empty(t, repo.GetAll(context.TODO()))
+	})
+	t.Run("positive series by labels", func(t *testing.T) {
+		repo := storage.NewRepo()
+		handl := NewHandlers(&repo, crypto.NewCryptoService())
+		handl.Metadata = metadata.NewRegistry()
+		for i := 0; i < 2; i++ {
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(payload("node.snappy")))
+			request.Header.Set("Content-Type", "application/x-protobuf")
+			request.Header.Set("Content-Encoding", "snappy")
+			request.Header.Set(models.AgentIDHeader, "prometheus1")
+			w := httptest.NewRecorder()
+			handl.HandlePostRemoteWrite(w, request)
+			require.Equal(t, 204, w.Code)
+		}
+		series := repo.GetSeries(context.TODO(), "node_cpu_seconds_total")
+		require.Len(t, series, 2)
+		assert.Equal(t, "idle", series[0].Labels["mode"])
+		assert.Equal(t, "user", series[1].Labels["mode"])
+		assert.Equal(t, "node1:9100", series[0].Source)
+		up := repo.GetSeries(context.TODO(), "up")
+		require.Len(t, up, 1)
+		assert.Equal(t, "prometheus1", up[0].Source)
+		help, ok := handl.Metadata.Get("node_load1")
+		require.True(t, ok)
+		assert.Equal(t, "1m load average.", help.Help)
+	})
 }
 
 func ExampleHandlers_HandleUpdate() {
@@ -478,6 +1297,7 @@ func ExampleHandlers_HandleGetHome() {
 	repo := storage.NewRepo()
 	_, handl := NewTestServer(&repo)
 	getData := httptest.NewRequest(http.MethodGet, "/", nil)
+	getData.Header.Set("Accept", "application/json")
 	w := httptest.NewRecorder()
 	mux := chi.NewRouter()
 	ctx := context.TODO()
@@ -491,11 +1311,14 @@ func ExampleHandlers_HandleGetHome() {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	checkSum := md5.Sum(byteVar)
-	checkSumStr := hex.EncodeToString(checkSum[:])
-	fmt.Println(checkSumStr)
+	var data []models.Metrics
+	json.Unmarshal(byteVar, &data)
+	for _, m := range data {
+		fmt.Println(m.StringData(), m.UpdatedAt != nil)
+	}
 	// Output:
-	// 9f588c81bb10904d7b5fb7dc7b8fc4fa
+	// PollCounter:counter:0 true
+	// RamMem:gauge:100.100000 true
 
 }
 func ExampleHandlers_HandleGetPing() {
@@ -544,3 +1367,190 @@ func NewTestServer(repo models.Storager) (*chi.Mux, *Handlers) {
 	return mux, &handl
 
 }
+
+func TestHandlers_HandlePostInfluxWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		query      string
+		code       int
+		wantSeries int
+		wantErrors []int
+	}{
+		{
+			name:       "positive lines",
+			body:       "cpu,host=web01 usage_idle=92.5,usage_user=3i 1650000000\ncpu,host=web02 usage_idle=80 1650000000\n",
+			query:      "?precision=s",
+			code:       204,
+			wantSeries: 3,
+		},
+		{
+			name:       "negative partial write",
+			body:       "cpu usage_idle=92.5\ncpu usage_idle=\nmem free=1i\ncpu usage_idle=1 yesterday\n",
+			code:       400,
+			wantSeries: 2,
+			wantErrors: []int{2, 4},
+		},
+		{
+			name:  "negative precision",
+			body:  "cpu usage_idle=92.5",
+			query: "?precision=d",
+			code:  400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			handl := NewHandlers(&repo, crypto.NewCryptoService())
+			request := httptest.NewRequest(http.MethodPost, "/write"+tt.query, strings.NewReader(tt.body))
+			request.Header.Set(models.AgentIDHeader, "telegraf1")
+			w := httptest.NewRecorder()
+			handl.HandlePostInfluxWrite(w, request)
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+			all := repo.GetAll(context.TODO())
+			assert.Len(t, all, tt.wantSeries)
+			for _, m := range all {
+				assert.Equal(t, "telegraf1", m.Source)
+			}
+			if tt.wantErrors != nil {
+				var result influx.WriteResult
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+				assert.Equal(t, tt.wantSeries, result.Accepted)
+				var lines []int
+				for _, e := range result.Errors {
+					lines = append(lines, e.Line)
+				}
+				assert.Equal(t, tt.wantErrors, lines)
+			}
+		})
+	}
+}
+
+func TestHandlers_HandlePostOTLPMetrics(t *testing.T) {
+	jsonBody := `{"resourceMetrics": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "checkout"}}]},
+		"scopeMetrics": [{"metrics": [
+			{"name": "queue.size", "description": "Jobs in queue", "gauge": {"dataPoints": [{"asDouble": 4.5}]}},
+			{"name": "http.size", "summary": {"dataPoints": [{"count": "1", "sum": 10}]}}
+		]}]
+	}]}`
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		code        int
+		wantSeries  int
+	}{
+		{
+			name:        "positive json",
+			body:        jsonBody,
+			contentType: "application/json",
+			code:        200,
+			wantSeries:  1,
+		},
+		{
+			name:        "negative content type",
+			body:        jsonBody,
+			contentType: "text/plain",
+			code:        415,
+		},
+		{
+			name:        "negative malformed",
+			body:        `{"resourceMetrics": 1}`,
+			contentType: "application/json",
+			code:        400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			handl := NewHandlers(&repo, crypto.NewCryptoService())
+			handl.Metadata = metadata.NewRegistry()
+			request := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(tt.body))
+			request.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			handl.HandlePostOTLPMetrics(w, request)
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+			all := repo.GetAll(context.TODO())
+			assert.Len(t, all, tt.wantSeries)
+			if tt.code != 200 {
+				return
+			}
+			assert.Equal(t, "checkout", all[0].Source)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.JSONEq(t, `{"partialSuccess": {"rejectedDataPoints": "1", "errorMessage": "http.size: unsupported data type"}}`, w.Body.String())
+			meta, ok := handl.Metadata.Get("queue.size")
+			require.True(t, ok)
+			assert.Equal(t, "Jobs in queue", meta.Help)
+		})
+	}
+}
+
+func TestHandlers_Stream(t *testing.T) {
+	repo := storage.NewRepo()
+	handl := NewHandlers(&repo, crypto.NewCryptoService())
+	broker, err := stream.NewBroker(&repo, 0)
+	require.NoError(t, err)
+	handl.Stream = broker
+	handl.StreamHeartbeat = 20 * time.Millisecond
+	mux := chi.NewRouter()
+	mux.Get("/stream", handl.HandleGetStream)
+	mux.Get("/stream/ws", handl.HandleGetStreamWS)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer broker.Close()
+
+	insert := func(id string, value float64) {
+		require.NoError(t, repo.InsertMetric(context.TODO(), models.Metrics{ID: id, MType: "gauge", Value: &value}))
+	}
+	insert("Alloc", 1)
+	insert("Frees", 1)
+
+	t.Run("negative bad filter", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/stream?name=[")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("positive sse resume", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodGet, srv.URL+"/stream?name=Alloc", nil)
+		require.NoError(t, err)
+		request.Header.Set("Last-Event-ID", "0")
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		insert("Frees", 2)
+		insert("Alloc", 2)
+		reader := bufio.NewReader(resp.Body)
+		var frames []string
+		heartbeat := false
+		for len(frames) < 2 || !heartbeat {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				frames = append(frames, strings.TrimSpace(line))
+			case strings.HasPrefix(line, ": heartbeat"):
+				heartbeat = true
+			}
+		}
+		assert.Equal(t, []string{"id: 1", "id: 4"}, frames)
+	})
+
+	t.Run("positive websocket", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/stream/ws?last_event_id=100", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		var m stream.Message
+		require.NoError(t, conn.ReadJSON(&m))
+		assert.Equal(t, stream.EventGap, m.Event)
+		insert("Alloc", 3)
+		require.NoError(t, conn.ReadJSON(&m))
+		assert.Equal(t, stream.EventUpdate, m.Event)
+		assert.Equal(t, "Alloc", m.New.ID)
+		assert.Equal(t, 3.0, *m.New.Value)
+		assert.Equal(t, 2.0, *m.Old.Value)
+	})
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/ndjson"
+	"github.com/MaximkaSha/log_tools/internal/query"
+	"github.com/MaximkaSha/log_tools/internal/validate"
+)
+
+// Errors of shared logic, transports map them to their status codes.
+var (
+	// ErrBadHash metric hash does not match server key.
+	ErrBadHash = errors.New("sign check fail")
+	// ErrNotFound metric is not found or is hidden as stale.
+	ErrNotFound = errors.New("metric not found")
+	// ErrBadQuery request parametrs are bad.
+	ErrBadQuery = errors.New("bad query")
+	// ErrBatchRejected no metric of batch is written because of rejected metrics.
+	ErrBatchRejected = errors.New("batch is rejected")
+)
+
+// Update checks metric and its hash and writes it to storage stamped with time of write.
+// It is shared by HTTP and gRPC endpoints, bad metric error wraps validate errors.
+func (h *Handlers) Update(ctx context.Context, m models.Metrics) error {
+	if err := h.Validator.Metric(m); err != nil {
+		return err
+	}
+	if h.cryptoService.IsEnable && !h.cryptoService.CheckHash(m) {
+		return ErrBadHash
+	}
+	stampServer(&m)
+	return h.Repo.InsertMetric(ctx, m)
+}
+
+// stampServer drops timestamps agent sent with metric, so storage stamps it with time of write
+// and agents can not make metric look fresh or stale.
+func stampServer(m *models.Metrics) {
+	m.UpdatedAt, m.FirstSeen = nil, nil
+}
+
+// checkMetrics returns metrics of data which pass Validator, number of rejected metrics
+// and error of the first of them. It is used by protocol endpoints which have no hashes.
+func (h *Handlers) checkMetrics(data []models.Metrics) ([]models.Metrics, int, error) {
+	good := data[:0]
+	var first error
+	for k := range data {
+		if err := h.Validator.Metric(data[k]); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		good = append(good, data[k])
+	}
+	return good, len(data) - len(good), first
+}
+
+// UpdateBatch checks metrics and their hashes and writes good ones to storage at once stamped with time of write.
+// Result has status and reason of every metric. With BatchAtomic policy nothing is written
+// if any metric is rejected, with BatchBestEffort good metrics are written.
+// If nothing is written because of rejected metrics, ErrBatchRejected is returned with result.
+// Batch with key is applied once, replayed is true if it was applied before and the original result is returned.
+// Keys are scoped by scope, usually agent ID, and bound to batch content: reused key with other batch
+// gets models.ErrKeyConflict.
+func (h *Handlers) UpdateBatch(ctx context.Context, scope string, key string, data []models.Metrics) (result models.BatchResult, replayed bool, err error) {
+	if err := h.Validator.BatchSize(len(data)); err != nil {
+		return models.BatchResult{}, false, err
+	}
+	hash := models.BatchHash(data)
+	result = models.BatchResult{Key: key, Items: make([]models.BatchItem, len(data))}
+	good := make([]models.Metrics, 0, len(data))
+	for k := range data {
+		item := models.BatchItem{Index: k, ID: data[k].ID, Status: models.BatchItemAccepted}
+		if err := h.Validator.Metric(data[k]); err != nil {
+			item.Status, item.Reason = models.BatchItemRejected, err.Error()
+		} else if h.cryptoService.IsEnable && !h.cryptoService.CheckHash(data[k]) {
+			item.Status, item.Reason = models.BatchItemRejected, ErrBadHash.Error()
+		} else {
+			stampServer(&data[k])
+			good = append(good, data[k])
+		}
+		result.Items[k] = item
+	}
+	result.Rejected = len(data) - len(good)
+	if result.Rejected > 0 && h.BatchPolicy != models.BatchBestEffort {
+		for k := range result.Items {
+			if result.Items[k].Status == models.BatchItemAccepted {
+				result.Items[k].Status, result.Items[k].Reason = models.BatchItemSkipped, "batch is atomic and has rejected metrics"
+			}
+		}
+		result.Rejected = len(data)
+		return result, false, ErrBatchRejected
+	}
+	if len(good) == 0 {
+		if result.Rejected > 0 {
+			return result, false, ErrBatchRejected
+		}
+		return result, false, nil
+	}
+	result.Accepted = len(good)
+	if key != "" {
+		return h.Repo.BatchInsertOnce(ctx, scopedKey(scope, key), hash, good, result)
+	}
+	return result, false, h.Repo.BatchInsert(ctx, good)
+}
+
+// scopedKey returns storage key of idempotency key of scope.
+func scopedKey(scope string, key string) string {
+	sum := sha256.Sum256([]byte(scope + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Ingest reads stream of metrics from dec and writes them to storage in chunks of NDJSONChunkSize.
+// Every metric is checked and its hash is verified, invalid lines are rejected with their numbers.
+// stamp, if it is not nil, is called for every metric before it is checked.
+// If reading or storage fails ingest stops and error is returned with progress so far,
+// error of reading wraps ndjson.ErrRead.
+func (h *Handlers) Ingest(ctx context.Context, dec ndjson.Decoder, stamp func(*models.Metrics)) (ndjson.Result, error) {
+	return h.ingest(ctx, dec, stamp, h.Repo.BatchInsert)
+}
+
+// Import is Ingest which sets counters to their values instead of adding them, so counters of export
+// are restored as they were and importing the same data again does not change them.
+func (h *Handlers) Import(ctx context.Context, dec ndjson.Decoder) (ndjson.Result, error) {
+	return h.ingest(ctx, dec, nil, h.Repo.BatchSet)
+}
+
+// ingest is Ingest which writes chunks with insert.
+func (h *Handlers) ingest(ctx context.Context, dec ndjson.Decoder, stamp func(*models.Metrics), insert func(context.Context, []models.Metrics) error) (ndjson.Result, error) {
+	size := h.NDJSONChunkSize
+	if size <= 0 {
+		size = ndjson.DefaultChunkSize
+	}
+	var result ndjson.Result
+	chunk := make([]models.Metrics, 0, size)
+	flush := func(line int) error {
+		if len(chunk) > 0 {
+			chunkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			if err := insert(chunkCtx, chunk); err != nil {
+				return err
+			}
+			result.Accepted += len(chunk)
+			result.Chunks++
+			chunk = chunk[:0]
+		}
+		result.CommittedLine = line
+		return nil
+	}
+	for {
+		line, m, err := dec.Next()
+		if err == io.EOF {
+			result.Lines = line
+			return result, flush(line)
+		}
+		result.Lines = line
+		if errors.Is(err, ndjson.ErrRead) {
+			// lines before broken one are good, keep them
+			if ferr := flush(line - 1); ferr != nil {
+				return result, ferr
+			}
+			return result, err
+		}
+		if err != nil {
+			result.Reject(line, err)
+			continue
+		}
+		if stamp != nil {
+			stamp(&m)
+		}
+		if err := h.Validator.Metric(m); err != nil {
+			result.Reject(line, err)
+			continue
+		}
+		if h.cryptoService.IsEnable && !h.cryptoService.CheckHash(m) {
+			result.Reject(line, ErrBadHash)
+			continue
+		}
+		chunk = append(chunk, m)
+		if len(chunk) == size {
+			if err := flush(line); err != nil {
+				return result, err
+			}
+		}
+	}
+}
+
+// Query evaluates aggregation query against stored metrics, stale metrics are skipped if they are hidden.
+func (h *Handlers) Query(ctx context.Context, q query.Query) (query.Result, error) {
+	if err := q.Prepare(); err != nil {
+		return query.Result{}, fmt.Errorf("%w: %s", ErrBadQuery, err)
+	}
+	return q.Eval(models.MarkStale(h.Repo.GetAll(ctx), time.Now(), h.StaleThreshold, h.HideStale)), nil
+}
+
+// isValidationError returns true if err is error of bad metric.
+func isValidationError(err error) bool {
+	return errors.Is(err, validate.ErrBadName) || errors.Is(err, validate.ErrUnknownType) ||
+		errors.Is(err, validate.ErrBadValue) || errors.Is(err, validate.ErrTooLarge)
+}
+
+// Value returns metric of data.Source signed with server key.
+// If source is empty value is aggregated across sources with agg.
+// If metric is not found or stale metric is hidden then ErrNotFound is returned with ID and type of data only.
+func (h *Handlers) Value(ctx context.Context, data models.Metrics, agg string) (models.Metrics, error) {
+	if agg != "" && !models.IsAggregation(agg) {
+		return models.Metrics{}, fmt.Errorf("%w: unknown aggregation %q", ErrBadQuery, agg)
+	}
+	d, err := h.getMetric(ctx, data, agg)
+	if err != nil || h.hidden(&d) {
+		return models.Metrics{ID: data.ID, MType: data.MType}, ErrNotFound
+	}
+	if h.cryptoService.IsEnable {
+		if _, err = h.cryptoService.Hash(&d); err != nil {
+			return models.Metrics{}, err
+		}
+	}
+	return d, nil
+}
+
+// List returns page of metrics matching q, stale metrics are marked or hidden.
+// Hidden metrics are filtered by storage before paging, so pages are full.
+func (h *Handlers) List(ctx context.Context, q models.ListQuery) (models.ListPage, error) {
+	if err := q.Prepare(); err != nil {
+		return models.ListPage{}, fmt.Errorf("%w: %s", ErrBadQuery, err)
+	}
+	now := time.Now()
+	if h.HideStale && h.StaleThreshold > 0 {
+		q.UpdatedSince = now.Add(-h.StaleThreshold)
+	}
+	page, err := h.Repo.List(ctx, q)
+	if err != nil {
+		return models.ListPage{}, err
+	}
+	page.Metrics = models.MarkStale(page.Metrics, now, h.StaleThreshold, h.HideStale)
+	return page, nil
+}
@@ -0,0 +1,229 @@
+//Package influx parses InfluxDB line protocol and maps points to metrics.
+//
+//Line is "measurement[,tag=value...] field=value[,field=value...] [timestamp]".
+//Every numeric or boolean field becomes gauge "measurement_field" with point
+//tags as labels. Integers (123i), unsigned integers (123u), floats and booleans
+//(stored as 1 and 0) are supported; string fields can not be stored and are skipped.
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+)
+
+//MaxBodySize - biggest accepted request body.
+const MaxBodySize = 32 << 20
+
+//WriteResult - result of write request with invalid lines.
+type WriteResult struct {
+	//Accepted - number of metrics written.
+	Accepted int `json:"accepted"`
+	//Errors - errors of invalid lines, they are not written.
+	Errors []LineError `json:"errors"`
+}
+
+//LineError - error of one line of request.
+type LineError struct {
+	//Line - number of line, starting from 1.
+	Line int `json:"line"`
+	//Error - what is wrong with line.
+	Error string `json:"error"`
+}
+
+//Precision - return duration of timestamp unit of precision parametr.
+//Both InfluxDB 1.x (n, u, ms, s, m, h) and 2.x (ns, us, ms, s) names are accepted, empty is nanoseconds.
+func Precision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown precision %q", precision)
+}
+
+//Parse - parse request body.
+//Metrics of valid lines are returned with errors of invalid lines, empty lines and comments are skipped.
+//Points without timestamp get now. If check is not nil, line with metric it rejects is invalid.
+func Parse(body string, unit time.Duration, now time.Time, check func(models.Metrics) error) ([]models.Metrics, []LineError) {
+	var data []models.Metrics
+	var lineErrors []LineError
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		metrics, err := ParseLine(line, unit, now)
+		for k := 0; err == nil && check != nil && k < len(metrics); k++ {
+			err = check(metrics[k])
+		}
+		if err != nil {
+			lineErrors = append(lineErrors, LineError{Line: i + 1, Error: err.Error()})
+			continue
+		}
+		data = append(data, metrics...)
+	}
+	return data, lineErrors
+}
+
+//ParseLine - parse one line to metrics, one per numeric field.
+func ParseLine(line string, unit time.Duration, now time.Time) ([]models.Metrics, error) {
+	key, rest, err := splitUnescaped(line, ' ', false)
+	if err != nil {
+		return nil, err
+	}
+	fieldSet, timestamp, err := splitUnescaped(strings.TrimLeft(rest, " "), ' ', true)
+	if err != nil {
+		return nil, err
+	}
+	if fieldSet == "" {
+		return nil, errors.New("no fields")
+	}
+	keyParts, err := splitAll(key, ',', false)
+	if err != nil {
+		return nil, err
+	}
+	measurement := unescape(keyParts[0])
+	if measurement == "" {
+		return nil, errors.New("no measurement")
+	}
+	var labels map[string]string
+	for _, tag := range keyParts[1:] {
+		k, v, err := splitUnescaped(tag, '=', false)
+		if err != nil || k == "" || v == "" {
+			return nil, fmt.Errorf("bad tag %q", tag)
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(keyParts)-1)
+		}
+		labels[unescape(k)] = unescape(v)
+	}
+	updated := now
+	if timestamp = strings.TrimSpace(timestamp); timestamp != "" {
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestamp %q", timestamp)
+		}
+		updated = time.Unix(0, 0).Add(time.Duration(ts) * unit)
+	}
+	fields, err := splitAll(fieldSet, ',', true)
+	if err != nil {
+		return nil, err
+	}
+	var result []models.Metrics
+	for _, field := range fields {
+		k, v, err := splitUnescaped(field, '=', true)
+		if err != nil || k == "" || v == "" {
+			return nil, fmt.Errorf("bad field %q", field)
+		}
+		value, numeric, err := parseFieldValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", unescape(k), err)
+		}
+		if !numeric {
+			continue
+		}
+		result = append(result, models.Metrics{
+			ID:        measurement + "_" + unescape(k),
+			MType:     "gauge",
+			Value:     &value,
+			Labels:    labels,
+			UpdatedAt: &updated,
+		})
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no numeric fields")
+	}
+	return result, nil
+}
+
+//parseFieldValue - return value of field, numeric is false for string fields.
+func parseFieldValue(v string) (value float64, numeric bool, err error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		if len(v) < 2 || !strings.HasSuffix(v, `"`) || strings.HasSuffix(v, `\"`) && !strings.HasSuffix(v, `\\"`) {
+			return 0, false, errors.New("unterminated string")
+		}
+		return 0, false, nil
+	case strings.HasSuffix(v, "i"):
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("bad integer %q", v)
+		}
+		return float64(i), true, nil
+	case strings.HasSuffix(v, "u"):
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("bad unsigned integer %q", v)
+		}
+		return float64(u), true, nil
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false, fmt.Errorf("bad value %q", v)
+	}
+	return f, true, nil
+}
+
+//splitUnescaped - split s by the first sep which is not escaped by backslash.
+//If quoted is true, sep inside double quotes is ignored too.
+//If there is no sep, s and empty rest are returned.
+func splitUnescaped(s string, sep byte, quoted bool) (string, string, error) {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quoted:
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			return s[:i], s[i+1:], nil
+		}
+	}
+	if inQuotes {
+		return "", "", errors.New("unterminated string")
+	}
+	return s, "", nil
+}
+
+//splitAll - split s by all unescaped sep.
+func splitAll(s string, sep byte, quoted bool) ([]string, error) {
+	var parts []string
+	for {
+		part, rest, err := splitUnescaped(s, sep, quoted)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+		if len(part) == len(s) {
+			return parts, nil
+		}
+		s = rest
+	}
+}
+
+var unescaper = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`, `\"`, `"`)
+
+func unescape(s string) string {
+	return unescaper.Replace(s)
+}
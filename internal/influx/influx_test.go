@@ -0,0 +1,121 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Unix(1660000000, 0)
+	tests := []struct {
+		name       string
+		line       string
+		unit       time.Duration
+		wantIDs    []string
+		wantValues []float64
+		wantLabels map[string]string
+		wantTime   time.Time
+		wantErr    bool
+	}{
+		{
+			name:       "positive fields and tags",
+			line:       "cpu,host=web01,region=eu usage_idle=92.5,usage_user=3i 1650000000000000000",
+			unit:       time.Nanosecond,
+			wantIDs:    []string{"cpu_usage_idle", "cpu_usage_user"},
+			wantValues: []float64{92.5, 3},
+			wantLabels: map[string]string{"host": "web01", "region": "eu"},
+			wantTime:   time.Unix(1650000000, 0),
+		},
+		{
+			name:       "positive escaped names and string field",
+			line:       `disk\ io,path=/var\,log,mode\=x=rw reads=7u,up=true,note="a, b=c \"d\"" 1650000000`,
+			unit:       time.Second,
+			wantIDs:    []string{"disk io_reads", "disk io_up"},
+			wantValues: []float64{7, 1},
+			wantLabels: map[string]string{"path": "/var,log", "mode=x": "rw"},
+			wantTime:   time.Unix(1650000000, 0),
+		},
+		{
+			name:       "positive no timestamp",
+			line:       "mem free=1e3",
+			unit:       time.Nanosecond,
+			wantIDs:    []string{"mem_free"},
+			wantValues: []float64{1000},
+			wantTime:   now,
+		},
+		{
+			name:    "negative no fields",
+			line:    "cpu,host=web01",
+			wantErr: true,
+		},
+		{
+			name:    "negative only string fields",
+			line:    `log msg="started"`,
+			wantErr: true,
+		},
+		{
+			name:    "negative bad integer",
+			line:    "cpu usage=1.5i",
+			wantErr: true,
+		},
+		{
+			name:    "negative bad tag",
+			line:    "cpu,host usage=1",
+			wantErr: true,
+		},
+		{
+			name:    "negative NaN",
+			line:    "cpu usage=NaN",
+			wantErr: true,
+		},
+		{
+			name:    "negative unterminated string",
+			line:    `log msg="started,count=1i`,
+			wantErr: true,
+		},
+		{
+			name:    "negative bad timestamp",
+			line:    "cpu usage=1 yesterday",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line, tt.unit, now)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, got, len(tt.wantIDs))
+			for i, m := range got {
+				assert.Equal(t, tt.wantIDs[i], m.ID)
+				assert.Equal(t, "gauge", m.MType)
+				assert.Equal(t, tt.wantValues[i], *m.Value)
+				assert.Equal(t, tt.wantLabels, m.Labels)
+				assert.True(t, tt.wantTime.Equal(*m.UpdatedAt))
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	body := "# comment\ncpu usage=1\n\ncpu usage=\nmem free=2i,used=3i\n"
+	data, lineErrors := Parse(body, time.Nanosecond, time.Now(), nil)
+	assert.Len(t, data, 3)
+	require.Len(t, lineErrors, 1)
+	assert.Equal(t, 4, lineErrors[0].Line)
+}
+
+func TestPrecision(t *testing.T) {
+	for precision, want := range map[string]time.Duration{"": time.Nanosecond, "us": time.Microsecond, "ms": time.Millisecond, "s": time.Second} {
+		got, err := Precision(precision)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := Precision("d")
+	assert.Error(t, err)
+}
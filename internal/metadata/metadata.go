@@ -0,0 +1,111 @@
+//Package metadata keeps descriptive information about metrics, such as help text and unit.
+//
+//Metrics themselves carry only name, type and value. Exporters look up
+//metadata by metric ID to describe metrics to external systems.
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+//Metadata - description of metric.
+type Metadata struct {
+	//Help - human readable description.
+	Help string `json:"help"`
+	//Unit - unit of metric value, empty if unknown or dimensionless.
+	Unit string `json:"unit,omitempty"`
+}
+
+//Registry - metadata of metrics by metric ID. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.RWMutex
+	entries map[string]Metadata
+}
+
+//NewRegistry - Registry constructor.
+//Registry is prefilled with metadata of metrics collected by agent.
+func NewRegistry() *Registry {
+	r := &Registry{
+		entries: make(map[string]Metadata, len(agentMetrics)),
+	}
+	for id, m := range agentMetrics {
+		r.entries[id] = m
+	}
+	return r
+}
+
+//Get - return metadata of metric, ok is false if there is none.
+func (r *Registry) Get(id string) (Metadata, bool) {
+	r.mu.RLock()
+	m, ok := r.entries[id]
+	r.mu.RUnlock()
+	if !ok && strings.HasPrefix(id, "CPUutilization") {
+		return Metadata{Help: "Utilization of CPU " + strings.TrimPrefix(id, "CPUutilization") + " of agent host.", Unit: "percent"}, true
+	}
+	return m, ok
+}
+
+//Set - set metadata of metric.
+func (r *Registry) Set(id string, m Metadata) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[id] = m
+}
+
+//Load - add metadata from JSON file, which is an object of Metadata by metric ID.
+//Loaded metadata replaces existing one.
+func (r *Registry) Load(file string) error {
+	jData, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var entries map[string]Metadata
+	if err = json.Unmarshal(jData, &entries); err != nil {
+		return fmt.Errorf("bad metadata file %s: %w", file, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, m := range entries {
+		r.entries[id] = m
+	}
+	return nil
+}
+
+//agentMetrics - metadata of metrics collected by agent.
+var agentMetrics = map[string]Metadata{
+	"Alloc":         {Help: "Bytes of allocated heap objects.", Unit: "bytes"},
+	"BuckHashSys":   {Help: "Bytes of memory in profiling bucket hash tables.", Unit: "bytes"},
+	"Frees":         {Help: "Cumulative count of heap objects freed."},
+	"GCCPUFraction": {Help: "Fraction of available CPU time used by the GC since the program started."},
+	"GCSys":         {Help: "Bytes of memory in garbage collection metadata.", Unit: "bytes"},
+	"HeapAlloc":     {Help: "Bytes of allocated heap objects.", Unit: "bytes"},
+	"HeapIdle":      {Help: "Bytes in idle (unused) heap spans.", Unit: "bytes"},
+	"HeapInuse":     {Help: "Bytes in in-use heap spans.", Unit: "bytes"},
+	"HeapObjects":   {Help: "Number of allocated heap objects."},
+	"HeapReleased":  {Help: "Bytes of physical memory returned to the OS.", Unit: "bytes"},
+	"HeapSys":       {Help: "Bytes of heap memory obtained from the OS.", Unit: "bytes"},
+	"LastGC":        {Help: "Time the last garbage collection finished, as nanoseconds since the Unix epoch.", Unit: "nanoseconds"},
+	"Lookups":       {Help: "Number of pointer lookups performed by the runtime."},
+	"MCacheInuse":   {Help: "Bytes of allocated mcache structures.", Unit: "bytes"},
+	"MCacheSys":     {Help: "Bytes of memory obtained from the OS for mcache structures.", Unit: "bytes"},
+	"MSpanInuse":    {Help: "Bytes of allocated mspan structures.", Unit: "bytes"},
+	"MSpanSys":      {Help: "Bytes of memory obtained from the OS for mspan structures.", Unit: "bytes"},
+	"Mallocs":       {Help: "Cumulative count of heap objects allocated."},
+	"NextGC":        {Help: "Target heap size of the next GC cycle.", Unit: "bytes"},
+	"NumForcedGC":   {Help: "Number of GC cycles that were forced by the application calling the GC function."},
+	"NumGC":         {Help: "Number of completed GC cycles."},
+	"OtherSys":      {Help: "Bytes of memory in miscellaneous off-heap runtime allocations.", Unit: "bytes"},
+	"PauseTotalNs":  {Help: "Cumulative nanoseconds in GC stop-the-world pauses since the program started.", Unit: "nanoseconds"},
+	"StackInuse":    {Help: "Bytes in stack spans.", Unit: "bytes"},
+	"StackSys":      {Help: "Bytes of stack memory obtained from the OS.", Unit: "bytes"},
+	"Sys":           {Help: "Total bytes of memory obtained from the OS.", Unit: "bytes"},
+	"TotalAlloc":    {Help: "Cumulative bytes allocated for heap objects.", Unit: "bytes"},
+	"PollCount":     {Help: "Number of times agent collected metrics."},
+	"RandomValue":   {Help: "Random value generated by agent on every poll."},
+	"TotalMemory":   {Help: "Total amount of RAM on agent host.", Unit: "bytes"},
+	"FreeMemory":    {Help: "Amount of free RAM on agent host.", Unit: "bytes"},
+}
@@ -0,0 +1,253 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//Sort orders of metrics listing.
+const (
+	SortID        = "id"
+	SortType      = "type"
+	SortSource    = "source"
+	SortUpdatedAt = "updated_at"
+)
+
+//DefaultListLimit - page size used when none is requested.
+const DefaultListLimit = 100
+
+//MaxListLimit - biggest page size.
+const MaxListLimit = 1000
+
+//sortKeyTimeLayout - fixed width layout, so time keys are ordered as strings.
+const sortKeyTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+//ListQuery - filter, order and page of metrics listing.
+type ListQuery struct {
+	//Type - metric type, empty for any.
+	Type string
+	//Prefix - metric ID prefix.
+	Prefix string
+	//Glob - metric ID pattern in path.Match syntax.
+	Glob string
+	//Regex - metric ID regular expression in RE2 syntax, every storage evaluates it with regexp.
+	Regex string
+	//Source - metric source, empty for any.
+	Source string
+	//UpdatedSince - skip metrics updated before it, zero for any. Metrics without update time pass.
+	UpdatedSince time.Time
+	//Sort - sort order: SortID (default), SortType, SortSource or SortUpdatedAt.
+	//Metrics with equal sort values are ordered by ID, source and labels key.
+	Sort string
+	//Desc - sort in descending order.
+	Desc bool
+	//Cursor - NextCursor of previous page.
+	Cursor string
+	//Limit - page size, DefaultListLimit if zero.
+	Limit int
+
+	regex  *regexp.Regexp
+	cursor *listCursor
+}
+
+//ListPage - page of metrics listing.
+type ListPage struct {
+	//Metrics - metrics of page.
+	Metrics []Metrics `json:"metrics"`
+	//NextCursor - cursor of next page, empty for last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type listCursor struct {
+	Key    string `json:"k"`
+	ID     string `json:"i"`
+	Source string `json:"s"`
+	Labels string `json:"l,omitempty"`
+}
+
+func (q *ListQuery) cursorOf(m Metrics) listCursor {
+	return listCursor{Key: q.SortKey(m), ID: m.ID, Source: m.Source, Labels: m.LabelsKey()}
+}
+
+//Prepare - check query and fill defaults. It must be called before other ListQuery methods.
+func (q *ListQuery) Prepare() error {
+	if q.Type != "" && q.Type != "gauge" && q.Type != "counter" {
+		return fmt.Errorf("unknown type %q", q.Type)
+	}
+	if q.Glob != "" {
+		if _, err := path.Match(q.Glob, ""); err != nil {
+			return fmt.Errorf("bad glob: %w", err)
+		}
+	}
+	if q.Regex != "" {
+		var err error
+		if q.regex, err = regexp.Compile(q.Regex); err != nil {
+			return fmt.Errorf("bad regex: %w", err)
+		}
+	}
+	switch q.Sort {
+	case "":
+		q.Sort = SortID
+	case SortID, SortType, SortSource, SortUpdatedAt:
+	default:
+		return fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	if q.Limit < 0 {
+		return errors.New("negative limit")
+	}
+	if q.Limit == 0 {
+		q.Limit = DefaultListLimit
+	}
+	if q.Limit > MaxListLimit {
+		q.Limit = MaxListLimit
+	}
+	q.cursor = nil
+	if q.Cursor != "" {
+		jData, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil {
+			return errors.New("bad cursor")
+		}
+		q.cursor = &listCursor{}
+		if err = json.Unmarshal(jData, q.cursor); err != nil {
+			return errors.New("bad cursor")
+		}
+		if q.Sort == SortUpdatedAt {
+			if _, err = time.Parse(sortKeyTimeLayout, q.cursor.Key); err != nil {
+				return errors.New("bad cursor")
+			}
+		}
+	}
+	return nil
+}
+
+//Match - return true if metric passes query filters.
+func (q *ListQuery) Match(m Metrics) bool {
+	if q.Type != "" && m.MType != q.Type {
+		return false
+	}
+	if q.Source != "" && m.Source != q.Source {
+		return false
+	}
+	if !q.UpdatedSince.IsZero() && m.UpdatedAt != nil && m.UpdatedAt.Before(q.UpdatedSince) {
+		return false
+	}
+	if q.Prefix != "" && !strings.HasPrefix(m.ID, q.Prefix) {
+		return false
+	}
+	if q.Glob != "" {
+		if ok, _ := path.Match(q.Glob, m.ID); !ok {
+			return false
+		}
+	}
+	if q.regex != nil && !q.regex.MatchString(m.ID) {
+		return false
+	}
+	return true
+}
+
+//SortKey - return value metric is sorted by.
+func (q *ListQuery) SortKey(m Metrics) string {
+	switch q.Sort {
+	case SortType:
+		return m.MType
+	case SortSource:
+		return m.Source
+	case SortUpdatedAt:
+		updated := time.Unix(0, 0)
+		if m.UpdatedAt != nil {
+			updated = *m.UpdatedAt
+		}
+		return updated.UTC().Format(sortKeyTimeLayout)
+	}
+	return m.ID
+}
+
+//Less - return true if a goes before b in query order.
+func (q *ListQuery) Less(a Metrics, b Metrics) bool {
+	return q.compare(q.cursorOf(a), q.cursorOf(b)) < 0
+}
+
+//AfterCursor - return true if metric goes after query cursor.
+func (q *ListQuery) AfterCursor(m Metrics) bool {
+	if q.cursor == nil {
+		return true
+	}
+	return q.compare(q.cursorOf(m), *q.cursor) > 0
+}
+
+//CursorValues - return sort value, ID, source and labels key of query cursor, ok is false if there is no cursor.
+//Sort value of SortUpdatedAt is time.Time.
+func (q *ListQuery) CursorValues() (key interface{}, id string, source string, labels string, ok bool) {
+	if q.cursor == nil {
+		return nil, "", "", "", false
+	}
+	key = q.cursor.Key
+	if q.Sort == SortUpdatedAt {
+		key, _ = time.Parse(sortKeyTimeLayout, q.cursor.Key)
+	}
+	return key, q.cursor.ID, q.cursor.Source, q.cursor.Labels, true
+}
+
+//NextCursor - return cursor of page which follows metric m.
+func (q *ListQuery) NextCursor(m Metrics) string {
+	jData, _ := json.Marshal(q.cursorOf(m))
+	return base64.RawURLEncoding.EncodeToString(jData)
+}
+
+func (q *ListQuery) compare(a listCursor, b listCursor) int {
+	result := strings.Compare(a.Key, b.Key)
+	if result == 0 {
+		result = strings.Compare(a.ID, b.ID)
+	}
+	if result == 0 {
+		result = strings.Compare(a.Source, b.Source)
+	}
+	if result == 0 {
+		result = strings.Compare(a.Labels, b.Labels)
+	}
+	if q.Desc {
+		return -result
+	}
+	return result
+}
+
+//GlobToRegex - convert path.Match pattern to anchored regular expression.
+func GlobToRegex(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	inClass := false
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			sb.WriteByte(c)
+		case c == '[':
+			inClass = true
+			sb.WriteByte(c)
+			if i+1 < len(glob) && glob[i+1] == '^' {
+				i++
+				sb.WriteString("^/")
+			}
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
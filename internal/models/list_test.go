@@ -0,0 +1,69 @@
+package models
+
+import (
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+func TestGlobToRegex(t *testing.T) {
+	tests := []struct {
+		glob string
+		ids  []string
+	}{
+		{glob: "CPU*", ids: []string{"CPUutilization1", "CPU", "Alloc", "xCPU"}},
+		{glob: "Heap?lloc", ids: []string{"HeapAlloc", "HeapXlloc", "Heaplloc"}},
+		{glob: "CPUutilization[12]", ids: []string{"CPUutilization1", "CPUutilization3"}},
+		{glob: "CPUutilization[^12]", ids: []string{"CPUutilization1", "CPUutilization3"}},
+		{glob: "a.b+c", ids: []string{"a.b+c", "aXbbc"}},
+		{glob: `Poll\*`, ids: []string{"Poll*", "PollCount"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob, func(t *testing.T) {
+			re := regexp.MustCompile(GlobToRegex(tt.glob))
+			for _, id := range tt.ids {
+				want, _ := path.Match(tt.glob, id)
+				if got := re.MatchString(id); got != want {
+					t.Errorf("GlobToRegex(%q) match %q = %v, want %v", tt.glob, id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestListQuery_Labels(t *testing.T) {
+	value := 1.0
+	data := []Metrics{
+		{ID: "cpu", MType: "gauge", Value: &value, Source: "node1", Labels: map[string]string{"mode": "user"}},
+		{ID: "cpu", MType: "gauge", Value: &value, Source: "node1", Labels: map[string]string{"mode": "idle"}},
+		{ID: "cpu", MType: "gauge", Value: &value, Source: "node1"},
+	}
+	q := ListQuery{Limit: 1}
+	var got []string
+	for {
+		if err := q.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		var page []Metrics
+		for _, m := range data {
+			if q.AfterCursor(m) {
+				page = append(page, m)
+			}
+		}
+		if len(page) == 0 {
+			break
+		}
+		sort.Slice(page, func(i, j int) bool { return q.Less(page[i], page[j]) })
+		got = append(got, page[0].LabelsKey())
+		q.Cursor = q.NextCursor(page[0])
+	}
+	want := []string{"", `{"mode":"idle"}`, `{"mode":"user"}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if data[0].SameSeries(data[1]) || !data[2].SameSeries(Metrics{ID: "cpu", Source: "node1", Labels: map[string]string{}}) {
+		t.Error("series must differ by labels only")
+	}
+}
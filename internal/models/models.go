@@ -3,7 +3,26 @@ package models
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	//AgentIDHeader - request header with ID of reporting agent.
+	AgentIDHeader = "X-Agent-ID"
+	//AgentHostHeader - request header with hostname of reporting agent.
+	AgentHostHeader = "X-Agent-Hostname"
+	//IdempotencyKeyHeader - request header with idempotency key of batch.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	//BatchIDHeader - request header with batch ID, used as idempotency key if there is no Idempotency-Key.
+	BatchIDHeader = "X-Batch-ID"
+	//ReplayedHeader - response header which is set if batch was already applied.
+	ReplayedHeader = "Idempotent-Replayed"
 )
 
 //Metrics describe metric structure.
@@ -18,11 +37,65 @@ type Metrics struct {
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
 	//Hash - MAC.
 	Hash string `json:"hash,omitempty"` // значение хеш-функции
+	//Source - ID of agent which reported metric, empty for unknown.
+	Source string `json:"source,omitempty"`
+	//Host - hostname of agent which reported metric.
+	Host string `json:"host,omitempty"`
+	//Labels - dimensions of metric, series of one metric and source differ by labels.
+	Labels map[string]string `json:"labels,omitempty"`
+	//FirstSeen - time metric was written first, set by storage.
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	//UpdatedAt - time metric was written last, set by storage if empty.
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	//Stale - true if metric was not updated longer than staleness threshold.
+	Stale bool `json:"stale,omitempty"`
 }
 
 //MetricsDB - []Metrics, array of metrics.
 type MetricsDB []Metrics
 
+//BatchResult - result of batch insert.
+type BatchResult struct {
+	//Key - idempotency key of batch, empty if none was sent.
+	Key string `json:"key,omitempty"`
+	//Accepted - number of metrics written.
+	Accepted int `json:"accepted"`
+	//Rejected - number of metrics not written.
+	Rejected int `json:"rejected"`
+	//Items - result of every metric in order of batch.
+	Items []BatchItem `json:"items,omitempty"`
+}
+
+//Statuses of batch items.
+const (
+	//BatchItemAccepted - metric is written.
+	BatchItemAccepted = "accepted"
+	//BatchItemRejected - metric is bad, Reason tells why.
+	BatchItemRejected = "rejected"
+	//BatchItemSkipped - metric is good but not written because atomic batch has rejected metrics.
+	BatchItemSkipped = "skipped"
+)
+
+//Batch policies.
+const (
+	//BatchAtomic - batch is written only if all metrics are good.
+	BatchAtomic = "atomic"
+	//BatchBestEffort - good metrics of batch are written, bad ones are rejected.
+	BatchBestEffort = "best_effort"
+)
+
+//BatchItem - result of one metric of batch.
+type BatchItem struct {
+	//Index - position of metric in batch.
+	Index int `json:"index"`
+	//ID - metric name.
+	ID string `json:"id"`
+	//Status - BatchItemAccepted, BatchItemRejected or BatchItemSkipped.
+	Status string `json:"status"`
+	//Reason - why metric is rejected or skipped.
+	Reason string `json:"reason,omitempty"`
+}
+
 //StringData return string "name:type:value" of metric.
 func (m *Metrics) StringData() string {
 	return m.formatString()
@@ -52,12 +125,237 @@ func NewMetric(varID string, varType string, varDelta *int64, varValue *float64,
 
 }
 
+//SameSeries - return true if m and other are the same metric of the same source with the same labels.
+func (m Metrics) SameSeries(other Metrics) bool {
+	return m.ID == other.ID && m.Source == other.Source && m.LabelsKey() == other.LabelsKey()
+}
+
+//LabelsKey - return canonical string of labels, empty if there are none.
+//Metrics with equal labels have equal keys.
+func (m Metrics) LabelsKey() string {
+	if len(m.Labels) == 0 {
+		return ""
+	}
+	//map keys are marshaled sorted
+	jData, _ := json.Marshal(m.Labels)
+	return string(jData)
+}
+
+//ParseLabelsKey - return labels of LabelsKey.
+func ParseLabelsKey(key string) (map[string]string, error) {
+	if key == "" {
+		return nil, nil
+	}
+	var labels map[string]string
+	if err := json.Unmarshal([]byte(key), &labels); err != nil {
+		return nil, fmt.Errorf("bad labels: %w", err)
+	}
+	return labels, nil
+}
+
+//Touch - set timestamps of metric written at now.
+//UpdatedAt set by writer (timestamp of protocol sample) is kept unless it is later than now,
+//FirstSeen is taken from stored metric if there is one, otherwise it is UpdatedAt.
+//FirstSeen set by writer is ignored.
+func (m *Metrics) Touch(stored *Metrics, now time.Time) {
+	if m.UpdatedAt == nil || m.UpdatedAt.After(now) {
+		m.UpdatedAt = &now
+	}
+	if stored != nil && stored.FirstSeen != nil {
+		m.FirstSeen = stored.FirstSeen
+	} else {
+		m.FirstSeen = m.UpdatedAt
+	}
+}
+
+//IsStale - return true if metric was not updated longer than threshold.
+//Zero threshold disables staleness.
+func (m Metrics) IsStale(now time.Time, threshold time.Duration) bool {
+	return threshold > 0 && m.UpdatedAt != nil && now.Sub(*m.UpdatedAt) > threshold
+}
+
+//MarkStale - set Stale of metrics not updated longer than threshold.
+//If hide is true stale metrics are removed instead.
+func MarkStale(data []Metrics, now time.Time, threshold time.Duration, hide bool) []Metrics {
+	result := make([]Metrics, 0, len(data))
+	for _, m := range data {
+		m.Stale = m.IsStale(now, threshold)
+		if m.Stale && hide {
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+//Float - return value of gauge or counter as float64, 0 if metric has none.
+func (m Metrics) Float() float64 {
+	if m.Value != nil {
+		return *m.Value
+	}
+	if m.Delta != nil {
+		return float64(*m.Delta)
+	}
+	return 0
+}
+
+//Aggregations across sources.
+const (
+	AggSum = "sum"
+	AggAvg = "avg"
+	AggMin = "min"
+	AggMax = "max"
+)
+
+//IsAggregation - return true if agg is known aggregation.
+func IsAggregation(agg string) bool {
+	return agg == AggSum || agg == AggAvg || agg == AggMin || agg == AggMax
+}
+
+//DefaultAggregation - aggregation used when none is requested: sum for counters, avg for gauges.
+func DefaultAggregation(mType string) string {
+	if mType == "counter" {
+		return AggSum
+	}
+	return AggAvg
+}
+
+//AggregateSources - merge series of one metric reported by different sources.
+//Single series is returned as is. If agg is empty DefaultAggregation is used.
+func AggregateSources(series []Metrics, agg string) (Metrics, error) {
+	if len(series) == 0 {
+		return Metrics{}, errors.New("no data")
+	}
+	if agg == "" {
+		agg = DefaultAggregation(series[0].MType)
+	}
+	if !IsAggregation(agg) {
+		return Metrics{}, fmt.Errorf("unknown aggregation %q", agg)
+	}
+	if len(series) == 1 {
+		return series[0], nil
+	}
+	result := Metrics{ID: series[0].ID, MType: series[0].MType}
+	var deltas, values []float64
+	for _, m := range series {
+		if m.FirstSeen != nil && (result.FirstSeen == nil || m.FirstSeen.Before(*result.FirstSeen)) {
+			result.FirstSeen = m.FirstSeen
+		}
+		if m.UpdatedAt != nil && (result.UpdatedAt == nil || m.UpdatedAt.After(*result.UpdatedAt)) {
+			result.UpdatedAt = m.UpdatedAt
+		}
+		if m.Delta != nil {
+			deltas = append(deltas, float64(*m.Delta))
+		}
+		if m.Value != nil {
+			values = append(values, *m.Value)
+		}
+	}
+	if len(deltas) > 0 {
+		delta := int64(Aggregate(deltas, agg))
+		result.Delta = &delta
+	}
+	if len(values) > 0 {
+		value := Aggregate(values, agg)
+		result.Value = &value
+	}
+	return result, nil
+}
+
+//AggregateAll - merge all series of the same metric across sources.
+//Order of metrics is kept.
+func AggregateAll(data []Metrics, agg string) ([]Metrics, error) {
+	var order []string
+	groups := make(map[string][]Metrics)
+	for _, m := range data {
+		if _, ok := groups[m.ID]; !ok {
+			order = append(order, m.ID)
+		}
+		groups[m.ID] = append(groups[m.ID], m)
+	}
+	result := make([]Metrics, 0, len(order))
+	for _, id := range order {
+		m, err := AggregateSources(groups[id], agg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+//Aggregate - reduce values with aggregation agg, values must not be empty.
+func Aggregate(values []float64, agg string) float64 {
+	result := values[0]
+	for _, v := range values[1:] {
+		switch agg {
+		case AggSum, AggAvg:
+			result += v
+		case AggMin:
+			if v < result {
+				result = v
+			}
+		case AggMax:
+			if v > result {
+				result = v
+			}
+		}
+	}
+	if agg == AggAvg {
+		result /= float64(len(values))
+	}
+	return result
+}
+
+//ErrKeyConflict - idempotency key was already used with other batch.
+var ErrKeyConflict = errors.New("idempotency key is used with other batch")
+
+//BatchHash - return hash of batch content, it binds idempotency key to batch.
+func BatchHash(data []Metrics) string {
+	h := sha256.New()
+	for _, m := range data {
+		var delta int64
+		var value float64
+		if m.Delta != nil {
+			delta = *m.Delta
+		}
+		if m.Value != nil {
+			value = *m.Value
+		}
+		fmt.Fprintf(h, "%q %q %t %d %t %x %q %q %q %q\n", m.ID, m.MType, m.Delta != nil, delta, m.Value != nil, math.Float64bits(value), m.Source, m.Host, m.LabelsKey(), m.Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//ChangeEvent - change of stored metric.
+type ChangeEvent struct {
+	//Seq - sequence number of change, it grows by one with every change.
+	Seq uint64 `json:"seq"`
+	//Old - stored metric before change, nil if metric was created.
+	Old *Metrics `json:"old,omitempty"`
+	//New - stored metric after change, counters carry stored sum, not received delta.
+	New Metrics `json:"new"`
+}
+
+//Subscription - ordered stream of ChangeEvent.
+type Subscription interface {
+	//Events - return channel of events, it is closed by Close.
+	Events() <-chan ChangeEvent
+	//Dropped - return number of events dropped because subscriber buffer was full.
+	Dropped() uint64
+	//Close - stop subscription.
+	Close()
+}
+
 //Storager - Interface which is used app to save the data.
 type Storager interface {
 	//InsertMetric - save models.Metrics.
 	InsertMetric(ctx context.Context, m Metrics) error
 	//GetMetric - get model.Metrics from storage.
+	//If data.Source is empty metric is aggregated across sources with DefaultAggregation.
 	GetMetric(data Metrics) (Metrics, error)
+	//GetSeries - get series of metric id reported by all sources.
+	GetSeries(ctx context.Context, id string) []Metrics
 	//InsertData - save metric raw data.
 	InsertData(ctx context.Context, typeVar string, name string, value string, hash string) int
 	//GetAll - get all model.Metrics data from storage.
@@ -70,6 +368,15 @@ type Storager interface {
 	PingDB() bool
 	//BatchInsert - Insert all collected metrics in one batch.
 	BatchInsert(ctx context.Context, dataModels []Metrics) error
-	//GetCurrentCommit - Get current commit from storage.
-	GetCurrentCommit() float64
+	//BatchSet - Insert all metrics in one batch, counters replace stored value instead of being added to it.
+	BatchSet(ctx context.Context, dataModels []Metrics) error
+	//BatchInsertOnce - Insert batch once per idempotency key and remember result with hash of batch.
+	//If key was already seen with the same hash, remembered result and true are returned and batch is not applied,
+	//if it was seen with other hash, ErrKeyConflict is returned.
+	BatchInsertOnce(ctx context.Context, key string, hash string, dataModels []Metrics, result BatchResult) (BatchResult, bool, error)
+	//Subscribe - subscribe for changes of metrics which ID matches pattern (path.Match syntax, empty for all).
+	//Size is buffer size, events which do not fit are dropped and counted by Subscription.Dropped.
+	Subscribe(pattern string, size int) (Subscription, error)
+	//List - get page of metrics which match query filters in query order.
+	List(ctx context.Context, q ListQuery) (ListPage, error)
 }
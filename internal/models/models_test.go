@@ -0,0 +1,61 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_Touch(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	first := now.Add(-24 * time.Hour)
+	tests := []struct {
+		name          string
+		m             Metrics
+		stored        *Metrics
+		wantUpdated   time.Time
+		wantFirstSeen time.Time
+	}{
+		{name: "positive new", wantUpdated: now, wantFirstSeen: now},
+		{name: "positive protocol timestamp", m: Metrics{UpdatedAt: &past}, wantUpdated: past, wantFirstSeen: past},
+		{name: "positive stored first seen", m: Metrics{UpdatedAt: &past}, stored: &Metrics{FirstSeen: &first}, wantUpdated: past, wantFirstSeen: first},
+		{name: "negative future timestamp is clamped", m: Metrics{UpdatedAt: &future}, wantUpdated: now, wantFirstSeen: now},
+		{name: "negative first seen of writer is ignored", m: Metrics{FirstSeen: &first}, wantUpdated: now, wantFirstSeen: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.m.Touch(tt.stored, now)
+			assert.Equal(t, tt.wantUpdated, *tt.m.UpdatedAt)
+			assert.Equal(t, tt.wantFirstSeen, *tt.m.FirstSeen)
+		})
+	}
+}
+
+func TestMetrics_Float(t *testing.T) {
+	value := 1.5
+	var delta int64 = 3
+	tests := []struct {
+		name string
+		m    Metrics
+		want float64
+	}{
+		{name: "positive gauge", m: Metrics{MType: "gauge", Value: &value}, want: 1.5},
+		{name: "positive counter", m: Metrics{MType: "counter", Delta: &delta}, want: 3},
+		{name: "negative no value", m: Metrics{MType: "gauge"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.m.Float())
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	values := []float64{2, 6, 1}
+	for agg, want := range map[string]float64{AggSum: 9, AggAvg: 3, AggMin: 1, AggMax: 6} {
+		assert.Equal(t, want, Aggregate(values, agg), agg)
+	}
+}
@@ -0,0 +1,152 @@
+//Package ndjson reads newline delimited JSON metrics as a stream.
+//
+//Every non-empty line is one models.Metrics JSON object. Lines are read one by
+//one with bounded buffer, so request of any size is ingested in constant memory:
+//metrics are written in chunks and only the first MaxErrors line errors are kept.
+package ndjson
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/validate"
+)
+
+//ContentType - media type of NDJSON request.
+const ContentType = "application/x-ndjson"
+
+//MaxLineSize - longest line in bytes, longer lines are rejected.
+const MaxLineSize = 64 << 10
+
+//DefaultChunkSize - number of metrics written to storage at once.
+const DefaultChunkSize = 1000
+
+//MaxErrors - number of line errors reported, the rest are only counted.
+const MaxErrors = 1000
+
+//ErrRead - stream can not be read, lines after it are lost.
+var ErrRead = errors.New("reading NDJSON stream failed")
+
+//ErrLineTooLong - line is longer than MaxLineSize, it is skipped.
+var ErrLineTooLong = fmt.Errorf("line is longer than %d bytes", MaxLineSize)
+
+//Result - progress of ingest.
+type Result struct {
+	//Lines - number of lines read.
+	Lines int `json:"lines"`
+	//Accepted - number of metrics written.
+	Accepted int `json:"accepted"`
+	//Rejected - number of invalid lines, they are not written.
+	Rejected int `json:"rejected"`
+	//Chunks - number of chunks written.
+	Chunks int `json:"chunks"`
+	//CommittedLine - every line up to it is written or rejected, ingest may be resumed after it.
+	CommittedLine int `json:"committed_line"`
+	//Errors - errors of first MaxErrors invalid lines.
+	Errors []LineError `json:"errors,omitempty"`
+	//DroppedErrors - number of line errors not listed in Errors.
+	DroppedErrors int `json:"dropped_errors,omitempty"`
+	//Error - error which stopped ingest, lines after CommittedLine are not written.
+	Error string `json:"error,omitempty"`
+}
+
+//LineError - error of one line.
+type LineError struct {
+	//Line - number of line, starting from 1.
+	Line int `json:"line"`
+	//Error - what is wrong with line.
+	Error string `json:"error"`
+}
+
+//Reject - count line as rejected and record its error.
+func (r *Result) Reject(line int, err error) {
+	r.Rejected++
+	if len(r.Errors) < MaxErrors {
+		r.Errors = append(r.Errors, LineError{Line: line, Error: err.Error()})
+	} else {
+		r.DroppedErrors++
+	}
+}
+
+//Reader - reads lines of NDJSON stream.
+type Reader struct {
+	rd   *bufio.Reader
+	line int
+}
+
+//NewReader - Reader constructor.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{rd: bufio.NewReaderSize(r, MaxLineSize)}
+}
+
+//Next - return number and data of next non-empty line, data is valid until the next call.
+//ErrLineTooLong is returned with number of line which is too long, reading may go on.
+//Error wrapping ErrRead is returned if stream can not be read.
+//io.EOF is returned at the end of stream.
+func (r *Reader) Next() (int, []byte, error) {
+	for {
+		data, err := r.rd.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			r.line++
+			if err = r.skipLine(); err != nil && err != io.EOF {
+				return r.line, nil, fmt.Errorf("%w: %s", ErrRead, err)
+			}
+			return r.line, nil, ErrLineTooLong
+		}
+		if err != nil && err != io.EOF {
+			return r.line, nil, fmt.Errorf("%w: %s", ErrRead, err)
+		}
+		if len(data) == 0 && err == io.EOF {
+			return r.line, nil, io.EOF
+		}
+		r.line++
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			return r.line, data, nil
+		}
+		if err == io.EOF {
+			return r.line, nil, io.EOF
+		}
+	}
+}
+
+//skipLine - discard the rest of current line.
+func (r *Reader) skipLine() error {
+	for {
+		_, err := r.rd.ReadSlice('\n')
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+	}
+}
+
+//Decoder - decodes metrics of stream one by one.
+type Decoder interface {
+	//Next - return number of line and metric of next record.
+	//Error wrapping ErrRead stops decoding, io.EOF is returned at the end of stream,
+	//other errors reject one record and decoding may go on.
+	Next() (int, models.Metrics, error)
+}
+
+//lineDecoder - Decoder of NDJSON stream.
+type lineDecoder struct {
+	rd *Reader
+}
+
+//NewDecoder - Decoder of NDJSON stream, unknown fields of metric are errors.
+func NewDecoder(r io.Reader) Decoder {
+	return lineDecoder{rd: NewReader(r)}
+}
+
+//Next - return number of line and metric decoded from it.
+func (d lineDecoder) Next() (int, models.Metrics, error) {
+	var m models.Metrics
+	line, data, err := d.rd.Next()
+	if err != nil {
+		return line, m, err
+	}
+	return line, m, validate.Decode(data, &m)
+}
@@ -0,0 +1,85 @@
+package ndjson
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type brokenReader struct{}
+
+func (brokenReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestReader_Next(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantLines []int
+		wantData  []string
+		wantErrs  []error
+	}{
+		{
+			name:      "positive lines",
+			body:      "{\"a\":1}\n{\"b\":2}\n",
+			wantLines: []int{1, 2, 2},
+			wantData:  []string{`{"a":1}`, `{"b":2}`, ""},
+			wantErrs:  []error{nil, nil, io.EOF},
+		},
+		{
+			name:      "positive empty lines and no trailing newline",
+			body:      "\n  \r\n{\"a\":1}\r\n\n{\"b\":2}",
+			wantLines: []int{3, 5, 5},
+			wantData:  []string{`{"a":1}`, `{"b":2}`, ""},
+			wantErrs:  []error{nil, nil, io.EOF},
+		},
+		{
+			name:      "negative too long line",
+			body:      strings.Repeat("x", MaxLineSize*2) + "\n{\"a\":1}\n",
+			wantLines: []int{1, 2, 2},
+			wantData:  []string{"", `{"a":1}`, ""},
+			wantErrs:  []error{ErrLineTooLong, nil, io.EOF},
+		},
+		{
+			name:      "negative empty",
+			wantLines: []int{0},
+			wantData:  []string{""},
+			wantErrs:  []error{io.EOF},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd := NewReader(strings.NewReader(tt.body))
+			for k := range tt.wantLines {
+				line, data, err := rd.Next()
+				assert.Equal(t, tt.wantLines[k], line)
+				assert.Equal(t, tt.wantData[k], string(data))
+				assert.ErrorIs(t, err, tt.wantErrs[k])
+				if tt.wantErrs[k] == nil {
+					require.NoError(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReader_NextBroken(t *testing.T) {
+	_, _, err := NewReader(brokenReader{}).Next()
+	assert.ErrorIs(t, err, ErrRead)
+}
+
+func TestResult_Reject(t *testing.T) {
+	var r Result
+	for line := 1; line <= MaxErrors+2; line++ {
+		r.Reject(line, ErrLineTooLong)
+	}
+	assert.Equal(t, MaxErrors+2, r.Rejected)
+	assert.Len(t, r.Errors, MaxErrors)
+	assert.Equal(t, 2, r.DroppedErrors)
+	assert.Equal(t, LineError{Line: 1, Error: ErrLineTooLong.Error()}, r.Errors[0])
+}
@@ -0,0 +1,344 @@
+//Package otlp decodes OTLP/HTTP metrics export requests and maps them to metrics.
+//
+//Request body is ExportMetricsServiceRequest encoded as protobuf or as JSON.
+//Gauge, Sum and Histogram data points are mapped, other data types are
+//rejected and reported in partial success of response.
+//
+//Source of metrics is built from service.namespace, service.name and
+//service.instance.id resource attributes joined by "/", host.name becomes host.
+//Data point attributes become metric labels, the point timestamp becomes UpdatedAt.
+//
+//Monotonic delta Sums become counters (double values are rounded), all other
+//Sums and Gauges become gauges: cumulative values can not be stored as counters
+//of this server, which are sums of reported deltas. Histogram point "name" becomes
+//"name.count" (counter for delta temporality, gauge otherwise), "name.bucket" with
+//label le per bucket in the same way and gauges "name.sum", "name.min" and "name.max"
+//when they are set.
+package otlp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/metadata"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	//ContentTypeProtobuf - content type of protobuf encoded request.
+	ContentTypeProtobuf = "application/x-protobuf"
+	//ContentTypeJSON - content type of JSON encoded request.
+	ContentTypeJSON = "application/json"
+)
+
+//MaxBodySize - biggest accepted request body.
+const MaxBodySize = 32 << 20
+
+//Resource attributes used for source and host.
+const (
+	ServiceNamespaceAttr  = "service.namespace"
+	ServiceNameAttr       = "service.name"
+	ServiceInstanceIDAttr = "service.instance.id"
+	HostNameAttr          = "host.name"
+)
+
+//BucketLabel - label with upper bound of histogram bucket.
+const BucketLabel = "le"
+
+//ErrUnsupportedContentType - request is neither protobuf nor JSON.
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+//Request - decoded export request.
+type Request struct {
+	*colmetricspb.ExportMetricsServiceRequest
+}
+
+//Decode - decode body of mediaType.
+func Decode(body []byte, mediaType string) (Request, error) {
+	req := Request{&colmetricspb.ExportMetricsServiceRequest{}}
+	var err error
+	switch mediaType {
+	case ContentTypeProtobuf:
+		err = proto.Unmarshal(body, req.ExportMetricsServiceRequest)
+	case ContentTypeJSON:
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, req.ExportMetricsServiceRequest)
+	default:
+		return Request{}, ErrUnsupportedContentType
+	}
+	if err != nil {
+		return Request{}, fmt.Errorf("bad request: %w", err)
+	}
+	return req, nil
+}
+
+//Encode - encode response of mediaType, rejected points are reported as partial success.
+func Encode(mediaType string, rejected int64, message string) ([]byte, error) {
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if rejected > 0 {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       message,
+		}
+	}
+	if mediaType == ContentTypeJSON {
+		return protojson.Marshal(resp)
+	}
+	return proto.Marshal(resp)
+}
+
+//Metrics - map data points to metrics.
+//Number of rejected data points and the reason of the first rejection are returned too.
+func (req Request) Metrics() (data []models.Metrics, rejected int64, message string) {
+	reject := func(n int, reason string) {
+		if rejected == 0 {
+			message = reason
+		}
+		rejected += int64(n)
+	}
+	for _, rm := range req.GetResourceMetrics() {
+		source, host := resourceSource(rm.GetResource().GetAttributes())
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				name := m.GetName()
+				if name == "" {
+					reject(dataPoints(m), "metric without name")
+					continue
+				}
+				var points []models.Metrics
+				var bad int
+				switch {
+				case m.GetGauge() != nil:
+					points, bad = numberPoints(name, "gauge", m.GetGauge().GetDataPoints())
+				case m.GetSum() != nil:
+					sum := m.GetSum()
+					mType := "gauge"
+					if sum.GetIsMonotonic() && sum.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+						mType = "counter"
+					}
+					points, bad = numberPoints(name, mType, sum.GetDataPoints())
+				case m.GetHistogram() != nil:
+					points, bad = histogramPoints(name, m.GetHistogram())
+				default:
+					reject(dataPoints(m), fmt.Sprintf("%s: unsupported data type", name))
+					continue
+				}
+				if bad > 0 {
+					reject(bad, fmt.Sprintf("%s: data point without value", name))
+				}
+				for k := range points {
+					points[k].Source = source
+					points[k].Host = host
+				}
+				data = append(data, points...)
+			}
+		}
+	}
+	return data, rejected, message
+}
+
+//SaveMetadata - save description and unit of metrics to registry.
+func (req Request) SaveMetadata(r *metadata.Registry) {
+	for _, rm := range req.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				if m.GetName() != "" && m.GetDescription() != "" {
+					r.Set(m.GetName(), metadata.Metadata{Help: m.GetDescription(), Unit: m.GetUnit()})
+				}
+			}
+		}
+	}
+}
+
+//resourceSource - return source and host of resource attributes.
+func resourceSource(attrs []*commonpb.KeyValue) (string, string) {
+	values := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		values[kv.GetKey()] = anyValueString(kv.GetValue())
+	}
+	var parts []string
+	for _, key := range []string{ServiceNamespaceAttr, ServiceNameAttr, ServiceInstanceIDAttr} {
+		if values[key] != "" {
+			parts = append(parts, values[key])
+		}
+	}
+	return strings.Join(parts, "/"), values[HostNameAttr]
+}
+
+//numberPoints - map Gauge or Sum data points, number of points without value is returned too.
+func numberPoints(name string, mType string, points []*metricspb.NumberDataPoint) ([]models.Metrics, int) {
+	data := make([]models.Metrics, 0, len(points))
+	bad := 0
+	for _, p := range points {
+		var value float64
+		switch v := p.GetValue().(type) {
+		case *metricspb.NumberDataPoint_AsDouble:
+			value = v.AsDouble
+		case *metricspb.NumberDataPoint_AsInt:
+			value = float64(v.AsInt)
+		default:
+			bad++
+			continue
+		}
+		if noValue(p.GetFlags(), value) {
+			bad++
+			continue
+		}
+		m := models.Metrics{ID: name, MType: mType, Labels: attributes(p.GetAttributes()), UpdatedAt: timestamp(p.GetTimeUnixNano())}
+		if mType == "counter" {
+			delta := int64(math.Round(value))
+			if v, ok := p.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+				delta = v.AsInt
+			}
+			m.Delta = &delta
+		} else {
+			m.Value = &value
+		}
+		data = append(data, m)
+	}
+	return data, bad
+}
+
+//histogramPoints - map Histogram data points, number of points without value is returned too.
+func histogramPoints(name string, h *metricspb.Histogram) ([]models.Metrics, int) {
+	delta := h.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	var data []models.Metrics
+	bad := 0
+	for _, p := range h.GetDataPoints() {
+		counts := p.GetBucketCounts()
+		bounds := p.GetExplicitBounds()
+		if noValue(p.GetFlags(), 0) || len(counts) > 0 && len(counts) != len(bounds)+1 {
+			bad++
+			continue
+		}
+		labels := attributes(p.GetAttributes())
+		updated := timestamp(p.GetTimeUnixNano())
+		count := func(id string, n uint64, labels map[string]string) models.Metrics {
+			m := models.Metrics{ID: id, Labels: labels, UpdatedAt: updated}
+			if delta {
+				d := int64(n)
+				m.MType, m.Delta = "counter", &d
+			} else {
+				v := float64(n)
+				m.MType, m.Value = "gauge", &v
+			}
+			return m
+		}
+		gauge := func(id string, v *float64) {
+			if v != nil && !math.IsNaN(*v) && !math.IsInf(*v, 0) {
+				value := *v
+				data = append(data, models.Metrics{ID: id, MType: "gauge", Value: &value, Labels: labels, UpdatedAt: updated})
+			}
+		}
+		data = append(data, count(name+".count", p.GetCount(), labels))
+		gauge(name+".sum", p.Sum)
+		gauge(name+".min", p.Min)
+		gauge(name+".max", p.Max)
+		var cumulative uint64
+		for i, n := range counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(bounds) {
+				le = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+			}
+			bucketLabels := make(map[string]string, len(labels)+1)
+			for k, v := range labels {
+				bucketLabels[k] = v
+			}
+			bucketLabels[BucketLabel] = le
+			data = append(data, count(name+".bucket", cumulative, bucketLabels))
+		}
+	}
+	return data, bad
+}
+
+//noValue - return true if data point has no value to store.
+func noValue(flags uint32, value float64) bool {
+	return flags&uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE) != 0 || math.IsNaN(value) || math.IsInf(value, 0)
+}
+
+//dataPoints - return number of data points of metric.
+func dataPoints(m *metricspb.Metric) int {
+	switch {
+	case m.GetGauge() != nil:
+		return len(m.GetGauge().GetDataPoints())
+	case m.GetSum() != nil:
+		return len(m.GetSum().GetDataPoints())
+	case m.GetHistogram() != nil:
+		return len(m.GetHistogram().GetDataPoints())
+	case m.GetExponentialHistogram() != nil:
+		return len(m.GetExponentialHistogram().GetDataPoints())
+	case m.GetSummary() != nil:
+		return len(m.GetSummary().GetDataPoints())
+	}
+	return 0
+}
+
+//timestamp - convert Unix nanoseconds to time, zero is now.
+func timestamp(nano uint64) *time.Time {
+	t := time.Now()
+	if nano != 0 {
+		t = time.Unix(0, int64(nano))
+	}
+	return &t
+}
+
+//attributes - convert attributes to labels.
+func attributes(attrs []*commonpb.KeyValue) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		labels[kv.GetKey()] = anyValueString(kv.GetValue())
+	}
+	return labels
+}
+
+//anyValueString - format attribute value, arrays and lists are formatted as JSON.
+func anyValueString(v *commonpb.AnyValue) string {
+	switch x := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return x.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(x.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(x.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(x.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return hex.EncodeToString(x.BytesValue)
+	case *commonpb.AnyValue_ArrayValue, *commonpb.AnyValue_KvlistValue:
+		data, _ := json.Marshal(anyValueJSON(v))
+		return string(data)
+	}
+	return ""
+}
+
+func anyValueJSON(v *commonpb.AnyValue) interface{} {
+	switch x := v.GetValue().(type) {
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]interface{}, 0, len(x.ArrayValue.GetValues()))
+		for _, item := range x.ArrayValue.GetValues() {
+			values = append(values, anyValueJSON(item))
+		}
+		return values
+	case *commonpb.AnyValue_KvlistValue:
+		values := make(map[string]interface{}, len(x.KvlistValue.GetValues()))
+		for _, kv := range x.KvlistValue.GetValues() {
+			values[kv.GetKey()] = anyValueJSON(kv.GetValue())
+		}
+		return values
+	}
+	return anyValueString(v)
+}
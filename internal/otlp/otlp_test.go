@@ -0,0 +1,152 @@
+package otlp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/metadata"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+//exportJSON - request as written by OpenTelemetry JSON exporters.
+const exportJSON = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [
+      {"key": "service.name", "value": {"stringValue": "checkout"}},
+      {"key": "service.instance.id", "value": {"stringValue": "pod-1"}},
+      {"key": "host.name", "value": {"stringValue": "node1"}}
+    ]},
+    "scopeMetrics": [{
+      "scope": {"name": "otel"},
+      "metrics": [
+        {
+          "name": "queue.size",
+          "description": "Jobs in queue",
+          "unit": "1",
+          "gauge": {"dataPoints": [{"asDouble": 4.5, "timeUnixNano": "1650000000000000000"}]}
+        },
+        {
+          "name": "http.requests",
+          "sum": {
+            "aggregationTemporality": 1,
+            "isMonotonic": true,
+            "dataPoints": [
+              {"asInt": "3", "timeUnixNano": "1650000000000000000", "attributes": [{"key": "route", "value": {"stringValue": "/pay"}}, {"key": "ok", "value": {"boolValue": true}}]},
+              {"asInt": "2", "timeUnixNano": "1650000000000000000", "attributes": [{"key": "route", "value": {"stringValue": "/cart"}}, {"key": "ok", "value": {"boolValue": true}}]}
+            ]
+          }
+        },
+        {
+          "name": "process.cpu.time",
+          "sum": {
+            "aggregationTemporality": "AGGREGATION_TEMPORALITY_CUMULATIVE",
+            "isMonotonic": true,
+            "dataPoints": [{"asDouble": 12.25, "timeUnixNano": "1650000000000000000"}]
+          }
+        },
+        {
+          "name": "http.duration",
+          "histogram": {
+            "aggregationTemporality": 1,
+            "dataPoints": [{
+              "timeUnixNano": "1650000000000000000",
+              "count": "6",
+              "sum": 1.5,
+              "bucketCounts": ["1", "4", "1"],
+              "explicitBounds": [0.1, 0.5]
+            }]
+          }
+        },
+        {
+          "name": "http.size",
+          "summary": {"dataPoints": [{"count": "1", "sum": 10}]}
+        },
+        {
+          "name": "empty",
+          "gauge": {"dataPoints": [{"flags": 1, "timeUnixNano": "1650000000000000000"}]}
+        }
+      ]
+    }]
+  }]
+}`
+
+func TestRequest_Metrics(t *testing.T) {
+	req, err := Decode([]byte(exportJSON), ContentTypeJSON)
+	require.NoError(t, err)
+	data, rejected, message := req.Metrics()
+	assert.Equal(t, int64(2), rejected)
+	assert.Equal(t, "http.size: unsupported data type", message)
+
+	got := make(map[string]models.Metrics)
+	for _, m := range data {
+		assert.Equal(t, "checkout/pod-1", m.Source)
+		assert.Equal(t, "node1", m.Host)
+		assert.True(t, time.Unix(1650000000, 0).Equal(*m.UpdatedAt))
+		got[m.ID+m.LabelsKey()] = m
+	}
+	assert.Len(t, got, 9)
+	assert.Equal(t, 4.5, *got["queue.size"].Value)
+	pay := got[`http.requests{"ok":"true","route":"/pay"}`]
+	assert.Equal(t, "counter", pay.MType)
+	assert.Equal(t, int64(3), *pay.Delta)
+	assert.Equal(t, "gauge", got["process.cpu.time"].MType)
+	assert.Equal(t, 12.25, *got["process.cpu.time"].Value)
+	assert.Equal(t, int64(6), *got["http.duration.count"].Delta)
+	assert.Equal(t, 1.5, *got["http.duration.sum"].Value)
+	assert.Equal(t, int64(1), *got[`http.duration.bucket{"le":"0.1"}`].Delta)
+	assert.Equal(t, int64(5), *got[`http.duration.bucket{"le":"0.5"}`].Delta)
+	assert.Equal(t, int64(6), *got[`http.duration.bucket{"le":"+Inf"}`].Delta)
+
+	registry := metadata.NewRegistry()
+	req.SaveMetadata(registry)
+	meta, ok := registry.Get("queue.size")
+	require.True(t, ok)
+	assert.Equal(t, "Jobs in queue", meta.Help)
+}
+
+func TestDecode(t *testing.T) {
+	req, err := Decode([]byte(exportJSON), ContentTypeJSON)
+	require.NoError(t, err)
+	body, err := proto.Marshal(req.ExportMetricsServiceRequest)
+	require.NoError(t, err)
+	tests := []struct {
+		name      string
+		body      []byte
+		mediaType string
+		wantErr   bool
+	}{
+		{name: "positive protobuf", body: body, mediaType: ContentTypeProtobuf},
+		{name: "positive json", body: []byte(exportJSON), mediaType: ContentTypeJSON},
+		{name: "negative protobuf", body: body[:len(body)-3], mediaType: ContentTypeProtobuf, wantErr: true},
+		{name: "negative json", body: []byte(`{"resourceMetrics": {}}`), mediaType: ContentTypeJSON, wantErr: true},
+		{name: "negative content type", body: body, mediaType: "text/plain", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.body, tt.mediaType)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, proto.Equal(req.ExportMetricsServiceRequest, got.ExportMetricsServiceRequest))
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	data, err := Encode(ContentTypeJSON, 2, "unsupported")
+	require.NoError(t, err)
+	var resp colmetricspb.ExportMetricsServiceResponse
+	require.NoError(t, protojson.Unmarshal(data, &resp))
+	assert.Equal(t, int64(2), resp.GetPartialSuccess().GetRejectedDataPoints())
+
+	data, err = Encode(ContentTypeProtobuf, 0, "")
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
@@ -0,0 +1,211 @@
+//Package prometheus renders metrics in Prometheus text exposition format (version 0.0.4).
+//
+//Metric IDs are sanitized to valid Prometheus names. Series are told apart by
+//metric labels and by source and host labels of the agent which reported them.
+//Metrics are read from storage page by page and written as they are read,
+//so memory use does not grow with the size of the store.
+package prometheus
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/metadata"
+	"github.com/MaximkaSha/log_tools/internal/models"
+)
+
+//ContentType - content type of text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//PageSize - number of metrics read from storage at once.
+const PageSize = models.MaxListLimit
+
+//Exporter - writes metrics of storage in exposition format.
+type Exporter struct {
+	//Repo - storage metrics are read from.
+	Repo models.Storager
+	//Metadata - source of HELP text, nil for none.
+	Metadata *metadata.Registry
+	//StaleThreshold - metrics not updated longer are stale, 0 disables staleness.
+	StaleThreshold time.Duration
+	//HideStale - skip stale metrics, otherwise they are written as usual.
+	HideStale bool
+}
+
+//family - metric family written last.
+type family struct {
+	name  string
+	id    string
+	mType string
+}
+
+//Write - write all metrics of storage to w.
+//Metrics of one ID are buffered and written ordered by type, so every family is
+//written at once. Metrics which names collide after sanitizing with an already
+//written metric of other ID or type are skipped, because a family must be written at once.
+func (e *Exporter) Write(ctx context.Context, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	written := make(map[string]family)
+	var group []models.Metrics
+	writeGroup := func() {
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].MType < group[j].MType
+		})
+		var last family
+		skip := false
+		for _, m := range group {
+			if m.ID != last.id || m.MType != last.mType {
+				last = family{name: SanitizeName(m.ID), id: m.ID, mType: m.MType}
+				prev, ok := written[last.name]
+				if skip = ok; skip {
+					fmt.Fprintf(bw, "# skipped %s %s: name collides with %s %s\n", m.MType, escapeHelp(m.ID), prev.mType, escapeHelp(prev.id))
+					continue
+				}
+				written[last.name] = last
+				e.writeHeader(bw, last)
+			}
+			if !skip {
+				writeSample(bw, last.name, m)
+			}
+		}
+		group = group[:0]
+	}
+	q := models.ListQuery{Limit: PageSize}
+	for {
+		page, err := e.Repo.List(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, m := range models.MarkStale(page.Metrics, time.Now(), e.StaleThreshold, e.HideStale) {
+			if len(group) > 0 && m.ID != group[0].ID {
+				writeGroup()
+			}
+			group = append(group, m)
+		}
+		if page.NextCursor == "" {
+			writeGroup()
+		}
+		if err = bw.Flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+func (e *Exporter) writeHeader(w *bufio.Writer, f family) {
+	if e.Metadata != nil {
+		if meta, ok := e.Metadata.Get(f.id); ok && meta.Help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(meta.Help))
+		}
+	}
+	mType := "untyped"
+	switch f.mType {
+	case "gauge":
+		mType = "gauge"
+	case "counter":
+		mType = "counter"
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, mType)
+}
+
+func writeSample(w *bufio.Writer, name string, m models.Metrics) {
+	w.WriteString(name)
+	labels := make([][2]string, 0, len(m.Labels)+2)
+	names := make(map[string]bool, len(m.Labels))
+	for k, v := range m.Labels {
+		k = strings.ReplaceAll(SanitizeName(k), ":", "_")
+		if names[k] {
+			continue
+		}
+		names[k] = true
+		labels = append(labels, [2]string{k, v})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i][0] < labels[j][0]
+	})
+	if m.Source != "" && !names["source"] {
+		labels = append(labels, [2]string{"source", m.Source})
+	}
+	if m.Host != "" && !names["host"] {
+		labels = append(labels, [2]string{"host", m.Host})
+	}
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l[0])
+			w.WriteString(`="`)
+			w.WriteString(labelEscaper.Replace(l[1]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(m))
+	w.WriteByte('\n')
+}
+
+func formatValue(m models.Metrics) string {
+	if m.MType == "counter" && m.Delta != nil {
+		return strconv.FormatInt(*m.Delta, 10)
+	}
+	value := m.Float()
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+//SanitizeName - convert metric ID to valid Prometheus metric name.
+//Characters other than letters, digits, '_' and ':' are replaced by '_',
+//name starting with digit gets '_' prefix.
+func SanitizeName(id string) string {
+	if id == "" {
+		return "_"
+	}
+	var sb strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			sb.WriteByte(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,168 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/MaximkaSha/log_tools/internal/metadata"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "Alloc", want: "Alloc"},
+		{id: "http.requests-total", want: "http_requests_total"},
+		{id: "ns:metric_1", want: "ns:metric_1"},
+		{id: "1st", want: "_1st"},
+		{id: "", want: "_"},
+		{id: "a b", want: "a_b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			assert.Equal(t, tt.want, SanitizeName(tt.id))
+		})
+	}
+}
+
+func TestExporter_Write(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []models.Metrics
+		want    string
+	}{
+		{
+			name: "positive types and help",
+			metrics: []models.Metrics{
+				counter("PollCount", "agent1", 5),
+				counter("PollCount", "agent2", 7),
+				gauge("Alloc", "agent1", 1.5),
+				gauge("CPUutilization2", "", 12),
+			},
+			want: `# HELP Alloc Bytes of allocated heap objects.
+# TYPE Alloc gauge
+Alloc{source="agent1",host="host-agent1"} 1.5
+# HELP CPUutilization2 Utilization of CPU 2 of agent host.
+# TYPE CPUutilization2 gauge
+CPUutilization2 12
+# HELP PollCount Number of times agent collected metrics.
+# TYPE PollCount counter
+PollCount{source="agent1",host="host-agent1"} 5
+PollCount{source="agent2",host="host-agent2"} 7
+`,
+		},
+		{
+			name: "positive sanitize and escape",
+			metrics: []models.Metrics{
+				gauge("disk.free", `a"b\c`, math.Inf(1)),
+				gauge("nan", "", math.NaN()),
+			},
+			want: `# TYPE disk_free gauge
+disk_free{source="a\"b\\c",host="host-a\"b\\c"} +Inf
+# TYPE nan gauge
+nan NaN
+`,
+		},
+		{
+			name: "positive labels",
+			metrics: []models.Metrics{
+				withLabels(gauge("node_cpu", "node1", 2), map[string]string{"mode": "user", "cpu": "0"}),
+				withLabels(gauge("node_cpu", "node1", 1), map[string]string{"mode": "idle", "cpu": "0", "host": "h1"}),
+			},
+			want: `# TYPE node_cpu gauge
+node_cpu{cpu="0",host="h1",mode="idle",source="node1"} 1
+node_cpu{cpu="0",mode="user",source="node1",host="host-node1"} 2
+`,
+		},
+		{
+			name: "positive collisions skipped",
+			metrics: []models.Metrics{
+				gauge("a.b", "", 1),
+				gauge("a_b", "", 2),
+				gauge("mixed", "agent1", 1),
+				counter("mixed", "agent2", 2),
+				gauge("mixed", "agent3", 3),
+			},
+			want: `# TYPE a_b gauge
+a_b 1
+# skipped gauge a_b: name collides with gauge a.b
+# TYPE mixed counter
+mixed{source="agent2",host="host-agent2"} 2
+# skipped gauge mixed: name collides with counter mixed
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewRepo()
+			require.NoError(t, repo.BatchInsert(context.TODO(), tt.metrics))
+			e := Exporter{Repo: &repo, Metadata: metadata.NewRegistry()}
+			var buf bytes.Buffer
+			require.NoError(t, e.Write(context.TODO(), &buf))
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestExporter_WritePages(t *testing.T) {
+	repo := storage.NewRepo()
+	var data []models.Metrics
+	for i := 0; i < PageSize+10; i++ {
+		data = append(data, gauge(fmt.Sprintf("m%04d", i), "", float64(i)))
+	}
+	require.NoError(t, repo.BatchInsert(context.TODO(), data))
+	e := Exporter{Repo: &repo}
+	var buf bytes.Buffer
+	require.NoError(t, e.Write(context.TODO(), &buf))
+	assert.Equal(t, PageSize+10, strings.Count(buf.String(), "# TYPE "))
+	assert.Contains(t, buf.String(), fmt.Sprintf("m%04d %d\n", PageSize+9, PageSize+9))
+}
+
+func TestExporter_WriteFamilyAcrossPages(t *testing.T) {
+	repo := storage.NewRepo()
+	var data []models.Metrics
+	for i := 0; i < PageSize+10; i++ {
+		if i%2 == 0 {
+			data = append(data, gauge("mixed", fmt.Sprintf("agent%04d", i), float64(i)))
+		} else {
+			data = append(data, counter("mixed", fmt.Sprintf("agent%04d", i), int64(i)))
+		}
+	}
+	require.NoError(t, repo.BatchInsert(context.TODO(), data))
+	e := Exporter{Repo: &repo}
+	var buf bytes.Buffer
+	require.NoError(t, e.Write(context.TODO(), &buf))
+	assert.Equal(t, 1, strings.Count(buf.String(), "# TYPE "))
+	assert.Equal(t, 1, strings.Count(buf.String(), "# skipped "))
+	assert.Equal(t, (PageSize+10)/2, strings.Count(buf.String(), "mixed{"))
+}
+
+func counter(id string, source string, delta int64) models.Metrics {
+	m := models.Metrics{ID: id, MType: "counter", Delta: &delta, Source: source}
+	if source != "" {
+		m.Host = "host-" + source
+	}
+	return m
+}
+
+func gauge(id string, source string, value float64) models.Metrics {
+	m := models.Metrics{ID: id, MType: "gauge", Value: &value, Source: source}
+	if source != "" {
+		m.Host = "host-" + source
+	}
+	return m
+}
+
+func withLabels(m models.Metrics, labels map[string]string) models.Metrics {
+	m.Labels = labels
+	return m
+}
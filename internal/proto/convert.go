@@ -0,0 +1,79 @@
+package proto
+
+import (
+	"strings"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//Metadata keys of requests.
+var (
+	//AgentIDKey - ID of agent which sends metrics.
+	AgentIDKey = strings.ToLower(models.AgentIDHeader)
+	//AgentHostKey - hostname of agent which sends metrics.
+	AgentHostKey = strings.ToLower(models.AgentHostHeader)
+	//IdempotencyKeyKey - idempotency key of UpdateBatch.
+	IdempotencyKeyKey = strings.ToLower(models.IdempotencyKeyHeader)
+)
+
+//ToModel - convert metric message to models.Metrics, nil message is empty metric.
+func (m *Metric) ToModel() models.Metrics {
+	if m == nil {
+		return models.Metrics{}
+	}
+	data := models.Metrics{
+		ID:     m.GetId(),
+		MType:  m.GetType(),
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Hash:   m.GetHash(),
+		Source: m.GetSource(),
+		Host:   m.GetHost(),
+	}
+	if len(m.GetLabels()) > 0 {
+		data.Labels = m.GetLabels()
+	}
+	if m.GetUpdatedAt() != nil {
+		t := m.GetUpdatedAt().AsTime()
+		data.UpdatedAt = &t
+	}
+	return data
+}
+
+//FromModel - convert models.Metrics to metric message.
+func FromModel(m models.Metrics) *Metric {
+	data := &Metric{
+		Id:     m.ID,
+		Type:   m.MType,
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Hash:   m.Hash,
+		Source: m.Source,
+		Host:   m.Host,
+		Labels: m.Labels,
+		Stale:  m.Stale,
+	}
+	if m.FirstSeen != nil {
+		data.FirstSeen = timestamppb.New(*m.FirstSeen)
+	}
+	if m.UpdatedAt != nil {
+		data.UpdatedAt = timestamppb.New(*m.UpdatedAt)
+	}
+	return data
+}
+
+//FromBatchResult - convert models.BatchResult to UpdateBatchResponse.
+func FromBatchResult(result models.BatchResult, replayed bool) *UpdateBatchResponse {
+	resp := &UpdateBatchResponse{
+		Key:      result.Key,
+		Accepted: int64(result.Accepted),
+		Rejected: int64(result.Rejected),
+		Replayed: replayed,
+		Items:    make([]*BatchItem, 0, len(result.Items)),
+	}
+	for _, item := range result.Items {
+		resp.Items = append(resp.Items, &BatchItem{Index: int64(item.Index), Id: item.ID, Status: item.Status, Reason: item.Reason})
+	}
+	return resp
+}
@@ -0,0 +1,126 @@
+//Package pubsub delivers metric change events from storage to subscribers.
+//
+//Every published change gets the next sequence number, and all subscribers
+//receive events in sequence order. Publishing never blocks the writer:
+//every subscriber has a bounded buffer, and if it is full when an event
+//arrives the event is dropped for that subscriber only and its Dropped
+//counter is incremented. Subscribers can detect lost events by a gap in Seq.
+package pubsub
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+)
+
+//DefaultBuffer - subscriber buffer size used when none is requested.
+const DefaultBuffer = 64
+
+//MaxBuffer - biggest subscriber buffer size.
+const MaxBuffer = 4096
+
+//Hub - publishes change events to subscribers.
+type Hub struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[*Subscription]struct{}
+}
+
+//NewHub - Hub constructor.
+func NewHub() *Hub {
+	return &Hub{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+//Subscription - models.Subscription of Hub.
+type Subscription struct {
+	hub     *Hub
+	pattern string
+	events  chan models.ChangeEvent
+	dropped uint64
+	closed  bool
+}
+
+//Subscribe - register subscriber for changes of metrics which ID matches pattern.
+//Pattern syntax is path.Match, empty pattern matches all metrics.
+//Size is buffer size, DefaultBuffer is used if it is not positive, it is limited by MaxBuffer.
+func (h *Hub) Subscribe(pattern string, size int) (models.Subscription, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		size = DefaultBuffer
+	}
+	if size > MaxBuffer {
+		size = MaxBuffer
+	}
+	sub := &Subscription{
+		hub:     h,
+		pattern: pattern,
+		events:  make(chan models.ChangeEvent, size),
+	}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub, nil
+}
+
+//HasSubscribers - return true if anybody is subscribed.
+//Writers use it to skip preparing events nobody reads.
+func (h *Hub) HasSubscribers() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+//Publish - send change of metric to subscribers.
+//Old is nil if metric was created.
+func (h *Hub) Publish(old *models.Metrics, new models.Metrics) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	event := models.ChangeEvent{Seq: h.seq, Old: old, New: new}
+	for sub := range h.subs {
+		if !sub.matches(new.ID) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (s *Subscription) matches(id string) bool {
+	if s.pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(s.pattern, id)
+	return ok
+}
+
+//Events - return channel of change events, it is closed by Close.
+func (s *Subscription) Events() <-chan models.ChangeEvent {
+	return s.events
+}
+
+//Dropped - return number of events dropped because buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+//Close - unregister subscriber and close its channel.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(s.hub.subs, s)
+	close(s.events)
+}
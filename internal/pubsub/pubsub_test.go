@@ -0,0 +1,75 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub_Publish(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		size        int
+		publish     []string
+		wantIDs     []string
+		wantSeq     []uint64
+		wantDropped uint64
+	}{
+		{
+			name:    "positive all",
+			publish: []string{"Alloc", "PollCount", "Alloc"},
+			wantIDs: []string{"Alloc", "PollCount", "Alloc"},
+			wantSeq: []uint64{1, 2, 3},
+		},
+		{
+			name:    "positive pattern",
+			pattern: "CPU*",
+			publish: []string{"CPUutilization1", "Alloc", "CPUutilization2"},
+			wantIDs: []string{"CPUutilization1", "CPUutilization2"},
+			wantSeq: []uint64{1, 3},
+		},
+		{
+			name:        "positive overflow drops newest",
+			size:        2,
+			publish:     []string{"A", "B", "C", "D"},
+			wantIDs:     []string{"A", "B"},
+			wantSeq:     []uint64{1, 2},
+			wantDropped: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			sub, err := hub.Subscribe(tt.pattern, tt.size)
+			require.NoError(t, err)
+			for _, id := range tt.publish {
+				hub.Publish(nil, models.Metrics{ID: id})
+			}
+			sub.Close()
+			var ids []string
+			var seq []uint64
+			for event := range sub.Events() {
+				ids = append(ids, event.New.ID)
+				seq = append(seq, event.Seq)
+			}
+			assert.Equal(t, tt.wantIDs, ids)
+			assert.Equal(t, tt.wantSeq, seq)
+			assert.Equal(t, tt.wantDropped, sub.Dropped())
+			assert.False(t, hub.HasSubscribers())
+		})
+	}
+}
+
+func TestHub_Subscribe(t *testing.T) {
+	hub := NewHub()
+	_, err := hub.Subscribe("[", 0)
+	assert.Error(t, err)
+	sub, err := hub.Subscribe("", MaxBuffer*2)
+	require.NoError(t, err)
+	assert.Equal(t, MaxBuffer, cap(sub.(*Subscription).events))
+	sub.Close()
+	sub.Close()
+}
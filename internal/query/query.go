@@ -0,0 +1,164 @@
+//Package query aggregates metrics across series, sources and hosts.
+//
+//Query selects metrics with filters of models.ListQuery, optionally splits them
+//into groups by source, host, ID, type or label and reduces every group with
+//aggregation. Counter value is its stored sum, gauge value is its last value.
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+)
+
+//Aggregations of query, sum, avg, min and max are models aggregations.
+const (
+	//AggCount - number of series.
+	AggCount = "count"
+	//AggTopK - K series with the biggest values.
+	AggTopK = "topk"
+)
+
+//Group keys which are metric fields, other keys are label names.
+const (
+	BySource = "source"
+	ByHost   = "host"
+	ByID     = "id"
+	ByType   = "type"
+)
+
+//Query - selector, aggregation and grouping of metrics.
+type Query struct {
+	//Filter - selects metrics, its sort and page are ignored.
+	Filter models.ListQuery
+	//Agg - sum, avg, min, max, count or topk.
+	Agg string
+	//K - number of series of topk.
+	K int
+	//By - group keys: BySource, ByHost, ByID, ByType or label name. All metrics are one group if it is empty.
+	By []string
+}
+
+//Group - aggregated group of series.
+type Group struct {
+	//Labels - values of group keys, series without label have empty value.
+	Labels map[string]string `json:"labels,omitempty"`
+	//Value - result of aggregation, it is not set for topk.
+	Value *float64 `json:"value,omitempty"`
+	//Count - number of series in group.
+	Count int `json:"count"`
+	//Series - series of topk ordered by value from the biggest.
+	Series []models.Metrics `json:"series,omitempty"`
+}
+
+//Result - groups of query ordered by their labels.
+type Result struct {
+	//Agg - aggregation of query.
+	Agg string `json:"agg"`
+	//Groups - aggregated groups, empty if no metric is selected.
+	Groups []Group `json:"groups"`
+}
+
+//IsAggregation - return true if agg is known query aggregation.
+func IsAggregation(agg string) bool {
+	return models.IsAggregation(agg) || agg == AggCount || agg == AggTopK
+}
+
+//Prepare - check query and prepare its filter. It must be called before Eval.
+func (q *Query) Prepare() error {
+	if !IsAggregation(q.Agg) {
+		return fmt.Errorf("unknown aggregation %q", q.Agg)
+	}
+	if q.Agg == AggTopK && q.K <= 0 {
+		return errors.New("topk needs positive k")
+	}
+	if q.Agg != AggTopK && q.K != 0 {
+		return errors.New("k is only used by topk")
+	}
+	seen := make(map[string]bool)
+	for _, key := range q.By {
+		if key == "" || seen[key] {
+			return fmt.Errorf("group key %q is empty or repeated", key)
+		}
+		seen[key] = true
+	}
+	q.Filter.Cursor = ""
+	q.Filter.Limit = 0
+	return q.Filter.Prepare()
+}
+
+//Eval - aggregate metrics of data which pass filter of prepared query.
+func (q *Query) Eval(data []models.Metrics) Result {
+	var order []string
+	groups := make(map[string][]models.Metrics)
+	labels := make(map[string]map[string]string)
+	for _, m := range data {
+		if !q.Filter.Match(m) || (m.Value == nil && m.Delta == nil) {
+			continue
+		}
+		key, groupLabels := q.groupOf(m)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+			labels[key] = groupLabels
+		}
+		groups[key] = append(groups[key], m)
+	}
+	sort.Strings(order)
+	result := Result{Agg: q.Agg, Groups: make([]Group, 0, len(order))}
+	for _, key := range order {
+		result.Groups = append(result.Groups, q.reduce(labels[key], groups[key]))
+	}
+	return result
+}
+
+//groupOf - return key and labels of group of metric.
+func (q *Query) groupOf(m models.Metrics) (string, map[string]string) {
+	if len(q.By) == 0 {
+		return "", nil
+	}
+	labels := make(map[string]string, len(q.By))
+	values := make([]string, len(q.By))
+	for i, key := range q.By {
+		switch key {
+		case BySource:
+			values[i] = m.Source
+		case ByHost:
+			values[i] = m.Host
+		case ByID:
+			values[i] = m.ID
+		case ByType:
+			values[i] = m.MType
+		default:
+			values[i] = m.Labels[key]
+		}
+		labels[key] = values[i]
+	}
+	return strings.Join(values, "\x00"), labels
+}
+
+//reduce - aggregate series of one group.
+func (q *Query) reduce(labels map[string]string, series []models.Metrics) Group {
+	g := Group{Labels: labels, Count: len(series)}
+	if q.Agg == AggTopK {
+		sorted := append([]models.Metrics{}, series...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Float() > sorted[j].Float() })
+		if len(sorted) > q.K {
+			sorted = sorted[:q.K]
+		}
+		g.Series = sorted
+		return g
+	}
+	value := float64(len(series))
+	if q.Agg != AggCount {
+		values := make([]float64, len(series))
+		for i, m := range series {
+			values[i] = m.Float()
+		}
+		value = models.Aggregate(values, q.Agg)
+	}
+	g.Value = &value
+	return g
+}
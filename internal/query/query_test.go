@@ -0,0 +1,129 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, source string, dc string, v float64) models.Metrics {
+	m := models.Metrics{ID: id, MType: "gauge", Value: &v, Source: source, Host: source + ".local"}
+	if dc != "" {
+		m.Labels = map[string]string{"dc": dc}
+	}
+	return m
+}
+
+func TestQuery_Eval(t *testing.T) {
+	var delta int64 = 10
+	data := []models.Metrics{
+		gauge("CPUutilization1", "agent-1", "eu", 20),
+		gauge("CPUutilization2", "agent-1", "eu", 40),
+		gauge("CPUutilization1", "agent-2", "us", 60),
+		gauge("CPUutilization1", "agent-3", "", 5),
+		gauge("HeapAlloc", "agent-1", "eu", 100),
+		{ID: "PollCount", MType: "counter", Delta: &delta, Source: "agent-1"},
+	}
+	tests := []struct {
+		name       string
+		query      Query
+		wantLabels []map[string]string
+		wantValues []float64
+		wantCounts []int
+		wantSeries [][]string
+	}{
+		{
+			name:       "positive sum",
+			query:      Query{Filter: models.ListQuery{Glob: "CPUutilization*"}, Agg: models.AggSum},
+			wantLabels: []map[string]string{nil},
+			wantValues: []float64{125},
+			wantCounts: []int{4},
+		},
+		{
+			name:       "positive avg by source",
+			query:      Query{Filter: models.ListQuery{Prefix: "CPU"}, Agg: models.AggAvg, By: []string{BySource}},
+			wantLabels: []map[string]string{{"source": "agent-1"}, {"source": "agent-2"}, {"source": "agent-3"}},
+			wantValues: []float64{30, 60, 5},
+			wantCounts: []int{2, 1, 1},
+		},
+		{
+			name:       "positive max by label",
+			query:      Query{Filter: models.ListQuery{Type: "gauge"}, Agg: models.AggMax, By: []string{"dc"}},
+			wantLabels: []map[string]string{{"dc": ""}, {"dc": "eu"}, {"dc": "us"}},
+			wantValues: []float64{5, 100, 60},
+			wantCounts: []int{1, 3, 1},
+		},
+		{
+			name:       "positive min by id and type",
+			query:      Query{Filter: models.ListQuery{Regex: "^CPUutilization1$"}, Agg: models.AggMin, By: []string{ByID, ByType}},
+			wantLabels: []map[string]string{{"id": "CPUutilization1", "type": "gauge"}},
+			wantValues: []float64{5},
+			wantCounts: []int{3},
+		},
+		{
+			name:       "positive count with counter",
+			query:      Query{Filter: models.ListQuery{Source: "agent-1"}, Agg: AggCount, By: []string{ByType}},
+			wantLabels: []map[string]string{{"type": "counter"}, {"type": "gauge"}},
+			wantValues: []float64{1, 3},
+			wantCounts: []int{1, 3},
+		},
+		{
+			name:       "positive topk by host",
+			query:      Query{Filter: models.ListQuery{Type: "gauge"}, Agg: AggTopK, K: 2, By: []string{ByHost}},
+			wantLabels: []map[string]string{{"host": "agent-1.local"}, {"host": "agent-2.local"}, {"host": "agent-3.local"}},
+			wantCounts: []int{3, 1, 1},
+			wantSeries: [][]string{{"HeapAlloc", "CPUutilization2"}, {"CPUutilization1"}, {"CPUutilization1"}},
+		},
+		{
+			name:  "positive nothing selected",
+			query: Query{Filter: models.ListQuery{Prefix: "Unknown"}, Agg: models.AggSum},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.query.Prepare())
+			result := tt.query.Eval(data)
+			assert.Equal(t, tt.query.Agg, result.Agg)
+			require.NotNil(t, result.Groups)
+			require.Len(t, result.Groups, len(tt.wantCounts))
+			for k, g := range result.Groups {
+				assert.Equal(t, tt.wantLabels[k], g.Labels)
+				assert.Equal(t, tt.wantCounts[k], g.Count)
+				if tt.wantSeries != nil {
+					assert.Nil(t, g.Value)
+					var ids []string
+					for _, m := range g.Series {
+						ids = append(ids, m.ID)
+					}
+					assert.Equal(t, tt.wantSeries[k], ids)
+					continue
+				}
+				require.NotNil(t, g.Value)
+				assert.Equal(t, tt.wantValues[k], *g.Value)
+			}
+		})
+	}
+}
+
+func TestQuery_Prepare(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   Query
+		wantErr bool
+	}{
+		{name: "positive topk", query: Query{Agg: AggTopK, K: 3, By: []string{BySource, "dc"}}},
+		{name: "negative unknown aggregation", query: Query{Agg: "median"}, wantErr: true},
+		{name: "negative topk without k", query: Query{Agg: AggTopK}, wantErr: true},
+		{name: "negative k without topk", query: Query{Agg: models.AggSum, K: 1}, wantErr: true},
+		{name: "negative repeated group key", query: Query{Agg: AggCount, By: []string{"dc", "dc"}}, wantErr: true},
+		{name: "negative bad regex", query: Query{Agg: AggCount, Filter: models.ListQuery{Regex: "("}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.query.Prepare()
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
@@ -0,0 +1,350 @@
+//Package ratelimit limits requests of every client with token bucket.
+//
+//Client is identified by its IP, agent ID with IP or known API key. Every client
+//has bucket of Burst tokens which is refilled with Rate tokens per second, request
+//takes one token. Request which finds bucket empty gets 429 with Retry-After header.
+//Limits of single clients may be overridden. Buckets of idle clients are full
+//again, so they are forgotten. Number of buckets is limited by MaxClients, new
+//clients over it share bucket of their IP, so rotating headers does not give
+//more requests.
+//
+//Handler limits HTTP requests, AllowClient is used by other servers: gRPC
+//server takes token for every call and every streamed message.
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+)
+
+//Client keys.
+const (
+	//KeyIP - client is IP of request.
+	KeyIP = "ip"
+	//KeyAgent - client is agent ID header together with IP, IP if request has no agent ID.
+	KeyAgent = "agent"
+	//KeyAPIKey - client is API key header, IP if request has no API key or key is unknown.
+	KeyAPIKey = "apikey"
+)
+
+//DefaultMaxClients - default number of buckets kept at once.
+const DefaultMaxClients = 10000
+
+//overflowClient - bucket shared by new clients when MaxClients buckets are kept.
+const overflowClient = "overflow"
+
+//DefaultAPIKeyHeader - default header of API key.
+const DefaultAPIKeyHeader = "X-API-Key"
+
+//sweepInterval - how often buckets of idle clients are forgotten.
+const sweepInterval = time.Minute
+
+//Limit - rate and burst of token bucket.
+type Limit struct {
+	//Rate - tokens added per second.
+	Rate float64 `json:"rate"`
+	//Burst - size of bucket.
+	Burst int `json:"burst"`
+}
+
+//Validate - return error if limit is not positive.
+func (l Limit) Validate() error {
+	if l.Rate <= 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) || l.Burst < 1 {
+		return errors.New("rate must be positive and burst must be at least 1")
+	}
+	return nil
+}
+
+//ParseOverrides - parse limits of clients like "agent-1=50/100;10.0.0.5=1/5", every entry is client=rate/burst.
+func ParseOverrides(entries []string) (map[string]Limit, error) {
+	result := make(map[string]Limit)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		client, limit, ok := strings.Cut(entry, "=")
+		rate, burst, ok2 := strings.Cut(limit, "/")
+		if !ok || !ok2 || client == "" {
+			return nil, fmt.Errorf("bad rate limit override %q", entry)
+		}
+		var l Limit
+		var err error
+		if l.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+			return nil, fmt.Errorf("bad rate limit override %q", entry)
+		}
+		if l.Burst, err = strconv.Atoi(burst); err != nil {
+			return nil, fmt.Errorf("bad rate limit override %q", entry)
+		}
+		if err = l.Validate(); err != nil {
+			return nil, fmt.Errorf("bad rate limit override %q: %w", entry, err)
+		}
+		result[client] = l
+	}
+	return result, nil
+}
+
+//ParseAPIKeys - return set of API keys, entries are trimmed and empty ones are skipped.
+func ParseAPIKeys(entries []string) map[string]bool {
+	result := make(map[string]bool)
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result[entry] = true
+		}
+	}
+	return result
+}
+
+//bucket - token bucket of one client.
+type bucket struct {
+	limit    Limit
+	tokens   float64
+	updated  time.Time
+	lastSeen time.Time
+	allowed  uint64
+	rejected uint64
+}
+
+//refill - add tokens for time passed since last update.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+	b.updated = now
+}
+
+//ClientStats - state of bucket of one client.
+type ClientStats struct {
+	//Client - client key with kind prefix, API keys are hashed, agents have their IP after "@".
+	Client string `json:"client"`
+	Limit
+	//Tokens - tokens left in bucket.
+	Tokens float64 `json:"tokens"`
+	//Allowed - number of allowed requests.
+	Allowed uint64 `json:"allowed"`
+	//Rejected - number of rejected requests.
+	Rejected uint64 `json:"rejected"`
+	//LastSeen - time of last request.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+//Stats - state of Limiter.
+type Stats struct {
+	//Key - KeyIP, KeyAgent or KeyAPIKey.
+	Key string `json:"key"`
+	//Default - limit of clients without override.
+	Default Limit `json:"default"`
+	//Allowed - number of allowed requests of all clients since start.
+	Allowed uint64 `json:"allowed"`
+	//Rejected - number of rejected requests of all clients since start.
+	Rejected uint64 `json:"rejected"`
+	//Clients - buckets of clients seen recently, the most rejected first.
+	Clients []ClientStats `json:"clients"`
+}
+
+//Limiter - token bucket limiter of clients. It is safe for concurrent use.
+type Limiter struct {
+	//APIKeyHeader - header of API key of KeyAPIKey.
+	APIKeyHeader string
+	//TrustProxy - use X-Real-IP or the first X-Forwarded-For address as client IP.
+	TrustProxy bool
+	//APIKeys - known API keys of KeyAPIKey, keys of overrides are known too.
+	//Requests with unknown keys are limited by IP.
+	APIKeys map[string]bool
+	//MaxClients - most buckets kept at once, 0 for no limit. One of them is kept for overflow
+	//bucket, new clients over the rest share bucket of their IP, or overflow bucket if their IP has none.
+	MaxClients int
+
+	key       string
+	limit     Limit
+	overrides map[string]Limit
+	now       func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	allowed   uint64
+	rejected  uint64
+	lastSweep time.Time
+}
+
+//NewLimiter - Limiter constructor. Overrides are limits by client IP, agent ID or API key, they may be nil.
+func NewLimiter(key string, limit Limit, overrides map[string]Limit) (*Limiter, error) {
+	if key != KeyIP && key != KeyAgent && key != KeyAPIKey {
+		return nil, fmt.Errorf("unknown rate limit key %q", key)
+	}
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+	return &Limiter{
+		APIKeyHeader: DefaultAPIKeyHeader,
+		MaxClients:   DefaultMaxClients,
+		key:          key,
+		limit:        limit,
+		overrides:    overrides,
+		now:          time.Now,
+		buckets:      make(map[string]*bucket),
+	}, nil
+}
+
+//Handler - middleware which rejects requests over limit with 429 and Retry-After header.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := l.Allow(r)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "Too many requests!", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Allow - take token of request client. If bucket is empty it returns false and time until next token.
+func (l *Limiter) Allow(r *http.Request) (bool, time.Duration) {
+	return l.take(l.clientOf(l.ipOf(r), r.Header.Get(models.AgentIDHeader), r.Header.Get(l.APIKeyHeader)))
+}
+
+//AllowClient - take token of client which is not HTTP request, like gRPC call, by its IP, agent ID and API key.
+//Agent ID and API key may be empty, they are used as request headers of Allow.
+func (l *Limiter) AllowClient(ip string, agent string, apiKey string) (bool, time.Duration) {
+	return l.take(l.clientOf(ip, agent, apiKey))
+}
+
+//take - take token of client bucket, id is key of overrides.
+func (l *Limiter) take(client string, id string, ip string) (bool, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now, false)
+	b, ok := l.buckets[client]
+	if !ok && l.full() {
+		l.sweep(now, true)
+		if l.full() {
+			client, id = KeyIP+":"+ip, ip
+			if b, ok = l.buckets[client]; !ok {
+				client, id = overflowClient, ""
+				b, ok = l.buckets[client]
+			}
+		}
+	}
+	if !ok {
+		limit, ok := l.overrides[id]
+		if !ok {
+			limit = l.limit
+		}
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+		l.buckets[client] = b
+	}
+	b.refill(now)
+	b.lastSeen = now
+	if b.tokens < 1 {
+		b.rejected++
+		l.rejected++
+		return false, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	b.allowed++
+	l.allowed++
+	return true, 0
+}
+
+//full - return true if there is no room for bucket of new client.
+//One bucket of MaxClients is kept for overflowClient, so number of buckets never exceeds MaxClients.
+//l.mu must be locked.
+func (l *Limiter) full() bool {
+	if l.MaxClients <= 0 {
+		return false
+	}
+	clients := len(l.buckets)
+	if _, ok := l.buckets[overflowClient]; ok {
+		clients--
+	}
+	return clients >= l.MaxClients-1
+}
+
+//sweep - forget buckets which are full again, once per sweepInterval unless force is true.
+//l.mu must be locked.
+func (l *Limiter) sweep(now time.Time, force bool) {
+	if !force && now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+//clientOf - return bucket key of client, client ID overrides are looked up by and client IP.
+//Agent ID is bound to IP, so agent can not get new bucket by changing its ID only.
+func (l *Limiter) clientOf(ip string, agent string, apiKey string) (string, string, string) {
+	switch l.key {
+	case KeyAgent:
+		if agent != "" {
+			return KeyAgent + ":" + agent + "@" + ip, agent, ip
+		}
+	case KeyAPIKey:
+		if apiKey != "" && l.knownAPIKey(apiKey) {
+			sum := sha256.Sum256([]byte(apiKey))
+			return KeyAPIKey + ":" + hex.EncodeToString(sum[:8]), apiKey, ip
+		}
+	}
+	return KeyIP + ":" + ip, ip, ip
+}
+
+//knownAPIKey - return true if key is in APIKeys or overrides.
+func (l *Limiter) knownAPIKey(key string) bool {
+	if l.APIKeys[key] {
+		return true
+	}
+	_, ok := l.overrides[key]
+	return ok
+}
+
+//ipOf - return client IP of request.
+func (l *Limiter) ipOf(r *http.Request) string {
+	if l.TrustProxy {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ip, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//Stats - return state of limiter.
+func (l *Limiter) Stats() Stats {
+	now := l.now()
+	l.mu.Lock()
+	stats := Stats{Key: l.key, Default: l.limit, Allowed: l.allowed, Rejected: l.rejected, Clients: make([]ClientStats, 0, len(l.buckets))}
+	for client, b := range l.buckets {
+		b.refill(now)
+		stats.Clients = append(stats.Clients, ClientStats{Client: client, Limit: b.limit, Tokens: b.tokens, Allowed: b.allowed, Rejected: b.rejected, LastSeen: b.lastSeen})
+	}
+	l.mu.Unlock()
+	sort.Slice(stats.Clients, func(i, j int) bool {
+		if stats.Clients[i].Rejected != stats.Clients[j].Rejected {
+			return stats.Clients[i].Rejected > stats.Clients[j].Rejected
+		}
+		return stats.Clients[i].Client < stats.Clients[j].Client
+	})
+	return stats
+}
@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string]Limit
+		wantErr bool
+	}{
+		{name: "positive", entries: []string{"agent-1=50/100", " 10.0.0.5=0.5/1 ", ""}, want: map[string]Limit{"agent-1": {Rate: 50, Burst: 100}, "10.0.0.5": {Rate: 0.5, Burst: 1}}},
+		{name: "positive empty", want: map[string]Limit{}},
+		{name: "negative no burst", entries: []string{"agent-1=50"}, wantErr: true},
+		{name: "negative no client", entries: []string{"=50/100"}, wantErr: true},
+		{name: "negative zero rate", entries: []string{"agent-1=0/100"}, wantErr: true},
+		{name: "negative zero burst", entries: []string{"agent-1=1/0"}, wantErr: true},
+		{name: "negative bad rate", entries: []string{"agent-1=x/1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOverrides(tt.entries)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLimiter_Handler(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		trustProxy bool
+		maxClients int
+		headers    []map[string]string
+		want       []int
+	}{
+		{
+			name:    "positive ip",
+			key:     KeyIP,
+			headers: []map[string]string{{}, {}, {}},
+			want:    []int{200, 200, 429},
+		},
+		{
+			name:    "positive agents have own buckets",
+			key:     KeyAgent,
+			headers: []map[string]string{{models.AgentIDHeader: "a"}, {models.AgentIDHeader: "a"}, {models.AgentIDHeader: "b"}, {models.AgentIDHeader: "a"}},
+			want:    []int{200, 200, 200, 429},
+		},
+		{
+			name:    "positive agent override",
+			key:     KeyAgent,
+			headers: []map[string]string{{models.AgentIDHeader: "big"}, {models.AgentIDHeader: "big"}, {models.AgentIDHeader: "big"}},
+			want:    []int{200, 200, 200},
+		},
+		{
+			name:    "positive api key without key falls back to ip",
+			key:     KeyAPIKey,
+			headers: []map[string]string{{DefaultAPIKeyHeader: "k1"}, {DefaultAPIKeyHeader: "k1"}, {}, {}, {DefaultAPIKeyHeader: "k1"}},
+			want:    []int{200, 200, 200, 200, 429},
+		},
+		{
+			name:    "negative unknown api key falls back to ip",
+			key:     KeyAPIKey,
+			headers: []map[string]string{{DefaultAPIKeyHeader: "x1"}, {DefaultAPIKeyHeader: "x2"}, {DefaultAPIKeyHeader: "x3"}},
+			want:    []int{200, 200, 429},
+		},
+		{
+			name:       "positive agents are bound to ip",
+			key:        KeyAgent,
+			trustProxy: true,
+			headers:    []map[string]string{{models.AgentIDHeader: "a"}, {models.AgentIDHeader: "a", "X-Forwarded-For": "10.0.0.9"}, {models.AgentIDHeader: "a"}, {models.AgentIDHeader: "a"}},
+			want:       []int{200, 200, 200, 429},
+		},
+		{
+			name:       "negative new agents over max clients share ip bucket",
+			key:        KeyAgent,
+			maxClients: 3,
+			headers:    []map[string]string{{}, {models.AgentIDHeader: "a"}, {models.AgentIDHeader: "b"}, {models.AgentIDHeader: "c"}},
+			want:       []int{200, 200, 200, 429},
+		},
+		{
+			name:       "negative new agents over max clients share overflow bucket",
+			key:        KeyAgent,
+			maxClients: 2,
+			headers:    []map[string]string{{models.AgentIDHeader: "a"}, {models.AgentIDHeader: "b"}, {models.AgentIDHeader: "c"}, {models.AgentIDHeader: "d"}},
+			want:       []int{200, 200, 200, 429},
+		},
+		{
+			name:       "positive trusted proxy",
+			key:        KeyIP,
+			trustProxy: true,
+			headers:    []map[string]string{{"X-Forwarded-For": "10.0.0.1, 10.0.0.2"}, {"X-Real-IP": "10.0.0.1"}, {"X-Forwarded-For": "10.0.0.3"}, {"X-Forwarded-For": "10.0.0.1"}},
+			want:       []int{200, 200, 200, 429},
+		},
+		{
+			name:    "negative proxy headers are ignored",
+			key:     KeyIP,
+			headers: []map[string]string{{"X-Forwarded-For": "10.0.0.1"}, {"X-Forwarded-For": "10.0.0.2"}, {"X-Forwarded-For": "10.0.0.3"}},
+			want:    []int{200, 200, 429},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLimiter(tt.key, Limit{Rate: 0.5, Burst: 2}, map[string]Limit{"big": {Rate: 1, Burst: 10}})
+			require.NoError(t, err)
+			now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+			l.now = func() time.Time { return now }
+			l.TrustProxy = tt.trustProxy
+			l.APIKeys = ParseAPIKeys([]string{"k1"})
+			if tt.maxClients > 0 {
+				l.MaxClients = tt.maxClients
+			}
+			handler := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for i, headers := range tt.headers {
+				request := httptest.NewRequest(http.MethodPost, "/update/", nil)
+				for key, value := range headers {
+					request.Header.Set(key, value)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, request)
+				require.Equal(t, tt.want[i], w.Code, "request %d", i)
+				if tt.maxClients > 0 {
+					assert.LessOrEqual(t, len(l.buckets), tt.maxClients)
+				}
+				if w.Code == 429 {
+					assert.Equal(t, "2", w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestLimiter_Refill(t *testing.T) {
+	l, err := NewLimiter(KeyIP, Limit{Rate: 2, Burst: 1}, nil)
+	require.NoError(t, err)
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	ok, _ := l.Allow(request)
+	assert.True(t, ok)
+	ok, retryAfter := l.Allow(request)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow(request)
+	assert.True(t, ok)
+
+	stats := l.Stats()
+	assert.Equal(t, uint64(2), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	require.Len(t, stats.Clients, 1)
+	assert.Equal(t, "ip:192.0.2.1", stats.Clients[0].Client)
+	assert.Equal(t, uint64(1), stats.Clients[0].Rejected)
+	assert.Equal(t, now, stats.Clients[0].LastSeen)
+
+	now = now.Add(sweepInterval)
+	request.RemoteAddr = "192.0.2.2:1234"
+	ok, _ = l.Allow(request)
+	assert.True(t, ok)
+	stats = l.Stats()
+	require.Len(t, stats.Clients, 1, "idle client is forgotten")
+	assert.Equal(t, "ip:192.0.2.2", stats.Clients[0].Client)
+	assert.Equal(t, uint64(1), stats.Rejected)
+}
+
+func TestNewLimiter(t *testing.T) {
+	_, err := NewLimiter("cookie", Limit{Rate: 1, Burst: 1}, nil)
+	assert.Error(t, err)
+	_, err = NewLimiter(KeyIP, Limit{Rate: 1}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,347 @@
+//Package rates tracks reported counter sequences per source and derives rates from them.
+//
+//Most counters are written as increments, like /update/counter/X/1 or StatsD
+//flushes, and their increase is the sum of increments. Counters listed in
+//Tracker.Cumulative are reported by a source as a cumulative sequence, the way
+//the agent sends PollCount. A value lower than the previous one means the
+//source was restarted (counter reset): the new value is counted from zero.
+//Storage stores such counters as their increments, so stored totals do not
+//jump and increases and rates stay correct across agent restarts.
+package rates
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+)
+
+//Sample - single counter observation.
+type Sample struct {
+	//Time - moment the value was received.
+	Time time.Time `json:"time"`
+	//Value - reported counter value.
+	Value int64 `json:"value"`
+	//Increase - increase of counter since previous sample.
+	Increase int64 `json:"increase"`
+	//Reset - cumulative counter was reset before the sample.
+	Reset bool `json:"reset,omitempty"`
+}
+
+//Rate - values derived from counter samples of one source over a window.
+type Rate struct {
+	//ID - counter name.
+	ID string `json:"id"`
+	//Source - who reported the counter.
+	Source string `json:"source"`
+	//Window - window the values are computed over.
+	Window string `json:"window"`
+	//Increase - counter increase over the window, resets are compensated.
+	Increase int64 `json:"increase"`
+	//PerSecond - average per-second rate over the window.
+	PerSecond float64 `json:"rate"`
+	//Resets - number of counter resets detected in the window.
+	Resets int `json:"resets"`
+	//Samples - number of samples in the window.
+	Samples int `json:"samples"`
+	//Last - last reported value.
+	Last int64 `json:"last"`
+}
+
+type seriesKey struct {
+	source string
+	id     string
+}
+
+//DefaultCumulative - IDs of counters which sources report as cumulative values by default.
+var DefaultCumulative = []string{"PollCount"}
+
+//Tracker keeps recent counter samples per source and metric.
+type Tracker struct {
+	//Cumulative - IDs of counters which sources report as cumulative values,
+	//other counters are increments. It must not be changed after the first Observe.
+	Cumulative map[string]bool
+
+	mu        sync.RWMutex
+	retention time.Duration
+	series    map[seriesKey][]Sample
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+//NewTracker - Tracker constructor.
+//Samples older than retention are dropped, so it is the longest window available for queries.
+func NewTracker(retention time.Duration) *Tracker {
+	cumulative := make(map[string]bool)
+	for _, id := range DefaultCumulative {
+		cumulative[id] = true
+	}
+	return &Tracker{
+		Cumulative: cumulative,
+		retention:  retention,
+		series:     make(map[seriesKey][]Sample),
+		now:        time.Now,
+	}
+}
+
+//Retention - return the longest window the tracker can answer for.
+func (t *Tracker) Retention() time.Duration {
+	return t.retention
+}
+
+//Observe - record counter value reported by source and return its increase.
+func (t *Tracker) Observe(source string, id string, value int64) int64 {
+	now := t.now()
+	key := seriesKey{source: source, id: id}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	samples := t.series[key]
+	sample := Sample{Time: now, Value: value}
+	sample.Increase, sample.Reset = increase(t.Cumulative[id], lastOf(samples), value)
+	t.series[key] = prune(append(samples, sample), now.Add(-t.retention))
+	t.sweep(now)
+	return sample.Increase
+}
+
+//Last - return last value reported by source, ok is false if there is none within retention.
+func (t *Tracker) Last(source string, id string) (value int64, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if last := lastOf(t.series[seriesKey{source: source, id: id}]); last != nil {
+		return *last, true
+	}
+	return 0, false
+}
+
+//lastOf - return pointer to last value of samples, nil if there are no samples.
+func lastOf(samples []Sample) *int64 {
+	if len(samples) == 0 {
+		return nil
+	}
+	return &samples[len(samples)-1].Value
+}
+
+//increase - return increase counter value means after last value, last is nil for the first value.
+//Increment is increase itself, cumulative value is compared with last one and lower value is reset.
+func increase(cumulative bool, last *int64, value int64) (int64, bool) {
+	if !cumulative || last == nil {
+		return value, false
+	}
+	if value < *last {
+		return value, true
+	}
+	return value - *last, false
+}
+
+//sweep - forget series which samples are all older than retention, once per retention.
+//t.mu must be locked.
+func (t *Tracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.retention {
+		return
+	}
+	t.lastSweep = now
+	from := now.Add(-t.retention)
+	for key, samples := range t.series {
+		if samples = prune(samples, from); len(samples) == 0 {
+			delete(t.series, key)
+		} else {
+			t.series[key] = samples
+		}
+	}
+}
+
+//Rates - compute rates over window for all tracked counters.
+//Empty id or source means any.
+func (t *Tracker) Rates(id string, source string, window time.Duration) []Rate {
+	if window <= 0 || window > t.retention {
+		window = t.retention
+	}
+	from := t.now().Add(-window)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := []Rate{}
+	for key, samples := range t.series {
+		if (id != "" && key.id != id) || (source != "" && key.source != source) {
+			continue
+		}
+		inWindow := prune(samples, from)
+		if len(inWindow) == 0 {
+			continue
+		}
+		rate := compute(inWindow)
+		rate.ID = key.id
+		rate.Source = key.source
+		rate.Window = window.String()
+		result = append(result, rate)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Source < result[j].Source
+	})
+	return result
+}
+
+//prune - drop samples older than from. Samples are sorted by time.
+func prune(samples []Sample, from time.Time) []Sample {
+	i := sort.Search(len(samples), func(i int) bool {
+		return !samples[i].Time.Before(from)
+	})
+	return samples[i:]
+}
+
+//compute - return rate of samples, increase of the first sample is before window.
+func compute(samples []Sample) Rate {
+	var rate Rate
+	rate.Samples = len(samples)
+	rate.Last = samples[len(samples)-1].Value
+	for _, sample := range samples[1:] {
+		rate.Increase += sample.Increase
+		if sample.Reset {
+			rate.Resets++
+		}
+	}
+	elapsed := samples[len(samples)-1].Time.Sub(samples[0].Time).Seconds()
+	if elapsed > 0 {
+		rate.PerSecond = float64(rate.Increase) / elapsed
+	}
+	return rate
+}
+
+type sourceKey struct{}
+
+//WithSource - return context which carries source of written metrics.
+//It is used for metrics which have no Source set.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+//SourceFromContext - return source stored by WithSource.
+func SourceFromContext(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey{}).(string)
+	return source
+}
+
+//SourceFromRequest - return source of request, which is the client host.
+func SourceFromRequest(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//Storage - models.Storager which feeds every written counter to Tracker.
+//Cumulative counters are stored as their increases, so stored totals do not jump on resets.
+type Storage struct {
+	models.Storager
+	//Tracker - tracker which receives counters.
+	Tracker *Tracker
+}
+
+//NewStorage - Storage constructor.
+func NewStorage(repo models.Storager, tracker *Tracker) *Storage {
+	return &Storage{
+		Storager: repo,
+		Tracker:  tracker,
+	}
+}
+
+//InsertMetric - save models.Metrics and observe it if it is counter.
+func (s *Storage) InsertMetric(ctx context.Context, m models.Metrics) error {
+	err := s.Storager.InsertMetric(ctx, s.increases(ctx, []models.Metrics{m})[0])
+	if err == nil {
+		s.observe(ctx, m)
+	}
+	return err
+}
+
+//InsertData - save raw data and observe it if it is counter.
+func (s *Storage) InsertData(ctx context.Context, typeVar string, name string, value string, hash string) int {
+	delta, err := strconv.ParseInt(value, 10, 64)
+	if typeVar != "counter" || err != nil {
+		return s.Storager.InsertData(ctx, typeVar, name, value, hash)
+	}
+	m := models.Metrics{ID: name, MType: typeVar, Delta: &delta}
+	stored := s.increases(ctx, []models.Metrics{m})[0]
+	result := s.Storager.InsertData(ctx, typeVar, name, strconv.FormatInt(*stored.Delta, 10), hash)
+	if result == http.StatusOK {
+		s.observe(ctx, m)
+	}
+	return result
+}
+
+//BatchInsert - save []models.Metrics and observe all counters.
+func (s *Storage) BatchInsert(ctx context.Context, dataModels []models.Metrics) error {
+	err := s.Storager.BatchInsert(ctx, s.increases(ctx, dataModels))
+	if err == nil {
+		for _, m := range dataModels {
+			s.observe(ctx, m)
+		}
+	}
+	return err
+}
+
+//BatchSet - save []models.Metrics with counters set to their values.
+//Counters are not observed, because they are totals, not increments.
+func (s *Storage) BatchSet(ctx context.Context, dataModels []models.Metrics) error {
+	return s.Storager.BatchSet(ctx, dataModels)
+}
+
+//BatchInsertOnce - save batch once per idempotency key and observe its counters if it was applied.
+func (s *Storage) BatchInsertOnce(ctx context.Context, key string, hash string, dataModels []models.Metrics, result models.BatchResult) (models.BatchResult, bool, error) {
+	result, replayed, err := s.Storager.BatchInsertOnce(ctx, key, hash, s.increases(ctx, dataModels), result)
+	if err == nil && !replayed {
+		for _, m := range dataModels {
+			s.observe(ctx, m)
+		}
+	}
+	return result, replayed, err
+}
+
+//increases - return copy of data where cumulative counters are replaced by their increases.
+//Data is not observed, it is done after it is stored.
+func (s *Storage) increases(ctx context.Context, data []models.Metrics) []models.Metrics {
+	result := make([]models.Metrics, len(data))
+	last := make(map[seriesKey]int64)
+	for i, m := range data {
+		result[i] = m
+		if m.MType != "counter" || m.Delta == nil || !s.Tracker.Cumulative[m.ID] {
+			continue
+		}
+		key := seriesKey{source: sourceOf(ctx, m), id: m.ID}
+		prev, ok := last[key]
+		if !ok {
+			prev, ok = s.Tracker.Last(key.source, key.id)
+		}
+		var prevPtr *int64
+		if ok {
+			prevPtr = &prev
+		}
+		delta, _ := increase(true, prevPtr, *m.Delta)
+		result[i].Delta = &delta
+		last[key] = *m.Delta
+	}
+	return result
+}
+
+func (s *Storage) observe(ctx context.Context, m models.Metrics) {
+	if m.MType != "counter" || m.Delta == nil {
+		return
+	}
+	s.Tracker.Observe(sourceOf(ctx, m), m.ID, *m.Delta)
+}
+
+//sourceOf - return source of metric, source of context if metric has none.
+func sourceOf(ctx context.Context, m models.Metrics) string {
+	if m.Source != "" {
+		return m.Source
+	}
+	return SourceFromContext(ctx)
+}
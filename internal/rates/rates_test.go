@@ -0,0 +1,160 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker_Rates(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []int64
+		window   time.Duration
+		increase int64
+		rate     float64
+		resets   int
+		samples  int
+	}{
+		{
+			name:     "positive monotonic",
+			values:   []int64{1, 2, 3, 4, 5},
+			window:   time.Minute,
+			increase: 4,
+			rate:     1,
+			samples:  5,
+		},
+		{
+			name:     "positive reset",
+			values:   []int64{10, 20, 2, 4},
+			window:   time.Minute,
+			increase: 14,
+			rate:     14.0 / 3,
+			resets:   1,
+			samples:  4,
+		},
+		{
+			name:     "positive window",
+			values:   []int64{1, 100, 101, 102},
+			window:   2 * time.Second,
+			increase: 2,
+			rate:     1,
+			samples:  3,
+		},
+		{
+			name:    "positive single sample",
+			values:  []int64{7},
+			window:  time.Minute,
+			samples: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewTracker(time.Hour)
+			clock := time.Now()
+			tracker.now = func() time.Time { return clock }
+			for _, v := range tt.values {
+				tracker.Observe("agent", "PollCount", v)
+				clock = clock.Add(time.Second)
+			}
+			clock = clock.Add(-time.Second)
+			got := tracker.Rates("PollCount", "", tt.window)
+			require.Len(t, got, 1)
+			assert.Equal(t, tt.increase, got[0].Increase)
+			assert.InDelta(t, tt.rate, got[0].PerSecond, 1e-9)
+			assert.Equal(t, tt.resets, got[0].Resets)
+			assert.Equal(t, tt.samples, got[0].Samples)
+			assert.Equal(t, tt.values[len(tt.values)-1], got[0].Last)
+		})
+	}
+}
+
+func TestTracker_Increments(t *testing.T) {
+	tracker := NewTracker(time.Hour)
+	clock := time.Now()
+	tracker.now = func() time.Time { return clock }
+	for _, v := range []int64{1, 1, 1, 5, 2} {
+		assert.Equal(t, v, tracker.Observe("agent", "requests", v))
+		clock = clock.Add(time.Second)
+	}
+	clock = clock.Add(-time.Second)
+	got := tracker.Rates("requests", "", time.Minute)
+	require.Len(t, got, 1)
+	assert.Equal(t, int64(9), got[0].Increase)
+	assert.Equal(t, 0, got[0].Resets)
+	assert.InDelta(t, 9.0/4, got[0].PerSecond, 1e-9)
+}
+
+func TestTracker_ForgetsIdleSeries(t *testing.T) {
+	tracker := NewTracker(time.Minute)
+	clock := time.Now()
+	tracker.now = func() time.Time { return clock }
+	tracker.Observe("agent1", "PollCount", 1)
+	tracker.Observe("agent2", "PollCount", 1)
+	clock = clock.Add(2 * time.Minute)
+	tracker.Observe("agent1", "PollCount", 2)
+	assert.Len(t, tracker.series, 1)
+	assert.Contains(t, tracker.series, seriesKey{source: "agent1", id: "PollCount"})
+}
+
+func TestStorage_InsertMetric(t *testing.T) {
+	repo := storage.NewRepo()
+	tracker := NewTracker(time.Hour)
+	store := NewStorage(&repo, tracker)
+	first := WithSource(context.TODO(), "10.0.0.1")
+	second := WithSource(context.TODO(), "10.0.0.2")
+	for _, v := range []int64{1, 2, 1} {
+		delta := v
+		require.NoError(t, store.InsertMetric(first, models.NewMetric("PollCount", "counter", &delta, nil, "")))
+	}
+	value := 1.5
+	require.NoError(t, store.InsertMetric(first, models.NewMetric("Alloc", "gauge", nil, &value, "")))
+	store.InsertData(second, "counter", "PollCount", "5", "")
+
+	got := tracker.Rates("", "", 0)
+	require.Len(t, got, 2)
+	assert.Equal(t, "10.0.0.1", got[0].Source)
+	assert.Equal(t, 1, got[0].Resets)
+	assert.Equal(t, int64(2), got[0].Increase)
+	assert.Equal(t, "10.0.0.2", got[1].Source)
+	assert.Equal(t, int64(5), got[1].Last)
+}
+
+func TestStorage_StoredTotals(t *testing.T) {
+	repo := storage.NewRepo()
+	store := NewStorage(&repo, NewTracker(time.Hour))
+	ctx := WithSource(context.TODO(), "10.0.0.1")
+	//agent reports PollCount 1, 2, 3, restarts and reports 1, 2
+	for _, v := range []int64{1, 2, 3} {
+		delta := v
+		require.NoError(t, store.InsertMetric(ctx, models.NewMetric("PollCount", "counter", &delta, nil, "")))
+	}
+	var one, two int64 = 1, 2
+	require.NoError(t, store.BatchInsert(ctx, []models.Metrics{
+		models.NewMetric("PollCount", "counter", &one, nil, ""),
+		models.NewMetric("PollCount", "counter", &two, nil, ""),
+	}))
+	//other counters are increments
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, store.InsertData(ctx, "counter", "requests", "1", ""))
+	}
+	got, err := repo.GetMetric(models.Metrics{ID: "PollCount"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *got.Delta)
+	got, err = repo.GetMetric(models.Metrics{ID: "requests"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *got.Delta)
+
+	rates := store.Tracker.Rates("", "", 0)
+	require.Len(t, rates, 2)
+	assert.Equal(t, int64(4), rates[0].Increase)
+	assert.Equal(t, 1, rates[0].Resets)
+	assert.Equal(t, int64(2), rates[1].Increase)
+	assert.Equal(t, 0, rates[1].Resets)
+}
@@ -0,0 +1,284 @@
+//Package remotewrite decodes Prometheus remote_write requests and maps them to metrics.
+//
+//Request body is a snappy (block format) compressed protobuf WriteRequest of
+//remote write protocol 1.0. Only fields needed to map samples are decoded,
+//exemplars and native histograms are skipped.
+//
+//Every series becomes a gauge: Prometheus counters are cumulative, while
+//counters of this server are sums of reported deltas. Metric ID is the
+//__name__ label, source is the instance label and other labels are kept as
+//metric labels. Only the latest sample of a series is stored, its timestamp
+//becomes UpdatedAt. Prometheus staleness markers are skipped.
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/metadata"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	//ContentType - content type of remote write request.
+	ContentType = "application/x-protobuf"
+	//ContentEncoding - content encoding of remote write request.
+	ContentEncoding = "snappy"
+	//VersionHeader - request header with protocol version.
+	VersionHeader = "X-Prometheus-Remote-Write-Version"
+)
+
+//MaxDecodedSize - biggest decompressed request accepted.
+const MaxDecodedSize = 32 << 20
+
+//NameLabel - label with metric name.
+const NameLabel = "__name__"
+
+//InstanceLabel - label with scraped instance, it becomes metric source.
+const InstanceLabel = "instance"
+
+//staleNaN - value Prometheus writes to mark series as stale.
+const staleNaN = 0x7ff0000000000002
+
+//ErrTooLarge - request is bigger than MaxDecodedSize.
+var ErrTooLarge = errors.New("request is too large")
+
+//WriteRequest - decoded remote write request.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+	Metadata   []MetricMetadata
+}
+
+//TimeSeries - labels and samples of one series.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+//Label - series label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+//Sample - series value at moment.
+type Sample struct {
+	Value float64
+	//Timestamp - milliseconds since the Unix epoch.
+	Timestamp int64
+}
+
+//MetricMetadata - description of metric family.
+type MetricMetadata struct {
+	Type       int32
+	FamilyName string
+	Help       string
+	Unit       string
+}
+
+//Decode - decompress and unmarshal request body.
+//If decompressed body is bigger than MaxDecodedSize, ErrTooLarge is returned.
+func Decode(body []byte) (WriteRequest, error) {
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		return WriteRequest{}, fmt.Errorf("bad snappy body: %w", err)
+	}
+	if size > MaxDecodedSize {
+		return WriteRequest{}, ErrTooLarge
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return WriteRequest{}, fmt.Errorf("bad snappy body: %w", err)
+	}
+	return Unmarshal(data)
+}
+
+//Unmarshal - unmarshal protobuf WriteRequest.
+func Unmarshal(data []byte) (WriteRequest, error) {
+	var req WriteRequest
+	err := walk(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			ts, err := unmarshalTimeSeries(value)
+			if err != nil {
+				return err
+			}
+			req.Timeseries = append(req.Timeseries, ts)
+		case num == 3 && typ == protowire.BytesType:
+			md, err := unmarshalMetadata(value)
+			if err != nil {
+				return err
+			}
+			req.Metadata = append(req.Metadata, md)
+		}
+		return nil
+	})
+	return req, err
+}
+
+func unmarshalTimeSeries(data []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	err := walk(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var l Label
+			err := walk(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					l.Name = string(value)
+				case num == 2 && typ == protowire.BytesType:
+					l.Value = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case num == 2 && typ == protowire.BytesType:
+			var s Sample
+			err := walk(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					v, _ := protowire.ConsumeFixed64(value)
+					s.Value = math.Float64frombits(v)
+				case num == 2 && typ == protowire.VarintType:
+					v, _ := protowire.ConsumeVarint(value)
+					s.Timestamp = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+func unmarshalMetadata(data []byte) (MetricMetadata, error) {
+	var md MetricMetadata
+	err := walk(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			md.Type = int32(v)
+		case num == 2 && typ == protowire.BytesType:
+			md.FamilyName = string(value)
+		case num == 4 && typ == protowire.BytesType:
+			md.Help = string(value)
+		case num == 5 && typ == protowire.BytesType:
+			md.Unit = string(value)
+		}
+		return nil
+	})
+	return md, err
+}
+
+//walk - call fn for every field of protobuf message.
+//Value of bytes field is its content, value of other fields is their raw encoding.
+func walk(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("bad protobuf: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+		var value []byte
+		if typ == protowire.BytesType {
+			value, n = protowire.ConsumeBytes(data)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n >= 0 {
+				value = data[:n]
+			}
+		}
+		if n < 0 {
+			return fmt.Errorf("bad protobuf: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Metrics - map series of request to metrics.
+//Staleness markers and other NaN and infinite samples can not be stored, they are skipped,
+//so are series without other samples.
+//Error is returned if any series has no name or has empty or duplicate label names.
+func (req WriteRequest) Metrics() ([]models.Metrics, error) {
+	result := make([]models.Metrics, 0, len(req.Timeseries))
+	for i, ts := range req.Timeseries {
+		m := models.Metrics{MType: "gauge"}
+		seen := make(map[string]bool, len(ts.Labels))
+		for _, l := range ts.Labels {
+			if l.Name == "" {
+				return nil, fmt.Errorf("series %d: empty label name", i)
+			}
+			if seen[l.Name] {
+				return nil, fmt.Errorf("series %d: duplicate label %q", i, l.Name)
+			}
+			seen[l.Name] = true
+			switch l.Name {
+			case NameLabel:
+				m.ID = l.Value
+			case InstanceLabel:
+				m.Source = l.Value
+				m.Host = instanceHost(l.Value)
+			default:
+				if m.Labels == nil {
+					m.Labels = make(map[string]string, len(ts.Labels))
+				}
+				m.Labels[l.Name] = l.Value
+			}
+		}
+		if m.ID == "" {
+			return nil, fmt.Errorf("series %d: no %s label", i, NameLabel)
+		}
+		latest := -1
+		for j, s := range ts.Samples {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue
+			}
+			if latest < 0 || s.Timestamp >= ts.Samples[latest].Timestamp {
+				latest = j
+			}
+		}
+		if latest < 0 {
+			continue
+		}
+		value := ts.Samples[latest].Value
+		updated := time.UnixMilli(ts.Samples[latest].Timestamp)
+		m.Value = &value
+		m.UpdatedAt = &updated
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+//SaveMetadata - save help text and unit of metric families to registry.
+func (req WriteRequest) SaveMetadata(r *metadata.Registry) {
+	for _, md := range req.Metadata {
+		if md.FamilyName == "" || md.Help == "" {
+			continue
+		}
+		r.Set(md.FamilyName, metadata.Metadata{Help: md.Help, Unit: md.Unit})
+	}
+}
+
+func instanceHost(instance string) string {
+	host, _, err := net.SplitHostPort(instance)
+	if err != nil {
+		return instance
+	}
+	return host
+}
@@ -0,0 +1,112 @@
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MaximkaSha/log_tools/internal/metadata"
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//Files in testdata are WriteRequest bodies produced by prompb package of Prometheus v0.37.0.
+
+func readPayload(t *testing.T, name string) []byte {
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return body
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "positive node",
+			file: "node.snappy",
+			want: []string{
+				`node_load1 node1:9100 node1 {"job":"node"} 0.5 1660000015000`,
+				`node_cpu_seconds_total node1:9100 node1 {"cpu":"0","job":"node","mode":"idle"} 12345.5 1660000015000`,
+				`node_cpu_seconds_total node1:9100 node1 {"cpu":"0","job":"node","mode":"user"} 678.25 1660000015000`,
+				`up   {"job":"prometheus"} 1 1660000015000`,
+			},
+		},
+		{
+			name: "positive empty",
+			file: "empty.snappy",
+		},
+		{
+			name:    "negative no name",
+			file:    "no_name.snappy",
+			wantErr: true,
+		},
+		{
+			name:    "negative framed snappy",
+			file:    "framed.snappy",
+			wantErr: true,
+		},
+		{
+			name:    "negative truncated protobuf",
+			file:    "truncated.snappy",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := Decode(readPayload(t, tt.file))
+			var metrics []models.Metrics
+			if err == nil {
+				metrics, err = req.Metrics()
+			}
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var got []string
+			for _, m := range metrics {
+				assert.Equal(t, "gauge", m.MType)
+				got = append(got, fmt.Sprintf("%s %s %s %s %v %d", m.ID, m.Source, m.Host, m.LabelsKey(), *m.Value, m.UpdatedAt.UnixMilli()))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWriteRequest_MetricsNonFinite(t *testing.T) {
+	name := []Label{{Name: NameLabel, Value: "node_load1"}}
+	req := WriteRequest{Timeseries: []TimeSeries{
+		{Labels: name, Samples: []Sample{{Value: 0.5, Timestamp: 1000}, {Value: math.NaN(), Timestamp: 2000}, {Value: math.Inf(1), Timestamp: 3000}}},
+		{Labels: name, Samples: []Sample{{Value: math.Float64frombits(staleNaN), Timestamp: 1000}, {Value: math.Inf(-1), Timestamp: 2000}}},
+	}}
+	metrics, err := req.Metrics()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 0.5, *metrics[0].Value)
+	assert.Equal(t, int64(1000), metrics[0].UpdatedAt.UnixMilli())
+}
+
+func TestWriteRequest_SaveMetadata(t *testing.T) {
+	req, err := Decode(readPayload(t, "node.snappy"))
+	require.NoError(t, err)
+	r := metadata.NewRegistry()
+	req.SaveMetadata(r)
+	got, ok := r.Get("node_cpu_seconds_total")
+	require.True(t, ok)
+	assert.Equal(t, metadata.Metadata{Help: "Seconds the CPUs spent in each mode.", Unit: "seconds"}, got)
+	_, ok = r.Get("up")
+	assert.False(t, ok)
+}
+
+func TestDecode_TooLarge(t *testing.T) {
+	//snappy block starts with varint of decoded length
+	_, err := Decode([]byte{0x80, 0x80, 0x80, 0x80, 0x01})
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
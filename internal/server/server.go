@@ -15,11 +15,22 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/MaximkaSha/log_tools/internal/alert"
+	"github.com/MaximkaSha/log_tools/internal/compress"
 	"github.com/MaximkaSha/log_tools/internal/crypto"
 	"github.com/MaximkaSha/log_tools/internal/database"
+	"github.com/MaximkaSha/log_tools/internal/graphite"
+	"github.com/MaximkaSha/log_tools/internal/grpcserver"
 	"github.com/MaximkaSha/log_tools/internal/handlers"
+	"github.com/MaximkaSha/log_tools/internal/metadata"
 	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/ratelimit"
+	"github.com/MaximkaSha/log_tools/internal/rates"
+	"github.com/MaximkaSha/log_tools/internal/statsd"
 	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/MaximkaSha/log_tools/internal/stream"
+	"github.com/MaximkaSha/log_tools/internal/validate"
+	"github.com/MaximkaSha/log_tools/internal/webhooks"
 	"github.com/caarlos0/env/v6"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
@@ -40,14 +51,95 @@ type Config struct {
 	KeyFileFlag string `env:"KEY" envDefault:"12345678"` // key
 	//DatabaseEnv - DSN string.
 	DatabaseEnv string `env:"DATABASE_DSN"`
+	//RateWindow - how long counter samples are kept to compute rates, 0 disables rates.
+	RateWindow time.Duration `env:"RATE_WINDOW" envDefault:"5m"`
+	//RateCumulative - IDs of counters which agents report as cumulative values, separated by ';'.
+	//They are stored as increases, other counters are increments.
+	RateCumulative []string `env:"RATE_CUMULATIVE" envDefault:"PollCount" envSeparator:";"`
+	//StaleThreshold - metrics not updated longer are stale, 0 disables staleness.
+	StaleThreshold time.Duration `env:"STALE_THRESHOLD" envDefault:"0s"`
+	//StaleMode - "mark" marks stale metrics in responses, "hide" hides them.
+	StaleMode string `env:"STALE_MODE" envDefault:"mark"`
+	//IdempotencyTTL - how long batch idempotency keys are remembered.
+	IdempotencyTTL time.Duration `env:"IDEMPOTENCY_TTL" envDefault:"24h"`
+	//MetadataFile - JSON file with help text and units of metrics, empty for built-in metadata only.
+	MetadataFile string `env:"METADATA_FILE"`
+	//StatsdAddress - host:port of StatsD UDP and TCP listener, empty disables StatsD.
+	StatsdAddress string `env:"STATSD_ADDRESS"`
+	//StatsdFlushInterval - how often aggregated StatsD metrics are written to storage.
+	StatsdFlushInterval time.Duration `env:"STATSD_FLUSH_INTERVAL" envDefault:"10s"`
+	//StatsdMaxSeries - most StatsD series aggregated at once, lines of new series over it are dropped.
+	StatsdMaxSeries int `env:"STATSD_MAX_SERIES" envDefault:"10000"`
+	//GraphiteAddress - host:port of Graphite plaintext TCP listener, empty disables Graphite.
+	GraphiteAddress string `env:"GRAPHITE_ADDRESS"`
+	//GraphiteTemplates - templates which map Graphite paths to metrics, separated by ';'.
+	GraphiteTemplates []string `env:"GRAPHITE_TEMPLATES" envSeparator:";"`
+	//GraphiteQueueSize - number of received Graphite lines waiting to be written.
+	GraphiteQueueSize int `env:"GRAPHITE_QUEUE_SIZE" envDefault:"10000"`
+	//StreamHistory - number of metric changes kept for resuming streams.
+	StreamHistory int `env:"STREAM_HISTORY" envDefault:"1000"`
+	//StreamBuffer - number of metric changes buffered for one stream client, slower clients are disconnected.
+	StreamBuffer int `env:"STREAM_BUFFER" envDefault:"256"`
+	//StreamHeartbeat - interval of heartbeats sent to idle stream clients.
+	StreamHeartbeat time.Duration `env:"STREAM_HEARTBEAT" envDefault:"15s"`
+	//GRPCAddress - host:port of gRPC API, empty disables gRPC.
+	GRPCAddress string `env:"GRPC_ADDRESS"`
+	//MaxDecompressedSize - limit of gzip or deflate request body after decoding, bigger requests get 413.
+	MaxDecompressedSize int64 `env:"MAX_DECOMPRESSED_SIZE" envDefault:"33554432"`
+	//MaxNameLength - longest metric name in bytes.
+	MaxNameLength int `env:"MAX_NAME_LENGTH" envDefault:"255"`
+	//MaxBodySize - biggest JSON body of update endpoints in bytes, bigger requests get 413.
+	MaxBodySize int64 `env:"MAX_BODY_SIZE" envDefault:"8388608"`
+	//MaxBatchSize - most metrics in one batch, bigger batches get 413.
+	MaxBatchSize int `env:"MAX_BATCH_SIZE" envDefault:"10000"`
+	//BatchPolicy - "atomic" writes batch only if all metrics are good, "best_effort" writes good metrics of batch.
+	BatchPolicy string `env:"BATCH_POLICY" envDefault:"atomic"`
+	//NDJSONChunkSize - number of metrics of NDJSON stream written to storage at once.
+	NDJSONChunkSize int `env:"NDJSON_CHUNK_SIZE" envDefault:"1000"`
+	//AlertRulesFile - JSON file with alert rules and webhooks, empty disables alerting.
+	AlertRulesFile string `env:"ALERT_RULES_FILE"`
+	//AlertInterval - how often alert rules are evaluated.
+	AlertInterval time.Duration `env:"ALERT_INTERVAL" envDefault:"30s"`
+	//WebhookBatchInterval - how long metric changes are collected before webhook batch is posted.
+	WebhookBatchInterval time.Duration `env:"WEBHOOK_BATCH_INTERVAL" envDefault:"1s"`
+	//WebhookBatchSize - most metric changes in one webhook batch.
+	WebhookBatchSize int `env:"WEBHOOK_BATCH_SIZE" envDefault:"100"`
+	//WebhookRetries - number of repeated attempts of failed webhook delivery.
+	WebhookRetries int `env:"WEBHOOK_RETRIES" envDefault:"3"`
+	//WebhookBackoff - delay before the first repeated webhook attempt, it doubles with every attempt.
+	WebhookBackoff time.Duration `env:"WEBHOOK_BACKOFF" envDefault:"1s"`
+	//WebhookAllowPrivate - allow webhooks to loopback, private and link-local addresses.
+	WebhookAllowPrivate bool `env:"WEBHOOK_ALLOW_PRIVATE" envDefault:"false"`
+	//WebhookAdminToken - bearer token of webhook management API, empty makes it read-only.
+	WebhookAdminToken string `env:"WEBHOOK_ADMIN_TOKEN" envDefault:""`
+	//RateLimit - requests per second allowed to one client over HTTP and gRPC, 0 disables rate limiting.
+	RateLimit float64 `env:"RATE_LIMIT" envDefault:"0"`
+	//RateLimitBurst - requests client may make at once above rate.
+	RateLimitBurst int `env:"RATE_LIMIT_BURST" envDefault:"100"`
+	//RateLimitKey - how client is identified: "ip", "agent" (X-Agent-ID) or "apikey".
+	RateLimitKey string `env:"RATE_LIMIT_KEY" envDefault:"ip"`
+	//RateLimitAPIKeyHeader - header of API key of "apikey" rate limit key.
+	RateLimitAPIKeyHeader string `env:"RATE_LIMIT_API_KEY_HEADER" envDefault:"X-API-Key"`
+	//RateLimitAPIKeys - API keys of "apikey" rate limit key separated by ';', requests with other keys are limited by IP.
+	//Keys of overrides are known too.
+	RateLimitAPIKeys []string `env:"RATE_LIMIT_API_KEYS" envSeparator:";"`
+	//RateLimitMaxClients - most clients tracked at once, new clients over it share bucket of their IP.
+	RateLimitMaxClients int `env:"RATE_LIMIT_MAX_CLIENTS" envDefault:"10000"`
+	//RateLimitOverrides - limits of single clients like "agent-1=50/100", separated by ';'.
+	RateLimitOverrides []string `env:"RATE_LIMIT_OVERRIDES" envSeparator:";"`
+	//RateLimitTrustProxy - take client IP from X-Real-IP or X-Forwarded-For headers.
+	RateLimitTrustProxy bool `env:"RATE_LIMIT_TRUST_PROXY" envDefault:"false"`
 }
 
 //Server - internal server structure.
 type Server struct {
-	cfg   Config
-	handl handlers.Handlers
-	srv   *http.Server
-	db    *database.Database
+	cfg      Config
+	handl    handlers.Handlers
+	srv      *http.Server
+	db       *database.Database
+	statsd   *statsd.Server
+	graphite *graphite.Server
+	grpc     *grpcserver.Server
 }
 
 //NewServer - Server constructor.
@@ -96,17 +188,112 @@ func NewServer() Server {
 	var repo models.Storager
 	if cfg.DatabaseEnv == "" {
 		imMemory := storage.NewRepo()
+		imMemory.KeyTTL = cfg.IdempotencyTTL
 		repo = &imMemory
 	} else {
 		DB := database.NewDatabase(cfg.DatabaseEnv)
+		DB.KeyTTL = cfg.IdempotencyTTL
 		repo = &DB
 		DB.InitDatabase()
 		serv.db = &DB
 	}
+	var tracker *rates.Tracker
+	if cfg.RateWindow > 0 {
+		tracker = rates.NewTracker(cfg.RateWindow)
+		tracker.Cumulative = make(map[string]bool)
+		for _, id := range cfg.RateCumulative {
+			tracker.Cumulative[id] = true
+		}
+		repo = rates.NewStorage(repo, tracker)
+	}
 	cryptoService := crypto.NewCryptoService()
 	cryptoService.InitCryptoService(cfg.KeyFileFlag)
 	handl := handlers.NewHandlers(repo, cryptoService)
+	handl.Rates = tracker
+	handl.StaleThreshold = cfg.StaleThreshold
+	switch cfg.StaleMode {
+	case "mark":
+	case "hide":
+		handl.HideStale = true
+	default:
+		log.Fatalf("Unknown STALE_MODE %q", cfg.StaleMode)
+	}
+	switch cfg.BatchPolicy {
+	case models.BatchAtomic, models.BatchBestEffort:
+		handl.BatchPolicy = cfg.BatchPolicy
+	default:
+		log.Fatalf("Unknown BATCH_POLICY %q", cfg.BatchPolicy)
+	}
+	handl.NDJSONChunkSize = cfg.NDJSONChunkSize
+	handl.Metadata = metadata.NewRegistry()
+	if cfg.MetadataFile != "" {
+		if err := handl.Metadata.Load(cfg.MetadataFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	broker, err := stream.NewBroker(repo, cfg.StreamHistory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	broker.BufferSize = cfg.StreamBuffer
+	handl.Stream = broker
+	handl.StreamHeartbeat = cfg.StreamHeartbeat
+	handl.Validator = validate.Validator{
+		MaxNameLength: cfg.MaxNameLength,
+		MaxBodySize:   cfg.MaxBodySize,
+		MaxBatchSize:  cfg.MaxBatchSize,
+	}
+	dispatcher, err := webhooks.NewDispatcher(repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dispatcher.BatchInterval = cfg.WebhookBatchInterval
+	dispatcher.BatchSize = cfg.WebhookBatchSize
+	dispatcher.Retries = cfg.WebhookRetries
+	dispatcher.Backoff = cfg.WebhookBackoff
+	dispatcher.AllowPrivate = cfg.WebhookAllowPrivate
+	handl.Webhooks = dispatcher
+	handl.WebhookToken = cfg.WebhookAdminToken
+	if cfg.RateLimit > 0 {
+		overrides, err := ratelimit.ParseOverrides(cfg.RateLimitOverrides)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limiter, err := ratelimit.NewLimiter(cfg.RateLimitKey, ratelimit.Limit{Rate: cfg.RateLimit, Burst: cfg.RateLimitBurst}, overrides)
+		if err != nil {
+			log.Fatalf("Bad rate limit: %s", err)
+		}
+		limiter.APIKeyHeader = cfg.RateLimitAPIKeyHeader
+		limiter.TrustProxy = cfg.RateLimitTrustProxy
+		limiter.MaxClients = cfg.RateLimitMaxClients
+		limiter.APIKeys = ratelimit.ParseAPIKeys(cfg.RateLimitAPIKeys)
+		handl.RateLimit = limiter
+	}
+	if cfg.AlertRulesFile != "" {
+		alertCfg, err := alert.LoadConfig(cfg.AlertRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if handl.Alerts, err = alert.NewManager(alertCfg, repo, tracker, cfg.AlertInterval); err != nil {
+			log.Fatal(err)
+		}
+		handl.Alerts.StaleThreshold = handl.StaleThreshold
+		handl.Alerts.HideStale = handl.HideStale
+	}
 	serv.handl = handl
+	if cfg.StatsdAddress != "" {
+		serv.statsd = statsd.NewServer(cfg.StatsdAddress, cfg.StatsdFlushInterval, repo)
+		serv.statsd.Validator = handl.Validator
+		serv.statsd.MaxSeries = cfg.StatsdMaxSeries
+	}
+	if cfg.GraphiteAddress != "" {
+		mapper, err := graphite.NewMapper(cfg.GraphiteTemplates)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serv.graphite = graphite.NewServer(cfg.GraphiteAddress, mapper, repo, cfg.GraphiteQueueSize)
+		serv.graphite.Validator = handl.Validator
+	}
 	serv.srv = &http.Server{}
 	return serv
 }
@@ -144,8 +331,37 @@ func (s *Server) StartServe() {
 		s.handl.SyncFile = s.cfg.StoreFile
 	}
 
+	if s.statsd != nil {
+		if err := s.statsd.Start(); err != nil {
+			log.Fatalf("Cant start StatsD: %s", err)
+		}
+	}
+	if s.graphite != nil {
+		if err := s.graphite.Start(); err != nil {
+			log.Fatalf("Cant start Graphite: %s", err)
+		}
+	}
+
+	if s.handl.Alerts != nil {
+		if err := s.handl.Alerts.Start(); err != nil {
+			log.Fatalf("Cant start alerting: %s", err)
+		}
+	}
+
+	if s.cfg.GRPCAddress != "" {
+		s.grpc = grpcserver.NewServer(s.cfg.GRPCAddress, &s.handl)
+		if err := s.grpc.Start(); err != nil {
+			log.Fatalf("Cant start gRPC: %s", err)
+		}
+	}
+
 	mux := chi.NewRouter()
 	compressor := middleware.NewCompressor(flate.DefaultCompression)
+	if s.handl.RateLimit != nil {
+		mux.Use(s.handl.RateLimit.Handler)
+	}
+	mux.Use(compress.Decompress(s.cfg.MaxDecompressedSize))
+	mux.Use(compress.Negotiate(compress.Gzip, compress.Deflate))
 	mux.Use(compressor.Handler)
 	mux.Post("/update/{type}/{name}/{value}", s.handl.HandleUpdate)
 	mux.Get("/value/{type}/{name}", s.handl.HandleGetUpdate)
@@ -154,11 +370,39 @@ func (s *Server) StartServe() {
 	mux.Post("/update/", s.handl.HandlePostJSONUpdate)
 	mux.Post("/updates/", s.handl.HandlePostJSONUpdates)
 	mux.Post("/value/", s.handl.HandlePostJSONValue)
+	mux.Get("/rates/", s.handl.HandleGetRates)
+	mux.Get("/rates/{name}", s.handl.HandleGetRates)
+	mux.Get("/stale/", s.handl.HandleGetStale)
+	mux.Get("/list/", s.handl.HandleGetList)
+	mux.Get("/metric/{type}/{name}", s.handl.HandleGetMetric)
+	mux.Get("/metrics", s.handl.HandleGetMetrics)
+	mux.Mount(handlers.APIPrefix, s.handl.APIRouter())
+	mux.Post("/write", s.handl.HandlePostInfluxWrite)
+	mux.Post("/v1/metrics", s.handl.HandlePostOTLPMetrics)
+	mux.Get("/stream", s.handl.HandleGetStream)
+	mux.Get("/stream/ws", s.handl.HandleGetStreamWS)
 	s.srv.Addr = s.cfg.Server
 	s.srv.Handler = mux
+	// streams never become idle, so they are closed before Shutdown waits for connections
+	s.srv.RegisterOnShutdown(s.handl.Stream.Close)
 	fmt.Println("Server is listening...")
 	if err := s.srv.ListenAndServe(); err != nil {
 		log.Printf("Server shutdown: %s", err.Error())
+		if s.statsd != nil {
+			if err := s.statsd.Close(); err != nil {
+				log.Printf("StatsD flush failed: %s", err)
+			}
+		}
+		if s.graphite != nil {
+			s.graphite.Close()
+		}
+		if s.handl.Alerts != nil {
+			s.handl.Alerts.Close()
+		}
+		s.handl.Webhooks.Close()
+		if s.grpc != nil {
+			s.grpc.Close()
+		}
 		if s.db != nil {
 			s.db.DB.Close()
 		}
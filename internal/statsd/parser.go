@@ -0,0 +1,104 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//Metric types of StatsD protocol.
+const (
+	TypeCounter   = "c"
+	TypeGauge     = "g"
+	TypeTimer     = "ms"
+	TypeHistogram = "h"
+	TypeSet       = "s"
+)
+
+//Line - parsed StatsD line.
+type Line struct {
+	//Name - metric name.
+	Name string
+	//Type - metric type, one of Type constants.
+	Type string
+	//Value - numeric value, not set for sets.
+	Value float64
+	//SetValue - member of set, set only for sets.
+	SetValue string
+	//Relative - gauge value is added to current value instead of replacing it.
+	Relative bool
+	//SampleRate - fraction of events the line stands for, 1 if not sampled.
+	SampleRate float64
+	//Tags - DogStatsD tags, nil if there are none.
+	Tags map[string]string
+}
+
+//Parse - parse single StatsD line "name:value|type[|@rate][|#tag:value,...]".
+func Parse(s string) (Line, error) {
+	s = strings.TrimSpace(s)
+	colon := strings.IndexByte(s, ':')
+	if colon <= 0 {
+		return Line{}, errors.New("no metric name")
+	}
+	line := Line{Name: s[:colon], SampleRate: 1}
+	fields := strings.Split(s[colon+1:], "|")
+	if len(fields) < 2 {
+		return Line{}, fmt.Errorf("%s: no metric type", line.Name)
+	}
+	line.Type = fields[1]
+	value := fields[0]
+	switch line.Type {
+	case TypeCounter, TypeTimer, TypeHistogram:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return Line{}, fmt.Errorf("%s: bad value %q", line.Name, value)
+		}
+		line.Value = v
+	case TypeGauge:
+		line.Relative = strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return Line{}, fmt.Errorf("%s: bad value %q", line.Name, value)
+		}
+		line.Value = v
+	case TypeSet:
+		line.SetValue = value
+	default:
+		return Line{}, fmt.Errorf("%s: unknown type %q", line.Name, line.Type)
+	}
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Line{}, fmt.Errorf("%s: bad sample rate %q", line.Name, field)
+			}
+			line.SampleRate = rate
+		case strings.HasPrefix(field, "#"):
+			line.Tags = parseTags(field[1:])
+		default:
+			return Line{}, fmt.Errorf("%s: unknown field %q", line.Name, field)
+		}
+	}
+	return line, nil
+}
+
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		k, v := tag, ""
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			k, v = tag[:i], tag[i+1:]
+		}
+		tags[k] = v
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
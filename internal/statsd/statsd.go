@@ -0,0 +1,476 @@
+// Package statsd receives StatsD metrics over UDP and TCP and writes them to storage.
+//
+// Lines are aggregated in memory and written once per flush interval.
+// Counters (c) are summed with sample rate compensated, and the sum is written
+// as counter delta. Gauges (g) keep the last value, values with sign are added
+// to current value. Timers (ms) and histograms (h) are written as gauges
+// NAME.min, NAME.max, NAME.mean, NAME.median, NAME.p90, NAME.p99, NAME.sum and
+// counter NAME.count. Sets (s) are written as gauge with number of unique members.
+// Only series updated during interval are written. DogStatsD tags become metric labels.
+// Counters without fraction left and gauges not updated for MaxIdle flushes are
+// forgotten, lines of new series over MaxSeries are dropped.
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/validate"
+)
+
+// DefaultSource - source of metrics received by StatsD listener.
+const DefaultSource = "statsd"
+
+// maxPacketSize - biggest UDP packet.
+const maxPacketSize = 65535
+
+// maxLineSize - longest TCP line.
+const maxLineSize = 64 * 1024
+
+// Defaults of Aggregator.
+const (
+	//DefaultMaxSeries - most series aggregated at once.
+	DefaultMaxSeries = 10000
+	//DefaultMaxIdle - number of flushes gauge or counter fraction is kept without updates.
+	DefaultMaxIdle = 6
+)
+
+type seriesKey struct {
+	name   string
+	labels string
+}
+
+type counter struct {
+	tags map[string]string
+	sum  float64
+	//rest - fraction of sum not written yet
+	rest float64
+	//idle - number of flushes without updates
+	idle int
+}
+
+type gauge struct {
+	tags    map[string]string
+	value   float64
+	updated bool
+	//idle - number of flushes without updates
+	idle int
+}
+
+type timer struct {
+	tags   map[string]string
+	values []float64
+	count  float64
+}
+
+type set struct {
+	tags    map[string]string
+	members map[string]struct{}
+}
+
+// Aggregator - aggregates StatsD lines between flushes. It is safe for concurrent use.
+type Aggregator struct {
+	//MaxSeries - most series aggregated at once, 0 for no limit.
+	MaxSeries int
+	//MaxIdle - number of flushes gauge or counter fraction is kept without updates.
+	//Relative gauge update after gauge is forgotten starts from zero.
+	MaxIdle int
+
+	mu       sync.Mutex
+	counters map[seriesKey]*counter
+	gauges   map[seriesKey]*gauge
+	timers   map[seriesKey]*timer
+	sets     map[seriesKey]*set
+}
+
+// NewAggregator - Aggregator constructor.
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		MaxSeries: DefaultMaxSeries,
+		MaxIdle:   DefaultMaxIdle,
+		counters:  make(map[seriesKey]*counter),
+		gauges:    make(map[seriesKey]*gauge),
+		timers:    make(map[seriesKey]*timer),
+		sets:      make(map[seriesKey]*set),
+	}
+}
+
+// Add - add parsed line. It returns false if line is dropped because there are MaxSeries series.
+func (a *Aggregator) Add(line Line) bool {
+	key := seriesKey{name: line.Name, labels: models.Metrics{Labels: line.Tags}.LabelsKey()}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.has(line.Type, key) && a.MaxSeries > 0 && a.series() >= a.MaxSeries {
+		return false
+	}
+	switch line.Type {
+	case TypeCounter:
+		c, ok := a.counters[key]
+		if !ok {
+			c = &counter{tags: line.Tags}
+			a.counters[key] = c
+		}
+		c.sum += line.Value / line.SampleRate
+	case TypeGauge:
+		g, ok := a.gauges[key]
+		if !ok {
+			g = &gauge{tags: line.Tags}
+			a.gauges[key] = g
+		}
+		if line.Relative {
+			g.value += line.Value
+		} else {
+			g.value = line.Value
+		}
+		g.updated = true
+	case TypeTimer, TypeHistogram:
+		t, ok := a.timers[key]
+		if !ok {
+			t = &timer{tags: line.Tags}
+			a.timers[key] = t
+		}
+		t.values = append(t.values, line.Value)
+		t.count += 1 / line.SampleRate
+	case TypeSet:
+		s, ok := a.sets[key]
+		if !ok {
+			s = &set{tags: line.Tags, members: make(map[string]struct{})}
+			a.sets[key] = s
+		}
+		s.members[line.SetValue] = struct{}{}
+	}
+	return true
+}
+
+// has - return true if series of type is aggregated, a.mu must be locked.
+func (a *Aggregator) has(typ string, key seriesKey) bool {
+	var ok bool
+	switch typ {
+	case TypeCounter:
+		_, ok = a.counters[key]
+	case TypeGauge:
+		_, ok = a.gauges[key]
+	case TypeTimer, TypeHistogram:
+		_, ok = a.timers[key]
+	case TypeSet:
+		_, ok = a.sets[key]
+	}
+	return ok
+}
+
+// series - return number of aggregated series, a.mu must be locked.
+func (a *Aggregator) series() int {
+	return len(a.counters) + len(a.gauges) + len(a.timers) + len(a.sets)
+}
+
+// Flush - return metrics aggregated since previous flush and start new interval.
+// Gauges keep their values for relative updates in next intervals until they are idle for MaxIdle flushes.
+func (a *Aggregator) Flush() []models.Metrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := []models.Metrics{}
+	for key, c := range a.counters {
+		if c.sum == 0 {
+			c.idle++
+		} else {
+			c.idle = 0
+		}
+		total := c.sum + c.rest
+		delta := math.Trunc(total)
+		c.rest = total - delta
+		c.sum = 0
+		if delta != 0 {
+			result = append(result, newCounter(key.name, c.tags, int64(delta)))
+		}
+		if c.rest == 0 || c.idle >= a.MaxIdle {
+			delete(a.counters, key)
+		}
+	}
+	for key, g := range a.gauges {
+		if g.updated {
+			result = append(result, newGauge(key.name, g.tags, g.value))
+			g.updated = false
+			g.idle = 0
+		} else if g.idle++; g.idle >= a.MaxIdle {
+			delete(a.gauges, key)
+		}
+	}
+	for key, t := range a.timers {
+		result = append(result, t.metrics(key.name)...)
+	}
+	a.timers = make(map[seriesKey]*timer)
+	for key, s := range a.sets {
+		result = append(result, newGauge(key.name, s.tags, float64(len(s.members))))
+	}
+	a.sets = make(map[seriesKey]*set)
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].LabelsKey() < result[j].LabelsKey()
+	})
+	return result
+}
+
+func (t *timer) metrics(name string) []models.Metrics {
+	values := t.values
+	sort.Float64s(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return []models.Metrics{
+		newCounter(name+".count", t.tags, int64(math.Round(t.count))),
+		newGauge(name+".min", t.tags, values[0]),
+		newGauge(name+".max", t.tags, values[len(values)-1]),
+		newGauge(name+".mean", t.tags, sum/float64(len(values))),
+		newGauge(name+".median", t.tags, percentile(values, 50)),
+		newGauge(name+".p90", t.tags, percentile(values, 90)),
+		newGauge(name+".p99", t.tags, percentile(values, 99)),
+		newGauge(name+".sum", t.tags, sum),
+	}
+}
+
+// percentile - nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func newCounter(id string, tags map[string]string, delta int64) models.Metrics {
+	return models.Metrics{ID: id, MType: "counter", Delta: &delta, Labels: tags}
+}
+
+func newGauge(id string, tags map[string]string, value float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &value, Labels: tags}
+}
+
+// Server - StatsD listener.
+type Server struct {
+	//Addr - host:port to listen UDP and TCP on.
+	Addr string
+	//FlushInterval - how often aggregated metrics are written.
+	FlushInterval time.Duration
+	//Repo - storage metrics are written to.
+	Repo models.Storager
+	//Source - source of written metrics.
+	Source string
+	//Validator - checks aggregated metrics, rejected ones are not written.
+	Validator validate.Validator
+	//MaxSeries - most series aggregated at once, 0 for no limit. It must be set before Start.
+	MaxSeries int
+
+	agg      *Aggregator
+	bad      uint64
+	dropped  uint64
+	udp      net.PacketConn
+	tcp      net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// NewServer - Server constructor.
+func NewServer(addr string, flushInterval time.Duration, repo models.Storager) *Server {
+	return &Server{
+		Addr:          addr,
+		FlushInterval: flushInterval,
+		Repo:          repo,
+		Source:        DefaultSource,
+		Validator:     validate.New(),
+		MaxSeries:     DefaultMaxSeries,
+		agg:           NewAggregator(),
+		conns:         make(map[net.Conn]struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start - open listeners and start flushing.
+func (s *Server) Start() error {
+	if s.FlushInterval <= 0 {
+		return errors.New("flush interval must be positive")
+	}
+	s.agg.MaxSeries = s.MaxSeries
+	var err error
+	if s.udp, err = net.ListenPacket("udp", s.Addr); err != nil {
+		return err
+	}
+	if s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String()); err != nil {
+		s.udp.Close()
+		return err
+	}
+	s.wg.Add(3)
+	go s.serveUDP()
+	go s.serveTCP()
+	go s.flushLoop()
+	log.Printf("StatsD is listening on %s", s.udp.LocalAddr())
+	return nil
+}
+
+// UDPAddr - return address of UDP listener.
+func (s *Server) UDPAddr() net.Addr {
+	return s.udp.LocalAddr()
+}
+
+// TCPAddr - return address of TCP listener.
+func (s *Server) TCPAddr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// Close - stop listeners and write metrics aggregated so far.
+func (s *Server) Close() error {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.udp.Close()
+		s.tcp.Close()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	})
+	s.wg.Wait()
+	return s.Flush(context.Background())
+}
+
+// Handle - parse and aggregate packet of newline separated lines.
+func (s *Server) Handle(packet []byte) {
+	for _, text := range strings.Split(string(packet), "\n") {
+		s.handleLine(text)
+	}
+}
+
+func (s *Server) handleLine(text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	line, err := Parse(text)
+	if err != nil {
+		atomic.AddUint64(&s.bad, 1)
+		return
+	}
+	if !s.agg.Add(line) {
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Flush - write metrics aggregated since previous flush.
+func (s *Server) Flush(ctx context.Context) error {
+	if bad := atomic.SwapUint64(&s.bad, 0); bad > 0 {
+		log.Printf("StatsD: %d malformed lines skipped", bad)
+	}
+	if dropped := atomic.SwapUint64(&s.dropped, 0); dropped > 0 {
+		log.Printf("StatsD: %d lines of new series dropped, series limit is %d", dropped, s.agg.MaxSeries)
+	}
+	data := s.agg.Flush()
+	good := data[:0]
+	for i := range data {
+		if err := s.Validator.Metric(data[i]); err != nil {
+			log.Printf("StatsD: %s", err)
+			continue
+		}
+		data[i].Source = s.Source
+		good = append(good, data[i])
+	}
+	if len(good) == 0 {
+		return nil
+	}
+	return s.Repo.BatchInsert(ctx, good)
+}
+
+func (s *Server) flushLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), s.FlushInterval)
+			if err := s.Flush(ctx); err != nil {
+				log.Printf("StatsD flush failed: %s", err)
+			}
+			cancel()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if n > 0 {
+			s.Handle(buf[:n])
+		}
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("StatsD UDP read failed: %s", err)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("StatsD TCP accept failed: %s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		select {
+		case <-s.done:
+			//Close has already closed connections
+			s.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text())
+	}
+}
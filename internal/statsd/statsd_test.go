@@ -0,0 +1,207 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Line
+		wantErr bool
+	}{
+		{
+			name: "positive counter",
+			line: "requests:1|c",
+			want: Line{Name: "requests", Type: TypeCounter, Value: 1, SampleRate: 1},
+		},
+		{
+			name: "positive sampled counter with tags",
+			line: "requests:2|c|@0.5|#route:home,canary",
+			want: Line{Name: "requests", Type: TypeCounter, Value: 2, SampleRate: 0.5, Tags: map[string]string{"route": "home", "canary": ""}},
+		},
+		{
+			name: "positive relative gauge",
+			line: "queue:-3|g",
+			want: Line{Name: "queue", Type: TypeGauge, Value: -3, Relative: true, SampleRate: 1},
+		},
+		{
+			name: "positive timer",
+			line: "db.query:12.5|ms|@0.1",
+			want: Line{Name: "db.query", Type: TypeTimer, Value: 12.5, SampleRate: 0.1},
+		},
+		{
+			name: "positive set",
+			line: "users:alice|s",
+			want: Line{Name: "users", Type: TypeSet, SetValue: "alice", SampleRate: 1},
+		},
+		{
+			name:    "negative no name",
+			line:    ":1|c",
+			wantErr: true,
+		},
+		{
+			name:    "negative no type",
+			line:    "requests:1",
+			wantErr: true,
+		},
+		{
+			name:    "negative unknown type",
+			line:    "requests:1|x",
+			wantErr: true,
+		},
+		{
+			name:    "negative value",
+			line:    "requests:one|c",
+			wantErr: true,
+		},
+		{
+			name:    "negative NaN gauge",
+			line:    "x:NaN|g",
+			wantErr: true,
+		},
+		{
+			name:    "negative infinite counter",
+			line:    "x:Inf|c",
+			wantErr: true,
+		},
+		{
+			name:    "negative sample rate",
+			line:    "requests:1|c|@2",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAggregator_Flush(t *testing.T) {
+	a := NewAggregator()
+	for _, text := range []string{
+		"requests:1|c",
+		"requests:1|c|@0.5",
+		"requests:1|c|#route:home",
+		"hits:1|c|@0.4",
+		"queue:10|g",
+		"queue:-3|g",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+	} {
+		line, err := Parse(text)
+		require.NoError(t, err)
+		a.Add(line)
+	}
+	for i := 1; i <= 10; i++ {
+		line, err := Parse(fmt.Sprintf("latency:%d|ms", i))
+		require.NoError(t, err)
+		a.Add(line)
+	}
+	assert.Equal(t, []string{
+		"hits:counter:2",
+		"latency.count:counter:10",
+		"latency.max:gauge:10.000000",
+		"latency.mean:gauge:5.500000",
+		"latency.median:gauge:5.000000",
+		"latency.min:gauge:1.000000",
+		"latency.p90:gauge:9.000000",
+		"latency.p99:gauge:10.000000",
+		"latency.sum:gauge:55.000000",
+		"queue:gauge:7.000000",
+		"requests:counter:3",
+		"requests:counter:1",
+		"users:gauge:2.000000",
+	}, stringData(a.Flush()))
+
+	//fraction of counter is carried, gauge keeps value for relative updates
+	for _, text := range []string{"hits:1|c|@0.4", "queue:+1|g"} {
+		line, err := Parse(text)
+		require.NoError(t, err)
+		a.Add(line)
+	}
+	assert.Equal(t, []string{"hits:counter:3", "queue:gauge:8.000000"}, stringData(a.Flush()))
+	assert.Empty(t, a.Flush())
+}
+
+func TestAggregator_Prune(t *testing.T) {
+	a := NewAggregator()
+	a.MaxSeries = 3
+	a.MaxIdle = 2
+	for _, text := range []string{"requests:1|c", "hits:1|c|@0.4", "queue:10|g", "users:alice|s"} {
+		line, err := Parse(text)
+		require.NoError(t, err)
+		a.Add(line)
+	}
+	assert.Equal(t, 3, a.series(), "set over limit is dropped")
+	assert.Equal(t, []string{"hits:counter:2", "queue:gauge:10.000000", "requests:counter:1"}, stringData(a.Flush()))
+	assert.Len(t, a.counters, 1, "counter without fraction is forgotten")
+	assert.Empty(t, a.Flush())
+	assert.Len(t, a.gauges, 1)
+	assert.Empty(t, a.Flush())
+	assert.Empty(t, a.counters, "idle fraction is forgotten")
+	assert.Empty(t, a.gauges, "idle gauge is forgotten")
+	line, err := Parse("users:alice|s")
+	require.NoError(t, err)
+	assert.True(t, a.Add(line))
+}
+
+func TestServer(t *testing.T) {
+	repo := storage.NewRepo()
+	s := NewServer("127.0.0.1:0", time.Hour, &repo)
+	require.NoError(t, s.Start())
+
+	udp, err := net.Dial("udp", s.UDPAddr().String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("requests:2|c\nbroken\nqueue:5|g"))
+	require.NoError(t, err)
+
+	tcp, err := net.Dial("tcp", s.TCPAddr().String())
+	require.NoError(t, err)
+	_, err = tcp.Write([]byte("requests:3|c\n"))
+	require.NoError(t, err)
+	require.NoError(t, tcp.Close())
+
+	//UDP delivery is asynchronous
+	require.Eventually(t, func() bool {
+		s.agg.mu.Lock()
+		defer s.agg.mu.Unlock()
+		c, ok := s.agg.counters[seriesKey{name: "requests"}]
+		return ok && c.sum == 5 && len(s.agg.gauges) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, s.Close())
+
+	got, err := repo.GetMetric(models.Metrics{ID: "requests", MType: "counter", Source: DefaultSource})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *got.Delta)
+	got, err = repo.GetMetric(models.Metrics{ID: "queue", MType: "gauge"})
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, *got.Value)
+	assert.Equal(t, DefaultSource, got.Source)
+}
+
+func stringData(data []models.Metrics) []string {
+	result := make([]string, 0, len(data))
+	for _, m := range data {
+		result = append(result, m.StringData())
+	}
+	return result
+}
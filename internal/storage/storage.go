@@ -9,16 +9,47 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/pubsub"
 	"github.com/MaximkaSha/log_tools/internal/utils"
 )
 
 //Repository - in memory storage.
+//Use NewRepo to create it.
 type Repository struct {
 	//JSONDB - array of models.Metrics
 	JSONDB []models.Metrics
+	//KeyTTL - how long batch idempotency keys are remembered.
+	KeyTTL time.Duration
+	mu     *sync.RWMutex
+	keys   *batchKeys
+	hub    *pubsub.Hub
+}
+
+//batchKey - remembered result and hash of batch.
+type batchKey struct {
+	result models.BatchResult
+	hash   string
+	added  time.Time
+}
+
+//batchKeys - remembered batch keys in the order they were added.
+type batchKeys struct {
+	byKey map[string]batchKey
+	order []string
+}
+
+//expire - forget keys added before cutoff.
+func (k *batchKeys) expire(cutoff time.Time) {
+	for len(k.order) > 0 && k.byKey[k.order[0]].added.Before(cutoff) {
+		delete(k.byKey, k.order[0])
+		k.order = k.order[1:]
+	}
 }
 
 //InsertMetrics - add models.Metrics to storage.
@@ -31,19 +62,51 @@ func (r *Repository) InsertMetric(ctx context.Context, m models.Metrics) error {
 //
 //DEPRICATED: use InsertMetric.
 func (r *Repository) AppendMetric(m models.Metrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.appendMetric(m)
+}
+
+//appendMetric - add metric and publish change, r.mu must be locked.
+func (r *Repository) appendMetric(m models.Metrics) {
+	r.putMetric(m, true)
+}
+
+//putMetric - save metric and publish change, counter is added to stored value if add is true.
+//r.mu must be locked.
+func (r *Repository) putMetric(m models.Metrics, add bool) {
+	m.Stale = false
 	for i := range r.JSONDB {
-		if r.JSONDB[i].ID == m.ID {
+		if r.JSONDB[i].SameSeries(m) {
+			old := r.JSONDB[i]
+			m.Touch(&r.JSONDB[i], time.Now())
 			if m.Delta != nil {
-				newDelta := *(r.JSONDB[i].Delta) + *(m.Delta)
+				var newDelta int64
+				if add && r.JSONDB[i].Delta != nil {
+					newDelta = *(r.JSONDB[i].Delta)
+				}
+				newDelta += *(m.Delta)
 				r.JSONDB[i].Delta = &newDelta
 			}
 			r.JSONDB[i].Value = m.Value
 			r.JSONDB[i].Hash = m.Hash
+			r.JSONDB[i].Host = m.Host
+			r.JSONDB[i].FirstSeen = m.FirstSeen
+			r.JSONDB[i].UpdatedAt = m.UpdatedAt
+			r.hub.Publish(&old, r.JSONDB[i])
 			return
 		}
 	}
 	//	log.Println(m)
+	m.Touch(nil, time.Now())
 	r.JSONDB = append(r.JSONDB, m)
+	r.hub.Publish(nil, m)
+}
+
+//Subscribe - subscribe for changes of metrics which ID matches pattern.
+//Events are published in the order of writes. Restore does not publish events.
+func (r *Repository) Subscribe(pattern string, size int) (models.Subscription, error) {
+	return r.hub.Subscribe(pattern, size)
 }
 
 //SaveData - save data from in-memory storage to file.
@@ -51,9 +114,12 @@ func (r *Repository) SaveData(file string) {
 	if file == "" {
 		return
 	}
+	r.mu.RLock()
 	jData, err := json.Marshal(r.JSONDB)
+	r.mu.RUnlock()
 	if err != nil {
-		log.Panic(err)
+		log.Printf("Cant save data: %s", err)
+		return
 	}
 	_ = ioutil.WriteFile(file, jData, 0644)
 }
@@ -74,22 +140,35 @@ func (r *Repository) Restore(file string) {
 	if err != nil {
 		log.Println("Data file corrupted")
 	} else {
+		r.mu.Lock()
 		r.JSONDB = data
+		r.mu.Unlock()
 		log.Print("Data restored from file")
 	}
 
 }
 
 //GetMetric - get models.Metrics from storage.
+//If data.Source is empty metric is aggregated across sources.
 func (r *Repository) GetMetric(data models.Metrics) (models.Metrics, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var series []models.Metrics
 	for i := range r.JSONDB {
 		//log.Printf("db: %s , data:%s", r.JSONDB[i].ID, data.ID)
-		if r.JSONDB[i].ID == data.ID {
-			data.Value = r.JSONDB[i].Value
-			data.Delta = r.JSONDB[i].Delta
-			return data, nil
+		if r.JSONDB[i].ID == data.ID && (data.Source == "" || r.JSONDB[i].Source == data.Source) {
+			series = append(series, r.JSONDB[i])
 		}
 	}
+	if found, err := models.AggregateSources(series, ""); err == nil {
+		data.Value = found.Value
+		data.Delta = found.Delta
+		data.Source = found.Source
+		data.Host = found.Host
+		data.FirstSeen = found.FirstSeen
+		data.UpdatedAt = found.UpdatedAt
+		return data, nil
+	}
 	var intVal = new(int64)
 	floatVal := 0.0
 	data.Delta = intVal
@@ -129,36 +208,113 @@ func (r *Repository) InsertData(ctx context.Context, typeVar string, name string
 }
 
 //GetAll - get all []models.Metrics from storage.
-func (r Repository) GetAll(ctx context.Context) []models.Metrics {
-	return r.JSONDB
+func (r *Repository) GetAll(ctx context.Context) []models.Metrics {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]models.Metrics{}, r.JSONDB...)
+}
+
+//GetSeries - get series of metric id reported by all sources.
+func (r *Repository) GetSeries(ctx context.Context, id string) []models.Metrics {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	series := []models.Metrics{}
+	for i := range r.JSONDB {
+		if r.JSONDB[i].ID == id {
+			series = append(series, r.JSONDB[i])
+		}
+	}
+	return series
+}
+
+//List - get page of metrics which match query filters in query order.
+func (r *Repository) List(ctx context.Context, q models.ListQuery) (models.ListPage, error) {
+	if err := q.Prepare(); err != nil {
+		return models.ListPage{}, err
+	}
+	matched := []models.Metrics{}
+	r.mu.RLock()
+	for _, m := range r.JSONDB {
+		if q.Match(m) && q.AfterCursor(m) {
+			matched = append(matched, m)
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(matched, func(i, j int) bool {
+		return q.Less(matched[i], matched[j])
+	})
+	page := models.ListPage{Metrics: matched}
+	if len(matched) > q.Limit {
+		page.Metrics = matched[:q.Limit]
+		page.NextCursor = q.NextCursor(page.Metrics[q.Limit-1])
+	}
+	return page, nil
 }
 
 //PingDB - get current status of DB.
 //Always false (we are not using DB).
-func (r Repository) PingDB() bool {
+func (r *Repository) PingDB() bool {
 	return false
 }
 
-//BatchInsert - not implemented.
-func (r Repository) BatchInsert(ctx context.Context, dataModels []models.Metrics) error {
-	return errors.New("not implemented for RAM storage")
+//BatchInsert - add all []models.Metrics to storage at once.
+func (r *Repository) BatchInsert(ctx context.Context, dataModels []models.Metrics) error {
+	if len(dataModels) == 0 {
+		return errors.New("empty batch")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range dataModels {
+		r.appendMetric(m)
+	}
+	return nil
 }
 
-//GetCurrentCommit - return randVal from storage.
-func (r Repository) GetCurrentCommit() float64 {
-	randVal := models.Metrics{
-		ID: "RandomValue",
+//BatchSet - save all []models.Metrics to storage at once, counters replace stored values.
+func (r *Repository) BatchSet(ctx context.Context, dataModels []models.Metrics) error {
+	if len(dataModels) == 0 {
+		return errors.New("empty batch")
 	}
-	randVal, err := r.GetMetric(randVal)
-	if err != nil {
-		return 0
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range dataModels {
+		r.putMetric(m, false)
+	}
+	return nil
+}
+
+//BatchInsertOnce - add batch to storage once per idempotency key.
+//If key was seen during KeyTTL with the same hash, stored result and true are returned and nothing is added,
+//if it was seen with other hash, models.ErrKeyConflict is returned.
+func (r *Repository) BatchInsertOnce(ctx context.Context, key string, hash string, dataModels []models.Metrics, result models.BatchResult) (models.BatchResult, bool, error) {
+	if len(dataModels) == 0 {
+		return result, false, errors.New("empty batch")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.keys.expire(now.Add(-r.KeyTTL))
+	if stored, ok := r.keys.byKey[key]; ok {
+		if stored.hash != hash {
+			return result, false, models.ErrKeyConflict
+		}
+		return stored.result, true, nil
+	}
+	for _, m := range dataModels {
+		r.appendMetric(m)
 	}
-	return *randVal.Value
+	r.keys.byKey[key] = batchKey{result: result, hash: hash, added: now}
+	r.keys.order = append(r.keys.order, key)
+	return result, false, nil
 }
 
 //NewRepo - Repository constructor.
 func NewRepo() Repository {
 	return Repository{
 		JSONDB: []models.Metrics{},
+		KeyTTL: 24 * time.Hour,
+		mu:     &sync.RWMutex{},
+		keys:   &batchKeys{byKey: make(map[string]batchKey)},
+		hub:    pubsub.NewHub(),
 	}
 }
@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/MaximkaSha/log_tools/internal/models"
 )
@@ -52,6 +54,113 @@ func TestRepository_insertCount(t *testing.T) {
 	}
 }
 
+func TestRepository_BatchInsertOnce(t *testing.T) {
+	tests := []struct {
+		name         string
+		ttl          time.Duration
+		wantReplayed bool
+		wantDelta    int64
+	}{
+		{
+			name:         "positive replayed",
+			ttl:          time.Hour,
+			wantReplayed: true,
+			wantDelta:    1,
+		},
+		{
+			name:         "positive expired key",
+			ttl:          0,
+			wantReplayed: false,
+			wantDelta:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			r := NewRepo()
+			r.KeyTTL = tt.ttl
+			delta := int64(1)
+			batch := []models.Metrics{{ID: "Test", MType: "counter", Delta: &delta}}
+			_, replayed, err := r.BatchInsertOnce(ctx, "key", models.BatchHash(batch), batch, models.BatchResult{Key: "key", Accepted: 1})
+			if err != nil || replayed {
+				t.Fatalf("Repository.BatchInsertOnce() replayed = %v, error = %v", replayed, err)
+			}
+			time.Sleep(time.Millisecond)
+			result, replayed, err := r.BatchInsertOnce(ctx, "key", models.BatchHash(batch), batch, models.BatchResult{Key: "key", Accepted: 5})
+			if err != nil || replayed != tt.wantReplayed {
+				t.Errorf("Repository.BatchInsertOnce() replayed = %v, error = %v, want replayed %v", replayed, err, tt.wantReplayed)
+			}
+			if tt.wantReplayed && result.Accepted != 1 {
+				t.Errorf("Repository.BatchInsertOnce() result = %v, want original result", result)
+			}
+			if m, _ := r.GetMetric(models.Metrics{ID: "Test"}); *m.Delta != tt.wantDelta {
+				t.Errorf("Repository.GetMetric() delta = %v, want %v", *m.Delta, tt.wantDelta)
+			}
+		})
+	}
+}
+
+func TestRepository_BatchInsertOnceConflict(t *testing.T) {
+	ctx := context.TODO()
+	r := NewRepo()
+	one, two := int64(1), int64(2)
+	first := []models.Metrics{{ID: "Test", MType: "counter", Delta: &one}}
+	second := []models.Metrics{{ID: "Test", MType: "counter", Delta: &two}}
+	if _, _, err := r.BatchInsertOnce(ctx, "key", models.BatchHash(first), first, models.BatchResult{Key: "key", Accepted: 1}); err != nil {
+		t.Fatalf("Repository.BatchInsertOnce() error = %v", err)
+	}
+	_, replayed, err := r.BatchInsertOnce(ctx, "key", models.BatchHash(second), second, models.BatchResult{Key: "key", Accepted: 1})
+	if !errors.Is(err, models.ErrKeyConflict) || replayed {
+		t.Errorf("Repository.BatchInsertOnce() replayed = %v, error = %v, want ErrKeyConflict", replayed, err)
+	}
+	if m, _ := r.GetMetric(models.Metrics{ID: "Test"}); *m.Delta != 1 {
+		t.Errorf("Repository.GetMetric() delta = %v, want 1", *m.Delta)
+	}
+}
+
+func TestRepository_BatchSet(t *testing.T) {
+	ctx := context.TODO()
+	r := NewRepo()
+	stored, total := int64(10), int64(3)
+	r.InsertMetric(ctx, models.Metrics{ID: "Test", MType: "counter", Delta: &stored})
+	for i := 0; i < 2; i++ {
+		if err := r.BatchSet(ctx, []models.Metrics{{ID: "Test", MType: "counter", Delta: &total}}); err != nil {
+			t.Fatalf("Repository.BatchSet() error = %v", err)
+		}
+	}
+	if m, _ := r.GetMetric(models.Metrics{ID: "Test"}); *m.Delta != 3 {
+		t.Errorf("Repository.GetMetric() delta = %v, want 3", *m.Delta)
+	}
+}
+
+func TestRepository_Subscribe(t *testing.T) {
+	ctx := context.TODO()
+	r := NewRepo()
+	sub, err := r.Subscribe("Poll*", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for _, v := range []int64{1, 2} {
+		delta := v
+		r.InsertMetric(ctx, models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	}
+	r.InsertMetric(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: new(float64)})
+	first := <-sub.Events()
+	if first.Old != nil || *first.New.Delta != 1 {
+		t.Errorf("first event = %+v, want created counter with 1", first)
+	}
+	second := <-sub.Events()
+	if second.Seq != first.Seq+1 || *second.Old.Delta != 1 || *second.New.Delta != 3 {
+		t.Errorf("second event = %+v, want counter changed from 1 to 3", second)
+	}
+	select {
+	case event := <-sub.Events():
+		t.Errorf("unexpected event %+v", event)
+	default:
+	}
+}
+
 /*
 func TestRepository_insertGouge(t *testing.T) {
 	type args struct {
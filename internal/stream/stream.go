@@ -0,0 +1,271 @@
+//Package stream delivers live metric changes to clients over Server-Sent Events and WebSocket.
+//
+//Broker holds one subscription to storage changes, so it sees every metric
+//written by any ingest path. The last changes are kept in a history ring:
+//client which reconnects with ID of the last event it has seen gets missed
+//events from history before live ones. If they are not in history anymore,
+//client gets EventGap and should reload state.
+//
+//Every client has a bounded buffer. Publishing never waits for clients: client
+//whose buffer is full is disconnected and may resume from history.
+package stream
+
+import (
+	"errors"
+	"path"
+	"sync"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/pubsub"
+)
+
+//DefaultHistory - number of changes kept for resuming clients.
+const DefaultHistory = 1000
+
+//DefaultBuffer - number of changes buffered for one client.
+const DefaultBuffer = 256
+
+//Events sent to clients.
+const (
+	//EventUpdate - metric was changed.
+	EventUpdate = "update"
+	//EventGap - some changes after requested event are not in history anymore.
+	EventGap = "gap"
+)
+
+//ErrClosed - broker is closed.
+var ErrClosed = errors.New("stream is closed")
+
+//Message - change sent to client.
+type Message struct {
+	//Event - EventUpdate or EventGap.
+	Event string `json:"event"`
+	//Seq - sequence number of change, it is event ID for resuming.
+	Seq uint64 `json:"seq,omitempty"`
+	//Old - metric before change, nil if metric was created.
+	Old *models.Metrics `json:"old,omitempty"`
+	//New - metric after change.
+	New *models.Metrics `json:"new,omitempty"`
+}
+
+//NewMessage - return update message of change.
+func NewMessage(ev models.ChangeEvent) Message {
+	return Message{Event: EventUpdate, Seq: ev.Seq, Old: ev.Old, New: &ev.New}
+}
+
+//Filter - selects changes client receives.
+type Filter struct {
+	//Pattern - metric ID pattern in path.Match syntax, empty for all.
+	Pattern string
+	//Type - metric type, empty for any.
+	Type string
+	//Source - metric source, empty for any.
+	Source string
+}
+
+//Validate - return error if filter is malformed.
+func (f Filter) Validate() error {
+	if _, err := path.Match(f.Pattern, ""); err != nil {
+		return err
+	}
+	if f.Type != "" && f.Type != "gauge" && f.Type != "counter" {
+		return errors.New("unknown type " + f.Type)
+	}
+	return nil
+}
+
+//Match - return true if metric passes filter.
+func (f Filter) Match(m models.Metrics) bool {
+	if f.Type != "" && m.MType != f.Type {
+		return false
+	}
+	if f.Source != "" && m.Source != f.Source {
+		return false
+	}
+	if f.Pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(f.Pattern, m.ID)
+	return ok
+}
+
+//Client - subscriber of Broker.
+type Client struct {
+	broker   *Broker
+	filter   Filter
+	events   chan models.ChangeEvent
+	overflow bool
+}
+
+//Events - return channel of live changes, it is closed when client is closed or its buffer overflows.
+func (c *Client) Events() <-chan models.ChangeEvent {
+	return c.events
+}
+
+//Overflowed - return true if client was disconnected because its buffer was full.
+//It is valid after Events channel is closed.
+func (c *Client) Overflowed() bool {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	return c.overflow
+}
+
+//Close - unsubscribe client.
+func (c *Client) Close() {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	c.broker.remove(c)
+}
+
+//Broker - fans out storage changes to clients.
+type Broker struct {
+	//BufferSize - buffer size of new clients.
+	BufferSize int
+
+	mu      sync.Mutex
+	sub     models.Subscription
+	history []models.ChangeEvent
+	next    int
+	full    bool
+	lastSeq uint64
+	clients map[*Client]struct{}
+	closed  bool
+	done    chan struct{}
+}
+
+//NewBroker - Broker constructor, it subscribes to changes of repo.
+//History is number of changes kept for resuming, DefaultHistory is used if it is not positive.
+func NewBroker(repo models.Storager, history int) (*Broker, error) {
+	if history <= 0 {
+		history = DefaultHistory
+	}
+	sub, err := repo.Subscribe("", pubsub.MaxBuffer)
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		BufferSize: DefaultBuffer,
+		sub:        sub,
+		history:    make([]models.ChangeEvent, history),
+		clients:    make(map[*Client]struct{}),
+		done:       make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *Broker) run() {
+	defer close(b.done)
+	for ev := range b.sub.Events() {
+		b.publish(ev)
+	}
+}
+
+//publish - add change to history and send it to clients.
+func (b *Broker) publish(ev models.ChangeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.history[b.next] = ev
+	b.next = (b.next + 1) % len(b.history)
+	if b.next == 0 {
+		b.full = true
+	}
+	b.lastSeq = ev.Seq
+	for c := range b.clients {
+		if !c.filter.Match(ev.New) {
+			continue
+		}
+		select {
+		case c.events <- ev:
+		default:
+			c.overflow = true
+			b.remove(c)
+		}
+	}
+}
+
+//remove - unregister client and close its channel, b.mu must be locked.
+func (b *Broker) remove(c *Client) {
+	if _, ok := b.clients[c]; !ok {
+		return
+	}
+	delete(b.clients, c)
+	close(c.events)
+}
+
+//Subscribe - register client for changes passing filter.
+//If resume is true, changes after lastID which are still in history are returned to be sent before live ones,
+//gap is true if some of them are lost. Live changes start right after returned ones.
+func (b *Broker) Subscribe(f Filter, lastID uint64, resume bool) (c *Client, replay []models.ChangeEvent, gap bool, err error) {
+	if err := f.Validate(); err != nil {
+		return nil, nil, false, err
+	}
+	size := b.BufferSize
+	if size <= 0 {
+		size = DefaultBuffer
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nil, false, ErrClosed
+	}
+	if resume {
+		replay, gap = b.since(lastID, f)
+	}
+	c = &Client{broker: b, filter: f, events: make(chan models.ChangeEvent, size)}
+	b.clients[c] = struct{}{}
+	return c, replay, gap, nil
+}
+
+//History - return changes kept in history in order of their sequence numbers.
+func (b *Broker) History() []models.ChangeEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	replay, _ := b.since(0, Filter{})
+	return replay
+}
+
+//since - return changes after lastID passing filter, gap is true if some changes are not in history.
+//b.mu must be locked.
+func (b *Broker) since(lastID uint64, f Filter) ([]models.ChangeEvent, bool) {
+	if lastID > b.lastSeq {
+		//sequence was restarted
+		return nil, true
+	}
+	events := b.history[:b.next]
+	if b.full {
+		events = append(append([]models.ChangeEvent{}, b.history[b.next:]...), b.history[:b.next]...)
+	}
+	gap := false
+	prev := lastID
+	var replay []models.ChangeEvent
+	for _, ev := range events {
+		if ev.Seq <= lastID {
+			continue
+		}
+		if ev.Seq != prev+1 {
+			gap = true
+		}
+		prev = ev.Seq
+		if f.Match(ev.New) {
+			replay = append(replay, ev)
+		}
+	}
+	return replay, gap || prev != b.lastSeq
+}
+
+//Close - disconnect all clients and stop receiving changes.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	for c := range b.clients {
+		b.remove(c)
+	}
+	b.mu.Unlock()
+	b.sub.Close()
+	<-b.done
+}
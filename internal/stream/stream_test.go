@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func insert(t *testing.T, repo models.Storager, ids ...string) {
+	for _, id := range ids {
+		v := 1.0
+		require.NoError(t, repo.InsertMetric(context.TODO(), models.Metrics{ID: id, MType: "gauge", Value: &v}))
+	}
+}
+
+//receive - read n events of client.
+func receive(t *testing.T, c *Client, n int) []uint64 {
+	var seqs []uint64
+	for i := 0; i < n; i++ {
+		select {
+		case ev := <-c.Events():
+			seqs = append(seqs, ev.Seq)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events of %d", i, n)
+		}
+	}
+	return seqs
+}
+
+func TestBroker_Subscribe(t *testing.T) {
+	repo := storage.NewRepo()
+	b, err := NewBroker(&repo, 5)
+	require.NoError(t, err)
+	defer b.Close()
+
+	live, _, _, err := b.Subscribe(Filter{Pattern: "CPU*"}, 0, false)
+	require.NoError(t, err)
+	insert(t, &repo, "CPU1", "Alloc", "CPU2", "Alloc", "CPU1", "Alloc", "Alloc")
+	assert.Equal(t, []uint64{1, 3, 5}, receive(t, live, 3))
+	live.Close()
+	_, ok := <-live.Events()
+	assert.False(t, ok)
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.lastSeq == 7
+	}, time.Second, 10*time.Millisecond)
+	var history []uint64
+	for _, ev := range b.History() {
+		history = append(history, ev.Seq)
+	}
+	assert.Equal(t, []uint64{3, 4, 5, 6, 7}, history)
+
+	tests := []struct {
+		name       string
+		filter     Filter
+		lastID     uint64
+		wantReplay []uint64
+		wantGap    bool
+	}{
+		{name: "positive resume", lastID: 4, wantReplay: []uint64{5, 6, 7}},
+		{name: "positive resume with filter", filter: Filter{Pattern: "CPU*"}, lastID: 3, wantReplay: []uint64{5}},
+		{name: "positive up to date", lastID: 7},
+		{name: "negative lost in history", lastID: 1, wantReplay: []uint64{3, 4, 5, 6, 7}, wantGap: true},
+		{name: "negative restarted sequence", lastID: 100, wantGap: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, replay, gap, err := b.Subscribe(tt.filter, tt.lastID, true)
+			require.NoError(t, err)
+			defer c.Close()
+			var seqs []uint64
+			for _, ev := range replay {
+				seqs = append(seqs, ev.Seq)
+			}
+			assert.Equal(t, tt.wantReplay, seqs)
+			assert.Equal(t, tt.wantGap, gap)
+		})
+	}
+
+	_, _, _, err = b.Subscribe(Filter{Type: "histogram"}, 0, false)
+	assert.Error(t, err)
+}
+
+func TestBroker_Overflow(t *testing.T) {
+	repo := storage.NewRepo()
+	b, err := NewBroker(&repo, 0)
+	require.NoError(t, err)
+	b.BufferSize = 2
+	slow, _, _, err := b.Subscribe(Filter{}, 0, false)
+	require.NoError(t, err)
+	fast, _, _, err := b.Subscribe(Filter{Type: "counter"}, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		insert(t, &repo, fmt.Sprint("Gauge", i))
+	}
+	//broker publishes asynchronously
+	require.Eventually(t, slow.Overflowed, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []uint64{1, 2}, receive(t, slow, 2))
+	_, ok := <-slow.Events()
+	assert.False(t, ok)
+
+	b.Close()
+	_, ok = <-fast.Events()
+	assert.False(t, ok)
+	assert.False(t, fast.Overflowed())
+	_, _, _, err = b.Subscribe(Filter{}, 0, false)
+	assert.ErrorIs(t, err, ErrClosed)
+}
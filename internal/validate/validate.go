@@ -0,0 +1,197 @@
+//Package validate checks metrics received by ingest endpoints.
+//
+//Every ingest endpoint (path, JSON, batch, NDJSON, remote write, InfluxDB, OTLP,
+//gRPC, StatsD and Graphite) checks metrics with one Validator, so the same
+//metric is accepted or rejected everywhere. Errors wrap sentinel errors of this
+//package, transports map them to their status codes.
+package validate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+)
+
+//Default limits.
+const (
+	//DefaultMaxNameLength - longest metric name in bytes.
+	DefaultMaxNameLength = 255
+	//DefaultMaxBodySize - biggest JSON request body in bytes.
+	DefaultMaxBodySize = 8 << 20
+	//DefaultMaxBatchSize - most metrics in one batch.
+	DefaultMaxBatchSize = 10000
+)
+
+//Errors of validation.
+var (
+	//ErrBadName - metric name is empty, too long or has forbidden characters.
+	ErrBadName = errors.New("bad metric name")
+	//ErrUnknownType - metric type is not gauge or counter.
+	ErrUnknownType = errors.New("unknown metric type")
+	//ErrBadValue - value does not match type or is not finite.
+	ErrBadValue = errors.New("bad metric value")
+	//ErrBadJSON - body is not JSON of expected shape.
+	ErrBadJSON = errors.New("bad JSON")
+	//ErrUnknownField - JSON object has field which metric does not have.
+	ErrUnknownField = errors.New("unknown field")
+	//ErrTooLarge - body or batch is bigger than limit.
+	ErrTooLarge = errors.New("request is too large")
+	//ErrReadBody - body could not be read, like client closed connection.
+	ErrReadBody = errors.New("can not read body")
+)
+
+//Validator - checks metrics against limits.
+type Validator struct {
+	//MaxNameLength - longest metric name in bytes.
+	MaxNameLength int
+	//MaxBodySize - biggest JSON request body in bytes.
+	MaxBodySize int64
+	//MaxBatchSize - most metrics in one batch.
+	MaxBatchSize int
+}
+
+//New - Validator constructor with default limits.
+func New() Validator {
+	return Validator{
+		MaxNameLength: DefaultMaxNameLength,
+		MaxBodySize:   DefaultMaxBodySize,
+		MaxBatchSize:  DefaultMaxBatchSize,
+	}
+}
+
+//Name - check metric name: it is not empty, not longer than MaxNameLength,
+//valid UTF-8 without spaces, control characters and '/', '?', '#' which break URL paths.
+func (v Validator) Name(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: name is empty", ErrBadName)
+	}
+	if v.MaxNameLength > 0 && len(name) > v.MaxNameLength {
+		return fmt.Errorf("%w: name is longer than %d bytes", ErrBadName, v.MaxNameLength)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%w: name is not valid UTF-8", ErrBadName)
+	}
+	for _, c := range name {
+		if unicode.IsSpace(c) || unicode.IsControl(c) || strings.ContainsRune("/?#", c) {
+			return fmt.Errorf("%w: name %q has forbidden character %q", ErrBadName, name, c)
+		}
+	}
+	return nil
+}
+
+//Metric - check name, type, value and labels of metric.
+//Gauge must have finite value and no delta, counter must have delta and no value.
+func (v Validator) Metric(m models.Metrics) error {
+	if err := v.Name(m.ID); err != nil {
+		return err
+	}
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil || m.Delta != nil {
+			return fmt.Errorf("%w: gauge %s must have value and no delta", ErrBadValue, m.ID)
+		}
+		if math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return fmt.Errorf("%w: gauge %s value is not finite", ErrBadValue, m.ID)
+		}
+	case "counter":
+		if m.Delta == nil || m.Value != nil {
+			return fmt.Errorf("%w: counter %s must have delta and no value", ErrBadValue, m.ID)
+		}
+	default:
+		return fmt.Errorf("%w: %s has type %q", ErrUnknownType, m.ID, m.MType)
+	}
+	for key := range m.Labels {
+		if err := v.Name(key); err != nil {
+			return fmt.Errorf("%s label: %w", m.ID, err)
+		}
+	}
+	return nil
+}
+
+//BatchSize - check that batch of n metrics is not bigger than MaxBatchSize.
+func (v Validator) BatchSize(n int) error {
+	if v.MaxBatchSize > 0 && n > v.MaxBatchSize {
+		return fmt.Errorf("%w: batch has %d metrics, limit is %d", ErrTooLarge, n, v.MaxBatchSize)
+	}
+	return nil
+}
+
+//Batch - check size of batch and every metric of it.
+func (v Validator) Batch(data []models.Metrics) error {
+	if err := v.BatchSize(len(data)); err != nil {
+		return err
+	}
+	for i := range data {
+		if err := v.Metric(data[i]); err != nil {
+			return fmt.Errorf("metric %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+//ParsePath - parse metric of path parametrs type, name and value and check it.
+//Counter value must be integer, gauge value must be finite number.
+func (v Validator) ParsePath(mType string, name string, value string) (models.Metrics, error) {
+	m := models.Metrics{ID: name, MType: mType}
+	switch mType {
+	case "gauge":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return m, fmt.Errorf("%w: %q is not a number", ErrBadValue, value)
+		}
+		m.Value = &f
+	case "counter":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("%w: %q is not an integer", ErrBadValue, value)
+		}
+		m.Delta = &d
+	}
+	return m, v.Metric(m)
+}
+
+//ReadBody - read request body not bigger than MaxBodySize.
+//Error is ErrTooLarge if body is bigger and ErrReadBody if it can not be read.
+func (v Validator) ReadBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := io.Reader(r.Body)
+	if v.MaxBodySize > 0 {
+		// one byte more than limit tells too large body from body of limit size
+		body = io.LimitReader(r.Body, v.MaxBodySize+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrReadBody, err)
+	}
+	if v.MaxBodySize > 0 && int64(len(data)) > v.MaxBodySize {
+		return nil, fmt.Errorf("%w: body is bigger than %d bytes", ErrTooLarge, v.MaxBodySize)
+	}
+	return data, nil
+}
+
+//Decode - decode one JSON value of body to dst, unknown fields and trailing data are errors.
+func Decode(body []byte, dst interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		// encoding/json has no error type of unknown field
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return fmt.Errorf("%w %s", ErrUnknownField, strings.TrimPrefix(err.Error(), "json: unknown field "))
+		}
+		return fmt.Errorf("%w: %s", ErrBadJSON, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("%w: data after JSON value", ErrBadJSON)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package validate
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidator_Metric(t *testing.T) {
+	value := 1.5
+	nan := math.NaN()
+	inf := math.Inf(-1)
+	var delta int64 = 2
+	tests := []struct {
+		name    string
+		metric  models.Metrics
+		wantErr error
+	}{
+		{
+			name:   "positive gauge",
+			metric: models.Metrics{ID: "Alloc", MType: "gauge", Value: &value},
+		},
+		{
+			name:   "positive counter with labels",
+			metric: models.Metrics{ID: "http.requests:total", MType: "counter", Delta: &delta, Labels: map[string]string{"code": "200 OK"}},
+		},
+		{
+			name:    "negative empty name",
+			metric:  models.Metrics{MType: "gauge", Value: &value},
+			wantErr: ErrBadName,
+		},
+		{
+			name:    "negative long name",
+			metric:  models.Metrics{ID: strings.Repeat("a", DefaultMaxNameLength+1), MType: "gauge", Value: &value},
+			wantErr: ErrBadName,
+		},
+		{
+			name:    "negative name with space",
+			metric:  models.Metrics{ID: "Alloc bytes", MType: "gauge", Value: &value},
+			wantErr: ErrBadName,
+		},
+		{
+			name:    "negative name with slash",
+			metric:  models.Metrics{ID: "a/b", MType: "gauge", Value: &value},
+			wantErr: ErrBadName,
+		},
+		{
+			name:    "negative bad label key",
+			metric:  models.Metrics{ID: "Alloc", MType: "gauge", Value: &value, Labels: map[string]string{"": "x"}},
+			wantErr: ErrBadName,
+		},
+		{
+			name:    "negative unknown type",
+			metric:  models.Metrics{ID: "Alloc", MType: "histogram", Value: &value},
+			wantErr: ErrUnknownType,
+		},
+		{
+			name:    "negative counter with value",
+			metric:  models.Metrics{ID: "PollCount", MType: "counter", Value: &value},
+			wantErr: ErrBadValue,
+		},
+		{
+			name:    "negative counter with delta and value",
+			metric:  models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta, Value: &value},
+			wantErr: ErrBadValue,
+		},
+		{
+			name:    "negative gauge without value",
+			metric:  models.Metrics{ID: "Alloc", MType: "gauge"},
+			wantErr: ErrBadValue,
+		},
+		{
+			name:    "negative gauge NaN",
+			metric:  models.Metrics{ID: "Alloc", MType: "gauge", Value: &nan},
+			wantErr: ErrBadValue,
+		},
+		{
+			name:    "negative gauge Inf",
+			metric:  models.Metrics{ID: "Alloc", MType: "gauge", Value: &inf},
+			wantErr: ErrBadValue,
+		},
+	}
+	v := New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Metric(tt.metric)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidator_ParsePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		mType   string
+		value   string
+		wantErr error
+	}{
+		{name: "positive counter", mType: "counter", value: "100"},
+		{name: "positive gauge", mType: "gauge", value: "-1.5e3"},
+		{name: "negative counter float", mType: "counter", value: "1.5", wantErr: ErrBadValue},
+		{name: "negative counter overflow", mType: "counter", value: "99999999999999999999", wantErr: ErrBadValue},
+		{name: "negative gauge text", mType: "gauge", value: "none", wantErr: ErrBadValue},
+		{name: "negative gauge NaN", mType: "gauge", value: "NaN", wantErr: ErrBadValue},
+		{name: "negative gauge Inf", mType: "gauge", value: "+Inf", wantErr: ErrBadValue},
+		{name: "negative unknown type", mType: "gouge", value: "1", wantErr: ErrUnknownType},
+	}
+	v := New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := v.ParsePath(tt.mType, "Metric", tt.value)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "Metric", m.ID)
+			assert.Equal(t, tt.mType == "counter", m.Delta != nil)
+			assert.Equal(t, tt.mType == "gauge", m.Value != nil)
+		})
+	}
+}
+
+func TestValidator_Batch(t *testing.T) {
+	value := 1.0
+	v := Validator{MaxNameLength: 10, MaxBatchSize: 2}
+	assert.NoError(t, v.Batch([]models.Metrics{{ID: "a", MType: "gauge", Value: &value}}))
+	err := v.Batch([]models.Metrics{{ID: "a", MType: "gauge", Value: &value}, {ID: "b", MType: "counter", Value: &value}})
+	assert.ErrorIs(t, err, ErrBadValue)
+	assert.Contains(t, err.Error(), "metric 1")
+	err = v.Batch(make([]models.Metrics, 3))
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr error
+	}{
+		{name: "positive metric", body: `{"id":"Alloc","type":"gauge","value":1}`},
+		{name: "positive trailing space", body: "{\"id\":\"Alloc\"}\n"},
+		{name: "negative unknown field", body: `{"id":"Alloc","type":"gauge","valeu":1}`, wantErr: ErrUnknownField},
+		{name: "negative wrong field type", body: `{"id":"Alloc","type":"gauge","value":"1"}`, wantErr: ErrBadJSON},
+		{name: "negative two values", body: `{"id":"Alloc"}{"id":"Alloc"}`, wantErr: ErrBadJSON},
+		{name: "negative empty", body: ``, wantErr: ErrBadJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m models.Metrics
+			err := Decode([]byte(tt.body), &m)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidator_ReadBody(t *testing.T) {
+	v := Validator{MaxBodySize: 8}
+	body, err := v.ReadBody(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("12345678")))
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", string(body))
+	_, err = v.ReadBody(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("123456789")))
+	assert.ErrorIs(t, err, ErrTooLarge)
+	_, err = v.ReadBody(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", iotest.ErrReader(errors.New("connection reset"))))
+	assert.ErrorIs(t, err, ErrReadBody)
+	assert.NotErrorIs(t, err, ErrTooLarge)
+}
@@ -0,0 +1,480 @@
+//Package webhooks posts metric changes to HTTP endpoints of subscriptions.
+//
+//Dispatcher holds one subscription to storage changes. Every webhook
+//subscription selects changes by metric ID pattern and minimum change of
+//value, matching changes are collected into batches which are posted as JSON
+//when batch is full or BatchInterval after its first change. Body is signed
+//with HMAC-SHA256 of subscription secret in SignatureHeader. Failed deliveries
+//are repeated with exponential backoff, the last deliveries of every
+//subscription are kept for inspection. Subscriptions live in memory only.
+//Deliveries to loopback, private, link-local and other internal addresses are
+//refused when connection is made, unless Dispatcher.AllowPrivate is set.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/pubsub"
+)
+
+//Defaults of Dispatcher.
+const (
+	//DefaultBatchInterval - how long changes are collected before batch is posted.
+	DefaultBatchInterval = time.Second
+	//DefaultBatchSize - most changes in one batch.
+	DefaultBatchSize = 100
+	//DefaultRetries - number of repeated attempts of failed delivery.
+	DefaultRetries = 3
+	//DefaultBackoff - delay before the first repeated attempt, it doubles with every attempt.
+	DefaultBackoff = time.Second
+	//DefaultHistory - number of deliveries kept for every subscription.
+	DefaultHistory = 100
+)
+
+//SignatureHeader - header with "sha256=" and hex HMAC-SHA256 of body with subscription secret.
+const SignatureHeader = "X-Signature-256"
+
+//DeliveryHeader - header with delivery ID.
+const DeliveryHeader = "X-Delivery-ID"
+
+//queueSize - number of changes waiting for subscription worker, newer ones are dropped.
+const queueSize = 1000
+
+//deliveryTimeout - timeout of one delivery attempt.
+const deliveryTimeout = 10 * time.Second
+
+//States of delivery.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+//Errors of Dispatcher.
+var (
+	//ErrNotFound - subscription is not found.
+	ErrNotFound = errors.New("webhook subscription is not found")
+	//ErrForbiddenAddress - subscription URL points to internal address.
+	ErrForbiddenAddress = errors.New("webhook address is not allowed")
+	//ErrBadSubscription - subscription has bad pattern, URL, secret or minimum change.
+	ErrBadSubscription = errors.New("bad webhook subscription")
+)
+
+//Subscription - webhook subscription to metric changes.
+type Subscription struct {
+	//ID - subscription ID, set by Dispatcher.
+	ID string `json:"id"`
+	//Pattern - metric ID pattern in path.Match syntax.
+	Pattern string `json:"pattern"`
+	//MinChange - smallest absolute change of value which is posted, 0 posts every change.
+	MinChange float64 `json:"min_change,omitempty"`
+	//URL - endpoint batches are posted to.
+	URL string `json:"url"`
+	//Secret - key of body signature, it is never returned.
+	Secret string `json:"-"`
+	//CreatedAt - time subscription was created.
+	CreatedAt time.Time `json:"created_at"`
+	//Dropped - number of changes dropped because worker was behind.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+//Delivery - attempt to post one batch.
+type Delivery struct {
+	//ID - delivery ID, it is sent in DeliveryHeader.
+	ID string `json:"id"`
+	//Events - number of changes in batch.
+	Events int `json:"events"`
+	//Status - DeliveryPending, DeliveryDelivered or DeliveryFailed.
+	Status string `json:"status"`
+	//Attempts - number of attempts made.
+	Attempts int `json:"attempts"`
+	//StatusCode - HTTP status of last attempt, 0 if there was no response.
+	StatusCode int `json:"status_code,omitempty"`
+	//Error - error of last failed attempt.
+	Error string `json:"error,omitempty"`
+	//CreatedAt - time batch was formed.
+	CreatedAt time.Time `json:"created_at"`
+	//FinishedAt - time batch was delivered or given up.
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+//Payload - body of delivery.
+type Payload struct {
+	//Subscription - subscription ID.
+	Subscription string `json:"subscription"`
+	//Delivery - delivery ID.
+	Delivery string `json:"delivery"`
+	//Events - changes of metrics in order, counters carry stored sum.
+	Events []models.ChangeEvent `json:"events"`
+}
+
+//Sign - return value of SignatureHeader of body signed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//Validate - return error wrapping ErrBadSubscription if subscription is malformed.
+func (s Subscription) Validate() error {
+	if _, err := path.Match(s.Pattern, ""); err != nil || s.Pattern == "" {
+		return fmt.Errorf("%w: bad pattern %q", ErrBadSubscription, s.Pattern)
+	}
+	if s.MinChange < 0 || math.IsNaN(s.MinChange) || math.IsInf(s.MinChange, 0) {
+		return fmt.Errorf("%w: min_change must be finite and not negative", ErrBadSubscription)
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be absolute http or https URL", ErrBadSubscription)
+	}
+	if s.Secret == "" {
+		return fmt.Errorf("%w: secret is empty", ErrBadSubscription)
+	}
+	return nil
+}
+
+//Match - return true if change must be posted to subscription:
+//metric ID matches pattern and value changed at least by MinChange. Created metric always matches.
+func (s Subscription) Match(ev models.ChangeEvent) bool {
+	if ok, _ := path.Match(s.Pattern, ev.New.ID); !ok {
+		return false
+	}
+	if ev.Old == nil {
+		return true
+	}
+	change := math.Abs(ev.New.Float() - ev.Old.Float())
+	return change > 0 && change >= s.MinChange
+}
+
+//subscriber - subscription with its worker.
+type subscriber struct {
+	sub        Subscription
+	dropped    uint64
+	events     chan models.ChangeEvent
+	stop       chan struct{}
+	deliveries []*Delivery
+	seq        uint64
+}
+
+//Dispatcher - posts storage changes to subscriptions. It is safe for concurrent use.
+type Dispatcher struct {
+	//BatchInterval - how long changes are collected before batch is posted.
+	BatchInterval time.Duration
+	//BatchSize - most changes in one batch.
+	BatchSize int
+	//Retries - number of repeated attempts, delivery is repeated on network error, 429 and 5xx status.
+	Retries int
+	//Backoff - delay before the first repeated attempt.
+	Backoff time.Duration
+	//History - number of deliveries kept for every subscription.
+	History int
+	//AllowPrivate - allow deliveries to loopback, private, link-local and other internal addresses.
+	AllowPrivate bool
+
+	client *http.Client
+	sub    models.Subscription
+	mu     sync.Mutex
+	subs   map[string]*subscriber
+	closed bool
+	wg     sync.WaitGroup
+	done   chan struct{}
+}
+
+//NewDispatcher - Dispatcher constructor, it subscribes to changes of repo.
+func NewDispatcher(repo models.Storager) (*Dispatcher, error) {
+	sub, err := repo.Subscribe("", pubsub.MaxBuffer)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{
+		BatchInterval: DefaultBatchInterval,
+		BatchSize:     DefaultBatchSize,
+		Retries:       DefaultRetries,
+		Backoff:       DefaultBackoff,
+		History:       DefaultHistory,
+		sub:           sub,
+		subs:          make(map[string]*subscriber),
+		done:          make(chan struct{}),
+	}
+	//address is checked after it is resolved, so DNS names and redirects can not lead to internal hosts
+	dialer := &net.Dialer{Timeout: deliveryTimeout, Control: d.checkAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client = &http.Client{Timeout: deliveryTimeout, Transport: transport}
+	go d.run()
+	return d, nil
+}
+
+//checkAddress - refuse connection to internal address unless AllowPrivate is set.
+func (d *Dispatcher) checkAddress(network string, address string, _ syscall.RawConn) error {
+	if d.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isInternal(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+//isInternal - return true for loopback, private, link-local, unspecified and multicast addresses.
+func isInternal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for ev := range d.sub.Events() {
+		d.mu.Lock()
+		for _, s := range d.subs {
+			if !s.sub.Match(ev) {
+				continue
+			}
+			select {
+			case s.events <- ev:
+			default:
+				s.dropped++
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+//Create - add subscription and start posting its changes. ID and CreatedAt of s are set.
+//URL with internal IP or localhost host is refused unless AllowPrivate is set.
+func (d *Dispatcher) Create(s Subscription) (Subscription, error) {
+	if err := s.Validate(); err != nil {
+		return Subscription{}, err
+	}
+	if !d.AllowPrivate {
+		u, _ := url.Parse(s.URL)
+		host := strings.ToLower(u.Hostname())
+		if ip := net.ParseIP(host); (ip != nil && isInternal(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return Subscription{}, fmt.Errorf("%w: %s", ErrBadSubscription, ErrForbiddenAddress)
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Subscription{}, err
+	}
+	s.ID = hex.EncodeToString(id)
+	s.CreatedAt = time.Now()
+	s.Dropped = 0
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return Subscription{}, errors.New("webhooks are closed")
+	}
+	sr := &subscriber{sub: s, events: make(chan models.ChangeEvent, queueSize), stop: make(chan struct{})}
+	d.subs[s.ID] = sr
+	d.wg.Add(1)
+	go d.work(sr)
+	return s, nil
+}
+
+//Delete - remove subscription, waiting retries of its delivery are cancelled.
+func (d *Dispatcher) Delete(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.subs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(d.subs, id)
+	close(s.stop)
+	return nil
+}
+
+//Get - return subscription.
+func (d *Dispatcher) Get(id string) (Subscription, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.subs[id]
+	if !ok {
+		return Subscription{}, ErrNotFound
+	}
+	return s.subscription(), nil
+}
+
+//List - return subscriptions ordered by creation time.
+func (d *Dispatcher) List() []Subscription {
+	d.mu.Lock()
+	result := make([]Subscription, 0, len(d.subs))
+	for _, s := range d.subs {
+		result = append(result, s.subscription())
+	}
+	d.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+//subscription - return subscription with its dropped counter.
+//d.mu must be locked.
+func (s *subscriber) subscription() Subscription {
+	sub := s.sub
+	sub.Dropped = s.dropped
+	return sub
+}
+
+//Deliveries - return last deliveries of subscription, the newest first.
+func (d *Dispatcher) Deliveries(id string) ([]Delivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.subs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result := make([]Delivery, 0, len(s.deliveries))
+	for k := len(s.deliveries) - 1; k >= 0; k-- {
+		result = append(result, *s.deliveries[k])
+	}
+	return result, nil
+}
+
+//Close - stop receiving changes and stop all subscriptions.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for id, s := range d.subs {
+		delete(d.subs, id)
+		close(s.stop)
+	}
+	d.mu.Unlock()
+	d.sub.Close()
+	<-d.done
+	d.wg.Wait()
+}
+
+//work - collect changes of subscription into batches and post them.
+func (d *Dispatcher) work(s *subscriber) {
+	defer d.wg.Done()
+	var batch []models.ChangeEvent
+	var flush <-chan time.Time
+	for {
+		select {
+		case ev := <-s.events:
+			batch = append(batch, ev)
+			if len(batch) == 1 {
+				flush = time.After(d.BatchInterval)
+			}
+			if len(batch) < d.BatchSize {
+				continue
+			}
+		case <-flush:
+		case <-s.stop:
+			return
+		}
+		d.deliver(s, batch)
+		batch, flush = nil, nil
+	}
+}
+
+//deliver - post batch, repeating failed attempts, and record delivery.
+func (d *Dispatcher) deliver(s *subscriber, batch []models.ChangeEvent) {
+	d.mu.Lock()
+	s.seq++
+	delivery := &Delivery{ID: fmt.Sprintf("%s-%d", s.sub.ID, s.seq), Events: len(batch), Status: DeliveryPending, CreatedAt: time.Now()}
+	s.deliveries = append(s.deliveries, delivery)
+	if d.History > 0 && len(s.deliveries) > d.History {
+		s.deliveries = s.deliveries[len(s.deliveries)-d.History:]
+	}
+	d.mu.Unlock()
+	body, err := json.Marshal(Payload{Subscription: s.sub.ID, Delivery: delivery.ID, Events: batch})
+	if err != nil {
+		d.finish(delivery, DeliveryFailed, 0, err)
+		return
+	}
+	delay := d.Backoff
+	for attempt := 0; ; attempt++ {
+		code, retry, err := d.post(s.sub, delivery.ID, body)
+		d.mu.Lock()
+		delivery.Attempts++
+		d.mu.Unlock()
+		if err == nil {
+			d.finish(delivery, DeliveryDelivered, code, nil)
+			return
+		}
+		if !retry || attempt >= d.Retries {
+			log.Printf("Webhook %s: delivery %s failed: %s", s.sub.URL, delivery.ID, err)
+			d.finish(delivery, DeliveryFailed, code, err)
+			return
+		}
+		d.mu.Lock()
+		delivery.StatusCode, delivery.Error = code, err.Error()
+		d.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			d.finish(delivery, DeliveryFailed, code, fmt.Errorf("subscription is stopped: %w", err))
+			return
+		}
+		delay *= 2
+	}
+}
+
+//finish - set final status of delivery.
+func (d *Dispatcher) finish(delivery *Delivery, status string, code int, err error) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery.Status = status
+	delivery.StatusCode = code
+	delivery.Error = ""
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	delivery.FinishedAt = &now
+}
+
+//post - make one attempt, retry is true if attempt may be repeated.
+func (d *Dispatcher) post(s Subscription, deliveryID string, body []byte) (code int, retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(s.Secret, body))
+	req.Header.Set(DeliveryHeader, deliveryID)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, !errors.Is(err, ErrForbiddenAddress), err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	return resp.StatusCode, resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("status %s", resp.Status)
+}
@@ -0,0 +1,209 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MaximkaSha/log_tools/internal/models"
+	"github.com/MaximkaSha/log_tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func TestSubscription_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sub     Subscription
+		wantErr bool
+	}{
+		{name: "positive", sub: Subscription{Pattern: "Heap*", MinChange: 1.5, URL: "https://example.com/hook", Secret: "s"}},
+		{name: "negative empty pattern", sub: Subscription{URL: "http://example.com", Secret: "s"}, wantErr: true},
+		{name: "negative bad pattern", sub: Subscription{Pattern: "[", URL: "http://example.com", Secret: "s"}, wantErr: true},
+		{name: "negative min change", sub: Subscription{Pattern: "*", MinChange: -1, URL: "http://example.com", Secret: "s"}, wantErr: true},
+		{name: "negative min change NaN", sub: Subscription{Pattern: "*", MinChange: math.NaN(), URL: "http://example.com", Secret: "s"}, wantErr: true},
+		{name: "negative relative url", sub: Subscription{Pattern: "*", URL: "/hook", Secret: "s"}, wantErr: true},
+		{name: "negative ftp url", sub: Subscription{Pattern: "*", URL: "ftp://example.com", Secret: "s"}, wantErr: true},
+		{name: "negative empty secret", sub: Subscription{Pattern: "*", URL: "http://example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sub.Validate()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrBadSubscription)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSubscription_Match(t *testing.T) {
+	old := gauge("HeapAlloc", 10)
+	sub := Subscription{Pattern: "Heap*", MinChange: 5}
+	tests := []struct {
+		name string
+		ev   models.ChangeEvent
+		want bool
+	}{
+		{name: "positive created", ev: models.ChangeEvent{New: gauge("HeapAlloc", 10)}, want: true},
+		{name: "positive big change", ev: models.ChangeEvent{Old: &old, New: gauge("HeapAlloc", 4)}, want: true},
+		{name: "negative small change", ev: models.ChangeEvent{Old: &old, New: gauge("HeapAlloc", 14)}},
+		{name: "negative other metric", ev: models.ChangeEvent{New: gauge("Alloc", 10)}},
+		{name: "negative no change", ev: models.ChangeEvent{Old: &old, New: gauge("HeapAlloc", 10)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sub.Match(tt.ev))
+		})
+	}
+}
+
+func TestDispatcher_Deliver(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []Payload
+	statuses := []int{http.StatusInternalServerError, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, Sign("secret", body), r.Header.Get(SignatureHeader))
+		var p Payload
+		assert.NoError(t, json.Unmarshal(body, &p))
+		assert.Equal(t, p.Delivery, r.Header.Get(DeliveryHeader))
+		mu.Lock()
+		defer mu.Unlock()
+		payloads = append(payloads, p)
+		w.WriteHeader(statuses[0])
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+	}))
+	defer srv.Close()
+	repo := storage.NewRepo()
+	d, err := NewDispatcher(&repo)
+	require.NoError(t, err)
+	defer d.Close()
+	d.BatchInterval = 20 * time.Millisecond
+	d.BatchSize = 2
+	d.Backoff = time.Millisecond
+	d.AllowPrivate = true
+	sub, err := d.Create(Subscription{Pattern: "Heap*", URL: srv.URL, Secret: "secret"})
+	require.NoError(t, err)
+
+	for _, m := range []models.Metrics{gauge("HeapAlloc", 1), gauge("Alloc", 1), gauge("HeapInuse", 2), gauge("HeapAlloc", 3)} {
+		require.NoError(t, repo.InsertMetric(context.TODO(), m))
+	}
+	assert.Eventually(t, func() bool {
+		deliveries, err := d.Deliveries(sub.ID)
+		return err == nil && len(deliveries) == 2 && deliveries[0].Status == DeliveryDelivered
+	}, time.Second, 5*time.Millisecond)
+
+	deliveries, err := d.Deliveries(sub.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deliveries[0].Events)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Equal(t, DeliveryDelivered, deliveries[1].Status)
+	assert.Equal(t, 2, deliveries[1].Events)
+	assert.Equal(t, 2, deliveries[1].Attempts)
+	assert.Equal(t, http.StatusOK, deliveries[1].StatusCode)
+	mu.Lock()
+	require.Len(t, payloads, 3)
+	assert.Equal(t, payloads[0], payloads[1])
+	assert.Equal(t, "HeapAlloc", payloads[1].Events[0].New.ID)
+	assert.Equal(t, "HeapInuse", payloads[1].Events[1].New.ID)
+	assert.Equal(t, "HeapAlloc", payloads[2].Events[0].New.ID)
+	mu.Unlock()
+
+	require.NoError(t, d.Delete(sub.ID))
+	_, err = d.Deliveries(sub.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, d.Delete(sub.ID), ErrNotFound)
+}
+
+func TestDispatcher_RetriesExhausted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	repo := storage.NewRepo()
+	d, err := NewDispatcher(&repo)
+	require.NoError(t, err)
+	defer d.Close()
+	d.BatchInterval = time.Millisecond
+	d.Retries = 2
+	d.Backoff = time.Millisecond
+	d.AllowPrivate = true
+	sub, err := d.Create(Subscription{Pattern: "*", URL: srv.URL, Secret: "secret"})
+	require.NoError(t, err)
+	require.NoError(t, repo.InsertMetric(context.TODO(), gauge("Alloc", 1)))
+	assert.Eventually(t, func() bool {
+		deliveries, err := d.Deliveries(sub.ID)
+		return err == nil && len(deliveries) == 1 && deliveries[0].Status == DeliveryFailed
+	}, time.Second, 5*time.Millisecond)
+	deliveries, err := d.Deliveries(sub.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[0].StatusCode)
+	assert.NotNil(t, deliveries[0].FinishedAt)
+}
+
+func TestDispatcher_PrivateAddress(t *testing.T) {
+	var called bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+	repo := storage.NewRepo()
+	d, err := NewDispatcher(&repo)
+	require.NoError(t, err)
+	defer d.Close()
+
+	for _, u := range []string{srv.URL, "http://10.0.0.1/hook", "http://169.254.169.254/latest", "http://[::1]:8080/", "http://LocalHost/hook"} {
+		_, err = d.Create(Subscription{Pattern: "*", URL: u, Secret: "secret"})
+		assert.ErrorIs(t, err, ErrBadSubscription, u)
+	}
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: "93.184.216.34:80"},
+		{address: "[2606:2800:220:1::1]:443"},
+		{address: "127.0.0.1:80", wantErr: true},
+		{address: "10.1.2.3:80", wantErr: true},
+		{address: "192.168.0.1:443", wantErr: true},
+		{address: "169.254.169.254:80", wantErr: true},
+		{address: "0.0.0.0:80", wantErr: true},
+		{address: "[::ffff:127.0.0.1]:80", wantErr: true},
+		{address: "[fe80::1]:80", wantErr: true},
+		{address: "[fd00::1]:80", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := d.checkAddress("tcp", tt.address, nil)
+		if tt.wantErr {
+			assert.ErrorIs(t, err, ErrForbiddenAddress, tt.address)
+		} else {
+			assert.NoError(t, err, tt.address)
+		}
+	}
+
+	//connection is checked after name is resolved and it is not retried
+	code, retry, err := d.post(Subscription{URL: srv.URL, Secret: "secret"}, "1", []byte("{}"))
+	assert.ErrorIs(t, err, ErrForbiddenAddress)
+	assert.False(t, retry)
+	assert.Equal(t, 0, code)
+	assert.False(t, called)
+
+	d.AllowPrivate = true
+	_, err = d.Create(Subscription{Pattern: "*", URL: srv.URL, Secret: "secret"})
+	assert.NoError(t, err)
+}